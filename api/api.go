@@ -1,5 +1,7 @@
 package api
 
+import "time"
+
 type ID string
 
 type ApiDefaultRequest struct {
@@ -16,24 +18,33 @@ type CreateResponse struct {
 }
 
 type Spec struct {
-	Name               string `schema:"name"`
-	Expiry             string `schema:"expiry"`
-	PachdVersion       string `schema:"pachdVersion"`
-	ConsoleVersion     string `schema:"consoleVersion"`
-	NotebooksVersion   string `schema:"notebooksVersion"`
-	MountServerVersion string `schema:"mountServerVersion"`
-	HelmVersion        string `schema:"helmVersion"`
-	DisableNotebooks   string `schema:"disableNotebooks"`
-	Backend            string `schema:"backend"`
-	ClusterStack       string `schema:"clusterStack"`
+	Name               string `schema:"name" yaml:"name"`
+	Expiry             string `schema:"expiry" yaml:"expiry"`
+	PachdVersion       string `schema:"pachdVersion" yaml:"pachdVersion"`
+	ConsoleVersion     string `schema:"consoleVersion" yaml:"consoleVersion"`
+	NotebooksVersion   string `schema:"notebooksVersion" yaml:"notebooksVersion"`
+	MountServerVersion string `schema:"mountServerVersion" yaml:"mountServerVersion"`
+	HelmVersion        string `schema:"helmVersion" yaml:"helmVersion"`
+	DisableNotebooks   string `schema:"disableNotebooks" yaml:"disableNotebooks"`
+	Backend            string `schema:"backend" yaml:"backend"`
+	ClusterStack       string `schema:"clusterStack" yaml:"clusterStack"`
+	// Comma separated, such as "team=core,protected". A "protected" label stops the deletion
+	// controller from destroying the workspace.
+	Labels string `schema:"labels" yaml:"labels"`
+	// ProgramRepo and ProgramRef pick the git repo, and the branch, tag or commit in it, that the
+	// Pulumi program comes from, such as a branch of poc-pulumi with a change to test. They
+	// default to the server's program source. The program-sources policy rule limits which repos
+	// and refs may be used, for admins too.
+	ProgramRepo string `schema:"programRepo" yaml:"programRepo"`
+	ProgramRef  string `schema:"programRef" yaml:"programRef"`
 	// This should be an actual file upload
-	ValuesYAML        string //schema:"valuesYaml" This field isn't handled by schema directly
-	ValuesYAMLContent []byte
-	InfraJSON         string //schema:"infraJson" This field isn't handled by schema directly
-	InfraJSONContent  []byte
+	ValuesYAML        string `yaml:"-"` //schema:"valuesYaml" This field isn't handled by schema directly
+	ValuesYAMLContent []byte `yaml:"-"`
+	InfraJSON         string `yaml:"-"` //schema:"infraJson" This field isn't handled by schema directly
+	InfraJSONContent  []byte `yaml:"-"`
 
 	// This is populated automatically by a header
-	CreatedBy string
+	CreatedBy string `yaml:"-"`
 }
 
 type GetConnectionInfoRequest struct {
@@ -67,11 +78,132 @@ type DeleteRequest struct {
 	ID ID
 }
 
+type HistoryResponse struct {
+	// Updates are newest first.
+	Updates []Update
+}
+
+// Update is one Pulumi operation on a workspace's stack.
+type Update struct {
+	Version int
+	// Kind is "update", "refresh" or "destroy".
+	Kind string
+	// Result is "succeeded", "failed" or "in-progress".
+	Result    string
+	StartTime string
+	EndTime   string `json:",omitempty"`
+	// Changed holds the versions, such as "pachd-version", that the update changed, with their
+	// new values.
+	Changed         map[string]string `json:",omitempty"`
+	ResourceChanges map[string]int    `json:",omitempty"`
+	// URL links to the update in the Pulumi console. It's empty for self-managed backends.
+	URL string `json:",omitempty"`
+}
+
+// Token is an API token, without its secret.
+type Token struct {
+	ID string
+	// Identity is who the token acts as. It's the CreatedBy of the workspaces it creates.
+	Identity string
+	// Scopes are "read", "write" and "admin". Each includes the ones before it.
+	Scopes    []string
+	IssuedBy  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type IssueTokenResponse struct {
+	Token Token
+	// Secret is the token to send as "Authorization: Bearer <secret>". Only its hash is kept, so
+	// it can't be shown again.
+	Secret string
+}
+
+type ListTokensResponse struct {
+	Tokens []Token
+}
+
+// QuotaLimits limit what a user, or the members of a team together, may have at once. Zero values
+// mean no limit.
+type QuotaLimits struct {
+	// MaxWorkspaces is the most workspaces that may exist at once.
+	MaxWorkspaces int `yaml:"maxWorkspaces"`
+	// MaxWorkspaceDays is the most days that the workspaces may have left until they expire, added
+	// up.
+	MaxWorkspaceDays float64 `yaml:"maxWorkspaceDays"`
+	// MaxExpiryDays is the furthest ahead a workspace's expiry may be.
+	MaxExpiryDays int `yaml:"maxExpiryDays"`
+	// Backends are the backends that workspaces may be created with. Empty means any.
+	Backends []string `yaml:"backends"`
+}
+
+// QuotaUsage is what a user or team has, against its limits.
+type QuotaUsage struct {
+	Name          string
+	Workspaces    []ID
+	WorkspaceDays float64
+	Limits        QuotaLimits
+}
+
+type QuotaResponse struct {
+	User QuotaUsage
+	// Teams are the teams the user is a member of.
+	Teams []QuotaUsage `json:",omitempty"`
+}
+
+// CredentialsResponse is a workspace's own credentials, by config key, such as "pachd-root-token".
+type CredentialsResponse struct {
+	ID          ID
+	Credentials map[string]string
+}
+
+// PolicyViolation is one way a create request breaks a policy rule.
+type PolicyViolation struct {
+	Rule string
+	// Field is what broke the rule, such as "expiry" or "valuesYaml: pachd.securityContext".
+	Field   string
+	Message string
+}
+
+// PolicyResponse is the response to a create request that breaks policy rules.
+type PolicyResponse struct {
+	Error      string
+	Violations []PolicyViolation
+}
+
+// AuditEvent records an action that changed something, taken by a user or a controller.
+type AuditEvent struct {
+	ID string
+	// Request is the ID of the first event of the request that the event is part of, so that the
+	// result of an action that was accepted can be found from the accepted event, and vice versa.
+	Request string
+	// Actor is the identity of the user, or "controller:<name>" for a controller.
+	Actor string
+	// Action is what was done, such as "create", "update", "delete" or "cancel".
+	Action    string
+	Workspace ID `json:",omitempty"`
+	// Params are the parameters of the action, with secrets redacted.
+	Params map[string]string `json:",omitempty"`
+	// Result is "accepted" for an action that carries on in the background, and "succeeded",
+	// "failed" or "denied" otherwise.
+	Result     string
+	Error      string `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+type AuditResponse struct {
+	// Events are newest first.
+	Events []AuditEvent
+}
+
 // TODO: Rename Workspace
 type ConnectionInfo struct {
-	ID           ID
-	Status       string
-	LastUpdated  string
+	ID          ID
+	Status      string
+	LastUpdated string
+	// PulumiURL links to the most recent update in the Pulumi console. It's empty for
+	// self-managed backends, which have no console.
 	PulumiURL    string
 	K8s          string
 	K8sNamespace string
@@ -83,6 +215,13 @@ type ConnectionInfo struct {
 	Expiry       string
 	CreatedBy    string
 	Backend      string
+	// ProgramCommit is the commit of the Pulumi program the workspace was last deployed from.
+	ProgramCommit string
+	// Alias is the name a prewarmed workspace was given when it was claimed.
+	Alias string
+	// Drifted is set if the last drift check found resources changed outside of helium.
+	Drifted        bool
+	DriftCheckedAt string
 }
 
 //{
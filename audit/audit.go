@@ -0,0 +1,185 @@
+// Package audit keeps an append-only log of every action that changes something, by users through
+// the API and UI and by the controllers: who did what to which workspace, with which parameters,
+// and how it went. Events are kept in the store, one document each, and are never updated.
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	psentry "github.com/pachyderm/helium/sentry"
+	"github.com/pachyderm/helium/store"
+)
+
+const (
+	eventPrefix = "audit/"
+
+	Accepted  = "accepted"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Denied    = "denied"
+)
+
+func eventKey(id string) string { return eventPrefix + id }
+
+// newID returns the ID of an event that started at t. IDs sort by when their events started, and
+// the random suffix keeps two that started in the same nanosecond apart.
+func newID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%019d-%s", t.UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// Controller is the actor of actions taken by the named controller.
+func Controller(name string) string { return "controller:" + name }
+
+// Record appends an event to the log, filling in its ID, and its StartedAt and FinishedAt if
+// they're unset. An event that can't be recorded is logged instead, so that auditing never stops
+// an action.
+func Record(e api.AuditEvent) {
+	save(&e)
+}
+
+func save(e *api.AuditEvent) {
+	if err := record(store.Default(), e); err != nil {
+		log.WithFields(log.Fields{
+			"actor":     e.Actor,
+			"action":    e.Action,
+			"workspace": e.Workspace,
+			"result":    e.Result,
+		}).Errorf("record audit event: %v", err)
+	}
+}
+
+func record(st store.Store, e *api.AuditEvent) error {
+	if e.StartedAt.IsZero() {
+		e.StartedAt = time.Now()
+	}
+	if e.FinishedAt.IsZero() {
+		e.FinishedAt = time.Now()
+	}
+	e.StartedAt, e.FinishedAt = e.StartedAt.UTC(), e.FinishedAt.UTC()
+	e.Params = Redact(e.Params)
+	id, err := newID(e.StartedAt)
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	if e.Request == "" {
+		e.Request = id
+	}
+	_, err = st.Put(eventKey(id), e, 0)
+	return err
+}
+
+// Redact returns params with the values of those that look like secrets replaced.
+func Redact(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		if psentry.SecretKey(k) && v != "" {
+			v = psentry.Redacted
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Filter selects events. Zero fields match everything.
+type Filter struct {
+	Actor     string
+	Action    string
+	Workspace api.ID
+	Result    string
+	Request   string
+	// Since and Until bound when events started.
+	Since time.Time
+	Until time.Time
+	// Limit is the most events to return, newest first.
+	Limit int
+}
+
+func (f *Filter) matches(e *api.AuditEvent) bool {
+	return (f.Actor == "" || strings.EqualFold(f.Actor, e.Actor)) &&
+		(f.Action == "" || f.Action == e.Action) &&
+		(f.Workspace == "" || f.Workspace == e.Workspace) &&
+		(f.Result == "" || f.Result == e.Result) &&
+		(f.Request == "" || f.Request == e.Request)
+}
+
+// Query returns the events the filter selects, newest first.
+func Query(f Filter) ([]api.AuditEvent, error) {
+	st := store.Default()
+	keys, err := st.List(eventPrefix)
+	if err != nil {
+		return nil, err
+	}
+	events := []api.AuditEvent{}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(events) >= f.Limit {
+			break
+		}
+		// Keys start with the time, so most events are filtered out without reading them.
+		if started, ok := keyTime(keys[i]); ok {
+			if !f.Until.IsZero() && started.After(f.Until) {
+				continue
+			}
+			if !f.Since.IsZero() && started.Before(f.Since) {
+				break
+			}
+		}
+		var e api.AuditEvent
+		if _, err := st.Get(keys[i], &e); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if f.matches(&e) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func keyTime(key string) (time.Time, bool) {
+	nanos, _, ok := strings.Cut(strings.TrimPrefix(key, eventPrefix), "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// Accept records an action that was accepted and carries on in the background. It returns the
+// event to record its result with, with Done, once it finishes, which has the same Request.
+func Accept(e api.AuditEvent) api.AuditEvent {
+	e.Result = Accepted
+	save(&e)
+	return e
+}
+
+// Done records an action that finished now, which failed if err isn't nil.
+func Done(e api.AuditEvent, err error) {
+	e.Result = Succeeded
+	if err != nil {
+		e.Result, e.Error = Failed, err.Error()
+	}
+	e.FinishedAt = time.Now()
+	Record(e)
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	psentry "github.com/pachyderm/helium/sentry"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestQuery(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	start := time.Now().Add(-time.Hour)
+	for i, e := range []api.AuditEvent{
+		{Actor: "a@example.com", Action: "create", Workspace: "one", Result: Accepted},
+		{Actor: "b@example.com", Action: "delete", Workspace: "one", Result: Succeeded},
+		{Actor: Controller("deletion"), Action: "delete", Workspace: "two", Result: Failed},
+		{Actor: "a@example.com", Action: "delete", Workspace: "two", Result: Denied},
+	} {
+		e.StartedAt = start.Add(time.Duration(i) * time.Minute)
+		Record(e)
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter Filter
+		want   []api.ID
+	}{
+		{"everything", Filter{}, []api.ID{"two", "two", "one", "one"}},
+		{"actor", Filter{Actor: "A@example.com"}, []api.ID{"two", "one"}},
+		{"action and workspace", Filter{Action: "delete", Workspace: "one"}, []api.ID{"one"}},
+		{"result", Filter{Result: Failed}, []api.ID{"two"}},
+		{"since", Filter{Since: start.Add(90 * time.Second)}, []api.ID{"two", "two"}},
+		{"until", Filter{Until: start.Add(90 * time.Second)}, []api.ID{"one", "one"}},
+		{"limit", Filter{Action: "delete", Limit: 2}, []api.ID{"two", "two"}},
+	} {
+		events, err := Query(test.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got []api.ID
+		for _, e := range events {
+			got = append(got, e.Workspace)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAcceptDone(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	Record(api.AuditEvent{Actor: "b@example.com", Action: "delete", Workspace: "two"})
+	e := Accept(api.AuditEvent{Actor: "a@example.com", Action: "create", Workspace: "one"})
+	Done(e, nil)
+
+	events, err := Query(Filter{Request: e.Request})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	// Both started at once, so they're in no particular order.
+	results := make(map[string]string)
+	for _, got := range events {
+		results[got.Result] = got.ID
+	}
+	if len(events) != 2 || results[Accepted] != e.Request || results[Succeeded] == "" {
+		t.Errorf("events of request %q: %+v, want the create's acceptance and its result", e.Request, events)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	got := Redact(map[string]string{
+		"name":             "example",
+		"pachd-root-token": "hunter2",
+		"aws-secret-key":   "AKIA",
+		"clientSecret":     "shh",
+		"tokenId":          "0123456789abcdef",
+		"valuesYaml":       "values.yaml",
+		"password":         "",
+	})
+	for k, want := range map[string]string{
+		"name":             "example",
+		"pachd-root-token": psentry.Redacted,
+		"aws-secret-key":   psentry.Redacted,
+		"clientSecret":     psentry.Redacted,
+		"tokenId":          "0123456789abcdef",
+		"valuesYaml":       "values.yaml",
+		"password":         "",
+	} {
+		if got[k] != want {
+			t.Errorf("%s is %q, want %q", k, got[k], want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+)
+
+// A caller's role follows from its scopes: viewers may only read, users may also manage the
+// workspaces they created, and admins may manage everything, including cluster backends.
+const (
+	RoleViewer = "viewer"
+	RoleUser   = "user"
+	RoleAdmin  = "admin"
+)
+
+// ErrForbidden is wrapped by every error CanManage returns for a workspace the caller may not
+// manage.
+var ErrForbidden = errors.New("forbidden")
+
+var (
+	// admins, viewers and bootstrapToken are from Configure. Until it's called there are none, so
+	// an unconfigured server grants nobody more than a user's scopes.
+	admins, viewers []string
+	bootstrapToken  string
+)
+
+// Configure sets which OIDC users are admins and viewers, and the bootstrap token, from c.
+func Configure(c *config.Config) {
+	admins, viewers, bootstrapToken = c.Admins, c.Viewers, c.BootstrapToken
+}
+
+// Role returns the role a token's scopes give it.
+func Role(t *api.Token) string {
+	switch {
+	case Allows(t.Scopes, ScopeAdmin):
+		return RoleAdmin
+	case Allows(t.Scopes, ScopeWrite):
+		return RoleUser
+	}
+	return RoleViewer
+}
+
+// UserScopes returns the scopes of a user logged in with the OIDC provider rather than with an
+// API token. Identities in the config's admins are admins, those in its viewers are viewers, and
+// everyone else is a user.
+func UserScopes(identity string) []string {
+	switch {
+	case listed(admins, identity):
+		return []string{ScopeAdmin}
+	case listed(viewers, identity):
+		return []string{ScopeRead}
+	}
+	return []string{ScopeWrite}
+}
+
+func listed(identities []string, identity string) bool {
+	for _, v := range identities {
+		if identity != "" && strings.EqualFold(v, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanManage checks that a token may update, extend or delete a workspace created by owner. Admins
+// may manage any workspace. Users may only manage the ones they created, and never those of a
+// cluster backend, which every other workspace in the cluster depends on. Viewers may manage
+// none.
+func CanManage(t *api.Token, owner string, cluster bool) error {
+	switch Role(t) {
+	case RoleAdmin:
+		return nil
+	case RoleViewer:
+		return fmt.Errorf("%w: viewers can't change workspaces", ErrForbidden)
+	}
+	if cluster {
+		return fmt.Errorf("%w: only admins can manage clusters", ErrForbidden)
+	}
+	if owner == "" {
+		return fmt.Errorf("%w: nobody owns the workspace, so only admins can manage it", ErrForbidden)
+	}
+	if !strings.EqualFold(owner, t.Identity) {
+		return fmt.Errorf("%w: the workspace belongs to %q", ErrForbidden, owner)
+	}
+	return nil
+}
+
+// CanProtect checks that a token may protect a workspace from the deletion controller, or stop
+// protecting it. Only admins may, or anyone could keep their workspaces past their expiry.
+func CanProtect(t *api.Token) error {
+	if Role(t) != RoleAdmin {
+		return fmt.Errorf("%w: only admins can protect workspaces or stop protecting them", ErrForbidden)
+	}
+	return nil
+}
+
+// CanReveal checks that a token may see the credentials of a workspace created by owner. Only the
+// owner may, so that nobody else, admins included, gets into a workspace without it showing up as
+// someone else's use of the owner's credentials.
+func CanReveal(t *api.Token, owner string) error {
+	if Role(t) == RoleViewer {
+		return fmt.Errorf("%w: viewers can't see credentials", ErrForbidden)
+	}
+	if owner == "" || !strings.EqualFold(owner, t.Identity) {
+		return fmt.Errorf("%w: only the workspace's owner can see its credentials", ErrForbidden)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+)
+
+func TestUserScopes(t *testing.T) {
+	Configure(&config.Config{Admins: []string{"boss@example.com", "ops@example.com"}, Viewers: []string{"auditor@example.com"}})
+	defer Configure(&config.Config{})
+	for identity, want := range map[string]string{
+		"ops@example.com":     RoleAdmin,
+		"Boss@Example.com":    RoleAdmin,
+		"auditor@example.com": RoleViewer,
+		"dev@example.com":     RoleUser,
+		"":                    RoleUser,
+	} {
+		if got := Role(&api.Token{Identity: identity, Scopes: UserScopes(identity)}); got != want {
+			t.Errorf("%q is a %s, want %s", identity, got, want)
+		}
+	}
+}
+
+func TestCanManage(t *testing.T) {
+	admin := &api.Token{Identity: "boss@example.com", Scopes: []string{ScopeAdmin}}
+	user := &api.Token{Identity: "dev@example.com", Scopes: []string{ScopeWrite}}
+	viewer := &api.Token{Identity: "dev@example.com", Scopes: []string{ScopeRead}}
+	for _, test := range []struct {
+		name    string
+		token   *api.Token
+		owner   string
+		cluster bool
+		allowed bool
+	}{
+		{"admin, someone else's", admin, "dev@example.com", false, true},
+		{"admin, cluster", admin, "", true, true},
+		{"user, own", user, "dev@example.com", false, true},
+		{"user, own in another case", user, "Dev@example.com", false, true},
+		{"user, someone else's", user, "other@example.com", false, false},
+		{"user, nobody's", user, "", false, false},
+		{"user, own cluster", user, "dev@example.com", true, false},
+		{"viewer, own", viewer, "dev@example.com", false, false},
+	} {
+		err := CanManage(test.token, test.owner, test.cluster)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: %v, want ErrForbidden", test.name, err)
+		}
+	}
+}
+
+func TestCanProtect(t *testing.T) {
+	if err := CanProtect(&api.Token{Identity: "boss@example.com", Scopes: []string{ScopeAdmin}}); err != nil {
+		t.Errorf("admin: %v", err)
+	}
+	if err := CanProtect(&api.Token{Identity: "dev@example.com", Scopes: []string{ScopeWrite}}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("user: %v, want ErrForbidden", err)
+	}
+}
+
+func TestCanReveal(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		token   *api.Token
+		owner   string
+		allowed bool
+	}{
+		{"owner", &api.Token{Identity: "dev@example.com", Scopes: []string{ScopeWrite}}, "Dev@example.com", true},
+		{"admin, someone else's", &api.Token{Identity: "boss@example.com", Scopes: []string{ScopeAdmin}}, "dev@example.com", false},
+		{"nobody's", &api.Token{Identity: "dev@example.com", Scopes: []string{ScopeWrite}}, "", false},
+		{"viewer, own", &api.Token{Identity: "dev@example.com", Scopes: []string{ScopeRead}}, "dev@example.com", false},
+	} {
+		err := CanReveal(test.token, test.owner)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: %v, want ErrForbidden", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package auth issues, checks and revokes the API tokens that authenticate requests to the REST
+// API. Each token acts as an identity, which becomes the CreatedBy of the workspaces it creates,
+// and has scopes limiting what it may do. Only a hash of each token is kept, in the store.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+
+	// DefaultTTL is how long a token lasts if it's issued without one.
+	DefaultTTL = 90 * 24 * time.Hour
+	// MaxTTL is the longest a token may last.
+	MaxTTL = 365 * 24 * time.Hour
+
+	// tokenMarker starts every token, so that leaked ones are easy to spot.
+	tokenMarker = "helium_"
+	tokenPrefix = "tokens/"
+	// BootstrapIdentity is the identity of the HELIUM_BOOTSTRAP_TOKEN, which is how the first real
+	// admin token is issued. It's only accepted until then.
+	BootstrapIdentity = "bootstrap"
+)
+
+var (
+	// ErrInvalidToken is returned by Authenticate for a token that doesn't exist, has been revoked
+	// or has expired.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInvalidRequest is returned by Issue for a token that can't be issued as asked.
+	ErrInvalidRequest = errors.New("invalid token request")
+	// ErrNoSuchToken is returned by Revoke for a token that doesn't exist.
+	ErrNoSuchToken = errors.New("no such token")
+
+	validID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+	// scopeRank orders the scopes: each includes every one ranked below it.
+	scopeRank = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+)
+
+// record is what's stored for a token.
+type record struct {
+	api.Token
+	// Hash is the hex SHA-256 of the token's secret part. Secrets are random, so a fast hash is
+	// enough.
+	Hash string
+}
+
+func tokenKey(id string) string { return tokenPrefix + id }
+
+// Allows reports whether a token with scopes may do what needs the scope required.
+func Allows(scopes []string, required string) bool {
+	for _, s := range scopes {
+		if scopeRank[s] >= scopeRank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// Issue creates a token acting as identity with scopes, lasting ttl, or DefaultTTL if it's 0. It
+// returns the token and its secret, which is never available again.
+func Issue(identity string, scopes []string, ttl time.Duration, issuedBy string, now time.Time) (*api.Token, string, error) {
+	identity = strings.TrimSpace(identity)
+	if identity == "" {
+		return nil, "", fmt.Errorf("%w: no identity", ErrInvalidRequest)
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: no scopes", ErrInvalidRequest)
+	}
+	for _, s := range scopes {
+		if scopeRank[s] == 0 {
+			return nil, "", fmt.Errorf("%w: unknown scope %q", ErrInvalidRequest, s)
+		}
+	}
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if ttl < 0 || ttl > MaxTTL {
+		return nil, "", fmt.Errorf("%w: ttl must be positive and at most %v", ErrInvalidRequest, MaxTTL)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	r := record{
+		Token: api.Token{
+			ID:        id,
+			Identity:  identity,
+			Scopes:    scopes,
+			IssuedBy:  issuedBy,
+			IssuedAt:  now.UTC(),
+			ExpiresAt: now.Add(ttl).UTC(),
+		},
+		Hash: hash(secret),
+	}
+	if _, err := store.Default().Put(tokenKey(id), r, 0); err != nil {
+		return nil, "", err
+	}
+	return &r.Token, tokenMarker + id + "_" + secret, nil
+}
+
+// Authenticate returns the token that a bearer token is, if it's valid at now. The config's
+// bootstrap token, if it's set, is an admin token acting as BootstrapIdentity, until a real admin
+// token has been issued. It's accepted again if every admin token expires or is revoked, so that
+// one can be issued.
+func Authenticate(bearer string, now time.Time) (*api.Token, error) {
+	if b := bootstrapToken; b != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(b)) == 1 {
+		admins, err := haveAdminToken(now)
+		if err != nil {
+			return nil, err
+		}
+		if admins {
+			return nil, fmt.Errorf("%w: the bootstrap token is disabled once an admin token has been issued", ErrInvalidToken)
+		}
+		return &api.Token{ID: BootstrapIdentity, Identity: BootstrapIdentity, Scopes: []string{ScopeAdmin}}, nil
+	}
+	rest := strings.TrimPrefix(bearer, tokenMarker)
+	id, secret, ok := strings.Cut(rest, "_")
+	if rest == bearer || !ok || !validID.MatchString(id) {
+		return nil, ErrInvalidToken
+	}
+	var r record
+	if _, err := store.Default().Get(tokenKey(id), &r); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(r.Hash)) != 1 || !now.Before(r.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	return &r.Token, nil
+}
+
+// haveAdminToken reports whether there's an admin token that's valid at now.
+func haveAdminToken(now time.Time) (bool, error) {
+	tokens, err := List()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tokens {
+		if Allows(t.Scopes, ScopeAdmin) && now.Before(t.ExpiresAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// List returns every token that hasn't been revoked, including expired ones, by when they were
+// issued.
+func List() ([]api.Token, error) {
+	st := store.Default()
+	keys, err := st.List(tokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []api.Token{}
+	for _, k := range keys {
+		var r record
+		if _, err := st.Get(k, &r); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		tokens = append(tokens, r.Token)
+	}
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].IssuedAt.Before(tokens[j].IssuedAt) })
+	return tokens, nil
+}
+
+// Revoke deletes a token, so it's no longer accepted.
+func Revoke(id string) error {
+	if !validID.MatchString(id) {
+		return ErrNoSuchToken
+	}
+	st := store.Default()
+	if _, err := st.Get(tokenKey(id), &record{}); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrNoSuchToken
+		}
+		return err
+	}
+	return st.Delete(tokenKey(id))
+}
+
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
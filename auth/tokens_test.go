@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestTokens(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	now := time.Now()
+
+	token, secret, err := Issue("someone@example.com", []string{ScopeWrite}, time.Hour, "admin@example.com", now)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !strings.HasPrefix(secret, tokenMarker+token.ID+"_") {
+		t.Errorf("secret %q doesn't name token %v", secret, token.ID)
+	}
+
+	got, err := Authenticate(secret, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if got.Identity != "someone@example.com" || got.IssuedBy != "admin@example.com" {
+		t.Errorf("authenticated as %+v", got)
+	}
+	for name, bearer := range map[string]string{
+		"wrong secret": tokenMarker + token.ID + "_" + strings.Repeat("0", 64),
+		"unknown id":   tokenMarker + "0123456789abcdef_" + secret[len(tokenMarker)+17:],
+		"bad id":       tokenMarker + "../../x_y",
+		"no marker":    strings.TrimPrefix(secret, tokenMarker),
+		"empty":        "",
+	} {
+		if _, err := Authenticate(bearer, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authenticate with %s: %v, want ErrInvalidToken", name, err)
+		}
+	}
+	if _, err := Authenticate(secret, now.Add(time.Hour)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate once expired: %v, want ErrInvalidToken", err)
+	}
+
+	tokens, err := List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != token.ID {
+		t.Errorf("List = %+v", tokens)
+	}
+
+	if err := Revoke(token.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := Authenticate(secret, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate once revoked: %v, want ErrInvalidToken", err)
+	}
+	if err := Revoke(token.ID); !errors.Is(err, ErrNoSuchToken) {
+		t.Errorf("Revoke again: %v, want ErrNoSuchToken", err)
+	}
+}
+
+func TestIssueValidation(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	for name, issue := range map[string]func() error{
+		"no identity":   func() error { _, _, err := Issue(" ", []string{ScopeRead}, 0, "", time.Now()); return err },
+		"no scopes":     func() error { _, _, err := Issue("a", nil, 0, "", time.Now()); return err },
+		"unknown scope": func() error { _, _, err := Issue("a", []string{"root"}, 0, "", time.Now()); return err },
+		"too long":      func() error { _, _, err := Issue("a", []string{ScopeRead}, 2*MaxTTL, "", time.Now()); return err },
+	} {
+		if err := issue(); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("Issue with %s: %v, want ErrInvalidRequest", name, err)
+		}
+	}
+}
+
+func TestBootstrapToken(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	Configure(&config.Config{BootstrapToken: "let-me-in"})
+	defer Configure(&config.Config{})
+	now := time.Now()
+	got, err := Authenticate("let-me-in", now)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if got.Identity != BootstrapIdentity || !Allows(got.Scopes, ScopeAdmin) {
+		t.Errorf("bootstrap token is %+v", got)
+	}
+
+	// Other tokens don't disable it.
+	if _, _, err := Issue("dev@example.com", []string{ScopeWrite}, time.Hour, BootstrapIdentity, now); err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := Authenticate("let-me-in", now); err != nil {
+		t.Errorf("Authenticate after issuing a write token: %v", err)
+	}
+
+	admin, _, err := Issue("boss@example.com", []string{ScopeAdmin}, time.Hour, BootstrapIdentity, now)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := Authenticate("let-me-in", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate after issuing an admin token = %v, want ErrInvalidToken", err)
+	}
+	// Once no admin token is valid, it's needed again.
+	if _, err := Authenticate("let-me-in", now.Add(2*time.Hour)); err != nil {
+		t.Errorf("Authenticate after the admin token expired: %v", err)
+	}
+	if err := Revoke(admin.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := Authenticate("let-me-in", now); err != nil {
+		t.Errorf("Authenticate after the admin token was revoked: %v", err)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	for _, test := range []struct {
+		scopes   []string
+		required string
+		want     bool
+	}{
+		{[]string{ScopeRead}, ScopeRead, true},
+		{[]string{ScopeRead}, ScopeWrite, false},
+		{[]string{ScopeWrite}, ScopeRead, true},
+		{[]string{ScopeWrite}, ScopeAdmin, false},
+		{[]string{ScopeRead, ScopeAdmin}, ScopeWrite, true},
+		{nil, ScopeRead, false},
+	} {
+		if got := Allows(test.scopes, test.required); got != test.want {
+			t.Errorf("Allows(%v, %q) = %v, want %v", test.scopes, test.required, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package catalog describes the backends helium can deploy: the Pulumi programs in poc-pulumi,
+// what each one is for, and which create parameters it takes. Create requests are checked against
+// it before anything is deployed.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+)
+
+// ErrInvalidSpec is wrapped by every error Prepare returns for a spec the backend can't deploy.
+var ErrInvalidSpec = errors.New("invalid spec")
+
+// Param is a create parameter a backend takes.
+type Param struct {
+	// Name is the parameter's form name, such as "clusterStack".
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+	// Default is used when the parameter isn't given.
+	Default string `yaml:"default"`
+}
+
+// Backend is a Pulumi program helium can deploy, named after its directory in poc-pulumi.
+type Backend struct {
+	Name        string `yaml:"name"`
+	Cloud       string `yaml:"cloud"`
+	Description string `yaml:"description"`
+	// Default marks the backend used when a request doesn't name one.
+	Default bool `yaml:"default"`
+	// Cluster marks a backend that deploys a whole cluster rather than a workspace, which only
+	// admins may create or destroy.
+	Cluster bool    `yaml:"cluster"`
+	Params  []Param `yaml:"params"`
+	// InfraJSONFields are the top level infraJson fields the backend reads. A backend without any
+	// doesn't take infraJson.
+	InfraJSONFields []string `yaml:"infraJsonFields"`
+}
+
+// Catalog is the contents of the catalog file.
+type Catalog struct {
+	Backends []Backend `yaml:"backends"`
+}
+
+// Load reads and validates a catalog file.
+func Load(path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+func parse(data []byte) (*Catalog, error) {
+	var c Catalog
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse backend catalog: %w", err)
+	}
+	seen := make(map[string]bool)
+	defaults := 0
+	for _, b := range c.Backends {
+		if b.Name == "" || b.Name != strings.ToLower(b.Name) {
+			return nil, fmt.Errorf("backend %q must have a lower case name", b.Name)
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("backend %q is listed twice", b.Name)
+		}
+		seen[b.Name] = true
+		if b.Default {
+			defaults++
+		}
+		for _, p := range b.Params {
+			if _, ok := specParams(&api.Spec{})[p.Name]; !ok && p.Name != "valuesYaml" {
+				return nil, fmt.Errorf("backend %q has unknown parameter %q", b.Name, p.Name)
+			}
+		}
+	}
+	if defaults != 1 {
+		return nil, fmt.Errorf("backend catalog has %d default backends, want 1", defaults)
+	}
+	return &c, nil
+}
+
+// Get returns the named backend, or nil.
+func (c *Catalog) Get(name string) *Backend {
+	for i := range c.Backends {
+		if c.Backends[i].Name == name {
+			return &c.Backends[i]
+		}
+	}
+	return nil
+}
+
+// Default returns the backend used when a request doesn't name one.
+func (c *Catalog) Default() *Backend {
+	for i := range c.Backends {
+		if c.Backends[i].Default {
+			return &c.Backends[i]
+		}
+	}
+	return nil
+}
+
+// Prepare checks a create request against its backend: the backend must exist, every required
+// parameter must be given, and no parameter the backend doesn't take may be. It fills in the
+// backend, if the request didn't name one, and parameter defaults.
+func (c *Catalog) Prepare(spec *api.Spec) error {
+	spec.Backend = strings.ToLower(spec.Backend)
+	if spec.Backend == "" {
+		spec.Backend = c.Default().Name
+	}
+	b := c.Get(spec.Backend)
+	if b == nil {
+		return fmt.Errorf("%w: unknown backend %q", ErrInvalidSpec, spec.Backend)
+	}
+
+	values := specParams(spec)
+	taken := make(map[string]bool)
+	for _, p := range b.Params {
+		taken[p.Name] = true
+		v, ok := values[p.Name]
+		if !ok {
+			continue
+		}
+		if *v == "" {
+			*v = p.Default
+		}
+		if *v == "" && p.Required {
+			return fmt.Errorf("%w: backend %q requires %v", ErrInvalidSpec, b.Name, p.Name)
+		}
+	}
+	var unsupported []string
+	for name, v := range values {
+		if *v != "" && !taken[name] {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if (spec.ValuesYAML != "" || len(spec.ValuesYAMLContent) > 0) && !taken["valuesYaml"] {
+		unsupported = append(unsupported, "valuesYaml")
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("%w: backend %q doesn't take %v", ErrInvalidSpec, b.Name, strings.Join(unsupported, ", "))
+	}
+	return checkInfraJSON(b, spec.InfraJSONContent)
+}
+
+// checkInfraJSON checks that infraJson only has fields the backend reads.
+func checkInfraJSON(b *Backend, content []byte) error {
+	if len(content) == 0 {
+		return nil
+	}
+	if len(b.InfraJSONFields) == 0 {
+		return fmt.Errorf("%w: backend %q doesn't take infraJson", ErrInvalidSpec, b.Name)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return fmt.Errorf("%w: infraJson: %v", ErrInvalidSpec, err)
+	}
+	known := make(map[string]bool)
+	for _, f := range b.InfraJSONFields {
+		known[f] = true
+	}
+	var unknown []string
+	for f := range fields {
+		if !known[f] {
+			unknown = append(unknown, f)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%w: backend %q doesn't read infraJson fields %v", ErrInvalidSpec, b.Name, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// specParams maps the form names of the backend specific parameters in a spec to its fields.
+// Parameters every backend takes, such as name and expiry, aren't included.
+func specParams(spec *api.Spec) map[string]*string {
+	return map[string]*string{
+		"pachdVersion":       &spec.PachdVersion,
+		"consoleVersion":     &spec.ConsoleVersion,
+		"notebooksVersion":   &spec.NotebooksVersion,
+		"mountServerVersion": &spec.MountServerVersion,
+		"helmVersion":        &spec.HelmVersion,
+		"disableNotebooks":   &spec.DisableNotebooks,
+		"clusterStack":       &spec.ClusterStack,
+	}
+}
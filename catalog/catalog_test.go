@@ -0,0 +1,99 @@
+package catalog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/helium/api"
+)
+
+const testCatalog = `
+backends:
+  - name: namespace
+    cloud: gcp
+    default: true
+    params:
+      - name: pachdVersion
+      - name: disableNotebooks
+        default: "False"
+      - name: valuesYaml
+  - name: cluster
+    cloud: aws
+    params:
+      - name: clusterStack
+        required: true
+    infraJsonFields: [k8s]
+`
+
+func TestShippedCatalog(t *testing.T) {
+	c, err := Load("../backends.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if d := c.Default(); d == nil || d.Name != "gcp_namespace_only" {
+		t.Errorf("default backend is %v, want gcp_namespace_only", d)
+	}
+	for _, name := range []string{"gcp_cluster_only", "aws_cluster_only"} {
+		if b := c.Get(name); b == nil || !b.Cluster {
+			t.Errorf("%s isn't marked as a cluster backend", name)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		"backends: [{name: a}]",
+		"backends: [{name: a, default: true}, {name: a}]",
+		"backends: [{name: A, default: true}]",
+		"backends: [{name: a, default: true, params: [{name: replicas}]}]",
+	} {
+		if _, err := parse([]byte(data)); err == nil {
+			t.Errorf("parse(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	c, err := parse([]byte(testCatalog))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	spec := api.Spec{PachdVersion: "2.5.0"}
+	if err := c.Prepare(&spec); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if spec.Backend != "namespace" || spec.DisableNotebooks != "False" {
+		t.Errorf("Prepare left backend %q and disableNotebooks %q, want the defaults", spec.Backend, spec.DisableNotebooks)
+	}
+
+	testData := []struct {
+		name    string
+		spec    api.Spec
+		wantErr string
+	}{
+		{name: "upper case backend", spec: api.Spec{Backend: "CLUSTER", ClusterStack: "c"}},
+		{name: "infraJson", spec: api.Spec{Backend: "cluster", ClusterStack: "c", InfraJSONContent: []byte(`{"k8s": {}}`)}},
+		{name: "unknown backend", spec: api.Spec{Backend: "gcp_namespace"}, wantErr: `unknown backend "gcp_namespace"`},
+		{name: "missing required", spec: api.Spec{Backend: "cluster"}, wantErr: "requires clusterStack"},
+		{name: "unsupported params", spec: api.Spec{Backend: "cluster", ClusterStack: "c", PachdVersion: "2.5.0", ValuesYAML: "values.yaml"}, wantErr: "doesn't take pachdVersion, valuesYaml"},
+		{name: "unsupported infraJson", spec: api.Spec{InfraJSONContent: []byte(`{}`)}, wantErr: "doesn't take infraJson"},
+		{name: "unknown infraJson field", spec: api.Spec{Backend: "cluster", ClusterStack: "c", InfraJSONContent: []byte(`{"k8s": {}, "rds": {}}`)}, wantErr: "doesn't read infraJson fields rds"},
+		{name: "invalid infraJson", spec: api.Spec{Backend: "cluster", ClusterStack: "c", InfraJSONContent: []byte(`{`)}, wantErr: "infraJson"},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			err := c.Prepare(&test.spec)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("Prepare: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidSpec) || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Prepare = %v, want an invalid spec error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
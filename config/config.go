@@ -0,0 +1,639 @@
+// Package config holds the server's settings: those that differ between deployments, such as
+// staging and prod, like which GCP project workspaces go in, their base URLs and the Auth0 tenant,
+// and everything else a deployment may tune, such as the other config files, the store, login and
+// the controllers. They're read from the config file, then overridden by environment variables,
+// and validated once at startup; main passes them to each subsystem.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/catalog"
+)
+
+const (
+	defaultConfigFile = "helium.yaml"
+	redacted          = "[redacted]"
+)
+
+// secretProviders are the secret providers the secrets package has.
+var secretProviders = map[string]bool{"env": true, "file": true, "vault": true}
+
+// File returns the path of the config file, from HELIUM_CONFIG_FILE.
+func File() string {
+	if v := os.Getenv("HELIUM_CONFIG_FILE"); v != "" {
+		return v
+	}
+	return defaultConfigFile
+}
+
+// Config is the server's settings. Each is overridden by the environment variable in its comment.
+type Config struct {
+	// Port is the API's port. HELIUM_PORT.
+	Port int `yaml:"port"`
+	GCP  struct {
+		// Project is where GCP workspaces are created. HELIUM_GCP_PROJECT.
+		Project string `yaml:"project"`
+		// Zone is the zone of their resources. HELIUM_GCP_ZONE.
+		Zone string `yaml:"zone"`
+	} `yaml:"gcp"`
+	// WorkspaceBaseURL is the domain workspaces get subdomains of. HELIUM_WORKSPACE_BASE_URL.
+	WorkspaceBaseURL string `yaml:"workspaceBaseURL"`
+	// TestCIBaseURL is the same for workspaces in the test-ci zone. HELIUM_TESTCI_BASE_URL.
+	TestCIBaseURL string `yaml:"testciBaseURL"`
+	Auth0         struct {
+		// Domain is the Auth0 tenant's URL, such as https://example.auth0.com/. HELIUM_AUTH0_DOMAIN.
+		Domain string `yaml:"domain"`
+		// Subdomain is the tenant's name. HELIUM_AUTH0_SUBDOMAIN.
+		Subdomain string `yaml:"subdomain"`
+		// ClientID is helium's application, which workspaces and OIDC logins use.
+		// HELIUM_CLIENT_ID.
+		ClientID string `yaml:"clientID"`
+		// ClientSecret is the application's secret, which is only read from HELIUM_CLIENT_SECRET,
+		// so that it's never in the config file.
+		ClientSecret string `yaml:"-"`
+	} `yaml:"auth0"`
+	AWS struct {
+		// Region is the AWS CLI's default region in prod. HELIUM_AWS_REGION.
+		Region string `yaml:"region"`
+	} `yaml:"aws"`
+	// DefaultExpiryDays is how many days from now workspaces that don't give an expiry expire.
+	// HELIUM_DEFAULT_EXPIRATION_DAYS.
+	DefaultExpiryDays int `yaml:"defaultExpiryDays"`
+	// Plugins are the Pulumi plugins installed at startup, and their versions.
+	Plugins map[string]string `yaml:"plugins"`
+	// ControllerInterval is how long the controlplane waits between passes of the recovery,
+	// pinned stack and orphan controllers. HELIUM_CONTROLLER_INTERVAL.
+	ControllerInterval time.Duration `yaml:"controllerInterval"`
+	// Controlplane paces the rest of the controllers.
+	Controlplane Controlplane `yaml:"controlplane"`
+	// DefaultBackend is the backend of workspaces that don't name one. HELIUM_DEFAULT_BACKEND.
+	DefaultBackend string `yaml:"defaultBackend"`
+	Sentry         struct {
+		// DSN is where errors are sent. HELIUM_SENTRY_DSN.
+		DSN string `yaml:"dsn"`
+		// Environment tags the errors. HELIUM_SENTRY_ENVIRONMENT.
+		Environment string `yaml:"environment"`
+	} `yaml:"sentry"`
+	// Files are the paths of the other config files.
+	Files Files `yaml:"files"`
+	// StoreDir is the store's directory, which every API and controlplane replica must share.
+	// HELIUM_STORE_DIR.
+	StoreDir string `yaml:"storeDir"`
+	// Program is where workspaces' Pulumi programs come from, unless a create request picks its
+	// own repo or ref.
+	Program Program `yaml:"program"`
+	// OIDC is how users log in to the UI. It's off unless an issuer is set.
+	OIDC OIDC `yaml:"oidc"`
+	// Admins are the identities of users logged in with OIDC who are admins. HELIUM_ADMINS, comma
+	// separated.
+	Admins []string `yaml:"admins"`
+	// Viewers are those who may only look. HELIUM_VIEWERS, comma separated.
+	Viewers []string `yaml:"viewers"`
+	// BootstrapToken, if set, is accepted as an admin API token while no real admin token is
+	// valid, to issue the first one. It's only read from HELIUM_BOOTSTRAP_TOKEN.
+	BootstrapToken string `yaml:"-"`
+	// Secrets is where the secrets every workspace shares are read from.
+	Secrets Secrets `yaml:"secrets"`
+	// Orphans is where the orphan controller looks for resources left behind.
+	Orphans Orphans `yaml:"orphans"`
+}
+
+// Files are the paths of the other config files.
+type Files struct {
+	// Backends is the backend catalog. HELIUM_BACKENDS_FILE.
+	Backends string `yaml:"backends"`
+	// Policies are the rules create requests are checked against. HELIUM_POLICY_FILE.
+	Policies string `yaml:"policies"`
+	// Quotas are the limits on each user and team. HELIUM_QUOTAS_FILE.
+	Quotas string `yaml:"quotas"`
+	// ClusterPool is the clusters workspaces are placed in. HELIUM_CLUSTER_POOL_FILE.
+	ClusterPool string `yaml:"clusterPool"`
+	// PrewarmPools are the workspaces kept ready to claim. HELIUM_PREWARM_POOLS_FILE.
+	PrewarmPools string `yaml:"prewarmPools"`
+	// PinnedStacks are the long-lived stacks kept present. HELIUM_PINNED_STACKS_FILE.
+	PinnedStacks string `yaml:"pinnedStacks"`
+}
+
+// Program is the server's own program source.
+type Program struct {
+	// Dir, if set, is a local checkout of the programs to use instead of cloning Repo.
+	// HELIUM_PROGRAM_DIR.
+	Dir string `yaml:"dir"`
+	// Repo is the git repo of the programs. HELIUM_PROGRAM_REPO.
+	Repo string `yaml:"repo"`
+	// Ref is its branch, tag or commit. HELIUM_PROGRAM_REF.
+	Ref string `yaml:"ref"`
+	// GitHubToken is sent to repos in pachyderm's GitHub organization. It's only read from
+	// HELIUM_GITHUB_PERSONAL_TOKEN.
+	GitHubToken string `yaml:"-"`
+}
+
+// OIDC is the OIDC provider users log in with. The client ID and secret are Auth0's.
+type OIDC struct {
+	// Issuer is the provider's URL. HELIUM_OIDC_ISSUER.
+	Issuer string `yaml:"issuer"`
+	// JWKSURL overrides the provider's keys URL. HELIUM_OIDC_JWKS_URL.
+	JWKSURL string `yaml:"jwksURL"`
+	// RedirectURL is helium's callback URL. HELIUM_OIDC_REDIRECT_URL.
+	RedirectURL string `yaml:"redirectURL"`
+	// Audience is what API bearer tokens must be issued for, defaulting to the client ID.
+	// HELIUM_OIDC_AUDIENCE.
+	Audience string `yaml:"audience"`
+	// AllowedDomains are the email domains that may log in. HELIUM_OIDC_ALLOWED_DOMAINS, comma
+	// separated.
+	AllowedDomains []string `yaml:"allowedDomains"`
+	// AllowedGroups are the groups whose members may log in. HELIUM_OIDC_ALLOWED_GROUPS, comma
+	// separated.
+	AllowedGroups []string `yaml:"allowedGroups"`
+	// GroupsClaim is the claim listing a user's groups, defaulting to "groups".
+	// HELIUM_OIDC_GROUPS_CLAIM.
+	GroupsClaim string `yaml:"groupsClaim"`
+	// SessionTTL is how long a UI login lasts, defaulting to 12 hours. HELIUM_SESSION_TTL.
+	SessionTTL time.Duration `yaml:"sessionTTL"`
+	// SessionKey signs UI sessions. It's only read from HELIUM_SESSION_KEY; without it, sessions
+	// don't survive a restart.
+	SessionKey string `yaml:"-"`
+}
+
+// Secrets is the secret provider, as the secrets package describes.
+type Secrets struct {
+	// Provider is env, file or vault. HELIUM_SECRET_PROVIDER.
+	Provider string `yaml:"provider"`
+	// Dir is the file provider's directory. HELIUM_SECRETS_DIR.
+	Dir   string `yaml:"dir"`
+	Vault struct {
+		// Addr is Vault's URL. VAULT_ADDR.
+		Addr string `yaml:"addr"`
+		// Path is the KV version 2 secret. HELIUM_VAULT_PATH.
+		Path string `yaml:"path"`
+		// Token is only read from VAULT_TOKEN.
+		Token string `yaml:"-"`
+	} `yaml:"vault"`
+}
+
+// Orphans is where the orphan controller looks, in the GCP project, for resources left behind.
+type Orphans struct {
+	// Collect deletes orphans, rather than only reporting them. HELIUM_ORPHAN_COLLECT.
+	Collect bool `yaml:"collect"`
+	// KubeContexts are the clusters whose namespaces are checked. HELIUM_ORPHAN_KUBE_CONTEXTS,
+	// comma separated.
+	KubeContexts []string `yaml:"kubeContexts"`
+	// Buckets checks storage buckets. HELIUM_ORPHAN_BUCKETS.
+	Buckets bool `yaml:"buckets"`
+	// Clusters are the location/cluster pairs whose node pools are checked.
+	// HELIUM_ORPHAN_CLUSTERS, comma separated.
+	Clusters []string `yaml:"clusters"`
+	// DNSZone is the managed zone whose record sets are checked. HELIUM_ORPHAN_DNS_ZONE.
+	DNSZone string `yaml:"dnsZone"`
+}
+
+// Controlplane is how the controlplane's controllers are paced.
+type Controlplane struct {
+	// Parallelism is how many stacks the deletion controller checks or destroys at once.
+	// HELIUM_CONTROLPLANE_PARALLELISM.
+	Parallelism int `yaml:"parallelism"`
+	// DestroyInterval is the least time between starting two destroys on the same cluster.
+	// HELIUM_CONTROLPLANE_DESTROY_INTERVAL.
+	DestroyInterval time.Duration `yaml:"destroyInterval"`
+	// DestroyTimeout bounds each destroy the reconciler runs, including waiting for its
+	// cluster's turn. Zero means no bound. HELIUM_CONTROLPLANE_DESTROY_TIMEOUT.
+	DestroyTimeout time.Duration `yaml:"destroyTimeout"`
+	// MinimumAge spares stacks created more recently from deletion.
+	// HELIUM_CONTROLPLANE_MINIMUM_AGE.
+	MinimumAge time.Duration `yaml:"minimumAge"`
+	// ResyncInterval is how often the reconciler lists every stack again.
+	// HELIUM_CONTROLPLANE_RESYNC_INTERVAL.
+	ResyncInterval time.Duration `yaml:"resyncInterval"`
+	// TriggerPollInterval is how often the reconciler looks for reconcile requests from the API.
+	// HELIUM_CONTROLPLANE_TRIGGER_POLL_INTERVAL.
+	TriggerPollInterval time.Duration `yaml:"triggerPollInterval"`
+	// LeaseDuration is how long the leader's lease lasts unrenewed.
+	// HELIUM_CONTROLPLANE_LEASE_DURATION.
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	// StuckThreshold is how long an update may stay in progress before the recovery controller
+	// recovers it. HELIUM_CONTROLPLANE_STUCK_THRESHOLD.
+	StuckThreshold time.Duration `yaml:"stuckThreshold"`
+	// PrewarmInterval is how often the prewarm pools are refilled. HELIUM_PREWARM_INTERVAL.
+	PrewarmInterval time.Duration `yaml:"prewarmInterval"`
+	// OrphanGracePeriod spares resources created more recently from orphan collection.
+	// HELIUM_ORPHAN_GRACE_PERIOD.
+	OrphanGracePeriod time.Duration `yaml:"orphanGracePeriod"`
+	// DriftCheckInterval is how often each workspace is checked for drift. Zero turns drift
+	// checks off. HELIUM_DRIFT_CHECK_INTERVAL.
+	DriftCheckInterval time.Duration `yaml:"driftCheckInterval"`
+	// DriftMinimumAge spares workspaces created more recently from drift checks.
+	// HELIUM_DRIFT_MINIMUM_AGE.
+	DriftMinimumAge time.Duration `yaml:"driftMinimumAge"`
+	// DriftPassInterval is how often the drift controller looks for workspaces due a check.
+	// HELIUM_DRIFT_PASS_INTERVAL.
+	DriftPassInterval time.Duration `yaml:"driftPassInterval"`
+	// ID names this replica in the leader lease, defaulting to its hostname and pid.
+	// HELIUM_CONTROLPLANE_ID.
+	ID string `yaml:"id"`
+	// DryRun reports what the controllers would destroy without destroying anything.
+	// HELIUM_CONTROLPLANE_DRY_RUN.
+	DryRun bool `yaml:"dryRun"`
+	// DeleteAll destroys every stack, expired or not. HELIUM_CONTROLPLANE_DELETE_ALL.
+	DeleteAll bool `yaml:"deleteAll"`
+	// ProtectedPatterns are patterns, as matched by path.Match, of stacks that are never
+	// destroyed. HELIUM_CONTROLPLANE_PROTECTED_PATTERNS, comma separated.
+	ProtectedPatterns []string `yaml:"protectedPatterns"`
+}
+
+// Defaults returns the settings helium has without a config file. Those that name a deployment's
+// own resources, such as its GCP project, base URLs, Auth0 tenant and Sentry DSN, have no default,
+// so that a deployment that leaves one out fails validation rather than using another's.
+func Defaults() *Config {
+	c := &Config{
+		Port: 2323,
+		Plugins: map[string]string{
+			"gcp":        "v6.5.0",
+			"kubernetes": "v3.12.1",
+			"aws":        "v5.7.0",
+			"eks":        "v0.40.0",
+			"postgresql": "v3.4.0",
+		},
+		ControllerInterval: 30 * time.Minute,
+		Controlplane: Controlplane{
+			Parallelism:         8,
+			DestroyInterval:     10 * time.Second,
+			DestroyTimeout:      time.Hour,
+			MinimumAge:          time.Hour,
+			ResyncInterval:      30 * time.Minute,
+			TriggerPollInterval: 5 * time.Second,
+			LeaseDuration:       30 * time.Second,
+			StuckThreshold:      2 * time.Hour,
+			PrewarmInterval:     time.Minute,
+			OrphanGracePeriod:   time.Hour,
+			DriftCheckInterval:  24 * time.Hour,
+			DriftMinimumAge:     24 * time.Hour,
+			DriftPassInterval:   30 * time.Minute,
+		},
+		DefaultBackend:    "gcp_namespace_only",
+		DefaultExpiryDays: 1,
+		Files: Files{
+			Backends:     "backends.yaml",
+			Policies:     "policies.yaml",
+			Quotas:       "quotas.yaml",
+			ClusterPool:  "cluster-pool.yaml",
+			PrewarmPools: "prewarm-pools.yaml",
+			PinnedStacks: "pinned-stacks.yaml",
+		},
+		Program: Program{
+			Repo: "https://github.com/pachyderm/poc-pulumi.git",
+			Ref:  "refs/heads/main",
+		},
+		Secrets: Secrets{Provider: "env", Dir: "/var/secrets/helium"},
+	}
+	c.GCP.Zone = "us-east1-b"
+	c.AWS.Region = "us-west-2"
+	c.Sentry.Environment = "dev"
+	c.Secrets.Vault.Path = "secret/data/helium"
+	return c
+}
+
+// Load reads a config file over the defaults, applies the environment's overrides, and validates
+// the result. A missing file means the defaults.
+func Load(path string) (*Config, error) {
+	c := Defaults()
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := parse(c, data); err != nil {
+		return nil, err
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parse(c *Config, data []byte) error {
+	// The file's plugins replace the defaults, rather than adding to them.
+	var plugins struct {
+		Plugins map[string]string `yaml:"plugins"`
+	}
+	if err := yaml.Unmarshal(data, &plugins); err != nil {
+		return fmt.Errorf("parse config file: %w", err)
+	}
+	if plugins.Plugins != nil {
+		c.Plugins = nil
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse config file: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	for env, field := range map[string]*string{
+		"HELIUM_GCP_PROJECT":        &c.GCP.Project,
+		"HELIUM_GCP_ZONE":           &c.GCP.Zone,
+		"HELIUM_WORKSPACE_BASE_URL": &c.WorkspaceBaseURL,
+		"HELIUM_TESTCI_BASE_URL":    &c.TestCIBaseURL,
+		"HELIUM_AUTH0_DOMAIN":       &c.Auth0.Domain,
+		"HELIUM_AUTH0_SUBDOMAIN":    &c.Auth0.Subdomain,
+		"HELIUM_CLIENT_ID":          &c.Auth0.ClientID,
+		"HELIUM_CLIENT_SECRET":      &c.Auth0.ClientSecret,
+		"HELIUM_AWS_REGION":         &c.AWS.Region,
+		"HELIUM_DEFAULT_BACKEND":    &c.DefaultBackend,
+		"HELIUM_SENTRY_DSN":         &c.Sentry.DSN,
+		"HELIUM_SENTRY_ENVIRONMENT": &c.Sentry.Environment,
+
+		"HELIUM_BACKENDS_FILE":      &c.Files.Backends,
+		"HELIUM_POLICY_FILE":        &c.Files.Policies,
+		"HELIUM_QUOTAS_FILE":        &c.Files.Quotas,
+		"HELIUM_CLUSTER_POOL_FILE":  &c.Files.ClusterPool,
+		"HELIUM_PREWARM_POOLS_FILE": &c.Files.PrewarmPools,
+		"HELIUM_PINNED_STACKS_FILE": &c.Files.PinnedStacks,
+		"HELIUM_STORE_DIR":          &c.StoreDir,
+
+		"HELIUM_PROGRAM_DIR":           &c.Program.Dir,
+		"HELIUM_PROGRAM_REPO":          &c.Program.Repo,
+		"HELIUM_PROGRAM_REF":           &c.Program.Ref,
+		"HELIUM_GITHUB_PERSONAL_TOKEN": &c.Program.GitHubToken,
+
+		"HELIUM_OIDC_ISSUER":       &c.OIDC.Issuer,
+		"HELIUM_OIDC_JWKS_URL":     &c.OIDC.JWKSURL,
+		"HELIUM_OIDC_REDIRECT_URL": &c.OIDC.RedirectURL,
+		"HELIUM_OIDC_AUDIENCE":     &c.OIDC.Audience,
+		"HELIUM_OIDC_GROUPS_CLAIM": &c.OIDC.GroupsClaim,
+		"HELIUM_SESSION_KEY":       &c.OIDC.SessionKey,
+		"HELIUM_BOOTSTRAP_TOKEN":   &c.BootstrapToken,
+
+		"HELIUM_SECRET_PROVIDER": &c.Secrets.Provider,
+		"HELIUM_SECRETS_DIR":     &c.Secrets.Dir,
+		"VAULT_ADDR":             &c.Secrets.Vault.Addr,
+		"HELIUM_VAULT_PATH":      &c.Secrets.Vault.Path,
+		"VAULT_TOKEN":            &c.Secrets.Vault.Token,
+
+		"HELIUM_ORPHAN_DNS_ZONE": &c.Orphans.DNSZone,
+		"HELIUM_CONTROLPLANE_ID": &c.Controlplane.ID,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	for env, field := range map[string]*int{
+		"HELIUM_PORT":                     &c.Port,
+		"HELIUM_DEFAULT_EXPIRATION_DAYS":  &c.DefaultExpiryDays,
+		"HELIUM_CONTROLPLANE_PARALLELISM": &c.Controlplane.Parallelism,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*field = n
+		}
+	}
+	cp := &c.Controlplane
+	for env, field := range map[string]*time.Duration{
+		"HELIUM_CONTROLLER_INTERVAL":                &c.ControllerInterval,
+		"HELIUM_CONTROLPLANE_DESTROY_INTERVAL":      &cp.DestroyInterval,
+		"HELIUM_CONTROLPLANE_DESTROY_TIMEOUT":       &cp.DestroyTimeout,
+		"HELIUM_CONTROLPLANE_MINIMUM_AGE":           &cp.MinimumAge,
+		"HELIUM_CONTROLPLANE_RESYNC_INTERVAL":       &cp.ResyncInterval,
+		"HELIUM_CONTROLPLANE_TRIGGER_POLL_INTERVAL": &cp.TriggerPollInterval,
+		"HELIUM_CONTROLPLANE_LEASE_DURATION":        &cp.LeaseDuration,
+		"HELIUM_CONTROLPLANE_STUCK_THRESHOLD":       &cp.StuckThreshold,
+		"HELIUM_PREWARM_INTERVAL":                   &cp.PrewarmInterval,
+		"HELIUM_ORPHAN_GRACE_PERIOD":                &cp.OrphanGracePeriod,
+		"HELIUM_DRIFT_CHECK_INTERVAL":               &cp.DriftCheckInterval,
+		"HELIUM_DRIFT_MINIMUM_AGE":                  &cp.DriftMinimumAge,
+		"HELIUM_DRIFT_PASS_INTERVAL":                &cp.DriftPassInterval,
+		"HELIUM_SESSION_TTL":                        &c.OIDC.SessionTTL,
+	} {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*field = d
+		}
+	}
+	for env, field := range map[string]*bool{
+		"HELIUM_ORPHAN_COLLECT":          &c.Orphans.Collect,
+		"HELIUM_ORPHAN_BUCKETS":          &c.Orphans.Buckets,
+		"HELIUM_CONTROLPLANE_DRY_RUN":    &cp.DryRun,
+		"HELIUM_CONTROLPLANE_DELETE_ALL": &cp.DeleteAll,
+	} {
+		if v := os.Getenv(env); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*field = b
+		}
+	}
+	for env, field := range map[string]*[]string{
+		"HELIUM_ADMINS":                          &c.Admins,
+		"HELIUM_VIEWERS":                         &c.Viewers,
+		"HELIUM_OIDC_ALLOWED_DOMAINS":            &c.OIDC.AllowedDomains,
+		"HELIUM_OIDC_ALLOWED_GROUPS":             &c.OIDC.AllowedGroups,
+		"HELIUM_ORPHAN_KUBE_CONTEXTS":            &c.Orphans.KubeContexts,
+		"HELIUM_ORPHAN_CLUSTERS":                 &c.Orphans.Clusters,
+		"HELIUM_CONTROLPLANE_PROTECTED_PATTERNS": &cp.ProtectedPatterns,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = splitList(v)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Validate checks that every setting is usable, and returns all the problems if not.
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Port <= 0 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", c.Port))
+	}
+	for _, required := range []struct{ name, v string }{
+		{"gcp.project", c.GCP.Project},
+		{"gcp.zone", c.GCP.Zone},
+		{"workspaceBaseURL", c.WorkspaceBaseURL},
+		{"testciBaseURL", c.TestCIBaseURL},
+		{"auth0.subdomain", c.Auth0.Subdomain},
+		{"aws.region", c.AWS.Region},
+		{"defaultBackend", c.DefaultBackend},
+		{"sentry.dsn", c.Sentry.DSN},
+		{"files.backends", c.Files.Backends},
+		{"files.policies", c.Files.Policies},
+		{"files.quotas", c.Files.Quotas},
+		{"files.clusterPool", c.Files.ClusterPool},
+		{"files.prewarmPools", c.Files.PrewarmPools},
+		{"files.pinnedStacks", c.Files.PinnedStacks},
+	} {
+		if required.v == "" {
+			problems = append(problems, required.name+" is required")
+		}
+	}
+	if u, err := url.Parse(c.Auth0.Domain); err != nil || u.Scheme != "https" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("auth0.domain %q isn't an https URL", c.Auth0.Domain))
+	}
+	if c.DefaultBackend != "" {
+		switch cat, err := catalog.Load(c.Files.Backends); {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("backend catalog: %v", err))
+		case cat.Get(c.DefaultBackend) == nil:
+			problems = append(problems, fmt.Sprintf("defaultBackend %q isn't in the backend catalog", c.DefaultBackend))
+		case cat.Default().Name != c.DefaultBackend:
+			// The API fills in the catalog's default, and pools and the pulumi backend this one,
+			// so they must agree.
+			problems = append(problems, fmt.Sprintf("defaultBackend %q isn't the backend catalog's default, %q", c.DefaultBackend, cat.Default().Name))
+		}
+	}
+	if c.DefaultExpiryDays < 1 || c.DefaultExpiryDays > 90 {
+		problems = append(problems, fmt.Sprintf("defaultExpiryDays %d isn't between 1 and 90", c.DefaultExpiryDays))
+	}
+	if len(c.Plugins) == 0 {
+		problems = append(problems, "plugins must list at least one plugin")
+	}
+	for _, name := range c.PluginNames() {
+		if version := c.Plugins[name]; !strings.HasPrefix(version, "v") {
+			problems = append(problems, fmt.Sprintf("plugin %s has version %q, which should start with v", name, version))
+		}
+	}
+	if c.ControllerInterval < time.Minute {
+		problems = append(problems, fmt.Sprintf("controllerInterval %v is shorter than a minute", c.ControllerInterval))
+	}
+	cp := c.Controlplane
+	if cp.Parallelism <= 0 {
+		problems = append(problems, fmt.Sprintf("controlplane.parallelism %d must be positive", cp.Parallelism))
+	}
+	for _, positive := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"resyncInterval", cp.ResyncInterval},
+		{"triggerPollInterval", cp.TriggerPollInterval},
+		{"leaseDuration", cp.LeaseDuration},
+		{"stuckThreshold", cp.StuckThreshold},
+		{"prewarmInterval", cp.PrewarmInterval},
+		{"driftPassInterval", cp.DriftPassInterval},
+	} {
+		if positive.d <= 0 {
+			problems = append(problems, fmt.Sprintf("controlplane.%s %v must be positive", positive.name, positive.d))
+		}
+	}
+	for _, nonNegative := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"destroyInterval", cp.DestroyInterval},
+		{"destroyTimeout", cp.DestroyTimeout},
+		{"minimumAge", cp.MinimumAge},
+		{"orphanGracePeriod", cp.OrphanGracePeriod},
+		{"driftCheckInterval", cp.DriftCheckInterval},
+		{"driftMinimumAge", cp.DriftMinimumAge},
+	} {
+		if nonNegative.d < 0 {
+			problems = append(problems, fmt.Sprintf("controlplane.%s %v is negative", nonNegative.name, nonNegative.d))
+		}
+	}
+	for _, p := range cp.ProtectedPatterns {
+		if _, err := path.Match(p, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("controlplane.protectedPatterns %q: %v", p, err))
+		}
+	}
+	if c.Program.Dir == "" {
+		if u, err := url.Parse(c.Program.Repo); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("program.repo %q isn't an https URL", c.Program.Repo))
+		}
+		if c.Program.Ref == "" {
+			problems = append(problems, "program.ref is required")
+		}
+	}
+	if c.OIDC.Issuer != "" {
+		if u, err := url.Parse(c.OIDC.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("oidc.issuer %q isn't an https URL", c.OIDC.Issuer))
+		}
+		if c.OIDC.RedirectURL == "" || c.Auth0.ClientID == "" {
+			problems = append(problems, "oidc needs a redirectURL and auth0.clientID")
+		}
+		if len(c.OIDC.AllowedDomains) == 0 && len(c.OIDC.AllowedGroups) == 0 {
+			problems = append(problems, "oidc needs allowedDomains or allowedGroups")
+		}
+	}
+	if c.OIDC.SessionTTL < 0 {
+		problems = append(problems, fmt.Sprintf("oidc.sessionTTL %v is negative", c.OIDC.SessionTTL))
+	}
+	switch s := c.Secrets; {
+	case !secretProviders[s.Provider]:
+		problems = append(problems, fmt.Sprintf("secrets.provider %q isn't env, file or vault", s.Provider))
+	case s.Provider == "file" && s.Dir == "":
+		problems = append(problems, "secrets.dir is required for the file provider")
+	case s.Provider == "vault" && (s.Vault.Addr == "" || s.Vault.Token == "" || s.Vault.Path == ""):
+		problems = append(problems, "the vault secret provider needs VAULT_ADDR, VAULT_TOKEN and secrets.vault.path")
+	}
+	for _, cluster := range c.Orphans.Clusters {
+		if location, name, ok := strings.Cut(cluster, "/"); !ok || location == "" || name == "" {
+			problems = append(problems, fmt.Sprintf("orphans.clusters %q isn't location/cluster", cluster))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// PluginNames returns the names of the plugins, sorted.
+func (c *Config) PluginNames() []string {
+	names := make([]string, 0, len(c.Plugins))
+	for name := range c.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Redacted returns a copy of the config that's safe to show, without the Sentry DSN's key or any
+// of the secrets.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Plugins = make(map[string]string, len(c.Plugins))
+	for k, v := range c.Plugins {
+		r.Plugins[k] = v
+	}
+	if c.Sentry.DSN != "" {
+		r.Sentry.DSN = redacted
+	}
+	for _, secret := range []*string{
+		&r.Auth0.ClientSecret,
+		&r.Program.GitHubToken,
+		&r.OIDC.SessionKey,
+		&r.BootstrapToken,
+		&r.Secrets.Vault.Token,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return &r
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Validate checks the default backend against the shipped catalog.
+	os.Setenv("HELIUM_BACKENDS_FILE", "../backends.yaml")
+	// The settings that name a deployment's own resources have no defaults.
+	for env, v := range map[string]string{
+		"HELIUM_GCP_PROJECT":        "staging",
+		"HELIUM_WORKSPACE_BASE_URL": "workspace.example.com",
+		"HELIUM_TESTCI_BASE_URL":    "test-ci.example.com",
+		"HELIUM_AUTH0_DOMAIN":       "https://example.auth0.com/",
+		"HELIUM_AUTH0_SUBDOMAIN":    "example",
+		"HELIUM_SENTRY_DSN":         "https://key@sentry.example.com/1",
+	} {
+		os.Setenv(env, v)
+	}
+	os.Exit(m.Run())
+}
+
+func TestLoad(t *testing.T) {
+	err := Defaults().Validate()
+	for _, required := range []string{"gcp.project", "workspaceBaseURL", "testciBaseURL", "auth0.subdomain", "auth0.domain", "sentry.dsn"} {
+		if err == nil || !strings.Contains(err.Error(), required) {
+			t.Errorf("validating the defaults: %v, want an error about %s", err, required)
+		}
+	}
+	if _, err := Load("../helium.yaml"); err != nil {
+		t.Errorf("Load of the shipped config file: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "helium.yaml")
+	if err := os.WriteFile(path, []byte(`
+gcp:
+  project: other
+plugins:
+  gcp: v6.5.0
+controllerInterval: 10m
+controlplane:
+  driftPassInterval: 1h
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HELIUM_PORT", "8080")
+	t.Setenv("HELIUM_GCP_ZONE", "us-west1-a")
+	t.Setenv("HELIUM_CONTROLPLANE_RESYNC_INTERVAL", "10m")
+	t.Setenv("HELIUM_CLIENT_SECRET", "shh")
+	t.Setenv("HELIUM_ADMINS", "boss@example.com, ops@example.com")
+	t.Setenv("HELIUM_CONTROLPLANE_DRY_RUN", "True")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.GCP.Project != "staging" || c.GCP.Zone != "us-west1-a" || c.Port != 8080 || c.ControllerInterval != 10*time.Minute {
+		t.Errorf("loaded %+v, want the file's project and interval, and the environment's zone and port", c)
+	}
+	if len(c.Plugins) != 1 || c.DefaultBackend != "gcp_namespace_only" {
+		t.Errorf("loaded %+v, want only the file's plugins, and the default backend", c)
+	}
+	if cp := c.Controlplane; cp.DriftPassInterval != time.Hour || cp.ResyncInterval != 10*time.Minute || cp.LeaseDuration != 30*time.Second {
+		t.Errorf("loaded %+v, want the file's drift pass interval, the environment's resync interval, and the default lease", cp)
+	}
+	if c.Auth0.ClientSecret != "shh" {
+		t.Errorf("loaded client secret %q, want the environment's", c.Auth0.ClientSecret)
+	}
+	if len(c.Admins) != 2 || c.Admins[1] != "ops@example.com" || !c.Controlplane.DryRun || c.Files.Policies != "policies.yaml" {
+		t.Errorf("loaded %+v, want the environment's admins and dry run, and the default policy file", c)
+	}
+
+	for _, test := range []struct {
+		env, value, problem string
+	}{
+		{"HELIUM_PORT", "http", "HELIUM_PORT"},
+		{"HELIUM_PORT", "70000", "port 70000"},
+		{"HELIUM_AUTH0_DOMAIN", "example.auth0.com", "auth0.domain"},
+		{"HELIUM_CONTROLLER_INTERVAL", "1s", "controllerInterval"},
+		{"HELIUM_DEFAULT_BACKEND", "no_such_backend", "defaultBackend"},
+		{"HELIUM_DEFAULT_BACKEND", "gcp_cluster_only", "catalog's default"},
+		{"HELIUM_DEFAULT_EXPIRATION_DAYS", "0", "defaultExpiryDays"},
+		{"HELIUM_CONTROLPLANE_LEASE_DURATION", "0s", "leaseDuration"},
+		{"HELIUM_DRIFT_PASS_INTERVAL", "soon", "HELIUM_DRIFT_PASS_INTERVAL"},
+		{"HELIUM_BACKENDS_FILE", "no-such-file.yaml", "backend catalog"},
+		{"HELIUM_GCP_PROJECT", "", "gcp.project"},
+		{"HELIUM_SENTRY_DSN", "", "sentry.dsn"},
+		{"HELIUM_CONTROLPLANE_DRY_RUN", "maybe", "HELIUM_CONTROLPLANE_DRY_RUN"},
+		{"HELIUM_CONTROLPLANE_PROTECTED_PATTERNS", "prod-[", "protectedPatterns"},
+		{"HELIUM_PROGRAM_REPO", "file:///src/poc-pulumi", "program.repo"},
+		{"HELIUM_OIDC_ISSUER", "https://example.auth0.com/", "oidc needs"},
+		{"HELIUM_SECRET_PROVIDER", "vault", "VAULT_ADDR"},
+		{"HELIUM_SECRET_PROVIDER", "keychain", "secrets.provider"},
+		{"HELIUM_ORPHAN_CLUSTERS", "us-east1-b", "orphans.clusters"},
+	} {
+		t.Run(test.env+"="+test.value, func(t *testing.T) {
+			t.Setenv(test.env, test.value)
+			if _, err := Load("no-such-file.yaml"); err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("Load: %v, want an error about %s", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestLoadRequiresPlugins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "helium.yaml")
+	if err := os.WriteFile(path, []byte("plugins: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "plugins") {
+		t.Errorf("Load with no plugins: %v, want an error about plugins", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Defaults()
+	c.Sentry.DSN = "https://key@sentry.example.com/1"
+	c.Auth0.ClientSecret = "shh"
+	c.OIDC.SessionKey = "shh"
+	c.BootstrapToken = "shh"
+	r := c.Redacted()
+	r.Plugins["gcp"] = "v0"
+	if r.Sentry.DSN != redacted || r.Auth0.ClientSecret != redacted || r.OIDC.SessionKey != redacted || r.BootstrapToken != redacted {
+		t.Errorf("Redacted should mask the DSN and secrets, got %+v", r)
+	}
+	if c.Sentry.DSN == redacted || c.BootstrapToken == redacted || c.Plugins["gcp"] == "v0" {
+		t.Errorf("Redacted changed the original, got %+v", c)
+	}
+}
@@ -1,79 +1,235 @@
 package controlplane
 
 import (
-	"os"
-	"strings"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
 	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
 )
 
+// Backend is the set of stack operations the controllers need. pulumiBackend implements it with
+// pulumi_backends; tests substitute fakes. The operations that run Pulumi take the controller's
+// context, which is cancelled when this replica stops leading, so that it stops changing stacks
+// once another replica may have started.
+type Backend interface {
+	List() (*api.ListResponse, error)
+	GetExpiry(api.ID) (time.Time, error)
+	GetMetadata(api.ID) (*pulumi_backends.Metadata, error)
+	Destroy(context.Context, api.ID) error
+	DestroyCascade(context.Context, api.ID) error
+	Dependents(api.ID) ([]api.ID, error)
+	Create(context.Context, *api.Spec) (*api.CreateResponse, error)
+	GetClaim(api.ID) (*pulumi_backends.Claim, error)
+	GetDrift(api.ID) (*pulumi_backends.Drift, error)
+	CheckDrift(context.Context, api.ID) (*pulumi_backends.Drift, error)
+}
+
+type pulumiBackend struct{}
+
+func (pulumiBackend) List() (*api.ListResponse, error) { return pulumi_backends.List() }
+func (pulumiBackend) GetExpiry(i api.ID) (time.Time, error) {
+	return pulumi_backends.GetExpiry(i)
+}
+func (pulumiBackend) GetMetadata(i api.ID) (*pulumi_backends.Metadata, error) {
+	return pulumi_backends.GetMetadata(i)
+}
+func (pulumiBackend) Destroy(ctx context.Context, i api.ID) error {
+	return pulumi_backends.Destroy(ctx, i)
+}
+func (pulumiBackend) DestroyCascade(ctx context.Context, i api.ID) error {
+	return pulumi_backends.DestroyCascade(ctx, i)
+}
+func (pulumiBackend) Dependents(i api.ID) ([]api.ID, error) {
+	return pulumi_backends.LiveDependents(context.Background(), i)
+}
+func (pulumiBackend) Create(ctx context.Context, s *api.Spec) (*api.CreateResponse, error) {
+	return pulumi_backends.Create(ctx, s)
+}
+func (pulumiBackend) GetClaim(i api.ID) (*pulumi_backends.Claim, error) {
+	return pulumi_backends.GetClaim(i)
+}
+func (pulumiBackend) GetDrift(i api.ID) (*pulumi_backends.Drift, error) {
+	return pulumi_backends.GetDrift(i)
+}
+func (pulumiBackend) CheckDrift(ctx context.Context, i api.ID) (*pulumi_backends.Drift, error) {
+	return pulumi_backends.CheckDrift(ctx, i)
+}
+
+// DeletionController decides what the Reconciler does with a stack that is due for deletion, and
+// destroys it if it may.
+type DeletionController struct {
+	Backend Backend
+	// Parallelism is the number of stacks checked or destroyed at once.
+	Parallelism int
+	// DestroyInterval is the minimum time between starting two destroys on the same cluster.
+	DestroyInterval time.Duration
+	// DestroyTimeout bounds each destroy, including waiting for its cluster's turn. A destroy
+	// that runs out of time fails, and is retried with backoff. Zero means no bound.
+	DestroyTimeout time.Duration
+	// DeleteAll destroys every stack, expired or not.
+	DeleteAll bool
+	// DryRun reports what would be destroyed without destroying anything.
+	DryRun bool
+	// Protection is checked before every destroy.
+	Protection Protection
+	// Store keeps the last decision about each stack.
+	Store store.Store
+}
+
+// outcome is what the reconciler did with a stack it processed.
+type outcome int
+
 const (
-	InfraPrewarmCount     = 2
-	WorkspacePrewarmCount = 2
+	outcomeKept outcome = iota
+	outcomeDestroyed
+	// outcomeFailed is a stack that couldn't be checked or destroyed, or whose destroy ran out
+	// of time. It's retried with backoff.
+	outcomeFailed
+	// outcomeSkipped is a destroy abandoned because the reconciler is stopping.
+	outcomeSkipped
+	outcomeProtected
+	outcomeWouldDestroy
+	outcomeWaiting
+	outcomeNoExpiry
 )
 
-var deletionControllerMode string = os.Getenv("HELIUM_CONTROLPLANE_DELETE_ALL")
-
-func RunDeletionController() error {
-	//For each Pach, check Expiry. If true, call Delete
+// NewDeletionController returns a DeletionController for the pulumi backend, paced by c and with
+// the delete-all and dry-run modes c turns on.
+func NewDeletionController(c *config.Config) *DeletionController {
+	return &DeletionController{
+		Backend:         pulumiBackend{},
+		Parallelism:     c.Controlplane.Parallelism,
+		DestroyInterval: c.Controlplane.DestroyInterval,
+		DestroyTimeout:  c.Controlplane.DestroyTimeout,
+		DeleteAll:       c.Controlplane.DeleteAll,
+		DryRun:          c.Controlplane.DryRun,
+		Protection:      NewProtection(c),
+		Store:           store.Default(),
+	}
+}
 
-	id, err := pulumi_backends.List()
+// destroy destroys a stack that is due for deletion for reason, unless it's protected or this is a
+// dry run.
+func (c *DeletionController) destroy(ctx context.Context, limiter *clusterLimiter, v api.ID, reason string) outcome {
+	md, err := c.Backend.GetMetadata(v)
 	if err != nil {
-		return err
+		log.Errorf("deletion controller error reading metadata for %v: %v", v, err)
+		return outcomeFailed
 	}
-	var nightlyPresent bool
-	for _, v := range id.IDs {
-		if v == "nightly-cluster" {
-			nightlyPresent = true
-		}
-		b, err := pulumi_backends.IsExpired(v)
-		if err != nil {
-			if strings.Contains(err.Error(), "expected stack output 'helium-expiry' not found for stack") {
-				log.Debugf("deletion controller destroying because expiry not found: %v", v)
-				err := pulumi_backends.Destroy(v)
-				if err != nil {
-					log.Errorf("deletion controller error destroying: %v", err)
-				}
-			} else {
-				log.Errorf("expiry error: %v", err)
-				continue
-			}
-		}
-		if b || deletionControllerMode == "True" {
-			log.Debugf("deletion controller destroying: %v", v)
-			err := pulumi_backends.Destroy(v)
-			if err != nil {
-				log.Errorf("deletion controller error destroying: %v", err)
-			}
-			time.Sleep(time.Second * 10)
-			// TODO: This is a bit of a hack for feeddog. Will cause a circular import if anything in pulumi_backends needs this package
-			if v == "nightly-cluster" {
-				time.Sleep(time.Minute * 5)
-				spec := &api.Spec{
-					Name:    "nightly-cluster",
-					Backend: "gcp_cluster_only",
-				}
-				_, err = pulumi_backends.Create(spec)
-				if err != nil {
-					log.Errorf("create handler: %v", err)
-				}
-			}
-		}
+	if protected := c.Protection.Check(v, md, time.Now()); protected != "" {
+		c.decide(v, "skip", protected)
+		return outcomeProtected
 	}
-	if !nightlyPresent {
-		spec := &api.Spec{
-			Name:    "nightly-cluster",
-			Backend: "gcp_cluster_only",
-		}
-		_, err = pulumi_backends.Create(spec)
-		if err != nil {
-			log.Errorf("create handler: %v", err)
+	if c.DryRun {
+		c.decide(v, "destroy", reason)
+		return outcomeWouldDestroy
+	}
+	// A cluster outlives what's deployed into it, so it waits for its dependents to go first.
+	deps, err := c.Backend.Dependents(v)
+	if err != nil {
+		log.Errorf("deletion controller error listing dependents of %v: %v", v, err)
+		return outcomeFailed
+	}
+	if len(deps) > 0 {
+		c.decide(v, "skip", fmt.Sprintf("%s, but %v are deployed into it", reason, deps))
+		return outcomeWaiting
+	}
+
+	if c.DestroyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DestroyTimeout)
+		defer cancel()
+	}
+	if err := limiter.Wait(ctx, md.ClusterStack); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Errorf("deletion controller timed out waiting for cluster %q to destroy %v", md.ClusterStack, v)
+			return outcomeFailed
 		}
+		log.Debugf("deletion controller stopping, not destroying %v", v)
+		return outcomeSkipped
 	}
+	c.decide(v, "destroy", reason)
+	event := api.AuditEvent{
+		Actor:     audit.Controller("deletion"),
+		Action:    "delete",
+		Workspace: v,
+		Params:    map[string]string{"reason": reason},
+		StartedAt: time.Now(),
+	}
+	err = c.Backend.Destroy(ctx, v)
+	audit.Done(event, err)
+	if err != nil {
+		log.Errorf("deletion controller error destroying: %v", err)
+		return outcomeFailed
+	}
+	return outcomeDestroyed
+}
 
-	return nil
+// decide logs a deletion decision and keeps it in the store for the API.
+func (c *DeletionController) decide(v api.ID, action, reason string) {
+	d := &Decision{
+		ID:     v,
+		Action: action,
+		Reason: reason,
+		DryRun: c.DryRun,
+		Time:   time.Now(),
+	}
+	log.WithFields(log.Fields{
+		"canonical":  "true",
+		"controller": "deletion",
+		"stack":      v,
+		"action":     action,
+		"reason":     reason,
+		"dryRun":     c.DryRun,
+	}).Info("deletion controller decision")
+	if err := putDecision(c.Store, d); err != nil {
+		log.Errorf("deletion controller error recording decision for %v: %v", v, err)
+	}
+}
+
+// clusterLimiter spaces out destroys on the same cluster, so a pass that finds many expired
+// workspaces doesn't tear down all of a cluster's namespaces at once.
+type clusterLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newClusterLimiter(interval time.Duration) *clusterLimiter {
+	return &clusterLimiter{interval: interval, next: make(map[string]time.Time)}
+}
+
+// Wait blocks until a destroy may start on cluster, or ctx is done.
+func (l *clusterLimiter) Wait(ctx context.Context, cluster string) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[cluster]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[cluster] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
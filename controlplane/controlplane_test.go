@@ -0,0 +1,385 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/policy"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+// TestMain keeps the audit log the controllers write in memory, gives the backend the default
+// settings, and checks specs against the shipped policy file.
+func TestMain(m *testing.M) {
+	store.SetDefault(store.NewMemory())
+	pulumi_backends.Configure(config.Defaults())
+	policy.SetFile("../policies.yaml")
+	os.Exit(m.Run())
+}
+
+// fakeBackend is an in-memory Backend. Stacks are expired if their value in expired is true, and
+// live in the cluster named by clusters.
+type fakeBackend struct {
+	mu           sync.Mutex
+	ids          []api.ID
+	expired      map[api.ID]bool
+	expiries     map[api.ID]time.Time
+	clusters     map[api.ID]string
+	failExpiry   map[api.ID]bool
+	noExpiry     map[api.ID]bool
+	labels       map[api.ID]map[string]string
+	createdAt    map[api.ID]time.Time
+	failCreate   map[string]bool
+	claims       map[api.ID]*pulumi_backends.Claim
+	drift        map[api.ID]*pulumi_backends.Drift
+	drifted      map[api.ID]bool
+	failDrift    map[api.ID]bool
+	busy         map[api.ID]bool
+	createDelay  time.Duration
+	destroyDelay time.Duration
+
+	destroyed   []api.ID
+	destroyedAt map[string][]time.Time
+	created     []string
+	driftChecks []api.ID
+	specs       []api.Spec
+}
+
+func newFakeBackend(ids ...api.ID) *fakeBackend {
+	return &fakeBackend{
+		ids:         ids,
+		expired:     make(map[api.ID]bool),
+		expiries:    make(map[api.ID]time.Time),
+		clusters:    make(map[api.ID]string),
+		failExpiry:  make(map[api.ID]bool),
+		noExpiry:    make(map[api.ID]bool),
+		labels:      make(map[api.ID]map[string]string),
+		createdAt:   make(map[api.ID]time.Time),
+		failCreate:  make(map[string]bool),
+		claims:      make(map[api.ID]*pulumi_backends.Claim),
+		drift:       make(map[api.ID]*pulumi_backends.Drift),
+		drifted:     make(map[api.ID]bool),
+		failDrift:   make(map[api.ID]bool),
+		busy:        make(map[api.ID]bool),
+		destroyedAt: make(map[string][]time.Time),
+	}
+}
+
+func (f *fakeBackend) List() (*api.ListResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &api.ListResponse{IDs: append([]api.ID(nil), f.ids...)}, nil
+}
+
+func (f *fakeBackend) GetExpiry(i api.ID) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := false
+	for _, id := range f.ids {
+		found = found || id == i
+	}
+	switch {
+	case !found:
+		return time.Time{}, pulumi_backends.ErrStackNotFound
+	case f.failExpiry[i]:
+		return time.Time{}, errors.New("boom")
+	case f.noExpiry[i]:
+		return time.Time{}, fmt.Errorf("%w: %v", pulumi_backends.ErrNoExpiry, i)
+	case !f.expiries[i].IsZero():
+		return f.expiries[i], nil
+	case f.expired[i]:
+		return time.Now().Add(-time.Hour), nil
+	}
+	return time.Now().Add(24 * time.Hour), nil
+}
+
+func (f *fakeBackend) GetMetadata(i api.ID) (*pulumi_backends.Metadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	md := &pulumi_backends.Metadata{
+		ClusterStack: f.clusters[i],
+		Labels:       f.labels[i],
+		CreatedAt:    f.createdAt[i],
+	}
+	if md.CreatedAt.IsZero() {
+		md.CreatedAt = time.Now().Add(-48 * time.Hour)
+	}
+	return md, nil
+}
+
+func (f *fakeBackend) Destroy(ctx context.Context, i api.ID) error {
+	f.mu.Lock()
+	f.destroyedAt[f.clusters[i]] = append(f.destroyedAt[f.clusters[i]], time.Now())
+	f.mu.Unlock()
+	time.Sleep(f.destroyDelay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.destroyed = append(f.destroyed, i)
+	for n, id := range f.ids {
+		if id == i {
+			f.ids = append(f.ids[:n:n], f.ids[n+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Dependents returns the stacks whose cluster is i.
+func (f *fakeBackend) Dependents(i api.ID) ([]api.ID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deps []api.ID
+	for _, id := range f.ids {
+		if f.clusters[id] == string(i) {
+			deps = append(deps, id)
+		}
+	}
+	return deps, nil
+}
+
+func (f *fakeBackend) DestroyCascade(ctx context.Context, i api.ID) error {
+	deps, _ := f.Dependents(i)
+	for _, d := range deps {
+		if err := f.DestroyCascade(ctx, d); err != nil {
+			return err
+		}
+	}
+	return f.Destroy(ctx, i)
+}
+
+// Create takes createDelay, or fails when ctx is done, like a Pulumi run that's interrupted.
+func (f *fakeBackend) Create(ctx context.Context, s *api.Spec) (*api.CreateResponse, error) {
+	select {
+	case <-time.After(f.createDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failCreate[s.Name] {
+		return nil, errors.New("boom")
+	}
+	f.created = append(f.created, s.Name)
+	f.ids = append(f.ids, api.ID(s.Name))
+	f.specs = append(f.specs, *s)
+	return &api.CreateResponse{ID: api.ID(s.Name)}, nil
+}
+
+func (f *fakeBackend) GetClaim(i api.ID) (*pulumi_backends.Claim, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.claims[i], nil
+}
+
+func (f *fakeBackend) GetDrift(i api.ID) (*pulumi_backends.Drift, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.drift[i], nil
+}
+
+// CheckDrift reports drift for the stacks set in drifted.
+func (f *fakeBackend) CheckDrift(ctx context.Context, i api.ID) (*pulumi_backends.Drift, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failDrift[i] {
+		return nil, errors.New("boom")
+	}
+	if f.busy[i] {
+		return nil, pulumi_backends.ErrWorkspaceBusy
+	}
+	f.driftChecks = append(f.driftChecks, i)
+	d := &pulumi_backends.Drift{CheckedAt: time.Now(), Drifted: f.drifted[i]}
+	if d.Drifted {
+		d.Resources = []pulumi_backends.ResourceDrift{{URN: "urn:" + string(i), Op: "update"}}
+	}
+	f.drift[i] = d
+	return d, nil
+}
+
+func TestDeletionMetrics(t *testing.T) {
+	f := newFakeBackend("nightly-cluster", "a", "b", "c", "d", "e")
+	f.expired["b"] = true
+	f.expired["d"] = true
+	f.failExpiry["e"] = true
+	r := newTestReconciler(f)
+	for _, id := range f.ids {
+		r.process(context.Background(), id)
+	}
+	if diff := cmp.Diff(Metrics{Checked: 5, Destroyed: 2, Failed: 1}, r.Metrics()); diff != "" {
+		t.Errorf("metrics (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]api.ID{"b", "d"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+	events, err := audit.Query(audit.Filter{Actor: audit.Controller("deletion"), Action: "delete", Workspace: "b"})
+	if err != nil {
+		t.Fatalf("audit.Query: %v", err)
+	}
+	if len(events) != 1 || events[0].Result != audit.Succeeded || events[0].Params["reason"] != "expired" {
+		t.Errorf("audit events for destroying b: %+v", events)
+	}
+	r.logMetrics(time.Hour)
+	if m := r.Metrics(); m != (Metrics{}) {
+		t.Errorf("metrics after logging them: %+v, want them reset", m)
+	}
+}
+
+func TestDeletionRateLimitsPerCluster(t *testing.T) {
+	f := newFakeBackend("a1", "a2", "a3", "b1")
+	for _, id := range f.ids {
+		f.expired[id] = true
+	}
+	f.clusters["a1"], f.clusters["a2"], f.clusters["a3"] = "a", "a", "a"
+	f.clusters["b1"] = "b"
+	interval := 50 * time.Millisecond
+	r := newTestReconciler(f)
+	r.limiter = newClusterLimiter(interval)
+	var wg sync.WaitGroup
+	for _, id := range f.ids {
+		wg.Add(1)
+		go func(id api.ID) {
+			defer wg.Done()
+			r.process(context.Background(), id)
+		}(id)
+	}
+	wg.Wait()
+	if m := r.Metrics(); m.Destroyed != 4 {
+		t.Errorf("destroyed %d stacks, want 4", m.Destroyed)
+	}
+	starts := f.destroyedAt["a"]
+	if len(starts) != 3 {
+		t.Fatalf("saw %d destroys on cluster a, want 3", len(starts))
+	}
+	for i := 1; i < len(starts); i++ {
+		// Allow for timer slop.
+		if gap := starts[i].Sub(starts[i-1]); gap < interval-5*time.Millisecond {
+			t.Errorf("destroys %d and %d on cluster a were %v apart, want at least %v", i-1, i, gap, interval)
+		}
+	}
+}
+
+func TestDeletionStopsWaitingWhenCancelled(t *testing.T) {
+	f := newFakeBackend("a1", "a2")
+	f.expired["a1"], f.expired["a2"] = true, true
+	f.clusters["a1"], f.clusters["a2"] = "a", "a"
+	r := newTestReconciler(f)
+	r.limiter = newClusterLimiter(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.process(ctx, "a1")
+	cancel()
+	r.process(ctx, "a2")
+	if diff := cmp.Diff(Metrics{Checked: 1, Destroyed: 1, Skipped: 1}, r.Metrics()); diff != "" {
+		t.Errorf("metrics (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeletionTimesOut(t *testing.T) {
+	f := newFakeBackend("a1", "a2")
+	f.expired["a1"], f.expired["a2"] = true, true
+	f.clusters["a1"], f.clusters["a2"] = "a", "a"
+	r := newTestReconciler(f)
+	r.Deletion.DestroyTimeout = 20 * time.Millisecond
+	r.limiter = newClusterLimiter(time.Hour)
+	r.process(context.Background(), "a1")
+	r.process(context.Background(), "a2")
+	if diff := cmp.Diff(Metrics{Checked: 1, Destroyed: 1, Failed: 1}, r.Metrics()); diff != "" {
+		t.Errorf("metrics (-want +got):\n%s", diff)
+	}
+	if _, ok := r.Queue.When("a2"); !ok {
+		t.Error("a2 wasn't queued to retry after its destroy timed out")
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	f := newFakeBackend("console-preview-cluster", "labelled", "young", "old", "fresh", "nightly-cluster")
+	f.labels["labelled"] = map[string]string{"protected": "true"}
+	f.createdAt["young"] = time.Now().Add(-10 * time.Minute)
+	c := &DeletionController{
+		Backend:         f,
+		DestroyInterval: time.Millisecond,
+		Protection: Protection{
+			NamePatterns: []string{"console-preview-*"},
+			MinimumAge:   time.Hour,
+			PinnedFile:   writePinnedConfig(t),
+		},
+		Store: store.NewMemory(),
+	}
+	limiter := newClusterLimiter(c.DestroyInterval)
+	for _, id := range f.ids {
+		c.destroy(context.Background(), limiter, id, "expired")
+	}
+	if diff := cmp.Diff([]api.ID{"old", "fresh"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+	want := []Decision{
+		{ID: "console-preview-cluster", Action: "skip", Reason: `name matches protected pattern "console-preview-*"`},
+		{ID: "labelled", Action: "skip", Reason: `has the "protected" label`},
+		{ID: "young", Action: "skip", Reason: "created 10m0s ago, younger than the minimum age of 1h0m0s"},
+		{ID: "old", Action: "destroy", Reason: "expired"},
+		{ID: "fresh", Action: "destroy", Reason: "expired"},
+		{ID: "nightly-cluster", Action: "skip", Reason: "pinned stack, rotated by the pinned stack controller"},
+	}
+	decisions, err := getDecisions(c.Store)
+	if err != nil {
+		t.Fatalf("getDecisions: %v", err)
+	}
+	byID := cmpopts.SortSlices(func(a, b Decision) bool { return a.ID < b.ID })
+	if diff := cmp.Diff(want, decisions, byID, cmpopts.IgnoreFields(Decision{}, "Time")); diff != "" {
+		t.Errorf("decisions (-want +got):\n%s", diff)
+	}
+}
+
+func TestProtectionRereadsPinnedStacks(t *testing.T) {
+	p := Protection{PinnedFile: writePinnedConfig(t)}
+	md := &pulumi_backends.Metadata{}
+	if reason := p.Check("late-cluster", md, time.Now()); reason != "" {
+		t.Fatalf("late-cluster is protected before it's pinned: %s", reason)
+	}
+	// Pinned after the protection was made.
+	late := testPinnedStacks + "  - name: late-cluster\n    spec:\n      backend: gcp_cluster_only\n"
+	if err := os.WriteFile(p.PinnedFile, []byte(late), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if reason := p.Check("late-cluster", md, time.Now()); reason == "" {
+		t.Error("late-cluster isn't protected after it's pinned")
+	}
+	// If the file can't be read, any stack might be pinned.
+	if err := os.WriteFile(p.PinnedFile, []byte("stacks: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if reason := p.Check("old", md, time.Now()); reason == "" {
+		t.Error("old isn't protected while the pinned stacks file is invalid")
+	}
+}
+
+func TestDeletionDeleteAllAndDryRun(t *testing.T) {
+	f := newFakeBackend("a", "b", "c", "d")
+	f.expired["a"] = true
+	f.failExpiry["b"] = true
+	// Even deleting everything leaves stacks without an expiry alone.
+	f.noExpiry["d"] = true
+	r := newTestReconciler(f)
+	r.Deletion.DeleteAll = true
+	r.Deletion.DryRun = true
+	for _, id := range f.ids {
+		r.process(context.Background(), id)
+	}
+	if len(f.destroyed) != 0 || len(f.created) != 0 {
+		t.Errorf("dry run destroyed %v and created %v", f.destroyed, f.created)
+	}
+	if diff := cmp.Diff(Metrics{Checked: 3, WouldDestroy: 2, Failed: 1, NoExpiry: 1}, r.Metrics()); diff != "" {
+		t.Errorf("metrics (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,84 @@
+package controlplane
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+const decisionPrefix = "deletion-decisions/"
+
+// Decision records what the deletion controller did with a stack that was a candidate for
+// deletion, and why. The last decision about each stack is kept in the store for the API until
+// the stack is gone; destroys are in the audit log too, with their reason.
+type Decision struct {
+	ID api.ID
+	// Action is "destroy" or "skip".
+	Action string
+	Reason string
+	DryRun bool
+	Time   time.Time
+}
+
+func decisionKey(i api.ID) string { return decisionPrefix + string(i) }
+
+// putDecision replaces the stored decision about a stack. The newest decision wins a conflict.
+func putDecision(s store.Store, d *Decision) error {
+	for {
+		version, err := s.Get(decisionKey(d.ID), &Decision{})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if _, err := s.Put(decisionKey(d.ID), d, version); !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// GetDecisions returns the last deletion decision about each stack, newest first.
+func GetDecisions() ([]Decision, error) {
+	return getDecisions(store.Default())
+}
+
+func getDecisions(s store.Store) ([]Decision, error) {
+	keys, err := s.List(decisionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var decisions []Decision
+	for _, k := range keys {
+		var d Decision
+		if _, err := s.Get(k, &d); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		decisions = append(decisions, d)
+	}
+	sort.SliceStable(decisions, func(i, j int) bool { return decisions[i].Time.After(decisions[j].Time) })
+	return decisions, nil
+}
+
+// pruneDecisions removes the decisions about stacks that aren't in live.
+func pruneDecisions(s store.Store, live []api.ID) error {
+	keep := make(map[string]bool, len(live))
+	for _, id := range live {
+		keep[decisionKey(id)] = true
+	}
+	keys, err := s.List(decisionPrefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !keep[k] {
+			if err := s.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
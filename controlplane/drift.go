@@ -0,0 +1,113 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+// DriftController periodically refreshes long-lived workspaces and previews reapplying them, to
+// flag the ones that have been changed by hand since helium deployed them. It only reports drift;
+// reapplying is left to the workspace's owner.
+type DriftController struct {
+	Backend Backend
+	// Interval is how long a check stays fresh. Zero turns drift checks off.
+	Interval time.Duration
+	// MinimumAge spares workspaces younger than this, which won't live long enough to matter.
+	MinimumAge time.Duration
+}
+
+// DriftMetrics summarizes a drift controller pass.
+type DriftMetrics struct {
+	Checked int
+	Drifted int
+	Failed  int
+}
+
+// NewDriftController returns a DriftController for the pulumi backend, paced by c.
+func NewDriftController(c *config.Config) *DriftController {
+	return &DriftController{
+		Backend:    pulumiBackend{},
+		Interval:   c.Controlplane.DriftCheckInterval,
+		MinimumAge: c.Controlplane.DriftMinimumAge,
+	}
+}
+
+// RunPass checks every workspace that is old enough and whose last check is older than Interval.
+// Checks are slow, so once ctx is done it stops picking up new workspaces.
+func (c *DriftController) RunPass(ctx context.Context, now time.Time) (*DriftMetrics, error) {
+	m := &DriftMetrics{}
+	if c.Interval <= 0 {
+		return m, nil
+	}
+	ids, err := c.Backend.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range ids.IDs {
+		if err := ctx.Err(); err != nil {
+			return m, err
+		}
+		due, err := c.due(v, now)
+		if err != nil {
+			log.Errorf("drift controller error checking %v: %v", v, err)
+			m.Failed++
+			continue
+		}
+		if !due {
+			continue
+		}
+		d, err := c.Backend.CheckDrift(ctx, v)
+		if errors.Is(err, pulumi_backends.ErrWorkspaceBusy) {
+			// It's checked on the next pass instead.
+			log.Infof("drift controller skipping %v: %v", v, err)
+			continue
+		}
+		if err != nil {
+			log.Errorf("drift controller error checking %v: %v", v, err)
+			m.Failed++
+			continue
+		}
+		m.Checked++
+		if !d.Drifted {
+			continue
+		}
+		m.Drifted++
+		log.WithFields(log.Fields{
+			"canonical":  "true",
+			"controller": "drift",
+			"stack":      v,
+			"resources":  len(d.Resources),
+		}).Warn("drift controller found drifted workspace")
+	}
+	log.WithFields(log.Fields{
+		"canonical":  "true",
+		"controller": "drift",
+		"checked":    m.Checked,
+		"drifted":    m.Drifted,
+		"failed":     m.Failed,
+	}).Info("drift controller pass complete")
+	return m, nil
+}
+
+// due reports whether a stack is old enough to check, and hasn't been checked within Interval.
+func (c *DriftController) due(v api.ID, now time.Time) (bool, error) {
+	md, err := c.Backend.GetMetadata(v)
+	if err != nil {
+		return false, err
+	}
+	if md.CreatedAt.IsZero() || now.Sub(md.CreatedAt) < c.MinimumAge {
+		return false, nil
+	}
+	last, err := c.Backend.GetDrift(v)
+	if err != nil {
+		return false, err
+	}
+	return last == nil || now.Sub(last.CheckedAt) >= c.Interval, nil
+}
@@ -0,0 +1,53 @@
+package controlplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+func TestDriftController(t *testing.T) {
+	now := time.Now()
+	f := newFakeBackend("drifted", "clean", "young", "fresh", "stale", "broken", "rotating")
+	f.drifted["drifted"] = true
+	f.createdAt["young"] = now.Add(-time.Hour)
+	f.drift["fresh"] = &pulumi_backends.Drift{CheckedAt: now.Add(-time.Hour)}
+	f.drift["stale"] = &pulumi_backends.Drift{CheckedAt: now.Add(-25 * time.Hour)}
+	f.failDrift["broken"] = true
+	// Busy workspaces are skipped until the next pass, without counting as failures.
+	f.busy["rotating"] = true
+	c := &DriftController{Backend: f, Interval: 24 * time.Hour, MinimumAge: 24 * time.Hour}
+
+	m, err := c.RunPass(context.Background(), now)
+	if err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	if diff := cmp.Diff(&DriftMetrics{Checked: 3, Drifted: 1, Failed: 1}, m); diff != "" {
+		t.Errorf("metrics (-want +got):\n%s", diff)
+	}
+	want := []api.ID{"drifted", "clean", "stale"}
+	if diff := cmp.Diff(want, f.driftChecks); diff != "" {
+		t.Errorf("checked (-want +got):\n%s", diff)
+	}
+
+	// Everything checked is fresh now, so a second pass only retries the failure.
+	f.driftChecks = nil
+	m, err = c.RunPass(context.Background(), now)
+	if err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	if len(f.driftChecks) != 0 || m.Failed != 1 {
+		t.Errorf("second pass checked %v and failed %d, want only the failure retried", f.driftChecks, m.Failed)
+	}
+
+	// A zero interval turns checks off.
+	c.Interval = 0
+	if m, _ := c.RunPass(context.Background(), now.Add(48*time.Hour)); m.Checked+m.Failed != 0 {
+		t.Errorf("disabled controller checked %d stacks", m.Checked+m.Failed)
+	}
+}
@@ -0,0 +1,177 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/store"
+)
+
+const leaseKey = "leases/controlplane"
+
+// Lease is the record a controlplane replica holds while it's the leader.
+type Lease struct {
+	Holder    string
+	RenewedAt time.Time
+	Duration  time.Duration
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.RenewedAt.Add(l.Duration))
+}
+
+// Elector makes sure only one controlplane replica reconciles at a time. Replicas compete for a
+// lease in the store; the holder renews it every LeaseDuration/3, and the others try to take it
+// over as often. If the leader dies, another replica leads within LeaseDuration plus
+// LeaseDuration/3, assuming the replicas' clocks roughly agree.
+type Elector struct {
+	Store store.Store
+	// Identity names this replica in the lease. It must be unique among replicas.
+	Identity      string
+	LeaseDuration time.Duration
+
+	now func() time.Time
+}
+
+// NewElector returns an elector using the default store and c's lease duration. The identity
+// is c's controlplane ID, defaulting to the hostname and pid.
+func NewElector(c *config.Config) *Elector {
+	id := c.Controlplane.ID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%v-%d", host, os.Getpid())
+	}
+	return &Elector{
+		Store:         store.Default(),
+		Identity:      id,
+		LeaseDuration: c.Controlplane.LeaseDuration,
+	}
+}
+
+func (e *Elector) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// TryAcquire takes the lease if it's free or expired, or renews it if this replica already holds
+// it. It reports whether this replica holds the lease afterwards.
+func (e *Elector) TryAcquire() (bool, error) {
+	var cur Lease
+	version, err := e.Store.Get(leaseKey, &cur)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return false, err
+	}
+	now := e.clock()
+	if err == nil && cur.Holder != e.Identity && !cur.expired(now) {
+		return false, nil
+	}
+	next := Lease{Holder: e.Identity, RenewedAt: now, Duration: e.LeaseDuration}
+	if _, err := e.Store.Put(leaseKey, next, version); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			// Another replica renewed or took the lease since we read it.
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Release gives up the lease if this replica holds it, so that another can lead straight away.
+func (e *Elector) Release() error {
+	var cur Lease
+	version, err := e.Store.Get(leaseKey, &cur)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cur.Holder != e.Identity {
+		return nil
+	}
+	// Expire the lease rather than deleting it, so the release can't race a takeover.
+	cur.Duration = 0
+	if _, err := e.Store.Put(leaseKey, cur, version); err != nil && !errors.Is(err, store.ErrConflict) {
+		return err
+	}
+	return nil
+}
+
+// Run calls lead whenever this replica becomes the leader, until ctx is done. The context passed to
+// lead is cancelled when the lease is lost, and lead must return promptly after that; Run doesn't
+// try to lead again until it has. On return the lease is released.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	interval := e.LeaseDuration / 3
+	l := log.WithFields(log.Fields{"controller": "leader", "identity": e.Identity})
+	defer func() {
+		if err := e.Release(); err != nil {
+			l.WithError(err).Error("leader election error releasing lease")
+		}
+	}()
+	for {
+		ok, err := e.TryAcquire()
+		if err != nil {
+			l.WithError(err).Error("leader election error acquiring lease")
+		}
+		if ok {
+			l.Info("leader election acquired lease")
+			e.leadUntilLost(ctx, interval, lead)
+			l.Info("leader election stopped leading")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// leadUntilLost runs lead while renewing the lease, and cancels it once the lease is lost or ctx is
+// done.
+func (e *Elector) leadUntilLost(ctx context.Context, interval time.Duration, lead func(ctx context.Context)) {
+	leadCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leadCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	l := log.WithFields(log.Fields{"controller": "leader", "identity": e.Identity})
+	renewed := e.clock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		ok, err := e.TryAcquire()
+		switch {
+		case ok:
+			renewed = e.clock()
+		case err == nil:
+			l.Warn("leader election lost lease to another replica")
+			return
+		case !e.clock().Before(renewed.Add(e.LeaseDuration - interval)):
+			// Another replica may take over once the lease expires, so stop a renewal
+			// interval before it does.
+			l.WithError(err).Error("leader election could not renew lease before it expired")
+			return
+		default:
+			l.WithError(err).Warn("leader election error renewing lease")
+		}
+	}
+}
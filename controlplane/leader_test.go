@@ -0,0 +1,175 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/store"
+)
+
+func TestElectorTryAcquire(t *testing.T) {
+	s := store.NewMemory()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	a := &Elector{Store: s, Identity: "a", LeaseDuration: 30 * time.Second, now: clock}
+	b := &Elector{Store: s, Identity: "b", LeaseDuration: 30 * time.Second, now: clock}
+
+	for _, step := range []struct {
+		e       *Elector
+		advance time.Duration
+		want    bool
+	}{
+		{a, 0, true},
+		{b, 0, false},
+		{a, 20 * time.Second, true}, // renews
+		{b, 20 * time.Second, false},
+		{b, 20 * time.Second, true}, // a's lease expired
+		{a, 0, false},
+	} {
+		now = now.Add(step.advance)
+		got, err := step.e.TryAcquire()
+		if err != nil {
+			t.Fatalf("%v TryAcquire: %v", step.e.Identity, err)
+		}
+		if got != step.want {
+			t.Errorf("at %v, %v TryAcquire = %v, want %v", now, step.e.Identity, got, step.want)
+		}
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatalf("Release by non-holder: %v", err)
+	}
+	if ok, _ := a.TryAcquire(); ok {
+		t.Errorf("release by a non-holder freed the lease")
+	}
+	if err := b.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if ok, _ := a.TryAcquire(); !ok {
+		t.Errorf("a couldn't acquire a released lease")
+	}
+}
+
+// TestElectorFailover runs two replicas and checks that they never lead at once, and that the
+// second takes over within the failover bound when the first stops.
+func TestElectorFailover(t *testing.T) {
+	s := store.NewMemory()
+	lease := 60 * time.Millisecond
+	var (
+		mu      sync.Mutex
+		leading = map[string]bool{}
+		overlap bool
+		started = make(chan string, 10)
+	)
+	lead := func(id string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			mu.Lock()
+			for other, ok := range leading {
+				if ok && other != id {
+					overlap = true
+				}
+			}
+			leading[id] = true
+			mu.Unlock()
+			started <- id
+			<-ctx.Done()
+			mu.Lock()
+			leading[id] = false
+			mu.Unlock()
+		}
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		(&Elector{Store: s, Identity: "a", LeaseDuration: lease}).Run(ctxA, lead("a"))
+	}()
+	if got := <-started; got != "a" {
+		t.Fatalf("%v led first, want a", got)
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go (&Elector{Store: s, Identity: "b", LeaseDuration: lease}).Run(ctxB, lead("b"))
+	// b can't lead while a renews.
+	select {
+	case id := <-started:
+		t.Fatalf("%v started leading while a held the lease", id)
+	case <-time.After(3 * lease):
+	}
+
+	// Stopping a releases the lease.
+	stopped := time.Now()
+	cancelA()
+	<-doneA
+	select {
+	case id := <-started:
+		if id != "b" {
+			t.Fatalf("%v took over, want b", id)
+		}
+	case <-time.After(lease + lease/3 + 50*time.Millisecond):
+		t.Fatalf("b didn't take over within the failover bound")
+	}
+	if d := time.Since(stopped); d > lease+lease/3+50*time.Millisecond {
+		t.Errorf("failover took %v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if overlap {
+		t.Errorf("two replicas led at once")
+	}
+}
+
+// partitionedStore is a Store whose writes fail once partitioned is set, like a replica cut off
+// from the store.
+type partitionedStore struct {
+	store.Store
+	mu          sync.Mutex
+	partitioned bool
+}
+
+func (p *partitionedStore) Put(key string, v any, version int64) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partitioned {
+		return 0, errors.New("partitioned")
+	}
+	return p.Store.Put(key, v, version)
+}
+
+func TestElectorStepsDownBeforeLeaseExpires(t *testing.T) {
+	s := &partitionedStore{Store: store.NewMemory()}
+	lease := 90 * time.Millisecond
+	e := &Elector{Store: s, Identity: "a", LeaseDuration: lease}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	stopped := make(chan time.Time, 1)
+	go e.Run(ctx, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		stopped <- time.Now()
+	})
+	<-started
+	time.Sleep(lease / 2)
+	s.mu.Lock()
+	s.partitioned = true
+	s.mu.Unlock()
+
+	var l Lease
+	if _, err := s.Get(leaseKey, &l); err != nil {
+		t.Fatalf("Get lease: %v", err)
+	}
+	select {
+	case at := <-stopped:
+		if expiry := l.RenewedAt.Add(l.Duration); at.After(expiry) {
+			t.Errorf("stopped leading %v after the lease expired", at.Sub(expiry))
+		}
+	case <-time.After(2 * lease):
+		t.Fatalf("still leading after the lease expired")
+	}
+}
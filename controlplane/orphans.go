@@ -0,0 +1,194 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/inventory"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+const orphanReportKey = "orphans/report"
+
+// Orphan is a resource labelled with a workspace that has no stack.
+type Orphan struct {
+	inventory.Resource
+	Inventory string
+	// Collected is set if the orphan was deleted.
+	Collected bool
+	// Protected is why the orphan wasn't deleted, if its workspace is protected.
+	Protected string `json:",omitempty"`
+	// Error is why deleting the orphan failed.
+	Error string `json:",omitempty"`
+}
+
+// OrphanReport is the result of the last orphan controller pass, kept in the store for the API.
+type OrphanReport struct {
+	GeneratedAt time.Time
+	Collect     bool
+	Orphans     []Orphan
+	// Errors maps the inventories that couldn't be listed to why. Their orphans are missing from
+	// the report.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// OrphanController finds cloud resources left behind by workspaces whose stacks are gone, such as
+// namespaces that PULUMI_K8S_DELETE_UNREACHABLE abandoned, or everything a RemoveStack dropped. With
+// Collect set, it deletes them too.
+type OrphanController struct {
+	Backend     Backend
+	Inventories []inventory.Inventory
+	Store       store.Store
+	// Collect deletes orphans, unless DryRun is set.
+	Collect bool
+	DryRun  bool
+	// GracePeriod spares resources created more recently than this, whose stack may not be
+	// listed yet.
+	GracePeriod time.Duration
+	// Protection spares orphans of pinned and protected-pattern workspaces from collection.
+	Protection Protection
+}
+
+// NewOrphanController returns an OrphanController for the pulumi backend and the inventories in
+// c's orphans section, in c's GCP project, with c's grace period. orphans.collect turns on
+// collection.
+func NewOrphanController(c *config.Config) *OrphanController {
+	return &OrphanController{
+		Backend:     pulumiBackend{},
+		Inventories: inventory.FromConfig(c),
+		Store:       store.Default(),
+		Collect:     c.Orphans.Collect,
+		DryRun:      c.Controlplane.DryRun,
+		GracePeriod: c.Controlplane.OrphanGracePeriod,
+		Protection:  NewProtection(c),
+	}
+}
+
+func RunOrphanController(ctx context.Context, c *config.Config) error {
+	oc := NewOrphanController(c)
+	if len(oc.Inventories) == 0 {
+		return nil
+	}
+	_, err := oc.RunPass(ctx, time.Now())
+	return err
+}
+
+// GetOrphanReport returns the last orphan report, or nil if there hasn't been a pass.
+func GetOrphanReport() (*OrphanReport, error) {
+	var r OrphanReport
+	if _, err := store.Default().Get(orphanReportKey, &r); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RunPass lists every inventory, compares the resources against the live stacks, collects the
+// orphans if configured to, and stores the report.
+func (c *OrphanController) RunPass(ctx context.Context, now time.Time) (*OrphanReport, error) {
+	report := &OrphanReport{GeneratedAt: now, Collect: c.Collect && !c.DryRun}
+	type listed struct {
+		inv       inventory.Inventory
+		resources []inventory.Resource
+	}
+	// List resources before stacks, so a workspace created in between can't look orphaned.
+	var all []listed
+	for _, inv := range c.Inventories {
+		rs, err := inv.List(ctx)
+		if err != nil {
+			log.Errorf("orphan controller error listing %v: %v", inv.Name(), err)
+			if report.Errors == nil {
+				report.Errors = make(map[string]string)
+			}
+			report.Errors[inv.Name()] = err.Error()
+			continue
+		}
+		all = append(all, listed{inv, rs})
+	}
+	ids, err := c.Backend.List()
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[api.ID]bool, len(ids.IDs))
+	for _, id := range ids.IDs {
+		live[id] = true
+	}
+
+	var collected, failed int
+	for _, l := range all {
+		for _, r := range l.resources {
+			if r.Workspace == "" || live[r.Workspace] {
+				continue
+			}
+			if !r.CreatedAt.IsZero() && now.Sub(r.CreatedAt) < c.GracePeriod {
+				continue
+			}
+			o := Orphan{Resource: r, Inventory: l.inv.Name()}
+			o.Protected = c.Protection.Check(r.Workspace, &pulumi_backends.Metadata{}, now)
+			if report.Collect && o.Protected == "" {
+				event := api.AuditEvent{
+					Actor:     audit.Controller("orphan"),
+					Action:    "delete",
+					Workspace: r.Workspace,
+					Params:    map[string]string{"resource": r.String(), "inventory": l.inv.Name()},
+					StartedAt: time.Now(),
+				}
+				err := l.inv.Delete(ctx, r)
+				audit.Done(event, err)
+				if err != nil {
+					o.Error = err.Error()
+					failed++
+				} else {
+					o.Collected = true
+					collected++
+				}
+			}
+			log.WithFields(log.Fields{
+				"canonical":  "true",
+				"controller": "orphan",
+				"resource":   r.String(),
+				"workspace":  r.Workspace,
+				"collected":  o.Collected,
+				"protected":  o.Protected,
+				"error":      o.Error,
+			}).Warn("orphan controller found orphaned resource")
+			report.Orphans = append(report.Orphans, o)
+		}
+	}
+
+	if err := putOrphanReport(c.Store, report); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"canonical":  "true",
+		"controller": "orphan",
+		"orphans":    len(report.Orphans),
+		"collected":  collected,
+		"failed":     failed,
+		"errors":     len(report.Errors),
+	}).Info("orphan controller pass complete")
+	return report, nil
+}
+
+// putOrphanReport replaces the stored report. Only the leader writes it, so a conflict means a
+// previous leader is finishing a pass, and the newer report wins either way.
+func putOrphanReport(s store.Store, r *OrphanReport) error {
+	for {
+		version, err := s.Get(orphanReportKey, &OrphanReport{})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if _, err := s.Put(orphanReportKey, r, version); !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/inventory"
+	"github.com/pachyderm/helium/store"
+)
+
+type fakeInventory struct {
+	name      string
+	resources []inventory.Resource
+	listErr   error
+	failing   map[string]bool
+	deleted   []string
+}
+
+func (f *fakeInventory) Name() string { return f.name }
+
+func (f *fakeInventory) List(ctx context.Context) ([]inventory.Resource, error) {
+	return f.resources, f.listErr
+}
+
+func (f *fakeInventory) Delete(ctx context.Context, r inventory.Resource) error {
+	if f.failing[r.Name] {
+		return errors.New("boom")
+	}
+	f.deleted = append(f.deleted, r.Name)
+	return nil
+}
+
+func TestOrphanController(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	namespaces := &fakeInventory{
+		name: "namespaces/test",
+		resources: []inventory.Resource{
+			{Kind: "namespace", Name: "live", Workspace: "live"},
+			{Kind: "namespace", Name: "gone", Workspace: "gone", CreatedAt: now.Add(-48 * time.Hour)},
+			{Kind: "namespace", Name: "new", Workspace: "new", CreatedAt: now.Add(-time.Minute)},
+			{Kind: "namespace", Name: "unlabelled"},
+			{Kind: "namespace", Name: "console-preview-old", Workspace: "console-preview-old"},
+			{Kind: "namespace", Name: "stuck", Workspace: "stuck"},
+		},
+		failing: map[string]bool{"stuck": true},
+	}
+	buckets := &fakeInventory{name: "buckets/test", listErr: errors.New("no credentials")}
+	s := store.NewMemory()
+	prev := store.Default()
+	store.SetDefault(s)
+	defer store.SetDefault(prev)
+	c := &OrphanController{
+		Backend:     newFakeBackend("live"),
+		Inventories: []inventory.Inventory{namespaces, buckets},
+		Store:       s,
+		Collect:     true,
+		GracePeriod: time.Hour,
+		Protection:  Protection{NamePatterns: []string{"console-preview-*"}},
+	}
+
+	report, err := c.RunPass(context.Background(), now)
+	if err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	want := []Orphan{
+		{Resource: namespaces.resources[1], Inventory: "namespaces/test", Collected: true},
+		{Resource: namespaces.resources[4], Inventory: "namespaces/test", Protected: `name matches protected pattern "console-preview-*"`},
+		{Resource: namespaces.resources[5], Inventory: "namespaces/test", Error: "boom"},
+	}
+	if diff := cmp.Diff(want, report.Orphans); diff != "" {
+		t.Errorf("orphans (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"gone"}, namespaces.deleted); diff != "" {
+		t.Errorf("deleted (-want +got):\n%s", diff)
+	}
+	for workspace, result := range map[api.ID]string{"gone": audit.Succeeded, "stuck": audit.Failed} {
+		events, err := audit.Query(audit.Filter{Actor: audit.Controller("orphan"), Action: "delete", Workspace: workspace})
+		if err != nil {
+			t.Fatalf("audit.Query: %v", err)
+		}
+		if len(events) != 1 || events[0].Result != result || events[0].Params["resource"] == "" {
+			t.Errorf("audit events for deleting %v: %+v, want one that %s", workspace, events, result)
+		}
+	}
+	if report.Errors["buckets/test"] != "no credentials" {
+		t.Errorf("errors are %v, want the bucket listing error", report.Errors)
+	}
+
+	var stored OrphanReport
+	if _, err := s.Get(orphanReportKey, &stored); err != nil {
+		t.Fatalf("Get report: %v", err)
+	}
+	if diff := cmp.Diff(report, &stored, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("stored report (-want +got):\n%s", diff)
+	}
+
+	// Without collection, orphans are only reported, and a second report replaces the first.
+	namespaces.deleted = nil
+	c.Collect = false
+	report, err = c.RunPass(context.Background(), now)
+	if err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	if len(namespaces.deleted) != 0 || len(report.Orphans) != 3 || report.Collect {
+		t.Errorf("report-only pass deleted %v and reported %d orphans", namespaces.deleted, len(report.Orphans))
+	}
+}
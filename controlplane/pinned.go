@@ -0,0 +1,283 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/policy"
+)
+
+// PinnedStack is a long-lived stack that the controlplane keeps present, and optionally recreates
+// on a schedule.
+type PinnedStack struct {
+	Name string   `yaml:"name"`
+	Spec api.Spec `yaml:"spec"`
+	// Schedule is a standard five field cron expression, in UTC. The stack is destroyed and
+	// recreated at the first scheduled time after it was created. Empty means never.
+	Schedule string `yaml:"schedule"`
+	// RecreateDelay is how long to wait between destroying the stack and creating it again.
+	RecreateDelay time.Duration `yaml:"recreateDelay"`
+	// DependsOn names pinned stacks that must exist before this one is created. Rotating a
+	// stack rotates everything that depends on it.
+	DependsOn []string `yaml:"dependsOn"`
+
+	schedule cron.Schedule
+}
+
+// PinnedConfig is the contents of the pinned stacks file.
+type PinnedConfig struct {
+	Stacks []PinnedStack `yaml:"stacks"`
+}
+
+// LoadPinnedConfig reads and validates a pinned stacks file. A missing file means there are no
+// pinned stacks. The returned stacks are ordered so that every stack comes after its dependencies.
+func LoadPinnedConfig(path string) (*PinnedConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &PinnedConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePinnedConfig(data)
+}
+
+func parsePinnedConfig(data []byte) (*PinnedConfig, error) {
+	var c PinnedConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse pinned stacks: %w", err)
+	}
+	byName := make(map[string]*PinnedStack, len(c.Stacks))
+	for i := range c.Stacks {
+		p := &c.Stacks[i]
+		if p.Name == "" {
+			return nil, fmt.Errorf("pinned stack %d has no name", i)
+		}
+		if _, ok := byName[p.Name]; ok {
+			return nil, fmt.Errorf("pinned stack %q is listed twice", p.Name)
+		}
+		if p.Spec.Name != "" && p.Spec.Name != p.Name {
+			return nil, fmt.Errorf("pinned stack %q has a spec named %q", p.Name, p.Spec.Name)
+		}
+		p.Spec.Name = p.Name
+		if p.Schedule != "" {
+			s, err := cron.ParseStandard(p.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("pinned stack %q has an invalid schedule: %w", p.Name, err)
+			}
+			p.schedule = s
+		}
+		byName[p.Name] = p
+	}
+	for _, p := range c.Stacks {
+		for _, d := range p.DependsOn {
+			if _, ok := byName[d]; !ok {
+				return nil, fmt.Errorf("pinned stack %q depends on %q, which isn't pinned", p.Name, d)
+			}
+		}
+	}
+
+	// Order the stacks so that dependencies come first.
+	var (
+		ordered []PinnedStack
+		state   = make(map[string]int) // 1: visiting, 2: done
+		visit   func(name string, path []string) error
+	)
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("pinned stacks have a dependency cycle: %v", append(path, name))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, d := range byName[name].DependsOn {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		ordered = append(ordered, *byName[name])
+		return nil
+	}
+	for _, p := range c.Stacks {
+		if err := visit(p.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	c.Stacks = ordered
+	return &c, nil
+}
+
+// Names returns the names of all pinned stacks.
+func (c *PinnedConfig) Names() []string {
+	var names []string
+	for _, p := range c.Stacks {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// dependents returns name and every pinned stack that transitively depends on it, in dependency
+// order.
+func (c *PinnedConfig) dependents(name string) []PinnedStack {
+	affected := map[string]bool{name: true}
+	var out []PinnedStack
+	// c.Stacks is in dependency order, so a single pass sees every dependency before its
+	// dependents.
+	for _, p := range c.Stacks {
+		if !affected[p.Name] {
+			for _, d := range p.DependsOn {
+				if affected[d] {
+					affected[p.Name] = true
+					break
+				}
+			}
+		}
+		if affected[p.Name] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// PinnedController keeps the stacks in the pinned stacks file present, and rotates them on their
+// schedules.
+type PinnedController struct {
+	Backend Backend
+	Path    string
+}
+
+func NewPinnedController(c *config.Config) *PinnedController {
+	return &PinnedController{
+		Backend: pulumiBackend{},
+		Path:    c.Files.PinnedStacks,
+	}
+}
+
+func RunPinnedController(ctx context.Context, c *config.Config) error {
+	return NewPinnedController(c).RunPass(ctx, time.Now())
+}
+
+// RunPass reconciles every pinned stack once, stopping early if ctx is done. The file is read on
+// every pass, so edits take effect without a restart.
+func (c *PinnedController) RunPass(ctx context.Context, now time.Time) error {
+	config, err := LoadPinnedConfig(c.Path)
+	if err != nil {
+		return err
+	}
+	if len(config.Stacks) == 0 {
+		return nil
+	}
+	ids, err := c.Backend.List()
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, id := range ids.IDs {
+		present[string(id)] = true
+	}
+
+	// Rotate first, so that a stack that is both due and missing dependents is only
+	// created once.
+	for _, p := range config.Stacks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p.schedule == nil || !present[p.Name] {
+			continue
+		}
+		md, err := c.Backend.GetMetadata(api.ID(p.Name))
+		if err != nil {
+			log.Errorf("pinned stack controller error reading metadata for %v: %v", p.Name, err)
+			continue
+		}
+		if md.CreatedAt.IsZero() || p.schedule.Next(md.CreatedAt).After(now) {
+			continue
+		}
+		l := log.WithFields(log.Fields{"controller": "pinned", "stack": p.Name, "created": md.CreatedAt})
+		l.Info("pinned stack controller rotating stack")
+		// Tear down dependents before the stack they depend on. Workspaces deployed into a
+		// rotated cluster that aren't pinned go with it.
+		affected := config.dependents(p.Name)
+		for i := len(affected) - 1; i >= 0; i-- {
+			d := affected[i]
+			if !present[d.Name] {
+				continue
+			}
+			l.Infof("pinned stack controller destroying %v", d.Name)
+			event := api.AuditEvent{
+				Actor:     audit.Controller("pinned"),
+				Action:    "delete",
+				Workspace: api.ID(d.Name),
+				Params:    map[string]string{"reason": "rotating " + p.Name, "cascade": "true"},
+				StartedAt: time.Now(),
+			}
+			err := c.Backend.DestroyCascade(ctx, api.ID(d.Name))
+			audit.Done(event, err)
+			if err != nil {
+				l.WithError(err).Errorf("pinned stack controller error destroying %v", d.Name)
+				break
+			}
+			present[d.Name] = false
+			if d.RecreateDelay > 0 {
+				select {
+				case <-time.After(d.RecreateDelay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	for _, p := range config.Stacks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if present[p.Name] {
+			continue
+		}
+		var missing []string
+		for _, d := range p.DependsOn {
+			if !present[d] {
+				missing = append(missing, d)
+			}
+		}
+		l := log.WithFields(log.Fields{"controller": "pinned", "stack": p.Name})
+		if len(missing) > 0 {
+			l.Warnf("pinned stack controller waiting for dependencies %v", missing)
+			continue
+		}
+		spec := p.Spec
+		if err := policy.Evaluate(&spec); err != nil {
+			// Pinned stacks are held to the same rules as the workspaces users create.
+			l.WithError(err).Error("pinned stack controller not creating stack")
+			continue
+		}
+		l.Info("pinned stack controller creating stack")
+		event := api.AuditEvent{
+			Actor:     audit.Controller("pinned"),
+			Action:    "create",
+			Workspace: api.ID(p.Name),
+			Params:    map[string]string{"backend": spec.Backend},
+			StartedAt: time.Now(),
+		}
+		_, err := c.Backend.Create(ctx, &spec)
+		audit.Done(event, err)
+		if err != nil {
+			l.WithError(err).Error("pinned stack controller error creating stack")
+			continue
+		}
+		present[p.Name] = true
+	}
+	return nil
+}
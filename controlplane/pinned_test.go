@@ -0,0 +1,171 @@
+package controlplane
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/policy"
+)
+
+const testPinnedStacks = `
+stacks:
+  - name: loadtest-namespace
+    dependsOn: [loadtest-cluster]
+    spec:
+      backend: gcp_namespace_only
+      clusterStack: loadtest-cluster
+      pachdVersion: 2.5.0
+  - name: loadtest-cluster
+    schedule: "0 4 * * *"
+    spec:
+      backend: gcp_cluster_only
+  - name: nightly-cluster
+    schedule: "0 4 * * *"
+    recreateDelay: 1ms
+    spec:
+      backend: gcp_cluster_only
+`
+
+func TestParsePinnedConfig(t *testing.T) {
+	c, err := parsePinnedConfig([]byte(testPinnedStacks))
+	if err != nil {
+		t.Fatalf("parsePinnedConfig: %v", err)
+	}
+	if diff := cmp.Diff([]string{"loadtest-cluster", "loadtest-namespace", "nightly-cluster"}, c.Names()); diff != "" {
+		t.Errorf("order (-want +got):\n%s", diff)
+	}
+	ns := c.Stacks[1]
+	want := api.Spec{Name: "loadtest-namespace", Backend: "gcp_namespace_only", ClusterStack: "loadtest-cluster", PachdVersion: "2.5.0"}
+	if diff := cmp.Diff(want, ns.Spec); diff != "" {
+		t.Errorf("spec (-want +got):\n%s", diff)
+	}
+	if got := c.Stacks[2].RecreateDelay; got != time.Millisecond {
+		t.Errorf("recreate delay %v, want 1ms", got)
+	}
+}
+
+func TestParsePinnedConfigErrors(t *testing.T) {
+	testData := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "cycle",
+			config:  "stacks:\n- {name: a, dependsOn: [b]}\n- {name: b, dependsOn: [a]}\n",
+			wantErr: "dependency cycle",
+		},
+		{
+			name:    "unknown dependency",
+			config:  "stacks:\n- {name: a, dependsOn: [b]}\n",
+			wantErr: `depends on "b", which isn't pinned`,
+		},
+		{
+			name:    "bad schedule",
+			config:  "stacks:\n- {name: a, schedule: every day}\n",
+			wantErr: "invalid schedule",
+		},
+		{
+			name:    "duplicate",
+			config:  "stacks:\n- {name: a}\n- {name: a}\n",
+			wantErr: "listed twice",
+		},
+		{
+			name:    "mismatched spec name",
+			config:  "stacks:\n- {name: a, spec: {name: b}}\n",
+			wantErr: `has a spec named "b"`,
+		},
+	}
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePinnedConfig([]byte(test.config))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func writePinnedConfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pinned-stacks.yaml")
+	if err := os.WriteFile(path, []byte(testPinnedStacks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPinnedControllerCreatesMissingStacks(t *testing.T) {
+	f := newFakeBackend("nightly-cluster")
+	f.createdAt["nightly-cluster"] = time.Now()
+	f.failCreate["loadtest-cluster"] = true
+	c := &PinnedController{Backend: f, Path: writePinnedConfig(t)}
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	// loadtest-namespace waits for its cluster, which failed to create.
+	if len(f.created) != 0 {
+		t.Errorf("created %v, want nothing", f.created)
+	}
+
+	f.failCreate["loadtest-cluster"] = false
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	if diff := cmp.Diff([]string{"loadtest-cluster", "loadtest-namespace"}, f.created); diff != "" {
+		t.Errorf("created (-want +got):\n%s", diff)
+	}
+	if got := f.specs[1].ClusterStack; got != "loadtest-cluster" {
+		t.Errorf("namespace created in cluster %q", got)
+	}
+}
+
+func TestPinnedControllerRotatesOnSchedule(t *testing.T) {
+	f := newFakeBackend("loadtest-cluster", "loadtest-namespace", "nightly-cluster")
+	now := time.Date(2022, 12, 2, 12, 0, 0, 0, time.UTC)
+	// Created after today's 4am rotation: not due.
+	f.createdAt["nightly-cluster"] = time.Date(2022, 12, 2, 5, 0, 0, 0, time.UTC)
+	// Created before today's 4am rotation: due.
+	f.createdAt["loadtest-cluster"] = time.Date(2022, 12, 1, 5, 0, 0, 0, time.UTC)
+	c := &PinnedController{Backend: f, Path: writePinnedConfig(t)}
+	if err := c.RunPass(context.Background(), now); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"loadtest-namespace", "loadtest-cluster"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"loadtest-cluster", "loadtest-namespace"}, f.created); diff != "" {
+		t.Errorf("created (-want +got):\n%s", diff)
+	}
+}
+
+// usePolicy points the policy rules at a file with the given contents for the rest of the test.
+func usePolicy(t *testing.T, rules string) {
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prev := policy.File()
+	policy.SetFile(path)
+	t.Cleanup(func() { policy.SetFile(prev) })
+}
+
+func TestPinnedControllerChecksPolicy(t *testing.T) {
+	usePolicy(t, `rules: [{rule: pachd-versions, versions: ["2.6.*"]}]`)
+	f := newFakeBackend()
+	c := &PinnedController{Backend: f, Path: writePinnedConfig(t)}
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	// loadtest-namespace's pachd 2.5.0 isn't allowed.
+	if diff := cmp.Diff([]string{"loadtest-cluster", "nightly-cluster"}, f.created); diff != "" {
+		t.Errorf("created (-want +got):\n%s", diff)
+	}
+}
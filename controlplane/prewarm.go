@@ -0,0 +1,151 @@
+package controlplane
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/policy"
+	"github.com/pachyderm/helium/pool"
+)
+
+// PrewarmController keeps each pool in the pools file topped up with ready, unclaimed workspaces.
+// Creates run in the background, so one controller must be kept across passes to know which are
+// still in flight.
+type PrewarmController struct {
+	Backend Backend
+	Path    string
+
+	mu       sync.Mutex
+	creating map[string]bool
+	wg       sync.WaitGroup
+}
+
+func NewPrewarmController(c *config.Config) *PrewarmController {
+	return &PrewarmController{
+		Backend: pulumiBackend{},
+		Path:    c.Files.PrewarmPools,
+	}
+}
+
+// RunPass starts enough creates to bring every pool up to its size, counting unclaimed pool stacks
+// and creates still in flight. It doesn't wait for the creates to finish, which run until they do
+// or ctx is done; Wait waits for them.
+func (c *PrewarmController) RunPass(ctx context.Context, now time.Time) error {
+	config, err := pool.LoadConfig(c.Path)
+	if err != nil {
+		return err
+	}
+	if len(config.Pools) == 0 {
+		return nil
+	}
+	ids, err := c.Backend.List()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creating == nil {
+		c.creating = make(map[string]bool)
+	}
+	for _, p := range config.Pools {
+		unclaimed := make(map[string]bool)
+		for name := range c.creating {
+			if strings.HasPrefix(name, p.StackPrefix()) {
+				unclaimed[name] = true
+			}
+		}
+		for _, id := range ids.IDs {
+			if !strings.HasPrefix(string(id), p.StackPrefix()) || unclaimed[string(id)] {
+				continue
+			}
+			claim, err := c.Backend.GetClaim(id)
+			if err != nil {
+				log.Errorf("prewarm controller error reading claim for %v: %v", id, err)
+				// Count it, so that a store outage doesn't overfill the pool.
+				unclaimed[string(id)] = true
+				continue
+			}
+			if claim == nil {
+				unclaimed[string(id)] = true
+			}
+		}
+
+		short := p.Size - len(unclaimed)
+		if short < 0 {
+			short = 0
+		}
+		spec := p.NewSpec(now)
+		if err := policy.Evaluate(&spec); err != nil {
+			// Pool workspaces are held to the same rules as the workspaces users create.
+			log.WithField("pool", p.Name).Errorf("prewarm controller not filling pool: %v", err)
+			continue
+		}
+		l := log.WithFields(log.Fields{
+			"canonical":  "true",
+			"controller": "prewarm",
+			"pool":       p.Name,
+			"size":       p.Size,
+			"unclaimed":  len(unclaimed),
+			"creating":   short,
+		})
+		l.Info("prewarm controller pass")
+		for i := 0; i < short; i++ {
+			spec := p.NewSpec(now)
+			c.creating[spec.Name] = true
+			c.wg.Add(1)
+			go c.create(ctx, spec)
+		}
+	}
+	return nil
+}
+
+func (c *PrewarmController) create(ctx context.Context, spec api.Spec) {
+	defer c.wg.Done()
+	defer func() {
+		c.mu.Lock()
+		delete(c.creating, spec.Name)
+		c.mu.Unlock()
+	}()
+	l := log.WithFields(log.Fields{"controller": "prewarm", "stack": spec.Name})
+	l.Info("prewarm controller creating stack")
+	event := api.AuditEvent{
+		Actor:     audit.Controller("prewarm"),
+		Action:    "create",
+		Workspace: api.ID(spec.Name),
+		Params:    map[string]string{"backend": spec.Backend},
+		StartedAt: time.Now(),
+	}
+	_, err := c.Backend.Create(ctx, &spec)
+	audit.Done(event, err)
+	if err != nil && ctx.Err() != nil {
+		// This replica stopped leading, and the next leader's recovery controller will clean
+		// up after the interrupted create.
+		l.WithError(err).Warn("prewarm controller create interrupted")
+		return
+	}
+	if err != nil {
+		// A failed stack would count against the pool until it expired, so don't keep it.
+		l.WithError(err).Error("prewarm controller error creating stack")
+		event.Action, event.Params["reason"], event.StartedAt = "delete", "creating it failed", time.Now()
+		err := c.Backend.Destroy(ctx, api.ID(spec.Name))
+		audit.Done(event, err)
+		if err != nil {
+			l.WithError(err).Error("prewarm controller error destroying failed stack")
+		}
+		return
+	}
+	l.Info("prewarm controller created stack")
+}
+
+// Wait blocks until every create started by the controller has finished.
+func (c *PrewarmController) Wait() {
+	c.wg.Wait()
+}
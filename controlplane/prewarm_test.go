@@ -0,0 +1,130 @@
+package controlplane
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pool"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+const testPrewarmPools = `
+pools:
+  - name: default
+  - name: pinned
+    size: 1
+    spec:
+      helmVersion: 2.5.0
+`
+
+func TestPrewarmControllerRefillsPools(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prewarm-pools.yaml")
+	if err := os.WriteFile(path, []byte(testPrewarmPools), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeBackend("other", "pool-default-aaaaaa", "pool-default-bbbbbb")
+	f.claims["pool-default-aaaaaa"] = &pulumi_backends.Claim{Stack: "pool-default-aaaaaa", CreatedBy: "a@example.com"}
+	f.createDelay = 50 * time.Millisecond
+	c := &PrewarmController{Backend: f, Path: path}
+
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	// Creates still in flight count towards the pools.
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	c.Wait()
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	c.Wait()
+
+	if len(f.specs) != 2 {
+		t.Fatalf("created %v, want one stack per pool", f.created)
+	}
+	sort.Slice(f.specs, func(i, j int) bool { return f.specs[i].Name < f.specs[j].Name })
+	for i, want := range []struct{ prefix, labels, helm string }{
+		{"pool-default-", "helium-pool=default", ""},
+		{"pool-pinned-", "helium-pool=pinned", "2.5.0"},
+	} {
+		s := f.specs[i]
+		if !strings.HasPrefix(s.Name, want.prefix) || s.Labels != want.labels || s.HelmVersion != want.helm || s.Backend != "gcp_namespace_only" {
+			t.Errorf("created %+v, want a stack for %s", s, want.prefix)
+		}
+	}
+}
+
+func TestPrewarmControllerChecksPolicy(t *testing.T) {
+	usePolicy(t, `rules: [{rule: pachd-versions, versions: ["2.6.*"]}]`)
+	path := filepath.Join(t.TempDir(), "prewarm-pools.yaml")
+	pools := "pools:\n  - name: default\n  - name: old\n    spec:\n      pachdVersion: 2.5.0\n"
+	if err := os.WriteFile(path, []byte(pools), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeBackend()
+	c := &PrewarmController{Backend: f, Path: path}
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	c.Wait()
+	for _, s := range f.specs {
+		if !strings.HasPrefix(s.Name, "pool-default-") {
+			t.Errorf("created %v, want only the default pool's stacks", f.created)
+		}
+	}
+	if len(f.specs) != pool.DefaultSize {
+		t.Errorf("created %v, want %d stacks", f.created, pool.DefaultSize)
+	}
+}
+
+func TestPrewarmControllerDestroysFailedCreates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prewarm-pools.yaml")
+	if err := os.WriteFile(path, []byte("pools: [{name: default, size: 1}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := &failingCreateBackend{newFakeBackend()}
+	c := &PrewarmController{Backend: f, Path: path}
+	if err := c.RunPass(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	c.Wait()
+	if len(f.destroyed) != 1 || !strings.HasPrefix(string(f.destroyed[0]), "pool-default-") {
+		t.Errorf("destroyed %v, want the failed pool stack", f.destroyed)
+	}
+}
+
+func TestPrewarmControllerStopsWhenNoLongerLeading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prewarm-pools.yaml")
+	if err := os.WriteFile(path, []byte("pools: [{name: default, size: 1}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeBackend()
+	f.createDelay = time.Hour
+	c := &PrewarmController{Backend: f, Path: path}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.RunPass(ctx, time.Now()); err != nil {
+		t.Fatalf("RunPass: %v", err)
+	}
+	cancel()
+	c.Wait()
+	// The interrupted create is left for the next leader, not destroyed by this replica.
+	if len(f.created) != 0 || len(f.destroyed) != 0 {
+		t.Errorf("created %v and destroyed %v after losing leadership, want neither", f.created, f.destroyed)
+	}
+}
+
+type failingCreateBackend struct {
+	*fakeBackend
+}
+
+func (f *failingCreateBackend) Create(ctx context.Context, s *api.Spec) (*api.CreateResponse, error) {
+	f.failCreate[s.Name] = true
+	return f.fakeBackend.Create(ctx, s)
+}
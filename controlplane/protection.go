@@ -0,0 +1,78 @@
+package controlplane
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+// ProtectedLabel marks a workspace that the deletion controller must never destroy.
+const ProtectedLabel = "protected"
+
+// Protected reports whether labels protect a workspace: they have ProtectedLabel, with any value
+// but "false".
+func Protected(labels map[string]string) bool {
+	v, ok := labels[ProtectedLabel]
+	return ok && v != "false"
+}
+
+// Protection is the set of rules the deletion controller refuses to violate, whatever a stack's
+// expiry says and even when HELIUM_CONTROLPLANE_DELETE_ALL is set.
+type Protection struct {
+	// NamePatterns are path.Match globs, such as "console-preview-*". Matching stacks are
+	// never destroyed.
+	NamePatterns []string
+	// MinimumAge spares stacks created more recently than this. Stacks that are still being
+	// created have no expiry yet, and the reconciler never offers them for deletion.
+	MinimumAge time.Duration
+	// PinnedFile is the pinned stacks file. The stacks in it are owned by the pinned stack
+	// controller, which rotates them on their own schedule. It's read on every check, as the
+	// controller reads it on every pass, so a stack pinned since startup is protected too.
+	PinnedFile string
+}
+
+// NewProtection takes protection rules from c's protected patterns and minimum age, and protects
+// every stack in c's pinned stacks file.
+func NewProtection(c *config.Config) Protection {
+	return Protection{
+		NamePatterns: c.Controlplane.ProtectedPatterns,
+		MinimumAge:   c.Controlplane.MinimumAge,
+		PinnedFile:   c.Files.PinnedStacks,
+	}
+}
+
+// Check returns why a stack is protected, or "" if it may be destroyed.
+func (p Protection) Check(i api.ID, md *pulumi_backends.Metadata, now time.Time) string {
+	if p.PinnedFile != "" {
+		pinned, err := LoadPinnedConfig(p.PinnedFile)
+		if err != nil {
+			// Any stack might be pinned.
+			return fmt.Sprintf("pinned stacks can't be read: %v", err)
+		}
+		for _, name := range pinned.Names() {
+			if name == string(i) {
+				return "pinned stack, rotated by the pinned stack controller"
+			}
+		}
+	}
+	for _, pattern := range p.NamePatterns {
+		if ok, _ := path.Match(pattern, string(i)); ok {
+			return fmt.Sprintf("name matches protected pattern %q", pattern)
+		}
+	}
+	if Protected(md.Labels) {
+		return fmt.Sprintf("has the %q label", ProtectedLabel)
+	}
+	// A stack with no recorded creation time has never had an update, so it has no resources
+	// that could be lost by destroying it.
+	if p.MinimumAge > 0 && !md.CreatedAt.IsZero() {
+		if age := now.Sub(md.CreatedAt); age < p.MinimumAge {
+			return fmt.Sprintf("created %v ago, younger than the minimum age of %v", age.Round(time.Minute), p.MinimumAge)
+		}
+	}
+	return ""
+}
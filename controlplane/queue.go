@@ -0,0 +1,215 @@
+package controlplane
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+)
+
+const (
+	defaultBaseBackoff = 30 * time.Second
+	defaultMaxBackoff  = 30 * time.Minute
+)
+
+// Queue is a work queue of stack IDs, each scheduled for a time. An ID is in the queue at most once,
+// at its earliest scheduled time, and is handed to one worker at a time: adding an ID that is being
+// processed schedules it again once the worker calls Done.
+type Queue struct {
+	// BaseBackoff is the delay before retrying an ID that failed once. It doubles with every
+	// consecutive failure, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	mu         sync.Mutex
+	items      itemHeap
+	queued     map[api.ID]*queueItem
+	processing map[api.ID]bool
+	// again holds the times of IDs added while they were being processed.
+	again    map[api.ID]time.Time
+	failures map[api.ID]int
+	wake     chan struct{}
+	now      func() time.Time
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		BaseBackoff: defaultBaseBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		queued:      make(map[api.ID]*queueItem),
+		processing:  make(map[api.ID]bool),
+		again:       make(map[api.ID]time.Time),
+		failures:    make(map[api.ID]int),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// Add schedules id for at, unless it's already scheduled earlier.
+func (q *Queue) Add(id api.ID, at time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(id, at)
+}
+
+func (q *Queue) add(id api.ID, at time.Time) {
+	if q.processing[id] {
+		if cur, ok := q.again[id]; !ok || at.Before(cur) {
+			q.again[id] = at
+		}
+		return
+	}
+	if it, ok := q.queued[id]; ok {
+		if at.Before(it.at) {
+			it.at = at
+			heap.Fix(&q.items, it.index)
+			q.signal()
+		}
+		return
+	}
+	it := &queueItem{id: id, at: at}
+	heap.Push(&q.items, it)
+	q.queued[id] = it
+	q.signal()
+}
+
+// AddAfterFailure schedules id with exponential backoff, and returns the delay.
+func (q *Queue) AddAfterFailure(id api.ID) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d := q.BaseBackoff
+	for i := 0; i < q.failures[id] && d < q.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.MaxBackoff {
+		d = q.MaxBackoff
+	}
+	q.failures[id]++
+	q.add(id, q.clock().Add(d))
+	return d
+}
+
+// Forget resets id's backoff after it was processed successfully.
+func (q *Queue) Forget(id api.ID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.failures, id)
+}
+
+// Get blocks until an ID is due, and returns it. The caller must call Done with it.
+func (q *Queue) Get(ctx context.Context) (api.ID, error) {
+	for {
+		q.mu.Lock()
+		wait := time.Duration(-1)
+		if len(q.items) > 0 {
+			it := q.items[0]
+			if wait = it.at.Sub(q.clock()); wait <= 0 {
+				heap.Pop(&q.items)
+				delete(q.queued, it.id)
+				q.processing[it.id] = true
+				if len(q.items) > 0 {
+					// Let another waiter look at the next item.
+					q.signal()
+				}
+				q.mu.Unlock()
+				return it.id, nil
+			}
+		}
+		q.mu.Unlock()
+
+		var (
+			t     *time.Timer
+			timer <-chan time.Time
+		)
+		if wait > 0 {
+			t = time.NewTimer(wait)
+			timer = t.C
+		}
+		select {
+		case <-ctx.Done():
+			if t != nil {
+				t.Stop()
+			}
+			return "", ctx.Err()
+		case <-q.wake:
+		case <-timer:
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// Done marks id as processed, scheduling it again if it was added in the meantime.
+func (q *Queue) Done(id api.ID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, id)
+	if at, ok := q.again[id]; ok {
+		delete(q.again, id)
+		q.add(id, at)
+	}
+}
+
+// Len returns the number of scheduled IDs, not counting those being processed.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// When returns the time id is scheduled for, if it's queued.
+func (q *Queue) When(id api.ID) (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if it, ok := q.queued[id]; ok {
+		return it.at, true
+	}
+	return time.Time{}, false
+}
+
+// signal wakes a waiting Get so it can recompute its wait. The channel holds one signal, so a Get
+// that takes an item passes the signal on while items remain.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+type queueItem struct {
+	id    api.ID
+	at    time.Time
+	index int
+}
+
+// itemHeap orders items by their scheduled time, for container/heap.
+type itemHeap []*queueItem
+
+func (h itemHeap) Len() int           { return len(h) }
+func (h itemHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *itemHeap) Push(x any) {
+	it := x.(*queueItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+func (h *itemHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,111 @@
+package controlplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+)
+
+func get(t *testing.T, q *Queue, within time.Duration) api.ID {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), within)
+	defer cancel()
+	id, err := q.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return id
+}
+
+func TestQueueOrdersByTime(t *testing.T) {
+	q := NewQueue()
+	now := time.Now()
+	q.Add("later", now.Add(40*time.Millisecond))
+	q.Add("now", now)
+	q.Add("soon", now.Add(20*time.Millisecond))
+	// Adding an ID again keeps its earliest time.
+	q.Add("now", now.Add(time.Hour))
+	q.Add("later", now.Add(30*time.Millisecond))
+	if q.Len() != 3 {
+		t.Errorf("queue has %d items, want 3", q.Len())
+	}
+	for _, want := range []api.ID{"now", "soon", "later"} {
+		if got := get(t, q, time.Second); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		q.Done(want)
+	}
+	if d := time.Since(now); d < 30*time.Millisecond {
+		t.Errorf("got every item after %v, before the last was due", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Get(ctx); err == nil {
+		t.Errorf("Get on an empty queue returned")
+	}
+}
+
+func TestQueueDefersAddsWhileProcessing(t *testing.T) {
+	q := NewQueue()
+	q.Add("a", time.Now())
+	id := get(t, q, time.Second)
+	q.Add(id, time.Now())
+	if q.Len() != 0 {
+		t.Fatalf("an ID being processed was queued again")
+	}
+	q.Done(id)
+	if got := get(t, q, time.Second); got != "a" {
+		t.Errorf("got %v, want a to be queued again after Done", got)
+	}
+}
+
+func TestQueueWakesWaiters(t *testing.T) {
+	q := NewQueue()
+	got := make(chan api.ID, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			id, err := q.Get(context.Background())
+			if err == nil {
+				got <- id
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	q.Add("a", time.Now())
+	q.Add("b", time.Now())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 2 waiters got an item", i)
+		}
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := NewQueue()
+	q.BaseBackoff = time.Second
+	q.MaxBackoff = 5 * time.Second
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, q.AddAfterFailure("a"))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("backoff %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+	if at, ok := q.When("a"); !ok || !at.Equal(now.Add(time.Second)) {
+		t.Errorf("a is scheduled for %v, want the earliest retry", at)
+	}
+	q.Forget("a")
+	if d := q.AddAfterFailure("a"); d != time.Second {
+		t.Errorf("backoff after Forget is %v, want %v", d, time.Second)
+	}
+}
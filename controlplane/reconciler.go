@@ -0,0 +1,328 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+const (
+	// updateRecheckInterval is how long to wait before looking again at a stack that was being
+	// updated. Creates normally finish within 20 minutes.
+	updateRecheckInterval = 5 * time.Minute
+
+	reconcileRequestPrefix = "reconcile-requests/"
+	resyncRequestKey       = reconcileRequestPrefix + "resync"
+	stackRequestPrefix     = reconcileRequestPrefix + "stacks/"
+)
+
+// Reconciler destroys stacks as they expire. Every stack is queued for the time it expires, so it's
+// destroyed on time rather than at the next pass, and a stack that fails is retried on its own with
+// backoff. All stacks are requeued every ResyncInterval, which picks up new stacks and changed
+// expiries, and RequestReconcile and RequestResync queue stacks on demand.
+type Reconciler struct {
+	// Deletion decides what to do with a stack that is due.
+	Deletion *DeletionController
+	Queue    *Queue
+	// Store is polled for reconcile requests.
+	Store               store.Store
+	ResyncInterval      time.Duration
+	TriggerPollInterval time.Duration
+
+	limiter *clusterLimiter
+
+	mu      sync.Mutex
+	metrics Metrics
+}
+
+// Metrics counts what the reconciler did with the stacks it processed over a resync interval.
+type Metrics struct {
+	// Checked is the number of stacks whose expiry was checked.
+	Checked int
+	// Destroyed is the number of stacks destroyed.
+	Destroyed int
+	// Failed is the number of stacks that couldn't be checked or destroyed, timed out destroys
+	// included.
+	Failed int
+	// Protected is the number of deletion candidates spared by a protection rule.
+	Protected int
+	// WouldDestroy is the number of stacks that would have been destroyed in dry-run mode.
+	WouldDestroy int
+	// Waiting is the number of deletion candidates kept until the workspaces deployed into them
+	// are destroyed.
+	Waiting int
+	// Skipped is the number of destroys abandoned because the reconciler was stopping.
+	Skipped int
+	// NoExpiry is the number of stacks left alone because they have no expiry yet.
+	NoExpiry int
+}
+
+func (r *Reconciler) record(o outcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := &r.metrics
+	switch o {
+	case outcomeKept:
+		m.Checked++
+	case outcomeDestroyed:
+		m.Checked++
+		m.Destroyed++
+	case outcomeProtected:
+		m.Checked++
+		m.Protected++
+	case outcomeWouldDestroy:
+		m.Checked++
+		m.WouldDestroy++
+	case outcomeWaiting:
+		m.Checked++
+		m.Waiting++
+	case outcomeFailed:
+		m.Failed++
+	case outcomeSkipped:
+		m.Skipped++
+	case outcomeNoExpiry:
+		m.Checked++
+		m.NoExpiry++
+	}
+}
+
+// Metrics returns the counts since the last resync interval began.
+func (r *Reconciler) Metrics() Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics
+}
+
+// logMetrics logs the counts for the resync interval that just ended, and starts counting again.
+func (r *Reconciler) logMetrics(interval time.Duration) {
+	r.mu.Lock()
+	m := r.metrics
+	r.metrics = Metrics{}
+	r.mu.Unlock()
+	log.WithFields(log.Fields{
+		"canonical":    "true",
+		"controller":   "reconciler",
+		"checked":      m.Checked,
+		"destroyed":    m.Destroyed,
+		"failed":       m.Failed,
+		"protected":    m.Protected,
+		"dryRun":       r.Deletion.DryRun,
+		"wouldDestroy": m.WouldDestroy,
+		"waiting":      m.Waiting,
+		"skipped":      m.Skipped,
+		"noExpiry":     m.NoExpiry,
+		"interval":     interval,
+	}).Info("reconciler interval complete")
+}
+
+// NewReconciler returns a Reconciler for the pulumi backend, paced by c.
+func NewReconciler(c *config.Config) *Reconciler {
+	return &Reconciler{
+		Deletion:            NewDeletionController(c),
+		Queue:               NewQueue(),
+		Store:               store.Default(),
+		ResyncInterval:      c.Controlplane.ResyncInterval,
+		TriggerPollInterval: c.Controlplane.TriggerPollInterval,
+	}
+}
+
+// RequestReconcile asks the leading controlplane to look at a stack now.
+func RequestReconcile(i api.ID) error {
+	return request(stackRequestPrefix + string(i))
+}
+
+// RequestResync asks the leading controlplane to look at every stack now.
+func RequestResync() error {
+	return request(resyncRequestKey)
+}
+
+func request(key string) error {
+	if _, err := store.Default().Put(key, time.Now(), 0); err != nil && !errors.Is(err, store.ErrConflict) {
+		return err
+	}
+	return nil
+}
+
+// Run processes the queue until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	r.limiter = newClusterLimiter(r.Deletion.DestroyInterval)
+	parallelism := r.Deletion.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				id, err := r.Queue.Get(ctx)
+				if err != nil {
+					return
+				}
+				r.process(ctx, id)
+				r.Queue.Done(id)
+			}
+		}()
+	}
+
+	resync := time.NewTicker(r.ResyncInterval)
+	defer resync.Stop()
+	poll := time.NewTicker(r.TriggerPollInterval)
+	defer poll.Stop()
+	if err := r.Resync(); err != nil {
+		log.Errorf("reconciler resync: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-resync.C:
+			r.logMetrics(r.ResyncInterval)
+			if err := r.Resync(); err != nil {
+				log.Errorf("reconciler resync: %v", err)
+			}
+		case <-poll.C:
+			if err := r.pollRequests(); err != nil {
+				log.Errorf("reconciler polling requests: %v", err)
+			}
+		}
+	}
+}
+
+// Resync queues every stack now.
+func (r *Reconciler) Resync() error {
+	ids, err := r.Deletion.Backend.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids.IDs {
+		r.Queue.Add(id, now)
+	}
+	if err := pruneDecisions(r.Deletion.Store, ids.IDs); err != nil {
+		log.Errorf("reconciler pruning deletion decisions: %v", err)
+	}
+	log.WithFields(log.Fields{"controller": "reconciler", "stacks": len(ids.IDs)}).Info("reconciler resync")
+	return nil
+}
+
+// pollRequests queues the stacks that were requested through the store.
+func (r *Reconciler) pollRequests() error {
+	keys, err := r.Store.List(reconcileRequestPrefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := r.Store.Delete(k); err != nil {
+			return err
+		}
+		if k == resyncRequestKey {
+			log.WithField("controller", "reconciler").Info("reconciler resync requested")
+			if err := r.Resync(); err != nil {
+				return err
+			}
+			continue
+		}
+		id := api.ID(strings.TrimPrefix(k, stackRequestPrefix))
+		log.WithFields(log.Fields{"controller": "reconciler", "stack": id}).Info("reconciler reconcile requested")
+		r.Queue.Add(id, time.Now())
+	}
+	return nil
+}
+
+// process looks at one stack: it's destroyed if it's due, and otherwise queued for when it will be.
+func (r *Reconciler) process(ctx context.Context, id api.ID) {
+	c := r.Deletion
+	now := time.Now()
+	l := log.WithFields(log.Fields{"canonical": "true", "controller": "reconciler", "stack": id})
+
+	var reason string
+	expiry, err := c.Backend.GetExpiry(id)
+	switch {
+	case errors.Is(err, pulumi_backends.ErrStackNotFound):
+		// Destroyed since it was queued.
+		r.Queue.Forget(id)
+		l.WithField("outcome", "gone").Info("reconciler processed stack")
+		return
+	case errors.Is(err, pulumi_backends.ErrUpdateInProgress):
+		r.record(outcomeKept)
+		next := now.Add(updateRecheckInterval)
+		r.Queue.Add(id, next)
+		l.WithFields(log.Fields{"outcome": "updating", "next": next}).Info("reconciler processed stack")
+		return
+	case errors.Is(err, pulumi_backends.ErrNoExpiry):
+		// A stack without an expiry is being created, or its create failed before it recorded
+		// one. Destroying it could race the create, so it's left alone and looked at again on
+		// the next resync.
+		c.decide(id, "skip", "no expiry recorded")
+		r.record(outcomeNoExpiry)
+		r.Queue.Forget(id)
+		l.WithField("outcome", "no expiry").Info("reconciler processed stack")
+		return
+	case err != nil:
+		r.record(outcomeFailed)
+		backoff := r.Queue.AddAfterFailure(id)
+		l.WithError(err).WithFields(log.Fields{"outcome": "failed", "backoff": backoff}).Error("reconciler processed stack")
+		return
+	case !now.Before(expiry):
+		reason = "expired"
+	case c.DeleteAll:
+		reason = "HELIUM_CONTROLPLANE_DELETE_ALL is set"
+	default:
+		r.record(outcomeKept)
+		r.Queue.Forget(id)
+		r.Queue.Add(id, expiry)
+		l.WithFields(log.Fields{"outcome": "kept", "next": expiry}).Info("reconciler processed stack")
+		return
+	}
+
+	o := c.destroy(ctx, r.limiter, id, reason)
+	r.record(o)
+	switch o {
+	case outcomeWaiting:
+		// Its dependents expire no later than it does, so they're due too. If they can't be
+		// listed, they're still looked at when they're due, and it's checked again regardless.
+		deps, err := c.Backend.Dependents(id)
+		if err != nil {
+			log.WithFields(log.Fields{"controller": "reconciler", "stack": id}).WithError(err).Error("reconciler could not list dependents to queue")
+		}
+		for _, d := range deps {
+			r.Queue.Add(d, now)
+		}
+		next := now.Add(updateRecheckInterval)
+		r.Queue.Add(id, next)
+		l.WithFields(log.Fields{"outcome": outcomeNames[o], "reason": reason, "next": next}).Info("reconciler processed stack")
+	case outcomeFailed:
+		backoff := r.Queue.AddAfterFailure(id)
+		l.WithFields(log.Fields{"outcome": "failed", "backoff": backoff}).Error("reconciler processed stack")
+	case outcomeSkipped:
+		// The controlplane is stopping; the next leader will resync.
+		l.WithField("outcome", "skipped").Info("reconciler processed stack")
+	default:
+		// Protected stacks and dry runs are looked at again on the next resync.
+		r.Queue.Forget(id)
+		l.WithFields(log.Fields{"outcome": outcomeNames[o], "reason": reason}).Info("reconciler processed stack")
+	}
+}
+
+var outcomeNames = map[outcome]string{
+	outcomeKept:         "kept",
+	outcomeDestroyed:    "destroyed",
+	outcomeFailed:       "failed",
+	outcomeSkipped:      "skipped",
+	outcomeProtected:    "protected",
+	outcomeWouldDestroy: "would destroy",
+	outcomeWaiting:      "waiting for dependents",
+	outcomeNoExpiry:     "no expiry",
+}
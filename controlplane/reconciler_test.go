@@ -0,0 +1,184 @@
+package controlplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+func newTestReconciler(f *fakeBackend) *Reconciler {
+	st := store.NewMemory()
+	return &Reconciler{
+		Deletion: &DeletionController{
+			Backend:         f,
+			Parallelism:     2,
+			DestroyInterval: time.Millisecond,
+			Store:           st,
+		},
+		Queue:               NewQueue(),
+		Store:               st,
+		ResyncInterval:      time.Hour,
+		TriggerPollInterval: 10 * time.Millisecond,
+		limiter:             newClusterLimiter(time.Millisecond),
+	}
+}
+
+func TestReconcilerProcess(t *testing.T) {
+	f := newFakeBackend("expired", "later", "broken", "protected", "creating")
+	f.expired["expired"] = true
+	f.expired["protected"] = true
+	f.labels["protected"] = map[string]string{"protected": "true"}
+	later := time.Now().Add(time.Hour)
+	f.expiries["later"] = later
+	f.failExpiry["broken"] = true
+	f.noExpiry["creating"] = true
+	r := newTestReconciler(f)
+	ctx := context.Background()
+
+	for _, id := range []api.ID{"expired", "later", "broken", "protected", "creating", "gone"} {
+		r.process(ctx, id)
+	}
+	if diff := cmp.Diff([]api.ID{"expired"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+	if at, ok := r.Queue.When("later"); !ok || !at.Equal(later) {
+		t.Errorf("later is scheduled for %v (%v), want its expiry %v", at, ok, later)
+	}
+	if at, ok := r.Queue.When("broken"); !ok || time.Until(at) < defaultBaseBackoff-time.Second {
+		t.Errorf("broken is scheduled for %v (%v), want a retry after backoff", at, ok)
+	}
+	for _, id := range []api.ID{"expired", "protected", "creating", "gone"} {
+		if _, ok := r.Queue.When(id); ok {
+			t.Errorf("%v was queued again", id)
+		}
+	}
+
+	decided := func() map[api.ID]string {
+		decisions, err := getDecisions(r.Deletion.Store)
+		if err != nil {
+			t.Fatalf("getDecisions: %v", err)
+		}
+		got := make(map[api.ID]string)
+		for _, d := range decisions {
+			got[d.ID] = d.Action + ": " + d.Reason
+		}
+		return got
+	}
+	want := map[api.ID]string{
+		"expired":   "destroy: expired",
+		"protected": `skip: has the "protected" label`,
+		"creating":  "skip: no expiry recorded",
+	}
+	if diff := cmp.Diff(want, decided()); diff != "" {
+		t.Errorf("decisions (-want +got):\n%s", diff)
+	}
+	// A resync forgets the decisions about stacks that are gone.
+	if err := r.Resync(); err != nil {
+		t.Fatalf("Resync: %v", err)
+	}
+	delete(want, "expired")
+	if diff := cmp.Diff(want, decided()); diff != "" {
+		t.Errorf("decisions after resync (-want +got):\n%s", diff)
+	}
+}
+
+func TestReconcilerWaitsForDependents(t *testing.T) {
+	f := newFakeBackend("cluster", "workspace")
+	f.expired["cluster"] = true
+	f.expired["workspace"] = true
+	f.clusters["workspace"] = "cluster"
+	r := newTestReconciler(f)
+	ctx := context.Background()
+
+	r.process(ctx, "cluster")
+	if len(f.destroyed) > 0 {
+		t.Fatalf("destroyed %v before its dependents", f.destroyed)
+	}
+	if at, ok := r.Queue.When("workspace"); !ok || at.After(time.Now()) {
+		t.Errorf("workspace is scheduled for %v (%v), want now", at, ok)
+	}
+	if at, ok := r.Queue.When("cluster"); !ok || time.Until(at) < updateRecheckInterval-time.Second {
+		t.Errorf("cluster is scheduled for %v (%v), want a recheck", at, ok)
+	}
+
+	r.process(ctx, "workspace")
+	r.process(ctx, "cluster")
+	if diff := cmp.Diff([]api.ID{"workspace", "cluster"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+}
+
+func TestReconcilerDestroysAtExpiry(t *testing.T) {
+	f := newFakeBackend("a", "b")
+	f.expiries["a"] = time.Now().Add(50 * time.Millisecond)
+	f.expiries["b"] = time.Now().Add(time.Hour)
+	r := newTestReconciler(f)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.destroyed)
+		f.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a wasn't destroyed after it expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if diff := cmp.Diff([]api.ID{"a"}, f.destroyed); diff != "" {
+		t.Errorf("destroyed (-want +got):\n%s", diff)
+	}
+}
+
+func TestReconcilerRequests(t *testing.T) {
+	defer store.SetDefault(store.Default())
+	store.SetDefault(store.NewMemory())
+	f := newFakeBackend("a", "b")
+	r := newTestReconciler(f)
+	r.Store = store.Default()
+
+	if err := RequestReconcile("a"); err != nil {
+		t.Fatalf("RequestReconcile: %v", err)
+	}
+	if err := RequestReconcile("a"); err != nil {
+		t.Fatalf("second RequestReconcile: %v", err)
+	}
+	if err := r.pollRequests(); err != nil {
+		t.Fatalf("pollRequests: %v", err)
+	}
+	if _, ok := r.Queue.When("a"); !ok || r.Queue.Len() != 1 {
+		t.Errorf("queue has %d items, want just a", r.Queue.Len())
+	}
+
+	if err := RequestResync(); err != nil {
+		t.Fatalf("RequestResync: %v", err)
+	}
+	if err := r.pollRequests(); err != nil {
+		t.Fatalf("pollRequests: %v", err)
+	}
+	if r.Queue.Len() != 2 {
+		t.Errorf("queue has %d items after a resync, want 2", r.Queue.Len())
+	}
+	if keys, _ := r.Store.List(reconcileRequestPrefix); len(keys) != 0 {
+		t.Errorf("requests %v weren't removed", keys)
+	}
+}
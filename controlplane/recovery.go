@@ -0,0 +1,151 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+// recoveryBackend is the set of stack operations the recovery controller needs. pulumiRecovery
+// implements it with pulumi_backends; tests substitute a fake.
+type recoveryBackend interface {
+	List() (*api.ListResponse, error)
+	GetPendingUpdate(api.ID) (*pulumi_backends.PendingUpdate, error)
+	RetryDestroys(i api.ID, kind string) (bool, error)
+	LockWorkspace(i api.ID, op string) (unlock func(), err error)
+	Cancel(context.Context, api.ID) error
+	ClearPendingOperations(context.Context, api.ID) (int, error)
+	Retry(ctx context.Context, i api.ID, kind string) error
+}
+
+type pulumiRecovery struct{}
+
+func (pulumiRecovery) List() (*api.ListResponse, error) { return pulumi_backends.List() }
+func (pulumiRecovery) GetPendingUpdate(i api.ID) (*pulumi_backends.PendingUpdate, error) {
+	return pulumi_backends.GetPendingUpdate(i)
+}
+func (pulumiRecovery) RetryDestroys(i api.ID, kind string) (bool, error) {
+	return pulumi_backends.RetryDestroys(i, kind)
+}
+func (pulumiRecovery) LockWorkspace(i api.ID, op string) (func(), error) {
+	return pulumi_backends.LockWorkspace(i, op)
+}
+func (pulumiRecovery) Cancel(ctx context.Context, i api.ID) error {
+	return pulumi_backends.Cancel(ctx, i)
+}
+func (pulumiRecovery) ClearPendingOperations(ctx context.Context, i api.ID) (int, error) {
+	return pulumi_backends.ClearPendingOperations(ctx, i)
+}
+func (pulumiRecovery) Retry(ctx context.Context, i api.ID, kind string) error {
+	return pulumi_backends.Retry(ctx, i, kind)
+}
+
+var recovery recoveryBackend = pulumiRecovery{}
+
+// RunRecoveryController finds stacks that have had an update in progress for longer than the
+// config's stuck threshold, which is what an interrupted Pulumi run leaves behind, assuming the
+// process running it died; creates normally finish within 20 minutes. Until they're recovered,
+// every later operation on them fails, including the deletion controller's Destroy. For each one it
+// takes the workspace's lock, cancels the update, clears pending operations out of the stack's
+// state, and retries the operation that was interrupted. A stack whose lock is held is skipped: its
+// update is still running somewhere, however long it's taking.
+func RunRecoveryController(ctx context.Context, c *config.Config) error {
+	ids, err := recovery.List()
+	if err != nil {
+		return err
+	}
+	for _, v := range ids.IDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pending, err := recovery.GetPendingUpdate(v)
+		if err != nil {
+			log.Errorf("recovery controller error checking for pending update: %v", err)
+			continue
+		}
+		if pending == nil || time.Since(pending.StartTime) < c.Controlplane.StuckThreshold {
+			continue
+		}
+		l := log.WithFields(log.Fields{
+			"controller": "recovery",
+			"stack":      v,
+			"kind":       pending.Kind,
+			"started":    pending.StartTime,
+		})
+		l.Warn("recovery controller found stuck update")
+		destroys, err := recovery.RetryDestroys(v, pending.Kind)
+		if err != nil {
+			l.WithError(err).Error("recovery controller could not tell how to retry update")
+			continue
+		}
+		if destroys && c.Controlplane.DryRun {
+			l.Info("recovery controller would recover stack by destroying it, but this is a dry run")
+			continue
+		}
+
+		if err := recoverStack(ctx, v, pending, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverStack cancels, clears and retries a stuck update, holding the workspace's lock throughout.
+// It only returns an error if ctx is done.
+func recoverStack(ctx context.Context, v api.ID, pending *pulumi_backends.PendingUpdate, l *log.Entry) error {
+	unlock, err := recovery.LockWorkspace(v, "recovery")
+	if errors.Is(err, pulumi_backends.ErrWorkspaceBusy) {
+		l.WithError(err).Info("recovery controller skipping stack whose update is still running")
+		return nil
+	}
+	if err != nil {
+		l.WithError(err).Error("recovery controller could not lock stack")
+		return nil
+	}
+	defer unlock()
+
+	l.Info("recovery controller cancelling update")
+	event := api.AuditEvent{
+		Actor:     audit.Controller("recovery"),
+		Action:    "cancel",
+		Workspace: v,
+		Params:    map[string]string{"kind": pending.Kind, "started": pending.StartTime.Format(time.RFC3339)},
+		StartedAt: time.Now(),
+	}
+	err = recovery.Cancel(ctx, v)
+	audit.Done(event, err)
+	if err != nil {
+		// Self-managed backends don't support cancel, and a lock can outlive the
+		// update that took it. Clearing the state is still worth trying.
+		l.WithError(err).Warn("recovery controller could not cancel update")
+	}
+
+	l.Info("recovery controller clearing pending operations")
+	n, err := recovery.ClearPendingOperations(ctx, v)
+	if err != nil {
+		l.WithError(err).Error("recovery controller could not clear pending operations")
+		return nil
+	}
+	l.Infof("recovery controller cleared %d pending operations", n)
+
+	l.Info("recovery controller retrying interrupted operation")
+	event.Action, event.StartedAt = "retry", time.Now()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err = recovery.Retry(ctx, v, pending.Kind)
+	audit.Done(event, err)
+	if err != nil {
+		l.WithError(err).Error("recovery controller retry failed")
+		return nil
+	}
+	l.Info("recovery controller recovered stack")
+	return nil
+}
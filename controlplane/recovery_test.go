@@ -0,0 +1,122 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+// fakeRecovery is a recoveryBackend with the pending updates in pending and the workspaces locked
+// by other operations in busy, which records the operations the recovery controller runs on each
+// stack.
+type fakeRecovery struct {
+	ids         []api.ID
+	pending     map[api.ID]*pulumi_backends.PendingUpdate
+	failPending map[api.ID]bool
+	failCancel  map[api.ID]bool
+	failClear   map[api.ID]bool
+	busy        map[api.ID]bool
+
+	ops map[api.ID][]string
+}
+
+func (f *fakeRecovery) List() (*api.ListResponse, error) {
+	return &api.ListResponse{IDs: f.ids}, nil
+}
+
+func (f *fakeRecovery) GetPendingUpdate(i api.ID) (*pulumi_backends.PendingUpdate, error) {
+	if f.failPending[i] {
+		return nil, errors.New("boom")
+	}
+	return f.pending[i], nil
+}
+
+func (f *fakeRecovery) RetryDestroys(i api.ID, kind string) (bool, error) {
+	return kind == "destroy", nil
+}
+
+func (f *fakeRecovery) LockWorkspace(i api.ID, op string) (func(), error) {
+	if f.busy[i] {
+		return nil, pulumi_backends.ErrWorkspaceBusy
+	}
+	f.ops[i] = append(f.ops[i], "lock")
+	return func() { f.ops[i] = append(f.ops[i], "unlock") }, nil
+}
+
+func (f *fakeRecovery) Cancel(ctx context.Context, i api.ID) error {
+	f.ops[i] = append(f.ops[i], "cancel")
+	if f.failCancel[i] {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func (f *fakeRecovery) ClearPendingOperations(ctx context.Context, i api.ID) (int, error) {
+	f.ops[i] = append(f.ops[i], "clear")
+	if f.failClear[i] {
+		return 0, errors.New("boom")
+	}
+	return 1, nil
+}
+
+func (f *fakeRecovery) Retry(ctx context.Context, i api.ID, kind string) error {
+	f.ops[i] = append(f.ops[i], "retry "+kind)
+	return nil
+}
+
+func TestRunRecoveryController(t *testing.T) {
+	stuck := time.Now().Add(-3 * time.Hour)
+	f := &fakeRecovery{
+		ids: []api.ID{"stuck", "young", "idle", "broken", "uncancellable", "uncleared", "destroying", "running"},
+		pending: map[api.ID]*pulumi_backends.PendingUpdate{
+			"stuck":         {Kind: "update", StartTime: stuck},
+			"young":         {Kind: "update", StartTime: time.Now().Add(-time.Minute)},
+			"uncancellable": {Kind: "update", StartTime: stuck},
+			"uncleared":     {Kind: "refresh", StartTime: stuck},
+			"destroying":    {Kind: "destroy", StartTime: stuck},
+			"running":       {Kind: "update", StartTime: stuck},
+		},
+		failPending: map[api.ID]bool{"broken": true},
+		failCancel:  map[api.ID]bool{"uncancellable": true},
+		failClear:   map[api.ID]bool{"uncleared": true},
+		// Another replica is still running this update, and holds its lock.
+		busy: map[api.ID]bool{"running": true},
+	}
+	defer func(prev recoveryBackend) { recovery = prev }(recovery)
+	recovery = f
+
+	for _, test := range []struct {
+		dryRun bool
+		want   map[api.ID][]string
+	}{
+		{false, map[api.ID][]string{
+			"stuck":         {"lock", "cancel", "clear", "retry update", "unlock"},
+			"uncancellable": {"lock", "cancel", "clear", "retry update", "unlock"},
+			"uncleared":     {"lock", "cancel", "clear", "unlock"},
+			"destroying":    {"lock", "cancel", "clear", "retry destroy", "unlock"},
+		}},
+		// A dry run leaves alone the stacks that recovering would destroy.
+		{true, map[api.ID][]string{
+			"stuck":         {"lock", "cancel", "clear", "retry update", "unlock"},
+			"uncancellable": {"lock", "cancel", "clear", "retry update", "unlock"},
+			"uncleared":     {"lock", "cancel", "clear", "unlock"},
+		}},
+	} {
+		f.ops = make(map[api.ID][]string)
+		c := config.Defaults()
+		c.Controlplane.DryRun = test.dryRun
+		if err := RunRecoveryController(context.Background(), c); err != nil {
+			t.Fatalf("RunRecoveryController with dry run %v: %v", test.dryRun, err)
+		}
+		if diff := cmp.Diff(test.want, f.ops); diff != "" {
+			t.Errorf("operations with dry run %v (-want +got):\n%s", test.dryRun, diff)
+		}
+	}
+}
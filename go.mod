@@ -4,10 +4,12 @@ go 1.18
 
 require (
 	github.com/getsentry/sentry-go v0.15.0
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/google/go-cmp v0.5.9
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/schema v1.2.0
 	github.com/pulumi/pulumi/sdk/v3 v3.47.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.7.0
 )
@@ -21,7 +23,6 @@ require (
 	github.com/cloudflare/circl v1.3.0 // indirect
 	github.com/go-git/gcfg v1.5.0 // indirect
 	github.com/go-git/go-billy/v5 v5.3.1 // indirect
-	github.com/go-git/go-git/v5 v5.4.2 // indirect
 	github.com/imdario/mergo v0.3.13 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/santhosh-tekuri/jsonschema/v5 v5.1.1 // indirect
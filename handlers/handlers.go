@@ -1,14 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -17,31 +19,338 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/audit"
+	"github.com/pachyderm/helium/auth"
+	"github.com/pachyderm/helium/catalog"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/controlplane"
+	"github.com/pachyderm/helium/oidc"
+	"github.com/pachyderm/helium/placement"
+	"github.com/pachyderm/helium/policy"
+	"github.com/pachyderm/helium/pool"
 	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/quota"
 	"github.com/pachyderm/helium/util"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	SECRET_PASSWORD        = "Bearer ***REMOVED***"
 	SECRET_PASSWORD_HEADER = "Authorization"
-	USER_HEADER            = "X-Forwarded-Email"
+	// USER_HEADER is the email the oauth proxy in front of the UI forwards. It's only trusted
+	// without OIDC, until every deployment logs users in with it, and then only to look.
+	USER_HEADER = "X-Forwarded-Email"
 )
 
 var decoder = schema.NewDecoder()
 var validNameCharacters = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{1,61}[a-z0-9]{1})$`)
 
-// Middleware function, which will be called for each request
+// oidcProvider logs users in, if OIDC is configured. Without it the UI is open to anyone, which is
+// only fit for local development.
+var oidcProvider *oidc.Provider
+
+// SetOIDC has users log in with an OIDC provider: the UI with UIAuthMiddleware, and the API with
+// the provider's JWTs as well as API tokens.
+func SetOIDC(p *oidc.Provider) { oidcProvider = p }
+
+// OIDC returns the OIDC provider set by SetOIDC, or nil.
+func OIDC() *oidc.Provider { return oidcProvider }
+
+// serverConfig is the server's settings, shown to admins by ConfigRequest. It's nil until
+// SetConfig is called.
+var serverConfig *config.Config
+
+// SetConfig sets the server's settings that ConfigRequest shows.
+func SetConfig(c *config.Config) { serverConfig = c }
+
+// backendCatalog is the catalog create requests are checked against, loaded once at startup. It's
+// nil until SetCatalog is called.
+var backendCatalog *catalog.Catalog
+
+// SetCatalog sets the backend catalog.
+func SetCatalog(c *catalog.Catalog) { backendCatalog = c }
+
+// backends returns the backend catalog, and writes the error response if SetCatalog wasn't called.
+func backends(w http.ResponseWriter) (*catalog.Catalog, bool) {
+	if backendCatalog == nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "no backend catalog")
+		log.Error("no backend catalog is set")
+		return nil, false
+	}
+	return backendCatalog, true
+}
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	logUserContextKey
+)
+
+// AuthMiddleware checks the request's API token, or with OIDC, the provider's JWT, and that its
+// scopes allow the request: the admin API and the audit log need admin, other reads need read, and
+// anything else needs write.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get(SECRET_PASSWORD_HEADER)
-		if token == SECRET_PASSWORD {
-			next.ServeHTTP(w, r)
-		} else {
+		header := r.Header.Get(SECRET_PASSWORD_HEADER)
+		if !strings.HasPrefix(header, "Bearer ") {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		token, err := authenticate(r.Context(), strings.TrimPrefix(header, "Bearer "))
+		if errors.Is(err, oidc.ErrNotAllowed) {
+			log.Infof("authenticate: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
 		}
+		if err != nil {
+			if !errors.Is(err, auth.ErrInvalidToken) && !errors.Is(err, oidc.ErrInvalidToken) {
+				log.Errorf("authenticate: %v", err)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if required := requiredScope(r); !auth.Allows(token.Scopes, required) {
+			logDenial(token, r.Method+" "+r.URL.Path, "", fmt.Errorf("%w: needs the %s scope", auth.ErrForbidden, required))
+			http.Error(w, fmt.Sprintf("Forbidden: needs the %s scope", required), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, withUser(r, token))
+	})
+}
+
+func authenticate(ctx context.Context, bearer string) (*api.Token, error) {
+	if oidcProvider != nil && oidc.LooksLikeJWT(bearer) {
+		claims, err := oidcProvider.Verify(ctx, bearer, oidcProvider.Audience(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return &api.Token{ID: "oidc", Identity: claims.Email, Scopes: auth.UserScopes(claims.Email)}, nil
+	}
+	return auth.Authenticate(bearer, time.Now())
+}
+
+// UIAuthMiddleware sends users of the UI who aren't logged in to log in with the OIDC provider, if
+// there is one. Without one, the user is whoever the oauth proxy in front of the UI says they are,
+// but only as a viewer: anyone who can reach the UI around the proxy can say they're anyone, so
+// creating or changing workspaces in the UI takes OIDC.
+func UIAuthMiddleware(next http.Handler) http.Handler {
+	if oidcProvider == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if email := r.Header.Get(USER_HEADER); email != "" {
+				r = withUser(r, &api.Token{ID: "proxy", Identity: email, Scopes: []string{auth.ScopeRead}})
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return oidcProvider.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := oidcProvider.Email(r)
+		next.ServeHTTP(w, withUser(r, &api.Token{ID: "session", Identity: email, Scopes: auth.UserScopes(email)}))
+	}))
+}
+
+// withUser returns the request as made by token, and has LoggingMiddleware log its identity.
+func withUser(r *http.Request, token *api.Token) *http.Request {
+	if u, ok := r.Context().Value(logUserContextKey).(*string); ok {
+		*u = token.Identity
+	}
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey, token))
+}
+
+func requiredScope(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/api/admin/"), r.URL.Path == "/v1/api/audit":
+		return auth.ScopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return auth.ScopeRead
+	}
+	return auth.ScopeWrite
+}
+
+// User returns who made a request: the identity of its API token or JWT, or the user logged in to
+// the UI. It's empty if nobody has authenticated, as in the UI without OIDC or the oauth proxy.
+func User(r *http.Request) string {
+	if token, ok := r.Context().Value(tokenContextKey).(*api.Token); ok {
+		return token.Identity
+	}
+	return ""
+}
+
+// caller returns the token a request was made with. A request nobody authenticated, as to the UI
+// without OIDC or the oauth proxy, gets an anonymous token without scopes, so it's a viewer and
+// may change nothing.
+func caller(r *http.Request) *api.Token {
+	if token, ok := r.Context().Value(tokenContextKey).(*api.Token); ok {
+		return token
+	}
+	return &api.Token{ID: "anonymous", Identity: "anonymous"}
+}
+
+// authorizeWorkspace checks that the caller may change an existing workspace with action, such as
+// "delete", and writes the error response if not.
+func authorizeWorkspace(w http.ResponseWriter, r *http.Request, action string, id api.ID) bool {
+	md, err := pulumi_backends.GetMetadata(pulumi_backends.Resolve(id))
+	if errors.Is(err, pulumi_backends.ErrStackNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "no such workspace")
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting workspace owner")
+		log.Errorf("%s handler: %v", action, err)
+		return false
+	}
+	return authorize(w, r, action, id, md.CreatedBy, md.Backend)
+}
+
+// authorizeCreate checks that the caller may create the workspace spec describes, which updates it
+// if it already exists, and writes the error response if not. An update keeps the workspace's
+// owner, whoever makes it, so spec gets the owner as its CreatedBy. It returns the action,
+// "create" or "update".
+func authorizeCreate(w http.ResponseWriter, r *http.Request, spec *api.Spec) (string, bool) {
+	action, owner := "create", User(r)
+	var labels map[string]string
+	var clusterStack string
+	md, err := pulumi_backends.GetMetadata(pulumi_backends.Resolve(api.ID(spec.Name)))
+	switch {
+	case err == nil:
+		action, owner, labels, clusterStack = "update", md.CreatedBy, md.Labels, md.ClusterStack
+		if owner != "" {
+			spec.CreatedBy = owner
+		}
+	case !errors.Is(err, pulumi_backends.ErrStackNotFound):
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting workspace owner")
+		log.Errorf("create handler: %v", err)
+		return "", false
+	}
+	if !authorize(w, r, action, api.ID(spec.Name), owner, spec.Backend) {
+		return "", false
+	}
+	if spec.ClusterStack != clusterStack && !authorizeClusterStack(w, r, action, spec) {
+		return "", false
+	}
+	return action, authorizeProtection(w, r, action, labels, spec)
+}
+
+// authorizeClusterStack checks that the caller may manage the helium cluster stack spec deploys
+// into, and writes the error response if not. Otherwise anyone could put workspaces into a
+// cluster, and so keep its owner from deleting it.
+func authorizeClusterStack(w http.ResponseWriter, r *http.Request, action string, spec *api.Spec) bool {
+	parent, ok := pulumi_backends.ClusterStackID(spec.ClusterStack)
+	if !ok {
+		return true
+	}
+	md, err := pulumi_backends.GetMetadata(parent)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting cluster stack owner")
+		log.Errorf("%s handler: %v", action, err)
+		return false
+	}
+	return authorize(w, r, action, parent, md.CreatedBy, md.Backend)
+}
+
+// authorizeProtection checks that the caller may set or clear the protected label, if spec changes
+// whether a workspace labelled with labels has it, and writes the error response if not.
+func authorizeProtection(w http.ResponseWriter, r *http.Request, action string, labels map[string]string, spec *api.Spec) bool {
+	if controlplane.Protected(labels) == controlplane.Protected(util.ParseLabels(spec.Labels)) {
+		return true
+	}
+	token := caller(r)
+	if err := auth.CanProtect(token); err != nil {
+		logDenial(token, action, api.ID(spec.Name), err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		return false
+	}
+	return true
+}
+
+// authorize checks that the caller may change a workspace created by owner with backend, and
+// writes the error response and logs the denial if not.
+func authorize(w http.ResponseWriter, r *http.Request, action string, id api.ID, owner, backend string) bool {
+	token := caller(r)
+	var cluster bool
+	if backendCatalog == nil {
+		log.Errorf("%s handler: no backend catalog is set", action)
+		cluster = true
+	} else if b := backendCatalog.Get(backend); b != nil {
+		cluster = b.Cluster
+	}
+	if err := auth.CanManage(token, owner, cluster); err != nil {
+		logDenial(token, action, id, err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		return false
+	}
+	return true
+}
+
+// checkProgramSource checks the program repo a create request asks for, and writes the error
+// response if it isn't https.
+func checkProgramSource(w http.ResponseWriter, r *http.Request, spec *api.Spec) bool {
+	err := pulumi_backends.CheckProgramSource(spec)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Infof("rejected create request: %v", err)
+		return false
+	}
+	return true
+}
+
+// logDenial logs and audits that token was refused permission to do action, to workspace id if
+// there is one.
+func logDenial(token *api.Token, action string, id api.ID, err error) {
+	audit.Record(api.AuditEvent{
+		Actor:     token.Identity,
+		Action:    action,
+		Workspace: id,
+		Result:    audit.Denied,
+		Error:     err.Error(),
 	})
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "denied",
+		"action":    action,
+		"id":        id,
+		"user":      token.Identity,
+		"role":      auth.Role(token),
+		"tokenId":   token.ID,
+	}).Warnf("request denied: %v", err)
+}
+
+// auditEvent starts the audit event of an action the request's caller takes, with the request's
+// form values and the names of any files it uploaded as its parameters.
+func auditEvent(r *http.Request, action string, id api.ID) api.AuditEvent {
+	if r.Form == nil {
+		r.ParseMultipartForm(32 << 20)
+	}
+	params := make(map[string]string)
+	for k, v := range r.Form {
+		params[k] = strings.Join(v, ",")
+	}
+	if r.MultipartForm != nil {
+		for k, files := range r.MultipartForm.File {
+			if len(files) > 0 {
+				params[k] = files[0].Filename
+			}
+		}
+	}
+	actor := User(r)
+	if actor == "" {
+		actor = "anonymous"
+	}
+	return api.AuditEvent{
+		Actor:     actor,
+		Action:    action,
+		Workspace: id,
+		Params:    params,
+		StartedAt: time.Now(),
+	}
 }
 
 func LoggingMiddleware(next http.Handler) http.Handler {
@@ -49,7 +358,9 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		start := time.Now()
 		url := r.URL
 		method := r.Method
-		user := r.Header.Get(USER_HEADER)
+		// The auth middlewares run inside this one, and fill in who the user is.
+		var user string
+		r = r.WithContext(context.WithValue(r.Context(), logUserContextKey, &user))
 		next.ServeHTTP(w, r)
 		duration := time.Since(start)
 		log.WithFields(log.Fields{
@@ -108,11 +419,20 @@ func AsyncCreationRequest(w http.ResponseWriter, r *http.Request) {
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
 
-	var spec api.Spec
-	var err error
+	id, _, ok := createFromForm(w, r, "create-api")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&api.CreateResponse{ID: id})
+}
 
-	err = r.ParseMultipartForm(32 << 20)
-	if err != nil {
+// createFromForm reads a create request's form and uploaded files, and starts it with startCreate.
+// It writes the error response and returns false if the form can't be read.
+func createFromForm(w http.ResponseWriter, r *http.Request, request string) (id api.ID, claimed bool, ok bool) {
+	var spec api.Spec
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
 		log.Errorf("Error parsing form: %v", err)
 	}
 	err = decoder.Decode(&spec, r.PostForm)
@@ -120,88 +440,77 @@ func AsyncCreationRequest(w http.ResponseWriter, r *http.Request) {
 		log.Errorf("Error decoding form: %v", err)
 	}
 
-	file, _, err := r.FormFile("valuesYaml")
+	f, content, err := readUpload(r, "valuesYaml")
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file") {
-			log.Debug("no file param")
-		} else {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("Error reading FormFile: %v", err)
-		}
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "failed to upload file: %v", err)
+		log.Errorf("reading valuesYaml upload: %v", err)
+		return "", false, false
 	}
-
-	var content []byte
-	var f *os.File
-	if file != nil {
-		f, err = os.CreateTemp("", "temp-values")
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error creating temp file: %v", err)
-			return
-		}
-		_, err = io.Copy(f, file)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
-		}
-		content, err = ioutil.ReadFile(f.Name())
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
-		}
-
+	if f != nil {
 		spec.ValuesYAML = f.Name()
 		spec.ValuesYAMLContent = content
 	}
-
-	fileInfra, _, err := r.FormFile("infraJson")
+	fInfra, contentInfra, err := readUpload(r, "infraJson")
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file") {
-			log.Debug("no file param")
-		} else {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("Error reading FormFile: %v", err)
-		}
+		removeUploads([]*os.File{f})
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "failed to upload file: %v", err)
+		log.Errorf("reading infraJson upload: %v", err)
+		return "", false, false
 	}
-
-	var contentInfra []byte
-	var fInfra *os.File
-	if fileInfra != nil {
-		fInfra, err = os.CreateTemp("", "temp-values")
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error creating temp file: %v", err)
-			return
-		}
-		_, err = io.Copy(fInfra, fileInfra)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
-		}
-		contentInfra, err = ioutil.ReadFile(fInfra.Name())
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
-		}
-
+	if fInfra != nil {
 		spec.InfraJSON = fInfra.Name()
 		spec.InfraJSONContent = contentInfra
 	}
+	return startCreate(w, r, &spec, request, f, fInfra)
+}
 
-	spec.CreatedBy = r.Header.Get(USER_HEADER)
+// readUpload copies the file uploaded as field to a temporary file, and returns it and its
+// content. It returns a nil file if nothing was uploaded as field.
+func readUpload(r *http.Request, field string) (*os.File, []byte, error) {
+	upload, _, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		log.Debugf("no %s file param", field)
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer upload.Close()
+	f, err := os.CreateTemp("", "temp-values")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(f, upload); err != nil {
+		removeUploads([]*os.File{f})
+		return nil, nil, err
+	}
+	content, err := os.ReadFile(f.Name())
+	if err != nil {
+		removeUploads([]*os.File{f})
+		return nil, nil, err
+	}
+	return f, content, nil
+}
 
+// startCreate takes a create request whose form and uploaded files have been read, names it, and
+// runs it through the catalog, authorization, policy and quota checks. It then claims a prewarmed
+// workspace for it, or places it and starts creating it in the background. request names the
+// request in the logs. It writes the error response and returns false if the request is refused
+// or fails; otherwise it returns the workspace's ID, and whether it's a prewarmed workspace that
+// was claimed. The uploaded files are removed once they're no longer needed.
+func startCreate(w http.ResponseWriter, r *http.Request, spec *api.Spec, request string, uploads ...*os.File) (id api.ID, claimed bool, ok bool) {
+	started := false
+	defer func() {
+		if !started {
+			removeUploads(uploads)
+		}
+	}()
+
+	spec.CreatedBy = User(r)
+
+	requestedName := spec.Name
 	if spec.Name == "" {
 		spec.Name = util.Name()
 	}
@@ -210,12 +519,35 @@ func AsyncCreationRequest(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, html.EscapeString("contains invalid character or is too long, must fit this regex ^[a-z0-9]([-a-z0-9]{1,61}[a-z0-9]{1})$"))
 		log.Errorf("invalid name: %v", spec.Name)
-		return
+		return "", false, false
+	}
+	if !prepareSpec(w, spec) {
+		return "", false, false
+	}
+	action, ok := authorizeCreate(w, r, spec)
+	if !ok {
+		return "", false, false
+	}
+	if !checkProgramSource(w, r, spec) {
+		return "", false, false
+	}
+	event := auditEvent(r, action, api.ID(spec.Name))
+	if !checkPolicy(w, r, spec, event) {
+		return "", false, false
+	}
+	release, ok := reserveQuota(w, r, spec, event)
+	if !ok {
+		return "", false, false
+	}
+	// A claimed prewarmed workspace keeps its pool name, and gets the requested one as an alias.
+	var alias string
+	if requestedName != "" {
+		alias = spec.Name
 	}
 
 	log.WithFields(log.Fields{
 		"canonical":          "true",
-		"request":            "create-api",
+		"request":            request,
 		"name":               spec.Name,
 		"createdBy":          spec.CreatedBy,
 		"expiry":             spec.Expiry,
@@ -226,29 +558,243 @@ func AsyncCreationRequest(w http.ResponseWriter, r *http.Request) {
 		"helmVersion":        spec.HelmVersion,
 		"disableNotebooks":   spec.DisableNotebooks,
 		"clusterStack":       spec.ClusterStack,
+		"labels":             spec.Labels,
 		"valuesYAML":         spec.ValuesYAML,
-		"valuesYAMLContent":  spec.ValuesYAMLContent,
-		"infraJSON":          spec.ValuesYAML,
-		"infraJSONContent":   contentInfra,
+		"valuesYAMLBytes":    len(spec.ValuesYAMLContent),
+		"infraJSON":          spec.InfraJSON,
+		"infraJSONBytes":     len(spec.InfraJSONContent),
 		"backend":            spec.Backend,
+		"programRepo":        spec.ProgramRepo,
+		"programRef":         spec.ProgramRef,
 	}).Infof("create parameters")
 
+	if id, ok := claimPrewarmed(spec, alias); ok {
+		// The claim records its own owner, of the prewarmed workspace.
+		release()
+		event.Action, event.Workspace = "claim", id
+		audit.Done(event, nil)
+		return id, true, true
+	}
+	unplace, ok := placeSpec(w, spec)
+	if !ok {
+		release()
+		return "", false, false
+	}
+	event = audit.Accept(event)
+
 	// TODO: This is a bit of a hack
-	go func(spec api.Spec, f *os.File, fInfra *os.File) {
-		_, err = pulumi_backends.Create(&spec)
+	started = true
+	go func(spec api.Spec) {
+		defer removeUploads(uploads)
+		_, err := pulumi_backends.Create(context.Background(), &spec)
+		audit.Done(event, err)
 		if err != nil {
+			// The workspace wasn't created, so it gives back its place and its quota.
+			unplace()
+			release()
 			log.Errorf("create handler: %v", err)
-			return
 		}
+	}(*spec)
+	return api.ID(spec.Name), false, true
+}
+
+// removeUploads closes and removes the temporary files a create request's uploads were copied to.
+func removeUploads(uploads []*os.File) {
+	for _, f := range uploads {
 		if f != nil {
-			defer os.Remove(f.Name())
-			defer f.Close()
+			f.Close()
+			os.Remove(f.Name())
 		}
-		if fInfra != nil {
-			defer os.Remove(fInfra.Name())
-			defer fInfra.Close()
+	}
+}
+
+// prepareSpec checks a create request against the backend catalog and the cluster stack it deploys
+// into, filling in defaults, and writes the error response if it's invalid.
+func prepareSpec(w http.ResponseWriter, spec *api.Spec) bool {
+	c, ok := backends(w)
+	if !ok {
+		return false
+	}
+	if err := c.Prepare(spec); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Infof("rejected create request: %v", err)
+		return false
+	}
+	if err := pulumi_backends.CheckClusterStack(spec, c); err != nil {
+		if errors.Is(err, pulumi_backends.ErrInvalidClusterStack) || errors.Is(err, pulumi_backends.ErrInvalidExpiry) {
+			w.WriteHeader(400)
+			fmt.Fprint(w, html.EscapeString(err.Error()))
+			log.Infof("rejected create request: %v", err)
+			return false
+		}
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error checking cluster stack")
+		log.Errorf("check cluster stack: %v", err)
+		return false
+	}
+	return true
+}
+
+// placeSpec places a workspace that doesn't name a cluster stack in one from the cluster pool, and
+// writes the error response if it can't be. The caller must call release if the workspace isn't
+// created after all.
+func placeSpec(w http.ResponseWriter, spec *api.Spec) (release func(), ok bool) {
+	clusterStack := spec.ClusterStack
+	undo, err := placement.Place(spec)
+	if err == nil && spec.ClusterStack != clusterStack {
+		// The pool's clusters bound the workspace's expiry just like one it named.
+		if err = pulumi_backends.CheckClusterStack(spec, backendCatalog); err != nil {
+			if err := undo(); err != nil {
+				log.Errorf("release placement of %v: %v", spec.Name, err)
+			}
 		}
-	}(spec, f, fInfra)
+	}
+	switch {
+	case errors.Is(err, placement.ErrInvalidValues), errors.Is(err, pulumi_backends.ErrInvalidExpiry):
+		w.WriteHeader(400)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Infof("rejected create request: %v", err)
+		return nil, false
+	case errors.Is(err, placement.ErrNoCapacity):
+		w.WriteHeader(503)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Warnf("create request: %v", err)
+		return nil, false
+	case err != nil:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error placing workspace")
+		log.Errorf("place workspace: %v", err)
+		return nil, false
+	}
+	return func() {
+		if err := undo(); err != nil {
+			log.Errorf("release placement of %v: %v", spec.Name, err)
+		}
+	}, true
+}
+
+// checkPolicy checks a create request against the policy rules, and writes the violations as the
+// response and audits the denial if it breaks any.
+func checkPolicy(w http.ResponseWriter, r *http.Request, spec *api.Spec, event api.AuditEvent) bool {
+	err := policy.Evaluate(spec)
+	if err == nil {
+		return true
+	}
+	var violations *policy.Error
+	if !errors.As(err, &violations) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error checking policy")
+		log.Errorf("check policy: %v", err)
+		return false
+	}
+	event.Result, event.Error = audit.Denied, err.Error()
+	audit.Record(event)
+	log.WithFields(log.Fields{
+		"canonical":  "true",
+		"request":    "policy",
+		"name":       spec.Name,
+		"user":       User(r),
+		"violations": len(violations.Violations),
+	}).Infof("rejected create request: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(violations.Response())
+	return false
+}
+
+// reserveQuota checks that the workspace spec describes keeps its creator within their quota, and
+// reserves it for them so that other creates count it while it's created. It writes the error
+// response and audits the denial if not. Admins aren't limited. The caller must call release if
+// the workspace isn't created after all.
+func reserveQuota(w http.ResponseWriter, r *http.Request, spec *api.Spec, event api.AuditEvent) (release func(), ok bool) {
+	token := caller(r)
+	if auth.Role(token) == auth.RoleAdmin {
+		return func() {}, true
+	}
+	undo, err := quota.Reserve(spec)
+	if err == nil {
+		return func() {
+			if err := undo(); err != nil {
+				log.Errorf("release quota reservation of %v: %v", spec.Name, err)
+			}
+		}, true
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, pulumi_backends.ErrInvalidExpiry):
+		w.WriteHeader(400)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Infof("rejected create request: %v", err)
+		return nil, false
+	case errors.Is(err, quota.ErrNotAllowed):
+		status = http.StatusForbidden
+	case errors.Is(err, quota.ErrExceeded):
+		status = http.StatusTooManyRequests
+	default:
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "error checking quota")
+		log.Errorf("check quota: %v", err)
+		return nil, false
+	}
+	event.Result, event.Error = audit.Denied, err.Error()
+	audit.Record(event)
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "quota",
+		"name":      spec.Name,
+		"user":      token.Identity,
+		"backend":   spec.Backend,
+		"expiry":    spec.Expiry,
+	}).Infof("create request over quota: %v", err)
+	w.WriteHeader(status)
+	fmt.Fprint(w, html.EscapeString(err.Error()))
+	return nil, false
+}
+
+// QuotaRequest returns what the caller, or for admins the user query value, has against their
+// quota and their teams'.
+func QuotaRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := User(r)
+	if u := r.URL.Query().Get("user"); u != "" && u != user {
+		token, _ := r.Context().Value(tokenContextKey).(*api.Token)
+		if token == nil || auth.Role(token) != auth.RoleAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "only admins can see other users' quotas")
+			return
+		}
+		user = u
+	}
+	res, err := quota.Usage(user)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting quota usage")
+		log.Errorf("quota handler: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// claimPrewarmed hands the request a prewarmed workspace, if there's a ready one that matches it.
+func claimPrewarmed(spec *api.Spec, alias string) (api.ID, bool) {
+	id, err := pool.Claim(spec, alias)
+	if err != nil {
+		if errors.Is(err, pool.ErrNoMatch) || errors.Is(err, pool.ErrNoneReady) || errors.Is(err, pulumi_backends.ErrAliasTaken) {
+			log.Debugf("not claiming a prewarmed workspace: %v", err)
+		} else {
+			log.Errorf("claim prewarmed workspace: %v", err)
+		}
+		return "", false
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "claim",
+		"id":        id,
+		"alias":     alias,
+		"createdBy": spec.CreatedBy,
+	}).Info("claimed prewarmed workspace")
+	return id, true
 }
 
 func IsExpiredRequest(w http.ResponseWriter, r *http.Request) {
@@ -268,12 +814,44 @@ func IsExpiredRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 // TODO: pick delete or destroy, not both
+//
+// DeleteRequest refuses to destroy a cluster stack that workspaces are deployed into, unless
+// cascade=true asks for them to be destroyed first. Users may only delete their own workspaces.
 func DeleteRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(r)
 	id := api.ID(vars["workspaceId"])
+	if !authorizeWorkspace(w, r, "delete", id) {
+		return
+	}
 
-	err := pulumi_backends.Destroy(id)
+	destroy := pulumi_backends.Destroy
+	if r.FormValue("cascade") == "true" {
+		// The caller must be able to delete everything the cascade would.
+		deps, err := pulumi_backends.CascadeDependents(r.Context(), id)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error listing dependents")
+			log.Errorf("delete handler: %v", err)
+			return
+		}
+		for _, d := range deps {
+			if !authorizeWorkspace(w, r, "delete", d) {
+				return
+			}
+		}
+		destroy = pulumi_backends.DestroyCascade
+	}
+	event := auditEvent(r, "delete", id)
+	// Not the request's context: a client that hangs up shouldn't interrupt the destroy.
+	err := destroy(context.Background(), id)
+	audit.Done(event, err)
+	if errors.Is(err, pulumi_backends.ErrHasDependents) || errors.Is(err, pulumi_backends.ErrWorkspaceBusy) {
+		w.WriteHeader(409)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		log.Infof("delete handler: %v", err)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, "error destroying stack")
@@ -283,193 +861,500 @@ func DeleteRequest(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-func UIListWorkspace(w http.ResponseWriter, r *http.Request) {
-	var res *api.ListResponse
-	res, err := pulumi_backends.List()
+// BackendsRequest lists the backends a workspace can be created with, and the parameters each
+// takes.
+func BackendsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := backends(w)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+// HistoryRequest lists every update of a workspace, newest first.
+func HistoryRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := api.ID(vars["workspaceId"])
+	res, err := pulumi_backends.History(id)
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintf(w, "error listing stacks")
-		log.Errorf("ui list handler: %v", err)
+		fmt.Fprintf(w, "error getting history for stack")
+		log.Errorf("history handler: %v", err)
 		return
 	}
-	tmpl := template.Must(template.ParseFiles("templates/list.tmpl"))
-	if err := tmpl.Execute(w, res); err != nil {
-		panic(err)
-	}
+	json.NewEncoder(w).Encode(res)
 }
 
-func UIRootHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl := template.Must(template.ParseFiles("templates/create.html"))
-	if err := tmpl.Execute(w, nil); err != nil {
-		panic(err)
+// RollbackRequest deploys a workspace again with the config of the successful update given by the
+// version form value. It returns once the rollback has started.
+func RollbackRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	if !authorizeWorkspace(w, r, "rollback", id) {
+		return
+	}
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "invalid version %q", html.EscapeString(r.FormValue("version")))
+		return
 	}
+	history, err := pulumi_backends.History(id)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting history for stack")
+		log.Errorf("rollback handler: %v", err)
+		return
+	}
+	found := false
+	for _, u := range history.Updates {
+		found = found || (u.Version == version && u.Kind == "update" && u.Result == "succeeded")
+	}
+	if !found {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "workspace has no successful update with version %d", version)
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "rollback",
+		"id":        id,
+		"version":   version,
+		"user":      User(r),
+	}).Info("rollback requested")
+	event := auditEvent(r, "rollback", id)
+	event = audit.Accept(event)
+	go func() {
+		err := pulumi_backends.Rollback(id, version)
+		audit.Done(event, err)
+		if err != nil {
+			log.Errorf("rollback handler: %v", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func UIGetWorkspace(w http.ResponseWriter, r *http.Request) {
+// DriftRequest returns the result of the last drift check of a workspace, with the resources that
+// no longer match what helium deployed.
+func DriftRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(r)
-	id := api.ID(vars["workspaceId"])
-	var res *api.GetConnectionInfoResponse
-	res, err := pulumi_backends.GetConnectionInfo(id)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	res, err := pulumi_backends.GetDrift(id)
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintf(w, "error getting connection info for stack")
-		log.Errorf("getConnInfo handler: %v", err)
+		fmt.Fprintf(w, "error getting drift for stack")
+		log.Errorf("drift handler: %v", err)
 		return
 	}
-
-	tmpl := template.Must(template.ParseFiles("templates/get.tmpl"))
-	if err := tmpl.Execute(w, res.Workspace); err != nil {
-		panic(err)
+	if res == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "workspace hasn't been checked for drift")
+		return
 	}
+	json.NewEncoder(w).Encode(res)
 }
 
-func UICreation(w http.ResponseWriter, r *http.Request) {
-	log.SetReportCaller(true)
-	log.SetLevel(log.DebugLevel)
-
-	var spec api.Spec
-	var err error
+// ReapplyRequest deploys a workspace again with the config it was last deployed with, putting back
+// anything that has drifted. It returns once the reapply has started.
+func ReapplyRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	if !authorizeWorkspace(w, r, "reapply", id) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "reapply",
+		"id":        id,
+		"user":      User(r),
+	}).Info("reapply requested")
+	event := auditEvent(r, "reapply", id)
+	event = audit.Accept(event)
+	go func() {
+		err := pulumi_backends.Reapply(id)
+		audit.Done(event, err)
+		if err != nil {
+			log.Errorf("reapply handler: %v", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
 
-	err = r.ParseMultipartForm(32 << 20)
+// CredentialsRequest returns a workspace's own credentials, to its owner only.
+func CredentialsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	token, ok := r.Context().Value(tokenContextKey).(*api.Token)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	md, err := pulumi_backends.GetMetadata(id)
+	if errors.Is(err, pulumi_backends.ErrStackNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "no such workspace")
+		return
+	}
 	if err != nil {
-		log.Errorf("Error parsing form: %v", err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting workspace owner")
+		log.Errorf("credentials handler: %v", err)
+		return
 	}
-	err = decoder.Decode(&spec, r.PostForm)
+	if err := auth.CanReveal(token, md.CreatedBy); err != nil {
+		logDenial(token, "reveal-credentials", id, err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, html.EscapeString(err.Error()))
+		return
+	}
+	event := auditEvent(r, "reveal-credentials", id)
+	creds, err := pulumi_backends.Credentials(id)
+	audit.Done(event, err)
 	if err != nil {
-		log.Errorf("Error decoding form: %v", err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting credentials")
+		log.Errorf("credentials handler: %v", err)
+		return
 	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "credentials",
+		"id":        id,
+		"user":      token.Identity,
+	}).Info("credentials revealed")
+	json.NewEncoder(w).Encode(&api.CredentialsResponse{ID: id, Credentials: creds})
+}
 
-	file, _, err := r.FormFile("valuesYaml")
-	if err != nil {
-		if strings.Contains(err.Error(), "no such file") {
-			log.Debug("no file param")
-		} else {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("Error reading FormFile: %v", err)
+// RotateCredentialsRequest deploys a workspace again with new credentials, in the background.
+func RotateCredentialsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	if !authorizeWorkspace(w, r, "rotate-credentials", id) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "rotate-credentials",
+		"id":        id,
+		"user":      User(r),
+	}).Info("credential rotation requested")
+	event := auditEvent(r, "rotate-credentials", id)
+	event = audit.Accept(event)
+	go func() {
+		err := pulumi_backends.RotateCredentials(id)
+		audit.Done(event, err)
+		if err != nil {
+			log.Errorf("rotate credentials handler: %v", err)
 		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfigRequest returns the server's settings, with anything secret redacted.
+func ConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if serverConfig == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "server config isn't set")
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serverConfig.Redacted())
+}
 
-	fileInfra, _, err := r.FormFile("infraJson")
+// ReconcileRequest asks the controlplane to look at a workspace now, rather than when it's next
+// due, such as after changing its expiry.
+func ReconcileRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	id := pulumi_backends.Resolve(api.ID(vars["workspaceId"]))
+	event := auditEvent(r, "reconcile", id)
+	err := controlplane.RequestReconcile(id)
+	audit.Done(event, err)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file") {
-			log.Debug("no file param")
-		} else {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("Error reading FormFile: %v", err)
-		}
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error requesting reconcile")
+		log.Errorf("reconcile handler: %v", err)
+		return
 	}
-	var content []byte
-	var f *os.File
-	if file != nil {
-		f, err = os.CreateTemp("", "temp-values")
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error creating temp file: %v", err)
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "reconcile",
+		"id":        id,
+		"user":      User(r),
+	}).Info("reconcile requested")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResyncRequest asks the controlplane to look at every workspace now.
+func ResyncRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	event := auditEvent(r, "resync", "")
+	err := controlplane.RequestResync()
+	audit.Done(event, err)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error requesting resync")
+		log.Errorf("resync handler: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "resync",
+		"user":      User(r),
+	}).Info("resync requested")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// IssueTokenRequest issues an API token acting as the identity form value, with the comma
+// separated scopes form value, lasting the ttl form value or auth.DefaultTTL. The response has the
+// token's secret, which can't be had again.
+func IssueTokenRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "invalid ttl %q", html.EscapeString(v))
 			return
 		}
-		_, err = io.Copy(f, file)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
+	}
+	var scopes []string
+	for _, s := range strings.Split(r.FormValue("scopes"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
 		}
-		content, err = ioutil.ReadFile(f.Name())
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
+	}
+	event := auditEvent(r, "issue-token", "")
+	token, secret, err := auth.Issue(r.FormValue("identity"), scopes, ttl, User(r), time.Now())
+	if token != nil {
+		event.Params["tokenId"] = token.ID
+	}
+	audit.Done(event, err)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidRequest) {
+			w.WriteHeader(400)
+			fmt.Fprint(w, html.EscapeString(err.Error()))
 			return
 		}
-		spec.ValuesYAML = f.Name()
-		spec.ValuesYAMLContent = content
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error issuing token")
+		log.Errorf("issue token handler: %v", err)
+		return
 	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "issue-token",
+		"tokenId":   token.ID,
+		"identity":  token.Identity,
+		"scopes":    strings.Join(token.Scopes, ","),
+		"expiresAt": token.ExpiresAt,
+		"user":      User(r),
+	}).Info("token issued")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&api.IssueTokenResponse{Token: *token, Secret: secret})
+}
 
-	var contentInfra []byte
-	var fInfra *os.File
-	if fileInfra != nil {
-		fInfra, err = os.CreateTemp("", "temp-values")
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error creating temp file: %v", err)
+// ListTokensRequest lists the API tokens that haven't been revoked, without their secrets.
+func ListTokensRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tokens, err := auth.List()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error listing tokens")
+		log.Errorf("list tokens handler: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(&api.ListTokensResponse{Tokens: tokens})
+}
+
+// RevokeTokenRequest revokes an API token, which stops working immediately.
+func RevokeTokenRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["tokenId"]
+	event := auditEvent(r, "revoke-token", "")
+	event.Params["tokenId"] = id
+	err := auth.Revoke(id)
+	audit.Done(event, err)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoSuchToken) {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "no such token")
 			return
 		}
-		_, err = io.Copy(fInfra, fileInfra)
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
-			return
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error revoking token")
+		log.Errorf("revoke token handler: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "revoke-token",
+		"tokenId":   id,
+		"user":      User(r),
+	}).Info("token revoked")
+	w.WriteHeader(200)
+}
+
+// AuditRequest returns audit events, to admins only, newest first, filtered by the actor, action,
+// workspace, result, since and until (RFC 3339) query values. It returns at most limit events,
+// 100 by default, unless format=jsonl exports every one as JSON lines.
+func AuditRequest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Actor:     q.Get("actor"),
+		Action:    q.Get("action"),
+		Workspace: api.ID(q.Get("workspace")),
+		Result:    q.Get("result"),
+		Request:   q.Get("request"),
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "invalid %s %q, want RFC 3339", name, html.EscapeString(v))
+				return
+			}
 		}
-		contentInfra, err = ioutil.ReadFile(fInfra.Name())
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "failed to upload file: %v", err)
-			log.Errorf("error copying file: %v", err)
+	}
+	jsonl := q.Get("format") == "jsonl"
+	if !jsonl {
+		f.Limit = 100
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "invalid limit %q", html.EscapeString(v))
 			return
 		}
+		f.Limit = n
+	}
+	events, err := audit.Query(f)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error querying audit log")
+		log.Errorf("audit handler: %v", err)
+		return
+	}
+	if jsonl {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="helium-audit.jsonl"`)
+		enc := json.NewEncoder(w)
+		for i := range events {
+			enc.Encode(&events[i])
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&api.AuditResponse{Events: events})
+}
 
-		spec.InfraJSON = fInfra.Name()
-		spec.InfraJSONContent = contentInfra
+// OrphansRequest returns the cloud resources the controlplane last found labelled with workspaces
+// that no longer exist.
+func OrphansRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := controlplane.GetOrphanReport()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting orphan report")
+		log.Errorf("orphans handler: %v", err)
+		return
+	}
+	if res == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "no orphan report yet")
+		return
 	}
-	spec.CreatedBy = r.Header.Get(USER_HEADER)
+	json.NewEncoder(w).Encode(res)
+}
 
-	if spec.Name == "" {
-		spec.Name = util.Name()
+// DecisionsRequest returns the last thing the deletion controller decided to do with each stack
+// that was due for deletion, and why, newest first.
+func DecisionsRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res, err := controlplane.GetDecisions()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting deletion decisions")
+		log.Errorf("decisions handler: %v", err)
+		return
 	}
-	spec.Name = strings.ToLower(spec.Name)
-	if badChar := validNameCharacters.FindString(spec.Name); badChar == "" {
+	if res == nil {
+		res = []controlplane.Decision{}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func UIListWorkspace(w http.ResponseWriter, r *http.Request) {
+	var res *api.ListResponse
+	res, err := pulumi_backends.List()
+	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintf(w, html.EscapeString("contains invalid character or is too long, must fit this regex ^[a-z0-9]([-a-z0-9]{1,61}[a-z0-9]{1})$"))
-		log.Errorf("invalid name: %v", spec.Name)
+		fmt.Fprintf(w, "error listing stacks")
+		log.Errorf("ui list handler: %v", err)
 		return
 	}
+	tmpl := template.Must(template.ParseFiles("templates/list.tmpl"))
+	if err := tmpl.Execute(w, res); err != nil {
+		panic(err)
+	}
+}
 
-	log.WithFields(log.Fields{
-		"canonical":          "true",
-		"request":            "create-ui",
-		"name":               spec.Name,
-		"createdBy":          spec.CreatedBy,
-		"expiry":             spec.Expiry,
-		"pachdVersion":       spec.PachdVersion,
-		"consoleVersion":     spec.ConsoleVersion,
-		"notebooksVersion":   spec.NotebooksVersion,
-		"mountServerVersion": spec.MountServerVersion,
-		"helmVersion":        spec.HelmVersion,
-		"disableNotebooks":   spec.DisableNotebooks,
-		"clusterStack":       spec.ClusterStack,
-		"valuesYAML":         spec.ValuesYAML,
-		"valuesYAMLContent":  spec.ValuesYAMLContent,
-		"infraJSON":          spec.ValuesYAML,
-		"infraJSONContent":   contentInfra,
-		"backend":            spec.Backend,
-	}).Infof("create parameters")
+func UIRootHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	c, ok := backends(w)
+	if !ok {
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/create.html"))
+	if err := tmpl.Execute(w, c); err != nil {
+		panic(err)
+	}
+}
 
-	// TODO: This is a bit of a hack
-	go func(spec api.Spec, f *os.File, fInfra *os.File) {
-		_, err = pulumi_backends.Create(&spec)
-		if err != nil {
-			log.Errorf("create handler: %v", err)
-			return
-		}
-		if f != nil {
-			defer os.Remove(f.Name())
-			defer f.Close()
-		}
-		if fInfra != nil {
-			defer os.Remove(fInfra.Name())
-			defer fInfra.Close()
-		}
-	}(spec, f, fInfra)
+func UIGetWorkspace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := api.ID(vars["workspaceId"])
+	var res *api.GetConnectionInfoResponse
+	res, err := pulumi_backends.GetConnectionInfo(id)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error getting connection info for stack")
+		log.Errorf("getConnInfo handler: %v", err)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/get.tmpl"))
+	if err := tmpl.Execute(w, res.Workspace); err != nil {
+		panic(err)
+	}
+}
+
+func UICreation(w http.ResponseWriter, r *http.Request) {
+	log.SetReportCaller(true)
+	log.SetLevel(log.DebugLevel)
+
+	id, claimed, ok := createFromForm(w, r, "create-ui")
+	if !ok {
+		return
+	}
+	if claimed {
+		http.Redirect(w, r, "/get/"+string(id), http.StatusSeeOther)
+		return
+	}
 	// Set the first requests data to creating, because a list lookup will race condition and fail.
 	// Meta refresh on template of ~10 seconds is plenty of time to make next list condition work.
 	res2 := &api.ConnectionInfo{
-		ID:     api.ID(spec.Name),
+		ID:     id,
 		Status: "creating",
 	}
 
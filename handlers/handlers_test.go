@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/auth"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestAuthorizeProtection(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	admin := &api.Token{Identity: "boss@example.com", Scopes: []string{auth.ScopeAdmin}}
+	user := &api.Token{Identity: "dev@example.com", Scopes: []string{auth.ScopeWrite}}
+	protected := map[string]string{"protected": "true", "team": "core"}
+	for _, test := range []struct {
+		name   string
+		token  *api.Token
+		labels map[string]string
+		spec   string
+		want   int
+	}{
+		{"user, unprotected", user, nil, "team=core", http.StatusOK},
+		{"user, keeping protection", user, protected, "protected,team=core", http.StatusOK},
+		{"user, protecting", user, nil, "protected=true", http.StatusForbidden},
+		{"user, unprotecting", user, protected, "team=core", http.StatusForbidden},
+		{"user, unprotecting with false", user, protected, "protected=false", http.StatusForbidden},
+		{"admin, protecting", admin, nil, "protected", http.StatusOK},
+		{"admin, unprotecting", admin, protected, "", http.StatusOK},
+	} {
+		r := withUser(httptest.NewRequest("POST", "/v1/api/workspace", nil), test.token)
+		w := httptest.NewRecorder()
+		authorizeProtection(w, r, "update", test.labels, &api.Spec{Name: "example", Labels: test.spec})
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestUIAuthMiddlewareWithoutOIDC(t *testing.T) {
+	auth.Configure(&config.Config{Admins: []string{"boss@example.com"}})
+	defer auth.Configure(&config.Config{})
+	var token *api.Token
+	h := UIAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = caller(r)
+	}))
+	r := httptest.NewRequest("POST", "/create", nil)
+	r.Header.Set(USER_HEADER, "boss@example.com")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if token.Identity != "boss@example.com" || auth.Role(token) != auth.RoleViewer {
+		t.Errorf("proxy header gave %q the %s role, want a viewer", token.Identity, auth.Role(token))
+	}
+}
+
+func TestStartCreateRemovesUploadsWhenRefused(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "temp-values")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := withUser(httptest.NewRequest("POST", "/v1/api/workspace", nil), &api.Token{Identity: "dev@example.com"})
+	w := httptest.NewRecorder()
+	if _, _, ok := startCreate(w, r, &api.Spec{Name: "not_a_name"}, "create-api", f, nil); ok {
+		t.Fatalf("startCreate of an invalid name succeeded")
+	}
+	if _, err := os.Stat(f.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("upload of a refused create wasn't removed: %v", err)
+	}
+}
+
+func TestReadUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("valuesYaml", "values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("pachd:\n  enabled: true\n"))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/v1/api/workspace", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	f, content, err := readUpload(r, "valuesYaml")
+	if err != nil {
+		t.Fatalf("readUpload: %v", err)
+	}
+	defer removeUploads([]*os.File{f})
+	if string(content) != "pachd:\n  enabled: true\n" {
+		t.Errorf("readUpload content = %q", content)
+	}
+	if f, _, err := readUpload(r, "infraJson"); f != nil || err != nil {
+		t.Errorf("readUpload of a missing file = %v, %v; want nothing", f, err)
+	}
+
+	// A form without uploads has no files, rather than failing.
+	r = httptest.NewRequest("POST", "/v1/api/workspace", strings.NewReader("name=dev"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if f, _, err := readUpload(r, "valuesYaml"); f != nil || err != nil {
+		t.Errorf("readUpload of a url encoded form = %v, %v; want nothing", f, err)
+	}
+}
+
+func TestCreateFromFormRefusesUnreadableUpload(t *testing.T) {
+	// The body ends before the upload does.
+	body := "--b\r\nContent-Disposition: form-data; name=\"valuesYaml\"; filename=\"values.yaml\"\r\n\r\npachd:"
+	r := httptest.NewRequest("POST", "/v1/api/workspace", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+	r = withUser(r, &api.Token{Identity: "dev@example.com"})
+	w := httptest.NewRecorder()
+	if _, _, ok := createFromForm(w, r, "create-api"); ok {
+		t.Fatal("createFromForm of a truncated upload succeeded")
+	}
+	if w.Code != 500 || !strings.HasPrefix(w.Body.String(), "failed to upload file") {
+		t.Errorf("createFromForm of a truncated upload wrote %d %q, want a single upload failure", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,266 @@
+// Package inventory lists the cloud resources that belong to workspaces, so that resources left
+// behind by destroyed stacks can be found. Workspace programs label every resource they create with
+// WorkspaceLabel; DNS records, which can't be labelled, are recognised by their name instead.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+)
+
+// WorkspaceLabel is the label, holding the workspace ID, on every resource a workspace creates.
+const WorkspaceLabel = "helium-workspace"
+
+// Resource is a cloud resource that belongs to a workspace.
+type Resource struct {
+	// Kind is "namespace", "bucket", "node-pool" or "dns-record".
+	Kind string
+	// Location is where the resource lives, such as a kube context, project or DNS zone.
+	Location  string
+	Name      string
+	Workspace api.ID
+	// CreatedAt is zero if the cloud doesn't report it.
+	CreatedAt time.Time
+}
+
+func (r Resource) String() string {
+	return fmt.Sprintf("%v %v/%v", r.Kind, r.Location, r.Name)
+}
+
+// Inventory lists and deletes one kind of resource in one place.
+type Inventory interface {
+	// Name identifies the inventory in logs and reports.
+	Name() string
+	// List returns every resource labelled with a workspace.
+	List(ctx context.Context) ([]Resource, error)
+	Delete(ctx context.Context, r Resource) error
+}
+
+// run runs a command and returns its stdout. Tests replace it.
+var run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v %v: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Namespaces lists workspace namespaces in one Kubernetes cluster, with kubectl.
+type Namespaces struct {
+	KubeContext string
+}
+
+func (n Namespaces) Name() string { return "namespaces/" + n.KubeContext }
+
+func (n Namespaces) List(ctx context.Context) ([]Resource, error) {
+	out, err := run(ctx, "kubectl", "--context", n.KubeContext, "get", "namespaces", "-l", WorkspaceLabel, "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name              string            `json:"name"`
+				Labels            map[string]string `json:"labels"`
+				CreationTimestamp time.Time         `json:"creationTimestamp"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse namespaces: %w", err)
+	}
+	var res []Resource
+	for _, i := range list.Items {
+		res = append(res, Resource{
+			Kind:      "namespace",
+			Location:  n.KubeContext,
+			Name:      i.Metadata.Name,
+			Workspace: api.ID(i.Metadata.Labels[WorkspaceLabel]),
+			CreatedAt: i.Metadata.CreationTimestamp,
+		})
+	}
+	return res, nil
+}
+
+func (n Namespaces) Delete(ctx context.Context, r Resource) error {
+	_, err := run(ctx, "kubectl", "--context", n.KubeContext, "delete", "namespace", r.Name, "--wait=false")
+	return err
+}
+
+// Buckets lists workspace storage buckets in one GCP project, with gcloud.
+type Buckets struct {
+	Project string
+}
+
+func (b Buckets) Name() string { return "buckets/" + b.Project }
+
+func (b Buckets) List(ctx context.Context) ([]Resource, error) {
+	out, err := run(ctx, "gcloud", "storage", "buckets", "list", "--project", b.Project,
+		"--filter", "labels."+WorkspaceLabel+":*", "--format", "json(name,labels,creation_time)")
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Name         string            `json:"name"`
+		Labels       map[string]string `json:"labels"`
+		CreationTime string            `json:"creation_time"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse buckets: %w", err)
+	}
+	var res []Resource
+	for _, i := range list {
+		created, _ := time.Parse(time.RFC3339, i.CreationTime)
+		res = append(res, Resource{
+			Kind:      "bucket",
+			Location:  b.Project,
+			Name:      i.Name,
+			Workspace: api.ID(i.Labels[WorkspaceLabel]),
+			CreatedAt: created,
+		})
+	}
+	return res, nil
+}
+
+func (b Buckets) Delete(ctx context.Context, r Resource) error {
+	_, err := run(ctx, "gcloud", "storage", "rm", "--recursive", "--project", b.Project, "gs://"+r.Name)
+	return err
+}
+
+// NodePools lists workspace node pools in one GKE cluster, with gcloud.
+type NodePools struct {
+	Project  string
+	Location string
+	Cluster  string
+}
+
+func (p NodePools) Name() string { return "node-pools/" + p.Location + "/" + p.Cluster }
+
+func (p NodePools) List(ctx context.Context) ([]Resource, error) {
+	out, err := run(ctx, "gcloud", "container", "node-pools", "list", "--project", p.Project,
+		"--location", p.Location, "--cluster", p.Cluster, "--format", "json(name,config.labels)")
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Name   string `json:"name"`
+		Config struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse node pools: %w", err)
+	}
+	var res []Resource
+	for _, i := range list {
+		w, ok := i.Config.Labels[WorkspaceLabel]
+		if !ok {
+			continue
+		}
+		res = append(res, Resource{
+			Kind:      "node-pool",
+			Location:  p.Location + "/" + p.Cluster,
+			Name:      i.Name,
+			Workspace: api.ID(w),
+		})
+	}
+	return res, nil
+}
+
+func (p NodePools) Delete(ctx context.Context, r Resource) error {
+	_, err := run(ctx, "gcloud", "container", "node-pools", "delete", r.Name, "--project", p.Project,
+		"--location", p.Location, "--cluster", p.Cluster, "--quiet", "--async")
+	return err
+}
+
+// DNSRecords lists the record sets in a Cloud DNS zone used only for workspaces, with gcloud. Each
+// record belongs to the workspace named by its label just below the zone's, so "ws-1.workspaces.example.com." and
+// "*.ws-1.workspaces.example.com." both belong to ws-1.
+type DNSRecords struct {
+	Project string
+	Zone    string
+}
+
+func (d DNSRecords) Name() string { return "dns-records/" + d.Zone }
+
+func (d DNSRecords) List(ctx context.Context) ([]Resource, error) {
+	zone, err := run(ctx, "gcloud", "dns", "managed-zones", "describe", d.Zone, "--project", d.Project, "--format", "value(dnsName)")
+	if err != nil {
+		return nil, err
+	}
+	suffix := "." + strings.TrimSpace(string(zone))
+	out, err := run(ctx, "gcloud", "dns", "record-sets", "list", "--project", d.Project, "--zone", d.Zone, "--format", "json(name,type)")
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse record sets: %w", err)
+	}
+	var res []Resource
+	for _, i := range list {
+		if !strings.HasSuffix(i.Name, suffix) {
+			// The zone apex, with its SOA and NS records.
+			continue
+		}
+		labels := strings.Split(strings.TrimSuffix(i.Name, suffix), ".")
+		res = append(res, Resource{
+			Kind:      "dns-record",
+			Location:  d.Zone,
+			Name:      i.Name + "/" + i.Type,
+			Workspace: api.ID(labels[len(labels)-1]),
+		})
+	}
+	return res, nil
+}
+
+func (d DNSRecords) Delete(ctx context.Context, r Resource) error {
+	name, typ, ok := strings.Cut(r.Name, "/")
+	if !ok {
+		return fmt.Errorf("invalid record %q", r.Name)
+	}
+	_, err := run(ctx, "gcloud", "dns", "record-sets", "delete", name, "--type", typ, "--project", d.Project, "--zone", d.Zone)
+	return err
+}
+
+// FromConfig returns the inventories in the config's orphans section: namespaces in each of its
+// kube contexts, and, in the GCP project, storage buckets if buckets is set, node pools in its
+// location/cluster pairs and record sets in its DNS zone.
+func FromConfig(c *config.Config) []Inventory {
+	var invs []Inventory
+	o, project := c.Orphans, c.GCP.Project
+	for _, kc := range o.KubeContexts {
+		invs = append(invs, Namespaces{KubeContext: kc})
+	}
+	if o.Buckets {
+		invs = append(invs, Buckets{Project: project})
+	}
+	for _, cl := range o.Clusters {
+		location, cluster, ok := strings.Cut(cl, "/")
+		if !ok {
+			log.Errorf("ignoring invalid cluster %q in orphans.clusters, want location/cluster", cl)
+			continue
+		}
+		invs = append(invs, NodePools{Project: project, Location: location, Cluster: cluster})
+	}
+	if o.DNSZone != "" {
+		invs = append(invs, DNSRecords{Project: project, Zone: o.DNSZone})
+	}
+	return invs
+}
@@ -0,0 +1,105 @@
+package inventory
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeRun replaces run with canned output, keyed by a prefix of the command line, and records every
+// command.
+func fakeRun(t *testing.T, outputs map[string]string) *[]string {
+	var calls []string
+	old := run
+	t.Cleanup(func() { run = old })
+	run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		cmd := strings.Join(append([]string{name}, args...), " ")
+		calls = append(calls, cmd)
+		for prefix, out := range outputs {
+			if strings.HasPrefix(cmd, prefix) {
+				return []byte(out), nil
+			}
+		}
+		return nil, nil
+	}
+	return &calls
+}
+
+func TestNamespaces(t *testing.T) {
+	calls := fakeRun(t, map[string]string{"kubectl --context c get": `{"items": [
+		{"metadata": {"name": "ws-1", "labels": {"helium-workspace": "ws-1"}, "creationTimestamp": "2023-01-01T00:00:00Z"}}
+	]}`})
+	n := Namespaces{KubeContext: "c"}
+	got, err := n.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []Resource{{Kind: "namespace", Location: "c", Name: "ws-1", Workspace: "ws-1", CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List (-want +got):\n%s", diff)
+	}
+	if err := n.Delete(context.Background(), got[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if last := (*calls)[len(*calls)-1]; last != "kubectl --context c delete namespace ws-1 --wait=false" {
+		t.Errorf("Delete ran %q", last)
+	}
+}
+
+func TestBucketsAndNodePools(t *testing.T) {
+	fakeRun(t, map[string]string{
+		"gcloud storage buckets": `[{"name": "ws-1-bucket", "labels": {"helium-workspace": "ws-1"}, "creation_time": "2023-01-01T00:00:00+00:00"}]`,
+		"gcloud container node-pools": `[
+			{"name": "default-pool", "config": {"labels": {}}},
+			{"name": "ws-2-pool", "config": {"labels": {"helium-workspace": "ws-2"}}}
+		]`,
+	})
+	buckets, err := Buckets{Project: "p"}.List(context.Background())
+	if err != nil {
+		t.Fatalf("List buckets: %v", err)
+	}
+	want := []Resource{{Kind: "bucket", Location: "p", Name: "ws-1-bucket", Workspace: "ws-1", CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	if diff := cmp.Diff(want, buckets); diff != "" {
+		t.Errorf("buckets (-want +got):\n%s", diff)
+	}
+	pools, err := NodePools{Project: "p", Location: "us-central1-a", Cluster: "c"}.List(context.Background())
+	if err != nil {
+		t.Fatalf("List node pools: %v", err)
+	}
+	want = []Resource{{Kind: "node-pool", Location: "us-central1-a/c", Name: "ws-2-pool", Workspace: "ws-2"}}
+	if diff := cmp.Diff(want, pools); diff != "" {
+		t.Errorf("node pools (-want +got):\n%s", diff)
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	calls := fakeRun(t, map[string]string{
+		"gcloud dns managed-zones": "workspaces.example.com.\n",
+		"gcloud dns record-sets list": `[
+			{"name": "workspaces.example.com.", "type": "SOA"},
+			{"name": "ws-1.workspaces.example.com.", "type": "A"},
+			{"name": "*.ws-1.workspaces.example.com.", "type": "CNAME"}
+		]`,
+	})
+	d := DNSRecords{Project: "p", Zone: "z"}
+	got, err := d.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	want := []Resource{
+		{Kind: "dns-record", Location: "z", Name: "ws-1.workspaces.example.com./A", Workspace: "ws-1"},
+		{Kind: "dns-record", Location: "z", Name: "*.ws-1.workspaces.example.com./CNAME", Workspace: "ws-1"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List (-want +got):\n%s", diff)
+	}
+	if err := d.Delete(context.Background(), got[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if last := (*calls)[len(*calls)-1]; last != "gcloud dns record-sets delete *.ws-1.workspaces.example.com. --type CNAME --project p --zone z" {
+		t.Errorf("Delete ran %q", last)
+	}
+}
@@ -1,35 +1,47 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime/debug"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/pachyderm/helium/auth"
+	"github.com/pachyderm/helium/catalog"
+	"github.com/pachyderm/helium/config"
 	"github.com/pachyderm/helium/controlplane"
 	"github.com/pachyderm/helium/handlers"
+	"github.com/pachyderm/helium/oidc"
+	"github.com/pachyderm/helium/placement"
+	"github.com/pachyderm/helium/policy"
+	"github.com/pachyderm/helium/pool"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/quota"
+	"github.com/pachyderm/helium/secrets"
 	psentry "github.com/pachyderm/helium/sentry"
-)
-
-const (
-	DEMO_PROJECT_ID       = "fancy-elephant-demos"
-	DEMO_GCP_ZONE         = "us-central1-a"
-	MINIMUM_PREWARM_COUNT = 2
-	SENTRY_DSN            = "***REMOVED***"
+	"github.com/pachyderm/helium/store"
 )
 
 func main() {
+	c, err := config.Load(config.File())
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
 	// Send error logs to Sentry.
 	if err := sentry.Init(sentry.ClientOptions{
-		Dsn:              SENTRY_DSN,
+		Dsn:              c.Sentry.DSN,
 		AttachStacktrace: false, // We do this ourselves.
-		Environment:      "dev",
+		Environment:      c.Sentry.Environment,
 		Release:          "v0.1",
 
 		// It would be nice to provide a Logrus logger (with 'log.WithField("source",
@@ -63,6 +75,8 @@ func main() {
 		}
 	}()
 
+	// Mask secrets before entries are written or sent to Sentry.
+	log.AddHook(psentry.RedactHook{})
 	log.AddHook(&psentry.Logrus{
 		EnabledLevels: []log.Level{
 			log.WarnLevel,
@@ -106,7 +120,7 @@ func main() {
 		}
 
 		// TODO: HACK
-		cmd = exec.Command("aws", "configure", "set", "region", "us-west-2")
+		cmd = exec.Command("aws", "configure", "set", "region", c.AWS.Region)
 		err = cmd.Run()
 		if err != nil {
 			log.Fatal(err)
@@ -122,10 +136,47 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	if mode == "API" || mode == "CONTROLPLANE" {
+		st, err := store.Open(c.StoreDir)
+		if err != nil {
+			log.Fatalf("store: %v", err)
+		}
+		store.SetDefault(st)
+	}
+	p, err := secrets.FromConfig(c.Secrets)
+	if err != nil {
+		log.Fatalf("secrets: %v", err)
+	}
+	secrets.SetDefault(p)
+	if mode == "API" || mode == "CONTROLPLANE" {
+		if err := pulumi_backends.CheckSecrets(context.Background()); err != nil {
+			log.Fatalf("secrets: %v", err)
+		}
+	}
+	pulumi_backends.Configure(c)
+	handlers.SetConfig(c)
+	auth.Configure(c)
+	policy.SetFile(c.Files.Policies)
+	if _, err := policy.LoadConfig(c.Files.Policies); err != nil {
+		log.Fatalf("policy: %v", err)
+	}
+	// The deletion controller protects the pinned stacks, so it mustn't start without them.
+	if _, err := controlplane.LoadPinnedConfig(c.Files.PinnedStacks); err != nil {
+		log.Fatalf("pinned stacks: %v", err)
+	}
+	quota.SetFile(c.Files.Quotas)
+	placement.SetFile(c.Files.ClusterPool)
+	pool.SetPoolsFile(c.Files.PrewarmPools)
+	cat, err := catalog.Load(c.Files.Backends)
+	if err != nil {
+		log.Fatalf("backend catalog: %v", err)
+	}
+	handlers.SetCatalog(cat)
+	pulumi_backends.EnsurePlugins()
 	if mode == "API" {
-		RunAPI()
+		RunAPI(c)
 	} else if mode == "CONTROLPLANE" {
-		RunControlplane()
+		RunControlplane(c)
 	} else {
 		log.Fatal("unknown mode of operation, please set the env var HELIUM_MODE")
 	}
@@ -139,19 +190,41 @@ func (a *App) Initialize() {
 	a.Router = mux.NewRouter()
 	a.Router.Use(handlers.SentryMiddleware)
 	a.Router.Use(handlers.LoggingMiddleware)
-	a.Router.HandleFunc("/", handlers.UIRootHandler)
+	a.Router.Handle("/", handlers.UIAuthMiddleware(http.HandlerFunc(handlers.UIRootHandler)))
 	a.Router.HandleFunc("/healthz", handlers.HealthCheck)
-	a.Router.HandleFunc("/get/{workspaceId}", handlers.UIGetWorkspace)
-	a.Router.HandleFunc("/create", handlers.UICreation)
-	a.Router.HandleFunc("/list", handlers.UIListWorkspace)
+	a.Router.Handle("/get/{workspaceId}", handlers.UIAuthMiddleware(http.HandlerFunc(handlers.UIGetWorkspace)))
+	a.Router.Handle("/create", handlers.UIAuthMiddleware(http.HandlerFunc(handlers.UICreation)))
+	a.Router.Handle("/list", handlers.UIAuthMiddleware(http.HandlerFunc(handlers.UIListWorkspace)))
+	if p := handlers.OIDC(); p != nil {
+		a.Router.HandleFunc(oidc.LoginPath, p.LoginHandler)
+		a.Router.HandleFunc(oidc.CallbackPath, p.CallbackHandler)
+		a.Router.HandleFunc(oidc.LogoutPath, p.LogoutHandler).Methods(http.MethodPost)
+	}
 
 	restRouter := a.Router.PathPrefix("/v1/api").Subrouter()
 	restRouter.Use(handlers.AuthMiddleware)
 	restRouter.HandleFunc("/workspaces", handlers.ListRequest).Methods("GET")
+	restRouter.HandleFunc("/backends", handlers.BackendsRequest).Methods("GET")
 	restRouter.HandleFunc("/workspace", handlers.AsyncCreationRequest).Methods("POST")
 	restRouter.HandleFunc("/workspace/{workspaceId}", handlers.GetConnInfoRequest).Methods("GET")
 	restRouter.HandleFunc("/workspace/{workspaceId}", handlers.DeleteRequest).Methods("DELETE")
 	restRouter.HandleFunc("/workspace/{workspaceId}/expired", handlers.IsExpiredRequest).Methods("GET")
+	restRouter.HandleFunc("/workspace/{workspaceId}/history", handlers.HistoryRequest).Methods("GET")
+	restRouter.HandleFunc("/workspace/{workspaceId}/rollback", handlers.RollbackRequest).Methods("POST")
+	restRouter.HandleFunc("/workspace/{workspaceId}/drift", handlers.DriftRequest).Methods("GET")
+	restRouter.HandleFunc("/workspace/{workspaceId}/reapply", handlers.ReapplyRequest).Methods("POST")
+	restRouter.HandleFunc("/workspace/{workspaceId}/credentials", handlers.CredentialsRequest).Methods("GET")
+	restRouter.HandleFunc("/workspace/{workspaceId}/credentials/rotate", handlers.RotateCredentialsRequest).Methods("POST")
+	restRouter.HandleFunc("/audit", handlers.AuditRequest).Methods("GET")
+	restRouter.HandleFunc("/quota", handlers.QuotaRequest).Methods("GET")
+	restRouter.HandleFunc("/admin/orphans", handlers.OrphansRequest).Methods("GET")
+	restRouter.HandleFunc("/admin/decisions", handlers.DecisionsRequest).Methods("GET")
+	restRouter.HandleFunc("/admin/config", handlers.ConfigRequest).Methods("GET")
+	restRouter.HandleFunc("/admin/tokens", handlers.ListTokensRequest).Methods("GET")
+	restRouter.HandleFunc("/admin/tokens", handlers.IssueTokenRequest).Methods("POST")
+	restRouter.HandleFunc("/admin/tokens/{tokenId}", handlers.RevokeTokenRequest).Methods("DELETE")
+	restRouter.HandleFunc("/admin/reconcile", handlers.ResyncRequest).Methods("POST")
+	restRouter.HandleFunc("/admin/reconcile/{workspaceId}", handlers.ReconcileRequest).Methods("POST")
 }
 
 var (
@@ -167,14 +240,27 @@ var (
 	Platform   = ""
 )
 
-func RunAPI() {
+func RunAPI(c *config.Config) {
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
 
+	if config, ok := oidc.FromConfig(c); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		p, err := oidc.NewProvider(ctx, config)
+		cancel()
+		if err != nil {
+			log.Fatalf("oidc: %v", err)
+		}
+		handlers.SetOIDC(p)
+		log.Infof("users log in with %v", config.Issuer)
+	} else {
+		log.Warn("oidc.issuer isn't set, so the UI trusts the oauth proxy's X-Forwarded-Email, and only to look at workspaces")
+	}
+
 	app := App{}
 	app.Initialize()
 	s := &http.Server{
-		Addr:    ":2323",
+		Addr:    fmt.Sprintf(":%d", c.Port),
 		Handler: app.Router,
 	}
 	//
@@ -202,16 +288,107 @@ func RunAPI() {
 	log.Infof("version dirty: %v", DirtyBuild)
 	log.Infof("version platform: %v", Platform)
 	log.Infof("version go: %v", version)
-	log.Info("starting server on :2323")
+	log.Infof("starting server on :%d", c.Port)
 	log.Fatal(s.ListenAndServe())
 }
 
-func RunControlplane() {
+// RunControlplane reconciles while this replica holds the controlplane lease, so several replicas
+// can run for availability without acting twice.
+func RunControlplane(c *config.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	controlplane.NewElector(c).Run(ctx, func(ctx context.Context) { runControllers(ctx, c) })
+}
+
+// backfilled is set once pulumi_backends.Backfill has run to the end, so that leading again doesn't
+// run it again. runControllers waits for it, so the next call sees it.
+var backfilled bool
+
+// runControllers runs the controllers until ctx is cancelled, when leadership is lost. The
+// controllers' Pulumi runs get ctx too, and it doesn't return until they've all stopped, so that
+// the lease isn't given up while this replica is still changing stacks.
+func runControllers(ctx context.Context, c *config.Config) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Workspaces from before helium recorded their cluster stacks and owners need them recorded,
+	// once. It reads every stack, so it runs alongside the controllers rather than holding them up.
+	if !backfilled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pulumi_backends.Backfill(ctx); err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("backfill: %v", err)
+				}
+				return
+			}
+			backfilled = true
+		}()
+	}
+	// The pools are refilled far more often than the other controllers run, since every claim
+	// leaves one short.
+	prewarm := controlplane.NewPrewarmController(c)
+	defer prewarm.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			if err := prewarm.RunPass(ctx, time.Now()); err != nil {
+				log.Errorf("prewarm controller: %v", err)
+			}
+			if !sleep(ctx, c.Controlplane.PrewarmInterval) {
+				return
+			}
+		}
+	}()
+	// Drift checks take minutes per workspace, so they get their own loop.
+	drift := controlplane.NewDriftController(c)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			if _, err := drift.RunPass(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				log.Errorf("drift controller: %v", err)
+			}
+			if !sleep(ctx, c.Controlplane.DriftPassInterval) {
+				return
+			}
+		}
+	}()
+	// The reconciler destroys stacks as they expire, rather than on the loop below.
+	reconciler := controlplane.NewReconciler(c)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reconciler.Run(ctx)
+	}()
 	for {
-		err := controlplane.RunDeletionController()
-		if err != nil {
-			log.Errorf("deletion controller: %v", err)
+		err := controlplane.RunRecoveryController(ctx, c)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("recovery controller: %v", err)
+		}
+		err = controlplane.RunPinnedController(ctx, c)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("pinned stack controller: %v", err)
+		}
+		err = controlplane.RunOrphanController(ctx, c)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("orphan controller: %v", err)
 		}
-		time.Sleep(1800 * time.Second)
+		if !sleep(ctx, c.ControllerInterval) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, and reports false if ctx was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
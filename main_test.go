@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/auth"
+	"github.com/pachyderm/helium/catalog"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/handlers"
+	"github.com/pachyderm/helium/oidc"
+	"github.com/pachyderm/helium/oidc/oidctest"
+	"github.com/pachyderm/helium/store"
 )
 
+func TestMain(m *testing.M) {
+	cat, err := catalog.Load("backends.yaml")
+	if err != nil {
+		log.Fatalf("catalog.Load: %v", err)
+	}
+	handlers.SetCatalog(cat)
+	os.Exit(m.Run())
+}
+
 func TestA(t *testing.T) {
 	log.Println("TestA running")
 }
@@ -44,9 +63,13 @@ func TestAuthList(t *testing.T) {
 	}
 }
 
+const testToken = "test-bootstrap-token"
+
 func TestList(t *testing.T) {
+	auth.Configure(&config.Config{BootstrapToken: testToken})
+	defer auth.Configure(&config.Config{})
 	req, _ := http.NewRequest("GET", "/v1/api/workspaces", nil)
-	req.Header.Set("Authorization", "Bearer ***REMOVED***")
+	req.Header.Set("Authorization", "Bearer "+testToken)
 	response := executeRequest(req)
 	actual := response.Code
 	expected := http.StatusOK
@@ -55,6 +78,163 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestAuthScopes(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	_, secret, err := auth.Issue("reader@example.com", []string{auth.ScopeRead}, time.Hour, "test", time.Now())
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	for _, test := range []struct {
+		method, url string
+		want        int
+	}{
+		{"GET", "/v1/api/backends", http.StatusOK},
+		{"POST", "/v1/api/admin/reconcile", http.StatusForbidden},
+		{"GET", "/v1/api/admin/tokens", http.StatusForbidden},
+		{"GET", "/v1/api/audit", http.StatusForbidden},
+		{"DELETE", "/v1/api/workspace/example", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		if got := executeRequest(req).Code; got != test.want {
+			t.Errorf("%s %s with a read token: got %d, want %d", test.method, test.url, got, test.want)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	auth.Configure(&config.Config{BootstrapToken: testToken})
+	defer auth.Configure(&config.Config{})
+	req, _ := http.NewRequest("POST", "/v1/api/admin/tokens", strings.NewReader("identity=someone@example.com&scopes=read"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	if got := executeRequest(req).Code; got != http.StatusCreated {
+		t.Fatalf("issuing a token: got %d", got)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/api/audit?action=issue-token", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	response := executeRequest(req)
+	var res api.AuditResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %q: %v", response.Body.String(), err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Actor != auth.BootstrapIdentity || res.Events[0].Params["identity"] != "someone@example.com" {
+		t.Errorf("audit events: %+v", res.Events)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/api/audit?format=jsonl&since=2000-01-01T00:00:00Z", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	response = executeRequest(req)
+	if lines := strings.Count(response.Body.String(), "\n"); lines != 1 || response.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("exported %d lines as %q, want 1 as JSON lines", lines, response.Header().Get("Content-Type"))
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/api/audit?since=yesterday", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	if got := executeRequest(req).Code; got != http.StatusBadRequest {
+		t.Errorf("invalid since: got %d, want 400", got)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	_, secret, err := auth.Issue("someone@example.com", []string{auth.ScopeWrite}, time.Hour, "test", time.Now())
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/v1/api/quota", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	response := executeRequest(req)
+	var res api.QuotaResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %q: %v", response.Body.String(), err)
+	}
+	if res.User.Name != "someone@example.com" || len(res.User.Workspaces) != 0 {
+		t.Errorf("quota usage: %+v", res)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/api/quota?user=other@example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if got := executeRequest(req).Code; got != http.StatusForbidden {
+		t.Errorf("another user's quota: got %d, want 403", got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	want := config.Defaults()
+	want.Sentry.DSN = "https://key@sentry.example.com/1"
+	handlers.SetConfig(want)
+	defer handlers.SetConfig(nil)
+	_, secret, err := auth.Issue("boss@example.com", []string{auth.ScopeAdmin}, time.Hour, "test", time.Now())
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/v1/api/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	response := executeRequest(req)
+	var c config.Config
+	if err := json.Unmarshal(response.Body.Bytes(), &c); err != nil {
+		t.Fatalf("decoding %q: %v", response.Body.String(), err)
+	}
+	if c.Port != 2323 || c.Sentry.DSN != "[redacted]" {
+		t.Errorf("config: %+v", c)
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	mock := oidctest.NewServer("helium", "secret")
+	defer mock.Close()
+	p, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:         mock.Issuer(),
+		ClientID:       mock.ClientID,
+		ClientSecret:   mock.ClientSecret,
+		RedirectURL:    "http://localhost:2323" + oidc.CallbackPath,
+		SessionKey:     []byte("test session key"),
+		AllowedDomains: []string{"example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	handlers.SetOIDC(p)
+	defer handlers.SetOIDC(nil)
+	viewer := mock.Token("helium", map[string]any{"email": "auditor@example.com"})
+	auth.Configure(&config.Config{Viewers: []string{"auditor@example.com"}})
+	defer auth.Configure(&config.Config{})
+
+	for _, test := range []struct {
+		method, url, bearer string
+		want                int
+	}{
+		{"GET", "/v1/api/backends", mock.Token("helium", nil), http.StatusOK},
+		{"GET", "/v1/api/backends", mock.Token("someone-else", nil), http.StatusUnauthorized},
+		{"GET", "/v1/api/backends", mock.Token("helium", map[string]any{"email": "someone@elsewhere.com"}), http.StatusForbidden},
+		{"GET", "/v1/api/admin/tokens", mock.Token("helium", nil), http.StatusForbidden},
+		{"GET", "/v1/api/backends", viewer, http.StatusOK},
+		{"DELETE", "/v1/api/workspace/example", viewer, http.StatusForbidden},
+		{"GET", "/list", "", http.StatusFound},
+		{"GET", oidc.LoginPath, "", http.StatusFound},
+		{"GET", oidc.LogoutPath, "", http.StatusMethodNotAllowed},
+		{"POST", oidc.LogoutPath, "", http.StatusFound},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		if test.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		if got := executeRequest(req).Code; got != test.want {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.url, got, test.want)
+		}
+	}
+}
+
 //
 
 func TestE2E(t *testing.T) {
@@ -63,7 +243,7 @@ func TestE2E(t *testing.T) {
 	//}
 	// List
 	req, _ := http.NewRequest("GET", "/v1/api/workspaces", nil)
-	req.Header.Set("Authorization", "Bearer ***REMOVED***")
+	req.Header.Set("Authorization", "Bearer "+testToken)
 	response := executeRequest(req)
 	actual := response.Code
 	expected := http.StatusOK
@@ -73,7 +253,7 @@ func TestE2E(t *testing.T) {
 	// Create
 	req, _ = http.NewRequest("POST", "/v1/api/workspace", nil)
 	response = executeRequest(req)
-	req.Header.Set("Authorization", "Bearer ***REMOVED***")
+	req.Header.Set("Authorization", "Bearer "+testToken)
 	actual = response.Code
 	expected = http.StatusOK
 	if expected != actual {
@@ -90,7 +270,7 @@ func TestE2E(t *testing.T) {
 		time.Sleep(10 * time.Second)
 		req, _ = http.NewRequest("Get", fmt.Sprintf("/v1/api/workspace/%s", id.ID), nil)
 		response = executeRequest(req)
-		req.Header.Set("Authorization", "Bearer ***REMOVED***")
+		req.Header.Set("Authorization", "Bearer "+testToken)
 		actual = response.Code
 		expected = http.StatusOK
 		if expected != actual {
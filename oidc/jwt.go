@@ -0,0 +1,220 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the provider's clock may be from helium's.
+const clockSkew = time.Minute
+
+// jwks is a JSON Web Key Set.
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		// RSA keys.
+		N string `json:"n"`
+		E string `json:"e"`
+		// EC keys.
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// publicKeys returns the set's signing keys by ID. Key types other than RSA and P-256 are skipped.
+func (s jwks) publicKeys() (map[string]any, error) {
+	keys := make(map[string]any)
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+// audience is a JWT aud claim, which is a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the claims of a verified token that helium uses.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	NotBefore     int64    `json:"nbf"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	// Groups are from the provider's GroupsClaim.
+	Groups []string `json:"-"`
+}
+
+// Verify checks that raw is a JWT signed by the provider, for aud, and valid at now, and returns
+// its claims. It must have an email, which mustn't be marked unverified, and the user must be in
+// an allowed domain or group.
+func (p *Provider) Verify(ctx context.Context, raw, aud string, now time.Time) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("%w: algorithm %q for an RSA key", ErrInvalidToken, header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("%w: algorithm %q for an EC key", ErrInvalidToken, header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported key %q", ErrInvalidToken, header.Kid)
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, c.Issuer)
+	case !c.Audience.contains(aud):
+		return nil, fmt.Errorf("%w: not for %q", ErrInvalidToken, aud)
+	case c.Expiry == 0 || now.After(time.Unix(c.Expiry, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case c.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(c.NotBefore, 0)):
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case c.Email == "":
+		return nil, fmt.Errorf("%w: no email", ErrInvalidToken)
+	case c.EmailVerified != nil && !*c.EmailVerified:
+		return nil, fmt.Errorf("%w: email %q isn't verified", ErrInvalidToken, c.Email)
+	}
+	var all map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return nil, err
+	}
+	if raw, ok := all[p.config.GroupsClaim]; ok {
+		// A claim that isn't a list of groups puts the user in none.
+		json.Unmarshal(raw, &c.Groups)
+	}
+	if err := p.allowed(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// allowed checks that a user is in one of the allowed domains or groups.
+func (p *Provider) allowed(c *Claims) error {
+	if i := strings.LastIndex(c.Email, "@"); i >= 0 {
+		for _, d := range p.config.AllowedDomains {
+			if strings.EqualFold(c.Email[i+1:], d) {
+				return nil
+			}
+		}
+	}
+	for _, g := range c.Groups {
+		for _, allowed := range p.config.AllowedGroups {
+			if g == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %q isn't in an allowed domain or group", ErrNotAllowed, c.Email)
+}
+
+// LooksLikeJWT reports whether a bearer token is a JWT rather than a helium API token.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Package oidc authenticates users with an OpenID Connect provider. The UI logs users in with the
+// authorization code flow and keeps them logged in with a signed session cookie, and the API
+// accepts the provider's JWTs as bearer tokens. Either way, the user is known by their email.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/config"
+)
+
+const (
+	defaultSessionTTL = 12 * time.Hour
+	// keyRefetchInterval is the least time between fetches of the JWKS, which is fetched again when
+	// a token is signed with a key that isn't in it, in case the provider rotated its keys.
+	keyRefetchInterval = time.Minute
+)
+
+var (
+	// ErrInvalidToken is returned by Verify for a token that isn't valid.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrNotAllowed is returned by Verify for a valid token of a user outside the allowed domains
+	// and groups.
+	ErrNotAllowed = errors.New("user not allowed")
+)
+
+// Config is how to reach the provider, and how helium is registered with it.
+type Config struct {
+	// Issuer is the provider's issuer URL, which its discovery document is under.
+	Issuer string
+	// JWKSURL overrides the jwks_uri from the discovery document.
+	JWKSURL      string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is helium's callback URL, as registered with the provider.
+	RedirectURL string
+	// Audience is the audience API bearer tokens must be for. It defaults to ClientID.
+	Audience string
+	// SessionKey signs session cookies. Sessions don't survive a restart without one.
+	SessionKey []byte
+	SessionTTL time.Duration
+	// AllowedDomains and AllowedGroups are who may use helium: users whose email is in one of the
+	// domains, or who are in one of the groups. At least one must be set, since the provider may
+	// have accounts for anyone.
+	AllowedDomains []string
+	AllowedGroups  []string
+	// GroupsClaim is the claim listing a user's groups, such as a namespaced custom claim for
+	// Auth0. It defaults to "groups".
+	GroupsClaim string
+}
+
+// FromConfig returns the OIDC settings in the server config, with Auth0's client ID and secret.
+// It reports false if no issuer is set, which leaves OIDC off.
+func FromConfig(c *config.Config) (Config, bool) {
+	o := c.OIDC
+	return Config{
+		Issuer:         o.Issuer,
+		JWKSURL:        o.JWKSURL,
+		ClientID:       c.Auth0.ClientID,
+		ClientSecret:   c.Auth0.ClientSecret,
+		RedirectURL:    o.RedirectURL,
+		Audience:       o.Audience,
+		SessionKey:     []byte(o.SessionKey),
+		SessionTTL:     o.SessionTTL,
+		AllowedDomains: o.AllowedDomains,
+		AllowedGroups:  o.AllowedGroups,
+		GroupsClaim:    o.GroupsClaim,
+	}, o.Issuer != ""
+}
+
+// Provider is an OIDC provider that helium is registered with.
+type Provider struct {
+	config                Config
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURL               string
+	client                *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// NewProvider reads the provider's discovery document and keys.
+func NewProvider(ctx context.Context, c Config) (*Provider, error) {
+	if c.ClientID == "" || c.RedirectURL == "" {
+		return nil, errors.New("oidc needs a client ID and a redirect URL")
+	}
+	if len(c.AllowedDomains) == 0 && len(c.AllowedGroups) == 0 {
+		return nil, errors.New("oidc needs allowed domains or groups, or anyone with an account at the provider could use helium")
+	}
+	if c.Audience == "" {
+		c.Audience = c.ClientID
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	if c.SessionTTL <= 0 {
+		c.SessionTTL = defaultSessionTTL
+	}
+	if len(c.SessionKey) == 0 {
+		log.Warn("no HELIUM_SESSION_KEY set, so UI sessions won't survive a restart")
+		c.SessionKey = make([]byte, 32)
+		if _, err := rand.Read(c.SessionKey); err != nil {
+			return nil, err
+		}
+	}
+	p := &Provider{config: c, client: &http.Client{Timeout: 10 * time.Second}}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(c.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, url, &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if discovery.Issuer != c.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer is %q, want %q", discovery.Issuer, c.Issuer)
+	}
+	p.authorizationEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURL = discovery.JWKSURI
+	if c.JWKSURL != "" {
+		p.jwksURL = c.JWKSURL
+	}
+	if err := p.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Audience is the audience API bearer tokens must be for.
+func (p *Provider) Audience() string { return p.config.Audience }
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) error {
+	var set jwks
+	if err := p.getJSON(ctx, p.jwksURL, &set); err != nil {
+		return fmt.Errorf("oidc keys: %w", err)
+	}
+	keys, err := set.publicKeys()
+	if err != nil {
+		return fmt.Errorf("oidc keys: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	return nil
+}
+
+// key returns the provider's key with ID kid, fetching the keys again if it's new.
+func (p *Provider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	stale := time.Since(p.keysFetched) > keyRefetchInterval
+	p.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+	if err := p.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
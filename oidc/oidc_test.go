@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T, mock *oidctest.Server, redirect string) *Provider {
+	t.Helper()
+	p, err := NewProvider(context.Background(), Config{
+		Issuer:         mock.Issuer(),
+		ClientID:       mock.ClientID,
+		ClientSecret:   mock.ClientSecret,
+		RedirectURL:    redirect,
+		Audience:       "https://helium/api",
+		SessionKey:     []byte("test session key"),
+		AllowedDomains: []string{"example.com"},
+		AllowedGroups:  []string{"helium-users"},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	return p
+}
+
+func TestVerify(t *testing.T) {
+	mock := oidctest.NewServer("helium", "secret")
+	defer mock.Close()
+	p := newTestProvider(t, mock, "http://helium/oauth/callback")
+	ctx := context.Background()
+	now := time.Now()
+
+	c, err := p.Verify(ctx, mock.Token("https://helium/api", nil), p.Audience(), now)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if c.Email != mock.Email {
+		t.Errorf("email is %q, want %q", c.Email, mock.Email)
+	}
+	listed := mock.Token("", map[string]any{"aud": []string{"other", "https://helium/api"}})
+	if _, err := p.Verify(ctx, listed, p.Audience(), now); err != nil {
+		t.Errorf("Verify with a list of audiences: %v", err)
+	}
+
+	valid := mock.Token("https://helium/api", nil)
+	for name, raw := range map[string]string{
+		"wrong audience": mock.Token("someone-else", nil),
+		"wrong issuer":   mock.Token("https://helium/api", map[string]any{"iss": "https://evil.example.com"}),
+		"expired":        mock.Token("https://helium/api", map[string]any{"exp": now.Add(-time.Hour).Unix()}),
+		"not yet valid":  mock.Token("https://helium/api", map[string]any{"nbf": now.Add(time.Hour).Unix()}),
+		"no email":       mock.Token("https://helium/api", map[string]any{"email": ""}),
+		"unverified":     mock.Token("https://helium/api", map[string]any{"email_verified": false}),
+		"tampered":       valid[:strings.LastIndex(valid, ".")] + ".AAAA",
+		"not a jwt":      "helium_0123456789abcdef_secret",
+	} {
+		if _, err := p.Verify(ctx, raw, p.Audience(), now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify %s token: %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	outsider := mock.Token("https://helium/api", map[string]any{"email": "someone@elsewhere.com"})
+	if _, err := p.Verify(ctx, outsider, p.Audience(), now); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Verify token of a user outside the allowed domain: %v, want ErrNotAllowed", err)
+	}
+	member := mock.Token("https://helium/api", map[string]any{"email": "someone@elsewhere.com", "groups": []string{"helium-users"}})
+	if _, err := p.Verify(ctx, member, p.Audience(), now); err != nil {
+		t.Errorf("Verify token of a user in an allowed group: %v", err)
+	}
+	if _, err := NewProvider(ctx, Config{Issuer: mock.Issuer(), ClientID: "helium", RedirectURL: "http://helium/oauth/callback"}); err == nil {
+		t.Errorf("NewProvider without allowed domains or groups succeeded")
+	}
+
+	// A new key is picked up once the old keys are stale.
+	mock.RotateKey()
+	p.keysFetched = time.Time{}
+	if _, err := p.Verify(ctx, mock.Token("https://helium/api", nil), p.Audience(), now); err != nil {
+		t.Errorf("Verify after key rotation: %v", err)
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	mock := oidctest.NewServer("helium", "secret")
+	defer mock.Close()
+	mux := http.NewServeMux()
+	helium := httptest.NewServer(mux)
+	defer helium.Close()
+	p := newTestProvider(t, mock, helium.URL+CallbackPath)
+	mux.HandleFunc(LoginPath, p.LoginHandler)
+	mux.HandleFunc(CallbackPath, p.CallbackHandler)
+	mux.HandleFunc(LogoutPath, p.LogoutHandler)
+	mux.Handle("/list", p.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := p.Email(r)
+		w.Write([]byte(email))
+	})))
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	res, err := client.Get(helium.URL + "/list")
+	if err != nil {
+		t.Fatalf("GET /list: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != mock.Email {
+		t.Errorf("after logging in, /list is %v %q, want the email %q", res.Status, body, mock.Email)
+	}
+	if res.Request.URL.Path != "/list" {
+		t.Errorf("ended up at %v, want /list", res.Request.URL)
+	}
+
+	// Without the login cookie, a callback is refused.
+	res, err = http.Get(helium.URL + CallbackPath + "?code=x&state=y")
+	if err != nil {
+		t.Fatalf("GET callback: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without a login is %v, want 400", res.Status)
+	}
+
+	res, err = client.Get(helium.URL + LogoutPath)
+	if err != nil {
+		t.Fatalf("GET logout: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET logout is %v, want 405", res.Status)
+	}
+	if _, err := client.Post(helium.URL+LogoutPath, "", nil); err != nil {
+		t.Fatalf("POST logout: %v", err)
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	res, err = client.Get(helium.URL + "/list")
+	if err != nil {
+		t.Fatalf("GET /list: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), LoginPath) {
+		t.Errorf("after logging out, /list is %v to %q, want a redirect to log in", res.Status, res.Header.Get("Location"))
+	}
+}
+
+func TestCookieSignature(t *testing.T) {
+	p := &Provider{config: Config{SessionKey: []byte("key")}}
+	w := httptest.NewRecorder()
+	if err := p.writeCookie(w, sessionCookie, session{Email: "a@example.com", Expires: time.Now().Add(time.Hour)}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if email, ok := p.Email(r); !ok || email != "a@example.com" {
+		t.Errorf("Email = %q, %v", email, ok)
+	}
+
+	// A login cookie isn't a session, even though it's signed with the same key.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookie, Value: cookie.Value})
+	if err := p.readCookie(r, loginCookie, &session{}); !errors.Is(err, errInvalidCookie) {
+		t.Errorf("reading a session cookie as a login cookie: %v", err)
+	}
+	other := &Provider{config: Config{SessionKey: []byte("other key")}}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if _, ok := other.Email(r); ok {
+		t.Errorf("a cookie signed with another key was accepted")
+	}
+}
@@ -0,0 +1,163 @@
+// Package oidctest is a mock OpenID Connect provider for tests. Its authorization endpoint logs
+// whoever asks in as Email straight away, and it signs tokens with a fresh RSA key.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Server is a mock OIDC provider.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Email is who the authorization endpoint logs in.
+	Email string
+
+	key   *rsa.PrivateKey
+	kid   string
+	mu    sync.Mutex
+	codes map[string]string // code -> nonce
+}
+
+// NewServer starts a mock provider with a client registered. Close it when done.
+func NewServer(clientID, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Email:        "someone@example.com",
+		key:          key,
+		kid:          "test-key",
+		codes:        make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", s.jwks)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Issuer is the provider's issuer URL.
+func (s *Server) Issuer() string { return s.URL }
+
+// RotateKey replaces the signing key, as a provider does from time to time.
+func (s *Server) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+	s.kid += "-rotated"
+}
+
+// Token returns a JWT signed by the provider, with the standard claims for aud, valid for an hour,
+// and any others in claims, which override them.
+func (s *Server) Token(aud string, claims map[string]any) string {
+	now := time.Now()
+	c := map[string]any{
+		"iss":   s.Issuer(),
+		"sub":   "user-1",
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"email": s.Email,
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	s.mu.Lock()
+	key, kid := s.key, s.kid
+	s.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(c)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 s.Issuer(),
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	key, kid := s.key, s.kid
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes())
+	s.mu.Lock()
+	s.codes[code] = q.Get("nonce")
+	s.mu.Unlock()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != s.ClientID || r.FormValue("client_secret") != s.ClientSecret {
+		http.Error(w, "bad client", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	nonce, ok := s.codes[r.FormValue("code")]
+	delete(s.codes, r.FormValue("code"))
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "bad code", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"token_type": "Bearer",
+		"id_token":   s.Token(s.ClientID, map[string]any{"nonce": nonce}),
+	})
+}
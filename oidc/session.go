@@ -0,0 +1,252 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionCookie = "helium_session"
+	loginCookie   = "helium_login"
+	// loginTTL is how long a user has to log in with the provider.
+	loginTTL = 10 * time.Minute
+
+	// LoginPath, CallbackPath and LogoutPath are where the handlers are served. LogoutPath takes
+	// POSTs.
+	LoginPath    = "/login"
+	CallbackPath = "/oauth/callback"
+	LogoutPath   = "/logout"
+)
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// session is what a session cookie holds.
+type session struct {
+	Email   string
+	Expires time.Time
+}
+
+// login is what the login cookie holds while the user is at the provider.
+type login struct {
+	State   string
+	Nonce   string
+	Next    string
+	Expires time.Time
+}
+
+// Email returns the email of the user logged in to the request's session.
+func (p *Provider) Email(r *http.Request) (string, bool) {
+	var s session
+	if err := p.readCookie(r, sessionCookie, &s); err != nil || time.Now().After(s.Expires) {
+		return "", false
+	}
+	return s.Email, true
+}
+
+// RequireLogin sends users who aren't logged in to log in, and back to where they were going
+// afterwards.
+func (p *Provider) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := p.Email(r); !ok {
+			http.Redirect(w, r, LoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoginHandler sends the user to the provider to log in.
+func (p *Provider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	l := login{
+		State:   randomString(),
+		Nonce:   randomString(),
+		Next:    r.URL.Query().Get("next"),
+		Expires: time.Now().Add(loginTTL),
+	}
+	// Only ever send users back into helium.
+	if !strings.HasPrefix(l.Next, "/") || strings.HasPrefix(l.Next, "//") {
+		l.Next = "/"
+	}
+	if err := p.writeCookie(w, loginCookie, l, l.Expires); err != nil {
+		log.Errorf("oidc login: %v", err)
+		http.Error(w, "error starting login", http.StatusInternalServerError)
+		return
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {l.State},
+		"nonce":         {l.Nonce},
+	}
+	http.Redirect(w, r, p.authorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+// CallbackHandler is where the provider sends the user back to. It exchanges the code for an ID
+// token, and logs the user in as its email.
+func (p *Provider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	var l login
+	if err := p.readCookie(r, loginCookie, &l); err != nil || time.Now().After(l.Expires) {
+		http.Error(w, "login expired, try again", http.StatusBadRequest)
+		return
+	}
+	p.clearCookie(w, loginCookie)
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Infof("oidc login failed: %v: %v", e, q.Get("error_description"))
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("state")), []byte(l.State)) {
+		http.Error(w, "login state doesn't match, try again", http.StatusBadRequest)
+		return
+	}
+	idToken, err := p.exchange(r.Context(), q.Get("code"))
+	if err != nil {
+		log.Errorf("oidc code exchange: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := p.Verify(r.Context(), idToken, p.config.ClientID, time.Now())
+	if err == nil && !hmac.Equal([]byte(claims.Nonce), []byte(l.Nonce)) {
+		err = fmt.Errorf("%w: nonce doesn't match", ErrInvalidToken)
+	}
+	if errors.Is(err, ErrNotAllowed) {
+		log.Infof("oidc login refused: %v", err)
+		http.Error(w, "you aren't allowed to use helium", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Errorf("oidc id token: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	s := session{Email: claims.Email, Expires: time.Now().Add(p.config.SessionTTL)}
+	if err := p.writeCookie(w, sessionCookie, s, s.Expires); err != nil {
+		log.Errorf("oidc session: %v", err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "login",
+		"user":      claims.Email,
+	}).Info("user logged in")
+	http.Redirect(w, r, l.Next, http.StatusFound)
+}
+
+// LogoutHandler ends the user's session. It only accepts POSTs, so that a link or image on another
+// page can't log the user out.
+func (p *Provider) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.clearCookie(w, sessionCookie)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchange trades an authorization code for an ID token at the token endpoint.
+func (p *Provider) exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %v", res.Status)
+	}
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// writeCookie sets a cookie holding v, signed with the session key.
+func (p *Provider) writeCookie(w http.ResponseWriter, name string, v any, expires time.Time) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + p.sign(name, payload),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readCookie reads a cookie written by writeCookie into v.
+func (p *Provider) readCookie(r *http.Request, name string, v any) error {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(p.sign(name, payload))) {
+		return errInvalidCookie
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidCookie
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (p *Provider) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// sign returns the signature of a cookie's payload. The name is signed too, so one kind of cookie
+// can't be passed off as another.
+func (p *Provider) sign(name, payload string) string {
+	m := hmac.New(sha256.New, p.config.SessionKey)
+	m.Write([]byte(name + "=" + payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,354 @@
+// Package placement chooses the cluster stack for a workspace that doesn't name one. The clusters
+// are listed in the cluster pool file, and the pool's Policy picks one of those that can take the
+// workspace, given how many workspaces each already has, what their values request, and the labels
+// that steer workspaces to particular clusters, such as gpu or loadtesting.
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+	"github.com/pachyderm/helium/util"
+)
+
+const (
+	defaultClusterPoolFile = "cluster-pool.yaml"
+	defaultPolicy          = "least-loaded"
+	// pendingPlacementAge is how long a placement counts against its cluster before the workspace
+	// is recorded as deployed into it. Creates normally get that far within a minute.
+	pendingPlacementAge = time.Hour
+
+	placementPrefix = "placements/"
+	// generationKey is rewritten by every placement, so that concurrent ones conflict.
+	generationKey = "placement-generation"
+)
+
+// ErrNoCapacity is returned by Place when the pool has clusters for the workspace's backend, but
+// none of them can take it.
+var ErrNoCapacity = errors.New("no cluster in the pool can take the workspace")
+
+// file is the path of the cluster pool file, from SetFile.
+var file = defaultClusterPoolFile
+
+// SetFile sets the path of the cluster pool file, from the config's files.clusterPool.
+func SetFile(path string) { file = path }
+
+// File returns the path of the cluster pool file.
+func File() string { return file }
+
+// Cluster is a cluster stack in the pool.
+type Cluster struct {
+	// Name is the cluster stack, as a spec's clusterStack would name it.
+	Name string `yaml:"name"`
+	// Backends are the backends that can be deployed into the cluster.
+	Backends []string `yaml:"backends"`
+	// Labels are matched against the workspace labels named by the pool's placementLabels.
+	Labels map[string]string `yaml:"labels"`
+	// MaxWorkspaces is the most workspaces the cluster takes. 0 means no limit.
+	MaxWorkspaces int `yaml:"maxWorkspaces"`
+	// CPU and Memory are what the resource requests in its workspaces' values may add up to, as
+	// Kubernetes quantities. Empty means no limit.
+	CPU    string `yaml:"cpu"`
+	Memory string `yaml:"memory"`
+
+	capacity Resources
+}
+
+// Config is the contents of the cluster pool file.
+type Config struct {
+	// Policy names the Policy that chooses among the clusters that can take a workspace.
+	Policy string `yaml:"policy"`
+	// PlacementLabels are the workspace labels that steer placement. A workspace is only placed in
+	// a cluster with the same value for each of them, where a missing label matches only a missing
+	// label: a workspace labelled gpu=true goes to a cluster labelled gpu=true, and one without a
+	// gpu label never does.
+	PlacementLabels []string  `yaml:"placementLabels"`
+	Clusters        []Cluster `yaml:"clusters"`
+
+	policy Policy
+}
+
+// LoadConfig reads and validates a cluster pool file. A missing file means there's no pool, and
+// every workspace goes to its backend's default cluster.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Config{policy: policies[defaultPolicy]}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+var validClusterName = regexp.MustCompile(`^[-a-z0-9]+(/[-a-z0-9]+/[-a-z0-9]+)?$`)
+
+func parseConfig(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse cluster pool: %w", err)
+	}
+	if c.Policy == "" {
+		c.Policy = defaultPolicy
+	}
+	c.policy = policies[c.Policy]
+	if c.policy == nil {
+		return nil, fmt.Errorf("cluster pool has an unknown policy %q", c.Policy)
+	}
+	seen := make(map[string]bool)
+	for i := range c.Clusters {
+		cl := &c.Clusters[i]
+		if !validClusterName.MatchString(cl.Name) {
+			return nil, fmt.Errorf("cluster %d has an invalid name %q", i, cl.Name)
+		}
+		if seen[cl.Name] {
+			return nil, fmt.Errorf("cluster %q is listed twice", cl.Name)
+		}
+		seen[cl.Name] = true
+		if len(cl.Backends) == 0 {
+			return nil, fmt.Errorf("cluster %q has no backends", cl.Name)
+		}
+		if cl.MaxWorkspaces < 0 {
+			return nil, fmt.Errorf("cluster %q has a negative maxWorkspaces", cl.Name)
+		}
+		var err error
+		if cl.CPU != "" {
+			if cl.capacity.MilliCPU, err = parseCPU(cl.CPU); err != nil {
+				return nil, fmt.Errorf("cluster %q: %w", cl.Name, err)
+			}
+		}
+		if cl.Memory != "" {
+			if cl.capacity.Memory, err = parseMemory(cl.Memory); err != nil {
+				return nil, fmt.Errorf("cluster %q: %w", cl.Name, err)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// serves reports whether backend can be deployed into the cluster.
+func (cl *Cluster) serves(backend string) bool {
+	for _, b := range cl.Backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the cluster has the same value as labels for each placement label.
+func (c *Config) matches(cl *Cluster, labels map[string]string) bool {
+	for _, k := range c.PlacementLabels {
+		if cl.Labels[k] != labels[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// placement records the cluster a workspace was placed in, and what its values request.
+type placement struct {
+	Workspace api.ID
+	Cluster   string
+	Resources Resources
+	PlacedAt  time.Time
+}
+
+// Backend is the part of pulumi_backends that placement needs.
+type Backend interface {
+	Dependents(api.ID) ([]api.ID, error)
+	// ClusterStack returns the cluster stack an existing workspace is deployed into, and whether
+	// the workspace exists.
+	ClusterStack(api.ID) (string, bool, error)
+}
+
+type pulumiBackend struct{}
+
+func (pulumiBackend) Dependents(i api.ID) ([]api.ID, error) { return pulumi_backends.Dependents(i) }
+
+func (pulumiBackend) ClusterStack(i api.ID) (string, bool, error) {
+	md, err := pulumi_backends.GetMetadata(pulumi_backends.Resolve(i))
+	if errors.Is(err, pulumi_backends.ErrStackNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return md.ClusterStack, true, nil
+}
+
+// Place sets spec.ClusterStack to a cluster from the pool, if it doesn't name one and the pool has
+// clusters for its backend, and records the placement so it counts against the cluster from now
+// on. A spec naming an existing workspace updates it where it is, in the cluster stack it's
+// deployed into. spec.Backend must already be filled in. release forgets the placement, for a
+// create that doesn't happen or fails.
+func Place(spec *api.Spec) (release func() error, err error) {
+	config, err := LoadConfig(File())
+	if err != nil {
+		return nil, err
+	}
+	return place(pulumiBackend{}, store.Default(), config, spec, time.Now())
+}
+
+func place(b Backend, st store.Store, config *Config, spec *api.Spec, now time.Time) (func() error, error) {
+	nothing := func() error { return nil }
+	if spec.ClusterStack != "" {
+		return nothing, nil
+	}
+	var serving []*Cluster
+	for i := range config.Clusters {
+		if config.Clusters[i].serves(spec.Backend) {
+			serving = append(serving, &config.Clusters[i])
+		}
+	}
+	if len(serving) == 0 {
+		return nothing, nil
+	}
+	clusterStack, exists, err := b.ClusterStack(api.ID(spec.Name))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		spec.ClusterStack = clusterStack
+		return nothing, nil
+	}
+	r := &Request{Spec: spec}
+	if r.Resources, err = Requests(spec.ValuesYAMLContent); err != nil {
+		return nil, err
+	}
+
+	labels := util.ParseLabels(spec.Labels)
+	// Replicas place workspaces concurrently, so a placement only stands if no other was made
+	// between reading the counts and recording it. Otherwise the counts may be stale, and it's
+	// placed again.
+	var chosen *Candidate
+	var candidates []Candidate
+	release, err := store.Serialize(st, generationKey, func() (func() error, error) {
+		placements, err := loadPlacements(st)
+		if err != nil {
+			return nil, err
+		}
+		candidates = nil
+		for _, cl := range serving {
+			if !config.matches(cl, labels) {
+				continue
+			}
+			c, err := candidate(b, st, cl, placements, now)
+			if err != nil {
+				return nil, err
+			}
+			if c.Fits(r.Resources) {
+				candidates = append(candidates, *c)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("%w: %d clusters serve %v, but none with room has the labels %v", ErrNoCapacity, len(serving), spec.Backend, placementLabels(config, labels))
+		}
+
+		chosen = config.policy.Choose(r, candidates)
+		p := placement{Workspace: api.ID(spec.Name), Cluster: chosen.Cluster.Name, Resources: r.Resources, PlacedAt: now}
+		if err := putPlacement(st, p); err != nil {
+			return nil, fmt.Errorf("record placement of %v: %w", spec.Name, err)
+		}
+		return func() error { return st.Delete(placementPrefix + spec.Name) }, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	spec.ClusterStack = chosen.Cluster.Name
+	log.WithFields(log.Fields{
+		"canonical":  "true",
+		"request":    "place",
+		"name":       spec.Name,
+		"cluster":    chosen.Cluster.Name,
+		"policy":     config.Policy,
+		"candidates": len(candidates),
+		"workspaces": chosen.Workspaces,
+		"milliCPU":   r.Resources.MilliCPU,
+		"memory":     r.Resources.Memory,
+	}).Info("placed workspace")
+	return release, nil
+}
+
+func placementLabels(config *Config, labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	for _, k := range config.PlacementLabels {
+		out[k] = labels[k]
+	}
+	return out
+}
+
+// putPlacement records a placement, replacing any earlier one of a workspace with the same name.
+func putPlacement(st store.Store, p placement) error {
+	key := placementPrefix + string(p.Workspace)
+	version, err := st.Get(key, &placement{})
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	_, err = st.Put(key, p, version)
+	return err
+}
+
+// loadPlacements returns every recorded placement, by workspace.
+func loadPlacements(st store.Store) (map[api.ID]placement, error) {
+	keys, err := st.List(placementPrefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[api.ID]placement)
+	for _, k := range keys {
+		var p placement
+		if _, err := st.Get(k, &p); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		out[p.Workspace] = p
+	}
+	return out, nil
+}
+
+// candidate counts what's placed in cl: the workspaces deployed into it, and those placed there
+// recently enough that they may still be being created. Placements of workspaces that are neither
+// are forgotten.
+func candidate(b Backend, st store.Store, cl *Cluster, placements map[api.ID]placement, now time.Time) (*Candidate, error) {
+	c := &Candidate{Cluster: cl}
+	deployed := make(map[api.ID]bool)
+	if parent, ok := pulumi_backends.ClusterStackID(cl.Name); ok {
+		deps, err := b.Dependents(parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps {
+			deployed[d] = true
+			c.Workspaces++
+			if p, ok := placements[d]; ok {
+				c.Requested = c.Requested.add(p.Resources)
+			}
+		}
+	}
+	for _, p := range placements {
+		if p.Cluster != cl.Name || deployed[p.Workspace] {
+			continue
+		}
+		if now.Sub(p.PlacedAt) < pendingPlacementAge {
+			c.Workspaces++
+			c.Requested = c.Requested.add(p.Resources)
+			continue
+		}
+		if err := st.Delete(placementPrefix + string(p.Workspace)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,220 @@
+package placement
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+type fakeBackend struct {
+	dependents map[api.ID][]api.ID
+}
+
+func (f *fakeBackend) Dependents(i api.ID) ([]api.ID, error) {
+	return f.dependents[i], nil
+}
+
+func (f *fakeBackend) ClusterStack(i api.ID) (string, bool, error) {
+	for parent, deps := range f.dependents {
+		for _, d := range deps {
+			if d == i {
+				return string(parent), true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+const testPool = `
+placementLabels: [gpu, loadtesting]
+clusters:
+  - name: shared-1
+    backends: [gcp_namespace_only]
+    maxWorkspaces: 3
+  - name: pachyderm/helium/shared-2
+    backends: [gcp_namespace_only]
+    maxWorkspaces: 3
+  - name: gpu
+    backends: [gcp_namespace_only]
+    labels:
+      gpu: "true"
+    cpu: "4"
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(testPool))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if c.Policy != defaultPolicy || len(c.Clusters) != 3 {
+		t.Errorf("got policy %q and %d clusters", c.Policy, len(c.Clusters))
+	}
+	if got := c.Clusters[2].capacity; got != (Resources{MilliCPU: 4000}) {
+		t.Errorf("gpu cluster capacity is %+v", got)
+	}
+
+	if _, err := LoadConfig("../cluster-pool.yaml"); err != nil {
+		t.Errorf("LoadConfig of the checked in pool: %v", err)
+	}
+
+	for _, bad := range []string{
+		"policy: random",
+		"clusters: [{name: a}]",
+		"clusters: [{name: A, backends: [x]}]",
+		"clusters: [{name: a, backends: [x]}, {name: a, backends: [x]}]",
+		"clusters: [{name: a, backends: [x], cpu: lots}]",
+		"clusters: [{name: a, backends: [x], maxWorkspaces: -1}]",
+	} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPlace(t *testing.T) {
+	config, err := parseConfig([]byte(testPool))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	b := &fakeBackend{dependents: map[api.ID][]api.ID{
+		"shared-1": {"a", "b"},
+		"shared-2": {"c"},
+	}}
+	st := store.NewMemory()
+	now := time.Now()
+
+	releases := make(map[string]func() error)
+	place := func(spec api.Spec) (string, error) {
+		t.Helper()
+		if spec.Backend == "" {
+			spec.Backend = "gcp_namespace_only"
+		}
+		release, err := place(b, st, config, &spec, now)
+		releases[spec.Name] = release
+		return spec.ClusterStack, err
+	}
+
+	if got, err := place(api.Spec{Name: "d"}); err != nil || got != "pachyderm/helium/shared-2" {
+		t.Errorf("placed d in %q (%v), want the emptier shared-2", got, err)
+	}
+	// d now counts against shared-2 while it's created, so the two are level and shared-1 is
+	// first.
+	if got, err := place(api.Spec{Name: "e"}); err != nil || got != "shared-1" {
+		t.Errorf("placed e in %q (%v), want shared-1", got, err)
+	}
+	if got, err := place(api.Spec{Name: "f"}); err != nil || got != "pachyderm/helium/shared-2" {
+		t.Errorf("placed f in %q (%v), want shared-2", got, err)
+	}
+	if _, err := place(api.Spec{Name: "g"}); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("placing g in full clusters: %v, want ErrNoCapacity", err)
+	}
+	// Updating a workspace leaves it where it is, even in a full cluster.
+	if got, err := place(api.Spec{Name: "a"}); err != nil || got != "shared-1" {
+		t.Errorf("placed existing a in %q (%v), want shared-1, where it's deployed", got, err)
+	}
+	// A create that fails gives its place back.
+	if err := releases["f"](); err != nil {
+		t.Fatalf("release f: %v", err)
+	}
+	if got, err := place(api.Spec{Name: "g"}); err != nil || got != "pachyderm/helium/shared-2" {
+		t.Errorf("placed g in %q (%v), want shared-2, where f was", got, err)
+	}
+
+	if got, err := place(api.Spec{Name: "h", Labels: "gpu=true"}); err != nil || got != "gpu" {
+		t.Errorf("placed h in %q (%v), want gpu", got, err)
+	}
+	big := []byte("pachd:\n  resources:\n    requests:\n      cpu: 5\n")
+	if _, err := place(api.Spec{Name: "i", Labels: "gpu=true", ValuesYAMLContent: big}); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("placing i with too much cpu: %v, want ErrNoCapacity", err)
+	}
+	if _, err := place(api.Spec{Name: "j", Labels: "loadtesting=true"}); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("placing j with no loadtesting cluster: %v, want ErrNoCapacity", err)
+	}
+
+	if got, err := place(api.Spec{Name: "k", ClusterStack: "mine"}); err != nil || got != "mine" {
+		t.Errorf("placed k, which named its cluster, in %q (%v)", got, err)
+	}
+	if got, err := place(api.Spec{Name: "l", Backend: "gcp_cluster_only"}); err != nil || got != "" {
+		t.Errorf("placed l, a backend the pool doesn't serve, in %q (%v)", got, err)
+	}
+
+	// Placements that never turned into workspaces stop counting, and are forgotten.
+	now = now.Add(2 * pendingPlacementAge)
+	if got, err := place(api.Spec{Name: "m"}); err != nil || got != "pachyderm/helium/shared-2" {
+		t.Errorf("placed m in %q (%v), want shared-2", got, err)
+	}
+	keys, err := st.List(placementPrefix)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("placements are %v, want h, which is in the gpu cluster that wasn't looked at, and m", keys)
+	}
+}
+
+// racingStore places another workspace, as another replica would, just before the first
+// placement is recorded.
+type racingStore struct {
+	*store.Memory
+	race func()
+}
+
+func (s *racingStore) Put(key string, v any, version int64) (int64, error) {
+	if key == generationKey && s.race != nil {
+		race := s.race
+		s.race = nil
+		race()
+	}
+	return s.Memory.Put(key, v, version)
+}
+
+func TestPlaceConcurrently(t *testing.T) {
+	config, err := parseConfig([]byte(testPool))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	b := &fakeBackend{dependents: map[api.ID][]api.ID{
+		"shared-1": {"a", "b"},
+		"shared-2": {"c", "d"},
+	}}
+	st := &racingStore{Memory: store.NewMemory()}
+	now := time.Now()
+	other := api.Spec{Name: "e", Backend: "gcp_namespace_only"}
+	st.race = func() {
+		if _, err := place(b, st, config, &other, now); err != nil {
+			t.Errorf("placing e: %v", err)
+		}
+	}
+	// Both see one slot left in each cluster, but f must not take the one e just took.
+	spec := api.Spec{Name: "f", Backend: "gcp_namespace_only"}
+	if _, err := place(b, st, config, &spec, now); err != nil {
+		t.Fatalf("placing f: %v", err)
+	}
+	if spec.ClusterStack == other.ClusterStack {
+		t.Errorf("placed e and f both in %q", spec.ClusterStack)
+	}
+	if _, err := place(b, st, config, &api.Spec{Name: "g", Backend: "gcp_namespace_only"}, now); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("placing g in full clusters: %v, want ErrNoCapacity", err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	config, err := parseConfig([]byte(testPool))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	candidates := []Candidate{
+		{Cluster: &config.Clusters[0], Workspaces: 1},
+		{Cluster: &config.Clusters[1], Workspaces: 2},
+	}
+	r := &Request{Spec: &api.Spec{}}
+	if got := (LeastLoaded{}).Choose(r, candidates); got.Cluster.Name != "shared-1" {
+		t.Errorf("LeastLoaded chose %v", got.Cluster.Name)
+	}
+	if got := (BinPack{}).Choose(r, candidates); got.Cluster.Name != "pachyderm/helium/shared-2" {
+		t.Errorf("BinPack chose %v", got.Cluster.Name)
+	}
+}
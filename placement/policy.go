@@ -0,0 +1,110 @@
+package placement
+
+import (
+	"github.com/pachyderm/helium/api"
+)
+
+// Candidate is a cluster in the pool, with what's already placed in it.
+type Candidate struct {
+	Cluster *Cluster
+	// Workspaces is the number of workspaces deployed into the cluster, or being created in it.
+	Workspaces int
+	// Requested is what those workspaces' values request.
+	Requested Resources
+}
+
+// Fits reports whether the cluster has room for another workspace requesting r.
+func (c *Candidate) Fits(r Resources) bool {
+	cl := c.Cluster
+	if cl.MaxWorkspaces > 0 && c.Workspaces >= cl.MaxWorkspaces {
+		return false
+	}
+	if cl.capacity.MilliCPU > 0 && c.Requested.MilliCPU+r.MilliCPU > cl.capacity.MilliCPU {
+		return false
+	}
+	if cl.capacity.Memory > 0 && c.Requested.Memory+r.Memory > cl.capacity.Memory {
+		return false
+	}
+	return true
+}
+
+// Utilization returns the largest fraction of any of the cluster's limits that would be used with
+// another workspace requesting r, or 0 for a cluster without limits.
+func (c *Candidate) Utilization(r Resources) float64 {
+	cl := c.Cluster
+	var u float64
+	if cl.MaxWorkspaces > 0 {
+		u = maxFloat(u, float64(c.Workspaces+1)/float64(cl.MaxWorkspaces))
+	}
+	if cl.capacity.MilliCPU > 0 {
+		u = maxFloat(u, float64(c.Requested.MilliCPU+r.MilliCPU)/float64(cl.capacity.MilliCPU))
+	}
+	if cl.capacity.Memory > 0 {
+		u = maxFloat(u, float64(c.Requested.Memory+r.Memory)/float64(cl.capacity.Memory))
+	}
+	return u
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Request is a workspace to be placed.
+type Request struct {
+	Spec *api.Spec
+	// Resources is what the workspace's values request.
+	Resources Resources
+}
+
+// Policy chooses the cluster a workspace is placed in. It's given only the candidates that can take
+// the workspace, in the order the pool file lists them, and there's always at least one.
+type Policy interface {
+	Choose(r *Request, candidates []Candidate) *Candidate
+}
+
+// LeastLoaded spreads workspaces out: it chooses the candidate that would be least utilized, and
+// among equals the one with fewest workspaces.
+type LeastLoaded struct{}
+
+func (LeastLoaded) Choose(r *Request, candidates []Candidate) *Candidate {
+	best := &candidates[0]
+	for i := range candidates[1:] {
+		c := &candidates[i+1]
+		cu, bu := c.Utilization(r.Resources), best.Utilization(r.Resources)
+		if cu < bu || (cu == bu && c.Workspaces < best.Workspaces) {
+			best = c
+		}
+	}
+	return best
+}
+
+// BinPack fills clusters up before starting on the next, so that idle ones can be scaled down: it
+// chooses the candidate that would be most utilized, and among equals the one with most workspaces.
+type BinPack struct{}
+
+func (BinPack) Choose(r *Request, candidates []Candidate) *Candidate {
+	best := &candidates[0]
+	for i := range candidates[1:] {
+		c := &candidates[i+1]
+		cu, bu := c.Utilization(r.Resources), best.Utilization(r.Resources)
+		if cu > bu || (cu == bu && c.Workspaces > best.Workspaces) {
+			best = c
+		}
+	}
+	return best
+}
+
+// policies are the policies a pool file can name.
+var policies = map[string]Policy{
+	"least-loaded": LeastLoaded{},
+	"bin-pack":     BinPack{},
+}
+
+// Register makes a policy available to pool files under name. It must be called before any
+// placement, such as from an init function.
+func Register(name string, p Policy) {
+	policies[name] = p
+}
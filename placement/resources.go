@@ -0,0 +1,137 @@
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidValues is returned for a values file whose resource requests can't be read.
+var ErrInvalidValues = errors.New("invalid resource requests in values")
+
+// Resources is an amount of CPU, in millicores, and memory, in bytes.
+type Resources struct {
+	MilliCPU int64
+	Memory   int64
+}
+
+func (r Resources) add(o Resources) Resources {
+	return Resources{MilliCPU: r.MilliCPU + o.MilliCPU, Memory: r.Memory + o.Memory}
+}
+
+// Requests adds up the resource requests in a helm values file: every resources block's requests,
+// or its limits where it has no requests, as Kubernetes would default them.
+func Requests(values []byte) (Resources, error) {
+	var r Resources
+	if len(values) == 0 {
+		return r, nil
+	}
+	var v any
+	if err := yaml.Unmarshal(values, &v); err != nil {
+		return r, fmt.Errorf("%w: %v", ErrInvalidValues, err)
+	}
+	err := walkRequests(v, func(cpu, memory string) error {
+		if cpu != "" {
+			n, err := parseCPU(cpu)
+			if err != nil {
+				return err
+			}
+			r.MilliCPU += n
+		}
+		if memory != "" {
+			n, err := parseMemory(memory)
+			if err != nil {
+				return err
+			}
+			r.Memory += n
+		}
+		return nil
+	})
+	if err != nil {
+		return Resources{}, fmt.Errorf("%w: %v", ErrInvalidValues, err)
+	}
+	return r, nil
+}
+
+func walkRequests(v any, f func(cpu, memory string) error) error {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if k == "resources" {
+				if res, ok := child.(map[string]any); ok {
+					block, ok := res["requests"].(map[string]any)
+					if !ok {
+						block, _ = res["limits"].(map[string]any)
+					}
+					if err := f(quantity(block["cpu"]), quantity(block["memory"])); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if err := walkRequests(child, f); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if err := walkRequests(child, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quantity returns a quantity as a string, as YAML reads unquoted ones like 2 or 0.5 as numbers.
+func quantity(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// parseCPU parses a Kubernetes CPU quantity, like 2, 0.5 or 500m, into millicores.
+func parseCPU(s string) (int64, error) {
+	if strings.HasSuffix(s, "m") {
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, "m"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cpu %q: %w", s, err)
+		}
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cpu %q: %w", s, err)
+	}
+	return int64(math.Ceil(f * 1000)), nil
+}
+
+var memorySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseMemory parses a Kubernetes memory quantity, like 512Mi, 2G or 1048576, into bytes.
+func parseMemory(s string) (int64, error) {
+	multiplier := 1.0
+	n := s
+	for _, m := range memorySuffixes {
+		if strings.HasSuffix(s, m.suffix) {
+			n, multiplier = strings.TrimSuffix(s, m.suffix), m.multiplier
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memory %q: %w", s, err)
+	}
+	return int64(math.Ceil(f * multiplier)), nil
+}
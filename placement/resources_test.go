@@ -0,0 +1,64 @@
+package placement
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRequests(t *testing.T) {
+	values := []byte(`
+pachd:
+  resources:
+    requests:
+      cpu: 500m
+      memory: 1Gi
+    limits:
+      cpu: 2
+      memory: 4Gi
+console:
+  resources:
+    limits:
+      cpu: 0.25
+      memory: 256M
+etcd:
+  storageSize: 10Gi
+sidecars:
+  - resources:
+      requests:
+        cpu: "1"
+`)
+	got, err := Requests(values)
+	if err != nil {
+		t.Fatalf("Requests: %v", err)
+	}
+	want := Resources{MilliCPU: 500 + 250 + 1000, Memory: 1<<30 + 256e6}
+	if got != want {
+		t.Errorf("Requests = %+v, want %+v", got, want)
+	}
+
+	if got, err := Requests(nil); err != nil || got != (Resources{}) {
+		t.Errorf("Requests(nil) = %+v, %v", got, err)
+	}
+	for _, bad := range []string{
+		"pachd: [",
+		"pachd:\n  resources:\n    requests:\n      cpu: lots\n",
+		"pachd:\n  resources:\n    requests:\n      memory: 1Qi\n",
+	} {
+		if _, err := Requests([]byte(bad)); !errors.Is(err, ErrInvalidValues) {
+			t.Errorf("Requests(%q) = %v, want ErrInvalidValues", bad, err)
+		}
+	}
+}
+
+func TestParseQuantities(t *testing.T) {
+	for s, want := range map[string]int64{"2": 2000, "0.5": 500, "100m": 100, "1.5": 1500} {
+		if got, err := parseCPU(s); err != nil || got != want {
+			t.Errorf("parseCPU(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for s, want := range map[string]int64{"512Mi": 512 << 20, "2G": 2e9, "1024": 1024, "1.5Ki": 1536} {
+		if got, err := parseMemory(s); err != nil || got != want {
+			t.Errorf("parseMemory(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+}
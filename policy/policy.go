@@ -0,0 +1,230 @@
+// Package policy checks create requests against rules before anything is deployed. Each rule
+// looks at the spec, its parsed values file and its parsed infraJson, and reports the violations
+// it finds; the policy file picks which rules run and configures them. Rules are Go code,
+// registered by name, so a new kind of rule is a new Factory.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+)
+
+const defaultPolicyFile = "policies.yaml"
+
+// file is the path of the policy file, from SetFile.
+var file = defaultPolicyFile
+
+// ErrViolation is wrapped by every *Error, so that callers can tell violations from failures to
+// evaluate the rules.
+var ErrViolation = errors.New("create request violates policy")
+
+// SetFile sets the path of the policy file, from the config's files.policies.
+func SetFile(path string) { file = path }
+
+// File returns the path of the policy file.
+func File() string { return file }
+
+// Input is what rules are evaluated against.
+type Input struct {
+	Spec *api.Spec
+	// Values is the parsed values file, or nil if there isn't one.
+	Values map[string]any
+	// Infra is the parsed infraJson, or nil if there isn't one.
+	Infra *InfraSpec
+}
+
+// InfraSpec is the infraJson the AWS backends read.
+type InfraSpec struct {
+	K8s struct {
+		NodePools []NodePool `json:"nodepools"`
+	} `json:"k8s"`
+	RDS *struct {
+		NodeType string `json:"nodeType"`
+		DiskType string `json:"diskType"`
+		DiskSize int    `json:"diskSize"`
+		DiskIOPS int    `json:"diskIOPS"`
+	} `json:"rds"`
+}
+
+// NodePool is a node pool of an InfraSpec's cluster.
+type NodePool struct {
+	NodeType         string `json:"nodeType"`
+	NodeNumInstances int    `json:"nodeNumInstances"`
+	NodeDiskType     string `json:"nodeDiskType"`
+	NodeDiskSize     int    `json:"nodeDiskSize"`
+	NodeDiskIOPS     int    `json:"nodeDiskIOPS"`
+}
+
+// Violation is one way a create request breaks a rule. Rules needn't set its Rule.
+type Violation = api.PolicyViolation
+
+// Error is the violations of a create request.
+type Error struct {
+	Violations []Violation
+}
+
+// Response is the response to the create request.
+func (e *Error) Response() *api.PolicyResponse {
+	return &api.PolicyResponse{Error: ErrViolation.Error(), Violations: e.Violations}
+}
+
+func (e *Error) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, fmt.Sprintf("%s: %s: %s", v.Rule, v.Field, v.Message))
+	}
+	return fmt.Sprintf("%v: %s", ErrViolation, strings.Join(msgs, "; "))
+}
+
+func (e *Error) Unwrap() error { return ErrViolation }
+
+// Rule checks create requests.
+type Rule interface {
+	Check(in *Input) []Violation
+}
+
+// Factory makes a rule from its entry in the policy file, which it decodes its settings from.
+type Factory func(config *yaml.Node) (Rule, error)
+
+var factories = map[string]Factory{
+	"no-privileged":   newNoPrivileged,
+	"gpu-expiry":      newGPUExpiry,
+	"pachd-versions":  newPachdVersions,
+	"program-sources": newProgramSources,
+}
+
+// Register makes a kind of rule available to the policy file by name.
+func Register(name string, f Factory) {
+	factories[name] = f
+}
+
+// Config is the contents of the policy file.
+type Config struct {
+	Rules []RuleConfig `yaml:"rules"`
+
+	rules []namedRule
+}
+
+// RuleConfig is an entry in the policy file: the kind of rule, and its settings alongside.
+type RuleConfig struct {
+	Rule   string
+	config *yaml.Node
+}
+
+func (c *RuleConfig) UnmarshalYAML(n *yaml.Node) error {
+	var head struct {
+		Rule string `yaml:"rule"`
+	}
+	if err := n.Decode(&head); err != nil {
+		return err
+	}
+	c.Rule, c.config = head.Rule, n
+	return nil
+}
+
+type namedRule struct {
+	name string
+	Rule
+}
+
+// LoadConfig reads a policy file and makes its rules. Unlike the other config files, a missing
+// policy file is an error rather than an empty one: the program-sources rule is all that keeps
+// specs from running any repo's program with the server's credentials, so a mistyped path must
+// not turn the rules off.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy file: %w", err)
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse policy file: %w", err)
+	}
+	for _, rc := range c.Rules {
+		f, ok := factories[rc.Rule]
+		if !ok {
+			return nil, fmt.Errorf("policy file: unknown rule %q", rc.Rule)
+		}
+		r, err := f(rc.config)
+		if err != nil {
+			return nil, fmt.Errorf("policy file: rule %q: %w", rc.Rule, err)
+		}
+		c.rules = append(c.rules, namedRule{name: rc.Rule, Rule: r})
+	}
+	return &c, nil
+}
+
+// has reports whether the config has a rule of the named kind.
+func (c *Config) has(rule string) bool {
+	for _, r := range c.rules {
+		if r.name == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate checks a create request against the rules in the policy file, and returns an *Error
+// with every violation if it breaks any.
+func Evaluate(spec *api.Spec) error {
+	c, err := LoadConfig(File())
+	if err != nil {
+		return err
+	}
+	return c.Evaluate(spec)
+}
+
+// Evaluate checks a create request against the config's rules. Without a program-sources rule,
+// nothing says which repos are safe to run with the server's credentials, so a spec can't name a
+// programRepo at all.
+func (c *Config) Evaluate(spec *api.Spec) error {
+	if len(c.rules) == 0 && spec.ProgramRepo == "" {
+		return nil
+	}
+	in := &Input{Spec: spec}
+	var violations []Violation
+	if len(spec.ValuesYAMLContent) > 0 {
+		if err := yaml.Unmarshal(spec.ValuesYAMLContent, &in.Values); err != nil {
+			violations = append(violations, Violation{Rule: "parse", Field: "valuesYaml", Message: err.Error()})
+		}
+	}
+	if len(spec.InfraJSONContent) > 0 {
+		in.Infra = &InfraSpec{}
+		if err := json.Unmarshal(spec.InfraJSONContent, in.Infra); err != nil {
+			violations = append(violations, Violation{Rule: "parse", Field: "infraJson", Message: err.Error()})
+		}
+	}
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	for _, r := range c.rules {
+		for _, v := range r.Check(in) {
+			v.Rule = r.name
+			violations = append(violations, v)
+		}
+	}
+	if spec.ProgramRepo != "" && !c.has("program-sources") {
+		violations = append(violations, Violation{
+			Rule:    "program-sources",
+			Field:   "programRepo",
+			Message: "the policy file has no program-sources rule, so only the server's program is allowed",
+		})
+	}
+	if len(violations) > 0 {
+		sort.SliceStable(violations, func(i, j int) bool { return violations[i].Rule < violations[j].Rule })
+		return &Error{Violations: violations}
+	}
+	return nil
+}
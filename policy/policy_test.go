@@ -0,0 +1,142 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+)
+
+const testConfig = `
+rules:
+  - rule: no-privileged
+  - rule: gpu-expiry
+    maxExpiryDays: 3
+  - rule: pachd-versions
+    versions: ["2.5.*", "2.6.*"]
+  - rule: program-sources
+    repos: ["https://github.com/pachyderm/"]
+    refs: ["main", "release-*"]
+`
+
+func TestParseConfig(t *testing.T) {
+	if _, err := LoadConfig("../policies.yaml"); err != nil {
+		t.Errorf("LoadConfig of the shipped policy file: %v", err)
+	}
+	if _, err := LoadConfig("no-such-file.yaml"); err == nil {
+		t.Errorf("LoadConfig of a missing policy file succeeded, want an error")
+	}
+	for _, data := range []string{
+		"rules: [{rule: no-such-rule}]",
+		"rules: [{rule: gpu-expiry, maxExpiryDays: 0}]",
+		"rules: [{rule: pachd-versions}]",
+		"rules: [{rule: pachd-versions, versions: ['[']}]",
+		"rules: [{rule: program-sources}]",
+		"rules: [{rule: program-sources, repos: ['git@github.com:pachyderm/']}]",
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestEvaluateWithoutPolicyFile(t *testing.T) {
+	prev := File()
+	SetFile("no-such-file.yaml")
+	t.Cleanup(func() { SetFile(prev) })
+	if err := Evaluate(&api.Spec{ProgramRepo: "https://github.com/someone/poc-pulumi"}); err == nil {
+		t.Errorf("Evaluate of an outside program repo without a policy file succeeded, want an error")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	c, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := func(days int) string { return time.Now().AddDate(0, 0, days).Format(pulumi_backends.ExpiryFormat) }
+
+	for _, test := range []struct {
+		name string
+		spec api.Spec
+		want []string
+	}{
+		{"no violations", api.Spec{PachdVersion: "2.6.1", ValuesYAMLContent: []byte("pachd:\n  resources: {}\n")}, nil},
+		{"default pachd version", api.Spec{}, nil},
+		{"privileged", api.Spec{ValuesYAMLContent: []byte(`
+pachd:
+  securityContext:
+    privileged: true
+    allowPrivilegeEscalation: false
+worker:
+  containers:
+    - hostNetwork: true
+`)}, []string{"valuesYaml: pachd.securityContext.privileged", "valuesYaml: worker.containers.0.hostNetwork"}},
+		{"quoted privileged", api.Spec{ValuesYAMLContent: []byte(`
+pachd:
+  securityContext:
+    privileged: "true"
+    hostPID: yes
+    allowPrivilegeEscalation: "false"
+`)}, []string{"valuesYaml: pachd.securityContext.hostPID", "valuesYaml: pachd.securityContext.privileged"}},
+		{"capabilities", api.Spec{ValuesYAMLContent: []byte(`
+pachd:
+  securityContext:
+    capabilities:
+      add: [NET_BIND_SERVICE, SYS_ADMIN]
+      drop: [ALL]
+`)}, []string{"valuesYaml: pachd.securityContext.capabilities.add"}},
+		{"root", api.Spec{ValuesYAMLContent: []byte(`
+pachd:
+  securityContext:
+    runAsUser: 0
+console:
+  securityContext:
+    runAsUser: 1000
+`)}, []string{"valuesYaml: pachd.securityContext.runAsUser"}},
+		{"gpu node pool", api.Spec{Expiry: expiry(10), InfraJSONContent: []byte(`{"k8s":{"nodepools":[{"nodeType":"p3.2xlarge"}]}}`)}, []string{"expiry"}},
+		{"gpu node pool expiring soon", api.Spec{Expiry: expiry(2), InfraJSONContent: []byte(`{"k8s":{"nodepools":[{"nodeType":"p3.2xlarge"}]}}`)}, nil},
+		{"gpu label", api.Spec{Expiry: expiry(10), Labels: "team=ml,gpu=true"}, []string{"expiry"}},
+		{"gpu request", api.Spec{Expiry: expiry(10), ValuesYAMLContent: []byte("pachd:\n  resources:\n    limits:\n      nvidia.com/gpu: 1\n")}, []string{"expiry"}},
+		{"cpu node pool", api.Spec{Expiry: expiry(10), InfraJSONContent: []byte(`{"k8s":{"nodepools":[{"nodeType":"m5.xlarge"}]}}`)}, nil},
+		{"unsupported version", api.Spec{PachdVersion: "v2.4.0"}, []string{"pachdVersion"}},
+		{"allowed program", api.Spec{ProgramRepo: "https://github.com/pachyderm/poc-pulumi", ProgramRef: "release-1"}, nil},
+		{"disallowed program", api.Spec{ProgramRepo: "https://github.com/someone/poc-pulumi", ProgramRef: "wip"}, []string{"programRepo", "programRef"}},
+		{"invalid program repo", api.Spec{ProgramRepo: "http://github.com/pachyderm/poc-pulumi"}, []string{"programRepo"}},
+		{"invalid values", api.Spec{ValuesYAMLContent: []byte("pachd: [")}, []string{"valuesYaml"}},
+	} {
+		err := c.Evaluate(&test.spec)
+		var got []string
+		if err != nil {
+			var v *Error
+			if !errors.As(err, &v) || !errors.Is(err, ErrViolation) {
+				t.Errorf("%s: %v isn't a violation", test.name, err)
+				continue
+			}
+			for _, violation := range v.Violations {
+				got = append(got, violation.Field)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: violated %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateWithoutProgramSources(t *testing.T) {
+	for _, data := range []string{"rules: []", "rules: [{rule: no-privileged}]"} {
+		c, err := parseConfig([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Evaluate(&api.Spec{}); err != nil {
+			t.Errorf("%s: Evaluate of the server's program: %v", data, err)
+		}
+		if err := c.Evaluate(&api.Spec{ProgramRepo: "https://github.com/pachyderm/poc-pulumi"}); !errors.Is(err, ErrViolation) {
+			t.Errorf("%s: Evaluate of a spec's program repo = %v, want a violation", data, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/util"
+)
+
+// privilegedKeys are the settings, anywhere in a values file, that give pods more access to their
+// node than a workspace needs when they're turned on.
+var privilegedKeys = []string{"privileged", "allowPrivilegeEscalation", "hostNetwork", "hostPID", "hostIPC"}
+
+// privilegedCapabilities are the Linux capabilities that amount to root on the node.
+var privilegedCapabilities = []string{"ALL", "SYS_ADMIN", "SYS_MODULE", "SYS_PTRACE", "SYS_RAWIO", "NET_ADMIN"}
+
+// NoPrivileged forbids values files that turn on any of the privileged settings, add any of the
+// privileged capabilities, or run as root with runAsUser: 0.
+type NoPrivileged struct{}
+
+func newNoPrivileged(*yaml.Node) (Rule, error) { return NoPrivileged{}, nil }
+
+func (NoPrivileged) Check(in *Input) []Violation {
+	var violations []Violation
+	walkValues(in.Values, nil, func(keys []string, v any) {
+		field := "valuesYaml: " + strings.Join(keys, ".")
+		key := keys[len(keys)-1]
+		switch {
+		case contains(privilegedKeys, key) && isTrue(v):
+			violations = append(violations, Violation{Field: field, Message: key + " may not be turned on"})
+		case key == "runAsUser" && fmt.Sprint(v) == "0":
+			violations = append(violations, Violation{Field: field, Message: "containers may not run as root"})
+		case key == "add" && len(keys) > 1 && keys[len(keys)-2] == "capabilities":
+			caps, _ := v.([]any)
+			for _, c := range caps {
+				name := strings.TrimPrefix(strings.ToUpper(fmt.Sprint(c)), "CAP_")
+				if contains(privilegedCapabilities, name) {
+					violations = append(violations, Violation{Field: field, Message: "capability " + name + " may not be added"})
+				}
+			}
+		}
+	})
+	return violations
+}
+
+// isTrue reports whether a value turns a setting on: true, or a string that Helm's YAML parser or
+// a template could take for it, such as "true" or yes.
+func isTrue(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "yes", "on", "y":
+			return true
+		}
+	}
+	return false
+}
+
+// ProgramSources restricts the Pulumi programs workspaces are deployed from. A spec without a
+// programRepo or programRef gets the server's, which is always allowed.
+type ProgramSources struct {
+	// Repos are the prefixes programRepo must be under, such as "https://github.com/pachyderm/".
+	Repos []string `yaml:"repos"`
+	// Refs are patterns of the branches, tags or commits programRef may be, as matched by
+	// path.Match. Empty means any.
+	Refs []string `yaml:"refs"`
+}
+
+func newProgramSources(config *yaml.Node) (Rule, error) {
+	var r ProgramSources
+	if err := config.Decode(&r); err != nil {
+		return nil, err
+	}
+	if len(r.Repos) == 0 {
+		return nil, fmt.Errorf("repos must list at least one repo prefix")
+	}
+	for _, repo := range r.Repos {
+		if _, err := pulumi_backends.ProgramRepoUnder(repo, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPatterns(r.Refs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r ProgramSources) Check(in *Input) []Violation {
+	var violations []Violation
+	if repo := in.Spec.ProgramRepo; repo != "" {
+		ok, err := pulumi_backends.ProgramRepoUnder(repo, r.Repos)
+		switch {
+		case err != nil:
+			violations = append(violations, Violation{Field: "programRepo", Message: err.Error()})
+		case !ok:
+			violations = append(violations, Violation{
+				Field:   "programRepo",
+				Message: fmt.Sprintf("%s isn't under an allowed repo, which are %s", repo, strings.Join(r.Repos, ", ")),
+			})
+		}
+	}
+	if ref := in.Spec.ProgramRef; ref != "" && len(r.Refs) > 0 && !matchAny(r.Refs, ref) {
+		violations = append(violations, Violation{
+			Field:   "programRef",
+			Message: fmt.Sprintf("%s isn't an allowed ref, which are %s", ref, strings.Join(r.Refs, ", ")),
+		})
+	}
+	return violations
+}
+
+// GPUExpiry requires workspaces with GPUs to expire soon, because GPU nodes are expensive. A
+// workspace has GPUs if a node pool in its infraJson has one of NodeTypes, its values request
+// nvidia.com/gpu, or it's labelled gpu=true.
+type GPUExpiry struct {
+	MaxExpiryDays int `yaml:"maxExpiryDays"`
+	// NodeTypes are patterns of GPU node types, as matched by path.Match.
+	NodeTypes []string `yaml:"nodeTypes"`
+}
+
+func newGPUExpiry(config *yaml.Node) (Rule, error) {
+	r := GPUExpiry{MaxExpiryDays: 3, NodeTypes: []string{"p2.*", "p3.*", "p4d.*", "g4dn.*", "g5.*"}}
+	if err := config.Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.MaxExpiryDays <= 0 {
+		return nil, fmt.Errorf("maxExpiryDays must be positive, not %d", r.MaxExpiryDays)
+	}
+	if err := checkPatterns(r.NodeTypes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r GPUExpiry) Check(in *Input) []Violation {
+	reason := r.gpus(in)
+	if reason == "" {
+		return nil
+	}
+	expiryStr, err := pulumi_backends.ParseExpiry(in.Spec.Expiry)
+	if err != nil {
+		return []Violation{{Field: "expiry", Message: fmt.Sprintf("invalid expiry %q", in.Spec.Expiry)}}
+	}
+	expiry, err := time.Parse(pulumi_backends.ExpiryFormat, expiryStr)
+	if err != nil {
+		return []Violation{{Field: "expiry", Message: err.Error()}}
+	}
+	if expiry.After(time.Now().AddDate(0, 0, r.MaxExpiryDays)) {
+		return []Violation{{
+			Field:   "expiry",
+			Message: fmt.Sprintf("workspaces with GPUs (%s) must expire within %d days", reason, r.MaxExpiryDays),
+		}}
+	}
+	return nil
+}
+
+// gpus returns why the workspace has GPUs, or "" if it doesn't.
+func (r GPUExpiry) gpus(in *Input) string {
+	if in.Infra != nil {
+		for _, np := range in.Infra.K8s.NodePools {
+			if matchAny(r.NodeTypes, np.NodeType) {
+				return "node type " + np.NodeType
+			}
+		}
+	}
+	if util.ParseLabels(in.Spec.Labels)["gpu"] == "true" {
+		return "label gpu=true"
+	}
+	var requested bool
+	walkValues(in.Values, nil, func(keys []string, v any) {
+		requested = requested || keys[len(keys)-1] == "nvidia.com/gpu"
+	})
+	if requested {
+		return "nvidia.com/gpu in values"
+	}
+	return ""
+}
+
+// PachdVersions restricts workspaces to the pachd versions that are supported. A spec without a
+// pachdVersion gets the backend's default, which always is.
+type PachdVersions struct {
+	// Versions are patterns of supported versions, as matched by path.Match, such as "2.5.*".
+	Versions []string `yaml:"versions"`
+}
+
+func newPachdVersions(config *yaml.Node) (Rule, error) {
+	var r PachdVersions
+	if err := config.Decode(&r); err != nil {
+		return nil, err
+	}
+	if len(r.Versions) == 0 {
+		return nil, fmt.Errorf("versions must list at least one version")
+	}
+	if err := checkPatterns(r.Versions); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r PachdVersions) Check(in *Input) []Violation {
+	v := strings.TrimPrefix(in.Spec.PachdVersion, "v")
+	if v == "" || matchAny(r.Versions, v) {
+		return nil
+	}
+	return []Violation{{
+		Field:   "pachdVersion",
+		Message: fmt.Sprintf("%s isn't a supported version, which are %s", in.Spec.PachdVersion, strings.Join(r.Versions, ", ")),
+	}}
+}
+
+// walkValues calls f with the path to, and value of, every map entry in the parsed values v, in
+// order. Lists are walked into, with their indexes as keys.
+func walkValues(v any, keys []string, f func(keys []string, v any)) {
+	switch v := v.(type) {
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for k := range v {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			path := append(keys[:len(keys):len(keys)], k)
+			f(path, v[k])
+			walkValues(v[k], path, f)
+		}
+	case []any:
+		for i, e := range v {
+			walkValues(e, append(keys[:len(keys):len(keys)], fmt.Sprint(i)), f)
+		}
+	}
+}
+
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
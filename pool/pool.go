@@ -0,0 +1,250 @@
+// Package pool hands out prewarmed workspaces. The controlplane keeps a few ready, unclaimed
+// workspaces for each profile in the pools file, and a create request that asks for nothing a
+// profile doesn't provide claims one of them instead of waiting for a new stack.
+package pool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/util"
+)
+
+const (
+	defaultPoolsFile = "prewarm-pools.yaml"
+	// DefaultSize is the number of ready workspaces kept for a profile that doesn't set a size.
+	DefaultSize = 2
+	// DefaultMaxAge is how long an unclaimed workspace lives before the deletion controller
+	// replaces it with a fresh one.
+	DefaultMaxAge = 7 * 24 * time.Hour
+	// Label is set on every pool stack, with the profile name as its value.
+	Label = "helium-pool"
+)
+
+var (
+	// ErrNoMatch is returned by Claim when no profile provides the requested spec.
+	ErrNoMatch = errors.New("no prewarm pool matches the request")
+	// ErrNoneReady is returned by Claim when the matching pool is empty.
+	ErrNoneReady = errors.New("no prewarmed workspace is ready")
+
+	validProfileName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,48}[a-z0-9])?$`)
+)
+
+// poolsFile is the path of the pools file, from SetPoolsFile.
+var poolsFile = defaultPoolsFile
+
+// SetPoolsFile sets the path of the pools file, from the config's files.prewarmPools.
+func SetPoolsFile(path string) { poolsFile = path }
+
+// PoolsFile returns the path of the pools file.
+func PoolsFile() string { return poolsFile }
+
+// Profile is a kind of workspace to keep prewarmed.
+type Profile struct {
+	Name string `yaml:"name"`
+	// Size is the number of ready, unclaimed workspaces to keep.
+	Size int `yaml:"size"`
+	// Spec is what the workspaces are created with. Its name and expiry are ignored.
+	Spec api.Spec `yaml:"spec"`
+	// MaxAge is how long an unclaimed workspace is kept before it's replaced.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Config is the contents of the pools file.
+type Config struct {
+	Pools []Profile `yaml:"pools"`
+}
+
+// LoadConfig reads and validates a pools file. A missing file means there are no pools.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse prewarm pools: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if !validProfileName.MatchString(p.Name) {
+			return nil, fmt.Errorf("prewarm pool %d has an invalid name %q", i, p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("prewarm pool %q is listed twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Size < 0 {
+			return nil, fmt.Errorf("prewarm pool %q has a negative size", p.Name)
+		}
+		if p.Size == 0 {
+			p.Size = DefaultSize
+		}
+		if p.MaxAge == 0 {
+			p.MaxAge = DefaultMaxAge
+		}
+		p.Spec.Name = ""
+		p.Spec.Expiry = ""
+		if p.Spec.Backend == "" {
+			p.Spec.Backend = pulumi_backends.DefaultBackend()
+		}
+	}
+	return &c, nil
+}
+
+// StackPrefix is the prefix of the names of the profile's stacks.
+func (p *Profile) StackPrefix() string {
+	return "pool-" + p.Name + "-"
+}
+
+// NewStackName returns a fresh name for one of the profile's stacks.
+func (p *Profile) NewStackName() string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("read random bytes: %v", err)
+	}
+	return p.StackPrefix() + hex.EncodeToString(b)
+}
+
+// NewSpec returns the spec to create one of the profile's stacks with.
+func (p *Profile) NewSpec(now time.Time) api.Spec {
+	spec := p.Spec
+	spec.Name = p.NewStackName()
+	spec.Expiry = now.Add(p.MaxAge).Format("2006-01-02")
+	labels := util.ParseLabels(spec.Labels)
+	labels[Label] = p.Name
+	spec.Labels = util.FormatLabels(labels)
+	spec.CreatedBy = "helium-prewarm"
+	return spec
+}
+
+// Matches reports whether a workspace created from the profile is what spec asks for. The name,
+// expiry and creator are set when the workspace is claimed, so they don't matter; everything else
+// must be the same, and uploaded files never match.
+func (p *Profile) Matches(spec *api.Spec) bool {
+	if spec.ValuesYAML != "" || len(spec.ValuesYAMLContent) > 0 || spec.InfraJSON != "" || len(spec.InfraJSONContent) > 0 {
+		return false
+	}
+	backend := strings.ToLower(spec.Backend)
+	if backend == "" {
+		backend = pulumi_backends.DefaultBackend()
+	}
+	return backend == p.Spec.Backend &&
+		spec.PachdVersion == p.Spec.PachdVersion &&
+		spec.ConsoleVersion == p.Spec.ConsoleVersion &&
+		spec.NotebooksVersion == p.Spec.NotebooksVersion &&
+		spec.MountServerVersion == p.Spec.MountServerVersion &&
+		spec.HelmVersion == p.Spec.HelmVersion &&
+		spec.DisableNotebooks == p.Spec.DisableNotebooks &&
+		spec.ClusterStack == p.Spec.ClusterStack &&
+		spec.ProgramRepo == p.Spec.ProgramRepo &&
+		spec.ProgramRef == p.Spec.ProgramRef &&
+		util.FormatLabels(util.ParseLabels(spec.Labels)) == util.FormatLabels(util.ParseLabels(p.Spec.Labels))
+}
+
+// Match returns the first profile that matches spec, or nil.
+func (c *Config) Match(spec *api.Spec) *Profile {
+	for i := range c.Pools {
+		if c.Pools[i].Matches(spec) {
+			return &c.Pools[i]
+		}
+	}
+	return nil
+}
+
+// Backend is the part of pulumi_backends that claiming needs.
+type Backend interface {
+	List() (*api.ListResponse, error)
+	GetConnectionInfo(api.ID) (*api.GetConnectionInfoResponse, error)
+	GetClaim(api.ID) (*pulumi_backends.Claim, error)
+	PutClaim(*pulumi_backends.Claim) error
+}
+
+type pulumiBackend struct{}
+
+func (pulumiBackend) List() (*api.ListResponse, error) { return pulumi_backends.List() }
+func (pulumiBackend) GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
+	return pulumi_backends.GetConnectionInfo(i)
+}
+func (pulumiBackend) GetClaim(i api.ID) (*pulumi_backends.Claim, error) {
+	return pulumi_backends.GetClaim(i)
+}
+func (pulumiBackend) PutClaim(c *pulumi_backends.Claim) error { return pulumi_backends.PutClaim(c) }
+
+// Claim hands a ready workspace from the pool matching spec to its creator. The workspace gets
+// alias, if it isn't empty, as a second name, and the creator and expiry from spec.
+func Claim(spec *api.Spec, alias string) (api.ID, error) {
+	config, err := LoadConfig(PoolsFile())
+	if err != nil {
+		return "", err
+	}
+	return claim(pulumiBackend{}, config, spec, alias, time.Now())
+}
+
+func claim(b Backend, config *Config, spec *api.Spec, alias string, now time.Time) (api.ID, error) {
+	p := config.Match(spec)
+	if p == nil {
+		return "", ErrNoMatch
+	}
+	expiry, err := pulumi_backends.ParseExpiry(spec.Expiry)
+	if err != nil {
+		return "", err
+	}
+	ids, err := b.List()
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids.IDs {
+		if alias != "" && string(id) == alias {
+			return "", fmt.Errorf("alias %q: %w", alias, pulumi_backends.ErrAliasTaken)
+		}
+	}
+	for _, id := range ids.IDs {
+		if !strings.HasPrefix(string(id), p.StackPrefix()) {
+			continue
+		}
+		if c, err := b.GetClaim(id); err != nil || c != nil {
+			continue
+		}
+		info, err := b.GetConnectionInfo(id)
+		if err != nil || info.Workspace.Status != "ready" {
+			continue
+		}
+		err = b.PutClaim(&pulumi_backends.Claim{
+			Stack:     id,
+			Alias:     alias,
+			CreatedBy: spec.CreatedBy,
+			Expiry:    expiry,
+			ClaimedAt: now,
+		})
+		if err != nil {
+			if errors.Is(err, pulumi_backends.ErrAliasTaken) {
+				return "", err
+			}
+			// Someone else claimed it first.
+			log.WithError(err).Debugf("claim of %v failed", id)
+			continue
+		}
+		return id, nil
+	}
+	return "", ErrNoneReady
+}
@@ -0,0 +1,182 @@
+package pool
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+// TestMain gives the backend the default settings, which pools use for their default backend and
+// expiry.
+func TestMain(m *testing.M) {
+	pulumi_backends.Configure(config.Defaults())
+	os.Exit(m.Run())
+}
+
+type fakeBackend struct {
+	ids    []api.ID
+	status map[api.ID]string
+}
+
+func (f *fakeBackend) List() (*api.ListResponse, error) {
+	return &api.ListResponse{IDs: f.ids}, nil
+}
+
+func (f *fakeBackend) GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
+	return &api.GetConnectionInfoResponse{Workspace: api.ConnectionInfo{ID: i, Status: f.status[i]}}, nil
+}
+
+func (f *fakeBackend) GetClaim(i api.ID) (*pulumi_backends.Claim, error) {
+	return pulumi_backends.GetClaim(i)
+}
+
+func (f *fakeBackend) PutClaim(c *pulumi_backends.Claim) error {
+	return pulumi_backends.PutClaim(c)
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`
+pools:
+  - name: default
+  - name: big
+    size: 5
+    maxAge: 48h
+    spec:
+      backend: gcp_cluster_only
+      helmVersion: 2.5.0
+`))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(c.Pools) != 2 {
+		t.Fatalf("got %d pools, want 2", len(c.Pools))
+	}
+	d := c.Pools[0]
+	if d.Size != DefaultSize || d.MaxAge != DefaultMaxAge || d.Spec.Backend != "gcp_namespace_only" {
+		t.Errorf("default pool has size %d, max age %v and backend %q", d.Size, d.MaxAge, d.Spec.Backend)
+	}
+	if b := c.Pools[1]; b.Size != 5 || b.MaxAge != 48*time.Hour || b.Spec.HelmVersion != "2.5.0" {
+		t.Errorf("big pool is %+v", b)
+	}
+
+	for _, bad := range []string{
+		"pools: [{name: ''}]",
+		"pools: [{name: Default}]",
+		"pools: [{name: a}, {name: a}]",
+		"pools: [{name: a, size: -1}]",
+	} {
+		if _, err := parseConfig([]byte(bad)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	c, err := parseConfig([]byte(`
+pools:
+  - name: default
+  - name: pinned
+    spec:
+      helmVersion: 2.5.0
+`))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	for _, tc := range []struct {
+		spec api.Spec
+		want string
+	}{
+		{api.Spec{}, "default"},
+		{api.Spec{Name: "mine", Expiry: "2030-01-01", CreatedBy: "me"}, "default"},
+		{api.Spec{Backend: "GCP_Namespace_Only"}, "default"},
+		{api.Spec{HelmVersion: "2.5.0"}, "pinned"},
+		{api.Spec{HelmVersion: "2.4.0"}, ""},
+		{api.Spec{Backend: "aws_namespace_only"}, ""},
+		{api.Spec{Labels: "team=core"}, ""},
+		{api.Spec{ValuesYAMLContent: []byte("a: b")}, ""},
+	} {
+		var got string
+		if p := c.Match(&tc.spec); p != nil {
+			got = p.Name
+		}
+		if got != tc.want {
+			t.Errorf("Match(%+v) = %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestNewSpec(t *testing.T) {
+	p := Profile{Name: "default", MaxAge: 48 * time.Hour, Spec: api.Spec{Labels: "team=core"}}
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := p.NewSpec(now)
+	if !strings.HasPrefix(s.Name, "pool-default-") {
+		t.Errorf("name %q doesn't have the pool prefix", s.Name)
+	}
+	if s.Expiry != "2023-01-03" {
+		t.Errorf("expiry is %q, want 2023-01-03", s.Expiry)
+	}
+	if s.Labels != "helium-pool=default,team=core" {
+		t.Errorf("labels are %q", s.Labels)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	c, err := parseConfig([]byte("pools: [{name: default}]"))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	f := &fakeBackend{
+		ids: []api.ID{"other", "pool-default-aaaaaa", "pool-default-bbbbbb", "pool-default-cccccc"},
+		status: map[api.ID]string{
+			"other":               "ready",
+			"pool-default-aaaaaa": "creating",
+			"pool-default-bbbbbb": "ready",
+			"pool-default-cccccc": "ready",
+		},
+	}
+	now := time.Now()
+
+	id, err := claim(f, c, &api.Spec{CreatedBy: "a@example.com"}, "mine", now)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if id != "pool-default-bbbbbb" {
+		t.Errorf("claimed %v, want the first ready pool stack", id)
+	}
+	if got := pulumi_backends.Resolve("mine"); got != id {
+		t.Errorf("alias resolves to %v, want %v", got, id)
+	}
+	cl, err := pulumi_backends.GetClaim(id)
+	if err != nil || cl == nil {
+		t.Fatalf("GetClaim: %v, %v", cl, err)
+	}
+	if cl.CreatedBy != "a@example.com" || cl.Expiry != now.AddDate(0, 0, 1).Format("2006-01-02") {
+		t.Errorf("claim is %+v", cl)
+	}
+
+	if _, err := claim(f, c, &api.Spec{}, "mine", now); !errors.Is(err, pulumi_backends.ErrAliasTaken) {
+		t.Errorf("claim with a taken alias: got %v, want ErrAliasTaken", err)
+	}
+	if _, err := claim(f, c, &api.Spec{}, "other", now); !errors.Is(err, pulumi_backends.ErrAliasTaken) {
+		t.Errorf("claim with an existing stack's name: got %v, want ErrAliasTaken", err)
+	}
+	id, err = claim(f, c, &api.Spec{}, "", now)
+	if err != nil || id != "pool-default-cccccc" {
+		t.Errorf("second claim got %v, %v, want pool-default-cccccc", id, err)
+	}
+	if _, err := claim(f, c, &api.Spec{}, "", now); !errors.Is(err, ErrNoneReady) {
+		t.Errorf("claim from an empty pool: got %v, want ErrNoneReady", err)
+	}
+	if _, err := claim(f, c, &api.Spec{HelmVersion: "1.0.0"}, "", now); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("claim of an unpooled spec: got %v, want ErrNoMatch", err)
+	}
+}
@@ -0,0 +1,75 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+)
+
+// Backfill records what helium keeps in the store about each workspace, for workspaces from before
+// it did: the cluster stack it's deployed into, and who owns it until when. Without them, a
+// cluster could be destroyed under its workspaces, and quotas wouldn't count them. A workspace
+// that can't be backfilled is logged and skipped, so that it doesn't hold up the rest.
+func Backfill(ctx context.Context) error {
+	stacks, err := List()
+	if err != nil {
+		return err
+	}
+	return backfill(ctx, stacks.IDs, GetMetadata, GetExpiry)
+}
+
+func backfill(ctx context.Context, ids []api.ID, metadata func(api.ID) (*Metadata, error), expiry func(api.ID) (time.Time, error)) error {
+	var owners, failed int
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, err := backfillStack(id, metadata, expiry)
+		if err != nil {
+			log.Errorf("backfill %v: %v", id, err)
+			failed++
+			continue
+		}
+		if ok {
+			owners++
+		}
+	}
+	log.WithFields(log.Fields{
+		"canonical": "true",
+		"request":   "backfill",
+		"stacks":    len(ids),
+		"owners":    owners,
+		"failed":    failed,
+	}).Info("backfilled workspace records")
+	return nil
+}
+
+// backfillStack backfills one workspace, and reports whether it recorded an owner.
+func backfillStack(id api.ID, metadata func(api.ID) (*Metadata, error), expiry func(api.ID) (time.Time, error)) (bool, error) {
+	md, err := metadata(id)
+	if errors.Is(err, ErrStackNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := addDependent(md.ClusterStack, id); err != nil {
+		return false, err
+	}
+	e, err := expiry(id)
+	if errors.Is(err, ErrStackNotFound) || errors.Is(err, ErrUpdateInProgress) {
+		// Gone, or being created or updated, which records its owner itself.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := backfillOwner(id, md.CreatedBy, e); err != nil {
+		return false, err
+	}
+	return md.CreatedBy != "", nil
+}
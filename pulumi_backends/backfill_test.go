@@ -0,0 +1,44 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestBackfill(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	expiry := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	metadata := func(i api.ID) (*Metadata, error) {
+		if i == "broken" {
+			return nil, errors.New("corrupt stack")
+		}
+		return &Metadata{ClusterStack: "cluster", CreatedBy: string(i) + "@example.com"}, nil
+	}
+	expiries := func(api.ID) (time.Time, error) { return expiry, nil }
+	if err := backfill(context.Background(), []api.ID{"a", "broken", "b"}, metadata, expiries); err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+
+	deps, err := Dependents("cluster")
+	if err != nil {
+		t.Fatalf("Dependents: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"a", "b"}, deps); diff != "" {
+		t.Errorf("dependents (-want +got):\n%s", diff)
+	}
+	owned, err := Ownerships()
+	if err != nil {
+		t.Fatalf("Ownerships: %v", err)
+	}
+	if len(owned) != 2 || owned[0].Owner != "a@example.com" || owned[1].Owner != "b@example.com" {
+		t.Errorf("ownerships are %+v, want a's and b's, past the broken stack", owned)
+	}
+}
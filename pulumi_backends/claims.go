@@ -0,0 +1,106 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+// Claim records that a prewarmed workspace was handed to a user. The stack was created before
+// anyone asked for it, so its outputs describe the pool, and the claim takes precedence over them.
+type Claim struct {
+	Stack api.ID
+	// Alias is the name the user asked for, if any. It resolves to Stack everywhere an ID is
+	// accepted.
+	Alias     string
+	CreatedBy string
+	// Expiry uses the same format as the helium-expiry output.
+	Expiry    string
+	ClaimedAt time.Time
+}
+
+// ErrAliasTaken is returned by PutClaim when another claimed workspace already has the alias.
+var ErrAliasTaken = errors.New("alias is taken")
+
+type alias struct {
+	Stack api.ID
+}
+
+func claimKey(i api.ID) string    { return "claims/" + string(i) }
+func aliasKey(name string) string { return "aliases/" + name }
+
+// GetClaim returns the claim on a stack, or nil if it hasn't been claimed.
+func GetClaim(i api.ID) (*Claim, error) {
+	var c Claim
+	if _, err := store.Default().Get(claimKey(i), &c); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// PutClaim records a claim. It fails with store.ErrConflict if the stack has already been claimed,
+// so concurrent claims of the same stack can't both succeed, and with ErrAliasTaken if the alias
+// is taken.
+func PutClaim(c *Claim) error {
+	st := store.Default()
+	if c.Alias != "" {
+		if _, err := st.Put(aliasKey(c.Alias), alias{Stack: c.Stack}, 0); errors.Is(err, store.ErrConflict) {
+			return fmt.Errorf("alias %q: %w", c.Alias, ErrAliasTaken)
+		} else if err != nil {
+			return fmt.Errorf("alias %q: %w", c.Alias, err)
+		}
+	}
+	if _, err := st.Put(claimKey(c.Stack), c, 0); err != nil {
+		if c.Alias != "" {
+			st.Delete(aliasKey(c.Alias))
+		}
+		return fmt.Errorf("claim %q: %w", c.Stack, err)
+	}
+	if err := setOwner(c.Stack, c.CreatedBy, c.Expiry); err != nil {
+		return fmt.Errorf("claim %q: record owner: %w", c.Stack, err)
+	}
+	return nil
+}
+
+// Resolve returns the stack a workspace name refers to, following the alias of a claimed
+// prewarmed workspace. Names that aren't aliases are returned unchanged.
+func Resolve(i api.ID) api.ID {
+	var a alias
+	if _, err := store.Default().Get(aliasKey(string(i)), &a); err != nil {
+		return i
+	}
+	return a.Stack
+}
+
+// applyClaim overrides the connection info of a claimed workspace with its claim.
+func applyClaim(ci *api.ConnectionInfo) error {
+	c, err := GetClaim(ci.ID)
+	if err != nil || c == nil {
+		return err
+	}
+	ci.Alias = c.Alias
+	ci.CreatedBy = c.CreatedBy
+	ci.Expiry = c.Expiry
+	return nil
+}
+
+// forgetClaim removes the claim on a destroyed stack, and its alias.
+func forgetClaim(i api.ID) error {
+	c, err := GetClaim(i)
+	if err != nil || c == nil {
+		return err
+	}
+	st := store.Default()
+	if c.Alias != "" {
+		if err := st.Delete(aliasKey(c.Alias)); err != nil {
+			return err
+		}
+	}
+	return st.Delete(claimKey(i))
+}
@@ -0,0 +1,153 @@
+package pulumi_backends
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentialKeys are the config keys, without the helium: namespace, of the credentials each
+// workspace gets its own of, so that knowing one workspace's doesn't get anyone into another.
+var credentialKeys = []string{
+	"pachd-root-token",
+	"pachd-enterprise-secret",
+	"pachd-oauthClientSecret",
+	"console-oauthClientSecret",
+	"postgres-password",
+	"postgres-pg-password",
+}
+
+// rotatedCredentialKeys are the credentials RotateCredentials replaces. The postgres passwords
+// aren't, since postgres only reads them when its database is first created, so new ones would
+// lock pachd out of it.
+var rotatedCredentialKeys = []string{
+	"pachd-root-token",
+	"pachd-enterprise-secret",
+	"pachd-oauthClientSecret",
+	"console-oauthClientSecret",
+}
+
+// generateCredentials returns new random credentials for each of keys.
+func generateCredentials(keys []string) (map[string]string, error) {
+	creds := make(map[string]string, len(keys))
+	for _, k := range keys {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		creds[k] = hex.EncodeToString(b)
+	}
+	return creds, nil
+}
+
+// recordedCredentials returns the credentials in a stack's config. Stacks created before each
+// workspace had its own have the shared ones, until they're rotated.
+func recordedCredentials(config auto.ConfigMap) map[string]string {
+	creds := make(map[string]string)
+	for _, k := range credentialKeys {
+		if v := config["helium:"+k].Value; v != "" {
+			creds[k] = v
+		}
+	}
+	return creds
+}
+
+// workspaceCredentials returns the credentials to deploy a stack with: the ones it was last
+// deployed with, so that updating a workspace doesn't change them, and new ones for a new stack.
+func workspaceCredentials(ctx context.Context, s auto.Stack) (map[string]string, error) {
+	creds, err := generateCredentials(credentialKeys)
+	if err != nil {
+		return nil, err
+	}
+	u, err := latestDeployment(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		for k, v := range recordedCredentials(u.Config) {
+			creds[k] = v
+		}
+	}
+	return creds, nil
+}
+
+// Credentials returns the credentials a workspace was last successfully deployed with.
+func Credentials(i api.ID) (map[string]string, error) {
+	ctx := context.Background()
+	s, err := selectStack(ctx, Resolve(i))
+	if err != nil {
+		return nil, err
+	}
+	u, err := latestDeployment(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("stack %q has no successful updates, so no credentials yet", i)
+	}
+	return recordedCredentials(u.Config), nil
+}
+
+// RotateCredentials deploys a workspace again with new credentials, and the rest of the config of
+// its most recent successful update. If the deploy fails, the old credentials are put back in the
+// stack's config. It holds the workspace's lock, so it fails with ErrWorkspaceBusy while another
+// operation, such as a create, destroy or drift check, runs on the workspace.
+func RotateCredentials(i api.ID) error {
+	ctx := context.Background()
+	i = Resolve(i)
+	unlock, err := lockWorkspace(i, "credential rotation")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := programStack(ctx, i)
+	if err != nil {
+		return err
+	}
+	old, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return err
+	}
+	creds, err := generateCredentials(rotatedCredentialKeys)
+	if err != nil {
+		return err
+	}
+	for k, v := range creds {
+		if err := s.SetConfig(ctx, "helium:"+k, auto.ConfigValue{Value: v, Secret: true}); err != nil {
+			return restoreCredentials(ctx, s, old, err)
+		}
+	}
+	_, err = s.Up(ctx, optup.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": "rotate-credentials", "stream": "stdout"}))))
+	if err != nil {
+		return restoreCredentials(ctx, s, old, err)
+	}
+	return nil
+}
+
+// restoreCredentials puts the rotated credentials in old, a stack's config from before a rotation
+// that failed with err, back, so that the next update deploys them.
+func restoreCredentials(ctx context.Context, s auto.Stack, old auto.ConfigMap, err error) error {
+	for _, k := range rotatedCredentialKeys {
+		key := "helium:" + k
+		v, ok := old[key]
+		var rerr error
+		if ok {
+			rerr = s.SetConfig(ctx, key, v)
+		} else {
+			rerr = s.RemoveConfig(ctx, key)
+		}
+		if rerr != nil {
+			return fmt.Errorf("%w, and restoring the old credentials failed: %v", err, rerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package pulumi_backends
+
+import (
+	"testing"
+)
+
+func TestGenerateCredentials(t *testing.T) {
+	a, err := generateCredentials(credentialKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := generateCredentials(credentialKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range credentialKeys {
+		if len(a[k]) != 48 || a[k] == b[k] {
+			t.Errorf("%s: generated %q and %q, want two different 48 character credentials", k, a[k], b[k])
+		}
+	}
+}
+
+func TestRotatedCredentialsKeepPostgresPasswords(t *testing.T) {
+	for _, k := range rotatedCredentialKeys {
+		if k == "postgres-password" || k == "postgres-pg-password" {
+			t.Errorf("%s is rotated, but postgres only reads it when the database is created", k)
+		}
+	}
+}
+
+func TestRecordedCredentials(t *testing.T) {
+	creds := recordedCredentials(stackConfig("pachd-root-token", "root", "postgres-password", "", "pachd-version", "2.5.0"))
+	if len(creds) != 1 || creds["pachd-root-token"] != "root" {
+		t.Errorf("recordedCredentials = %v, want only the root token", creds)
+	}
+}
@@ -0,0 +1,233 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/catalog"
+	"github.com/pachyderm/helium/store"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrHasDependents is returned by Destroy for a cluster stack that workspaces are still
+	// deployed into.
+	ErrHasDependents = errors.New("stack has dependents")
+	// ErrInvalidClusterStack is returned by CheckClusterStack for a cluster stack that can't be
+	// deployed into.
+	ErrInvalidClusterStack = errors.New("invalid cluster stack")
+)
+
+// dependent records that a workspace is deployed into a cluster stack.
+type dependent struct {
+	Stack     api.ID
+	CreatedAt time.Time
+}
+
+func dependentsPrefix(parent api.ID) string    { return "dependents/" + string(parent) + "/" }
+func dependentKey(parent, child api.ID) string { return dependentsPrefix(parent) + string(child) }
+
+// ClusterStackID returns the helium stack a Spec.ClusterStack names, which may be a bare stack name
+// or fully qualified as <org>/helium/<name>. It reports false for a stack outside helium's project,
+// whose lifetime helium doesn't manage.
+func ClusterStackID(clusterStack string) (api.ID, bool) {
+	parts := strings.Split(clusterStack, "/")
+	switch {
+	case clusterStack == "":
+		return "", false
+	case len(parts) == 1:
+		return api.ID(clusterStack), true
+	case len(parts) == 3 && parts[1] == project:
+		return api.ID(parts[2]), true
+	}
+	return "", false
+}
+
+// Dependents returns the workspaces deployed into a stack.
+func Dependents(parent api.ID) ([]api.ID, error) {
+	st := store.Default()
+	keys, err := st.List(dependentsPrefix(parent))
+	if err != nil {
+		return nil, err
+	}
+	var ids []api.ID
+	for _, k := range keys {
+		ids = append(ids, api.ID(strings.TrimPrefix(k, dependentsPrefix(parent))))
+	}
+	return ids, nil
+}
+
+// LiveDependents returns the workspaces deployed into a stack, like Dependents, but first forgets
+// any whose stacks were removed without helium, which would otherwise keep the stack from ever
+// being destroyed.
+func LiveDependents(ctx context.Context, parent api.ID) ([]api.ID, error) {
+	return pruneDependents(parent, func(child api.ID) (bool, error) {
+		_, err := selectStack(ctx, child)
+		if errors.Is(err, ErrStackNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// pruneDependents forgets the dependents of parent that exists reports are gone, and returns the
+// rest.
+func pruneDependents(parent api.ID, exists func(api.ID) (bool, error)) ([]api.ID, error) {
+	deps, err := Dependents(parent)
+	if err != nil {
+		return nil, err
+	}
+	var live []api.ID
+	for _, d := range deps {
+		ok, err := exists(d)
+		if err != nil {
+			return nil, fmt.Errorf("check dependent %v of %v: %w", d, parent, err)
+		}
+		if ok {
+			live = append(live, d)
+			continue
+		}
+		log.Infof("forgetting dependent %v of %v, whose stack no longer exists", d, parent)
+		if err := store.Default().Delete(dependentKey(parent, d)); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// addDependent records that child is deployed into the cluster stack clusterStack, if helium
+// manages it. It reports whether it wasn't recorded already, so that a create that fails can forget
+// it again.
+func addDependent(clusterStack string, child api.ID) (bool, error) {
+	parent, ok := ClusterStackID(clusterStack)
+	if !ok {
+		return false, nil
+	}
+	_, err := store.Default().Put(dependentKey(parent, child), dependent{Stack: child, CreatedAt: time.Now().UTC()}, 0)
+	if errors.Is(err, store.ErrConflict) {
+		// Updating an existing workspace.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// removeDependent forgets that child is deployed into clusterStack, once child is destroyed.
+func removeDependent(clusterStack string, child api.ID) error {
+	parent, ok := ClusterStackID(clusterStack)
+	if !ok {
+		return nil
+	}
+	return store.Default().Delete(dependentKey(parent, child))
+}
+
+// CheckClusterStack checks that the cluster stack a spec deploys into exists, is a cluster, with a
+// backend c marks as one, and isn't being updated. A workspace can't outlive its cluster, so if
+// the spec asks for a later expiry than the cluster's, it's brought forward to the cluster's.
+func CheckClusterStack(spec *api.Spec, c *catalog.Catalog) error {
+	if spec.ClusterStack == "" {
+		return nil
+	}
+	parent, ok := ClusterStackID(spec.ClusterStack)
+	if !ok {
+		// Another project's stack can be checked for, but its expiry is its own business.
+		if _, err := selectStack(context.Background(), api.ID(spec.ClusterStack)); err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidClusterStack, spec.ClusterStack, err)
+		}
+		return nil
+	}
+	parentExpiry, err := GetExpiry(parent)
+	switch {
+	case errors.Is(err, ErrStackNotFound):
+		return fmt.Errorf("%w: %q doesn't exist", ErrInvalidClusterStack, spec.ClusterStack)
+	case errors.Is(err, ErrUpdateInProgress):
+		return fmt.Errorf("%w: %q is being updated, try again once it's ready", ErrInvalidClusterStack, spec.ClusterStack)
+	case err != nil:
+		return err
+	}
+	md, err := GetMetadata(parent)
+	if err != nil {
+		return err
+	}
+	if err := checkClusterBackend(spec.ClusterStack, md.Backend, c); err != nil {
+		return err
+	}
+	requested, err := ParseExpiry(spec.Expiry)
+	if err != nil {
+		return err
+	}
+	if requested > parentExpiry.Format(timeFormat) {
+		log.Infof("bringing expiry of %v forward from %v to that of its cluster stack %v", spec.Name, requested, parent)
+		spec.Expiry = parentExpiry.Format(timeFormat)
+	}
+	return nil
+}
+
+// checkClusterBackend checks that a cluster stack with backend is a cluster that workspaces can be
+// deployed into, rather than a workspace itself.
+func checkClusterBackend(clusterStack, backend string, c *catalog.Catalog) error {
+	if b := c.Get(backend); b == nil || !b.Cluster {
+		return fmt.Errorf("%w: %q has the %q backend, which isn't a cluster", ErrInvalidClusterStack, clusterStack, backend)
+	}
+	return nil
+}
+
+// clusterExpiry returns the expiry of the cluster stack a workspace is deployed into, or false if
+// the workspace isn't in a cluster helium manages, or that cluster's expiry can't be known yet.
+func clusterExpiry(clusterStack string) (time.Time, bool, error) {
+	parent, ok := ClusterStackID(clusterStack)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	expiry, err := GetExpiry(parent)
+	if errors.Is(err, ErrStackNotFound) || errors.Is(err, ErrUpdateInProgress) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return expiry, true, nil
+}
+
+// CascadeDependents returns everything DestroyCascade would destroy before a stack: the workspaces
+// deployed into it, and into those, and so on.
+func CascadeDependents(ctx context.Context, i api.ID) ([]api.ID, error) {
+	deps, err := LiveDependents(ctx, Resolve(i))
+	if err != nil {
+		return nil, err
+	}
+	all := deps
+	for _, d := range deps {
+		more, err := CascadeDependents(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, more...)
+	}
+	return all, nil
+}
+
+// DestroyCascade destroys a stack after everything deployed into it, depth first.
+func DestroyCascade(ctx context.Context, i api.ID) error {
+	i = Resolve(i)
+	deps, err := LiveDependents(ctx, i)
+	if err != nil {
+		return err
+	}
+	for _, d := range deps {
+		log.Infof("destroying %v, which is deployed into %v", d, i)
+		err := DestroyCascade(ctx, d)
+		if errors.Is(err, ErrStackNotFound) {
+			// Removed without helium, so nothing forgot it.
+			err = store.Default().Delete(dependentKey(i, d))
+		}
+		if err != nil {
+			return fmt.Errorf("destroy dependent %v of %v: %w", d, i, err)
+		}
+	}
+	return Destroy(ctx, i)
+}
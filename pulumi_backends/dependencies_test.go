@@ -0,0 +1,122 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/catalog"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestClusterStackID(t *testing.T) {
+	testData := []struct {
+		clusterStack string
+		want         api.ID
+		wantOK       bool
+	}{
+		{clusterStack: ""},
+		{clusterStack: "my-cluster", want: "my-cluster", wantOK: true},
+		{clusterStack: "pachyderm/helium/my-cluster", want: "my-cluster", wantOK: true},
+		{clusterStack: "pachyderm/ci-cluster/main"},
+		{clusterStack: "helium/my-cluster"},
+	}
+	for _, test := range testData {
+		t.Run(test.clusterStack, func(t *testing.T) {
+			got, ok := ClusterStackID(test.clusterStack)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("ClusterStackID(%q) = %q, %v; want %q, %v", test.clusterStack, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestDependents(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+
+	for _, d := range []struct {
+		cluster string
+		child   api.ID
+	}{
+		{"cluster", "b"},
+		{"pachyderm/helium/cluster", "a"},
+		{"cluster-2", "c"},
+		{"pachyderm/other/cluster", "d"},
+		{"", "e"},
+	} {
+		if _, err := addDependent(d.cluster, d.child); err != nil {
+			t.Fatalf("addDependent(%q, %q): %v", d.cluster, d.child, err)
+		}
+	}
+	// Updating a workspace records it again, but it wasn't added by the update.
+	if added, err := addDependent("cluster", "a"); err != nil || added {
+		t.Fatalf("addDependent again: %v, %v", added, err)
+	}
+
+	got, err := Dependents("cluster")
+	if err != nil {
+		t.Fatalf("Dependents: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"a", "b"}, got); diff != "" {
+		t.Errorf("dependents (-want +got):\n%s", diff)
+	}
+
+	if err := removeDependent("cluster", "a"); err != nil {
+		t.Fatalf("removeDependent: %v", err)
+	}
+	if err := removeDependent("pachyderm/other/cluster", "d"); err != nil {
+		t.Fatalf("removeDependent of external cluster: %v", err)
+	}
+	got, err = Dependents("cluster")
+	if err != nil {
+		t.Fatalf("Dependents: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"b"}, got); diff != "" {
+		t.Errorf("dependents after removal (-want +got):\n%s", diff)
+	}
+}
+
+func TestPruneDependents(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+
+	for _, child := range []api.ID{"a", "b", "c"} {
+		if _, err := addDependent("cluster", child); err != nil {
+			t.Fatalf("addDependent(%q): %v", child, err)
+		}
+	}
+	// b was destroyed without helium.
+	exists := func(i api.ID) (bool, error) { return i != "b", nil }
+	got, err := pruneDependents("cluster", exists)
+	if err != nil {
+		t.Fatalf("pruneDependents: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"a", "c"}, got); diff != "" {
+		t.Errorf("live dependents (-want +got):\n%s", diff)
+	}
+	got, err = Dependents("cluster")
+	if err != nil {
+		t.Fatalf("Dependents: %v", err)
+	}
+	if diff := cmp.Diff([]api.ID{"a", "c"}, got); diff != "" {
+		t.Errorf("dependents after pruning (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckClusterBackend(t *testing.T) {
+	c := &catalog.Catalog{Backends: []catalog.Backend{
+		{Name: "gcp_namespace_only"},
+		{Name: "gcp_cluster_only", Cluster: true},
+	}}
+	if err := checkClusterBackend("cluster", "gcp_cluster_only", c); err != nil {
+		t.Errorf("cluster backend: %v", err)
+	}
+	for _, backend := range []string{"gcp_namespace_only", "retired", ""} {
+		if err := checkClusterBackend("workspace", backend, c); !errors.Is(err, ErrInvalidClusterStack) {
+			t.Errorf("deploying into a %q stack: %v, want ErrInvalidClusterStack", backend, err)
+		}
+	}
+}
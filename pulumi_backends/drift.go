@@ -0,0 +1,187 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+	"github.com/pachyderm/helium/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResourceDrift is a resource whose live state no longer matches what the stack's program
+// declares, typically because someone changed it by hand.
+type ResourceDrift struct {
+	URN  string
+	Type string
+	// Op is what reapplying the stack would do to the resource: "create", "update", "delete" or
+	// "replace".
+	Op string
+	// Diffs are the properties that differ.
+	Diffs []string `json:",omitempty"`
+}
+
+// Drift is the result of the most recent drift check of a stack.
+type Drift struct {
+	CheckedAt time.Time
+	Drifted   bool
+	Resources []ResourceDrift `json:",omitempty"`
+}
+
+func driftKey(i api.ID) string { return "drift/" + string(i) }
+
+// GetDrift returns the result of the last drift check of a stack, or nil if it hasn't been checked.
+func GetDrift(i api.ID) (*Drift, error) {
+	var d Drift
+	if _, err := store.Default().Get(driftKey(i), &d); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+// putDrift replaces the recorded drift of a stack. Only the controlplane leader checks drift, so
+// the latest check wins a conflict.
+func putDrift(i api.ID, d *Drift) error {
+	st := store.Default()
+	for {
+		version, err := st.Get(driftKey(i), &Drift{})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if _, err := st.Put(driftKey(i), d, version); !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func driftRefreshKey(i api.ID) string { return "drift-refreshes/" + string(i) }
+
+// driftRefresh records that a drift check is refreshing a stack. Helium otherwise only refreshes a
+// stack on the way to destroying it, so Retry needs to tell an interrupted drift check apart.
+type driftRefresh struct {
+	StartedAt time.Time
+}
+
+// startDriftRefresh records that a drift check is about to refresh a stack.
+func startDriftRefresh(i api.ID) error {
+	st := store.Default()
+	for {
+		version, err := st.Get(driftRefreshKey(i), &driftRefresh{})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if _, err := st.Put(driftRefreshKey(i), driftRefresh{StartedAt: time.Now().UTC()}, version); !errors.Is(err, store.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// endDriftRefresh forgets that a drift check was refreshing a stack, once the refresh has finished
+// or something else is about to refresh it.
+func endDriftRefresh(i api.ID) error {
+	return store.Default().Delete(driftRefreshKey(i))
+}
+
+// isDriftRefresh reports whether the last refresh helium started on a stack was a drift check's.
+func isDriftRefresh(i api.ID) (bool, error) {
+	_, err := store.Default().Get(driftRefreshKey(i), &driftRefresh{})
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// forgetDrift removes the recorded drift of a stack that was destroyed or reapplied.
+func forgetDrift(i api.ID) error {
+	return store.Default().Delete(driftKey(i))
+}
+
+// applyDrift marks the connection info of a workspace whose last drift check found drift.
+func applyDrift(ci *api.ConnectionInfo) error {
+	d, err := GetDrift(ci.ID)
+	if err != nil || d == nil {
+		return err
+	}
+	ci.Drifted = d.Drifted
+	ci.DriftCheckedAt = d.CheckedAt.Format(time.RFC3339)
+	return nil
+}
+
+// CheckDrift refreshes a stack, so its state matches what's really deployed, then previews
+// reapplying its program to find the resources that no longer match it. The result is recorded
+// for GetDrift.
+func CheckDrift(ctx context.Context, i api.ID) (*Drift, error) {
+	unlock, err := lockWorkspace(i, "drift check")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	s, err := programStack(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := startDriftRefresh(i); err != nil {
+		return nil, err
+	}
+	_, err = s.Refresh(ctx, optrefresh.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": "drift-refresh", "stream": "stdout"}))))
+	// An interrupted refresh is left pending, and the record of why it was run must outlast it.
+	if ctx.Err() == nil {
+		if err := endDriftRefresh(i); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("refresh %q: %w", i, err)
+	}
+
+	evs := make(chan events.EngineEvent)
+	done := make(chan []ResourceDrift)
+	go func() {
+		var rs []ResourceDrift
+		for ev := range evs {
+			if r, ok := resourceDrift(ev); ok {
+				rs = append(rs, r)
+			}
+		}
+		done <- rs
+	}()
+	_, err = s.Preview(ctx, optpreview.EventStreams(evs), optpreview.Diff())
+	// Preview closes evs once it's done with them, even if it fails.
+	rs := <-done
+	if err != nil {
+		return nil, fmt.Errorf("preview %q: %w", i, err)
+	}
+
+	d := &Drift{CheckedAt: time.Now().UTC(), Drifted: len(rs) > 0, Resources: rs}
+	if err := putDrift(i, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// resourceDrift returns the drifted resource an engine event from a preview describes, if any.
+// Resources that are unchanged or only read aren't drift, and nor are the create-replacement and
+// delete-replaced steps that accompany every replace.
+func resourceDrift(ev events.EngineEvent) (ResourceDrift, bool) {
+	if ev.ResourcePreEvent == nil {
+		return ResourceDrift{}, false
+	}
+	md := ev.ResourcePreEvent.Metadata
+	switch md.Op {
+	case "create", "update", "delete", "replace":
+	default:
+		return ResourceDrift{}, false
+	}
+	return ResourceDrift{URN: md.URN, Type: md.Type, Op: string(md.Op), Diffs: md.Diffs}, true
+}
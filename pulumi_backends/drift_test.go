@@ -0,0 +1,41 @@
+package pulumi_backends
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+func TestResourceDrift(t *testing.T) {
+	pre := func(op apitype.OpType, urn string, diffs ...string) events.EngineEvent {
+		return events.EngineEvent{EngineEvent: apitype.EngineEvent{ResourcePreEvent: &apitype.ResourcePreEvent{
+			Metadata: apitype.StepEventMetadata{Op: op, URN: urn, Type: "kubernetes:apps/v1:Deployment", Diffs: diffs},
+		}}}
+	}
+	evs := []events.EngineEvent{
+		{EngineEvent: apitype.EngineEvent{SummaryEvent: &apitype.SummaryEvent{}}},
+		pre("same", "urn:same"),
+		pre("read", "urn:read"),
+		pre("update", "urn:pachd", "spec"),
+		pre("create", "urn:deleted-by-hand"),
+		pre("create-replacement", "urn:console"),
+		pre("replace", "urn:console", "metadata"),
+		pre("delete-replaced", "urn:console"),
+	}
+	var got []ResourceDrift
+	for _, ev := range evs {
+		if r, ok := resourceDrift(ev); ok {
+			got = append(got, r)
+		}
+	}
+	want := []ResourceDrift{
+		{URN: "urn:pachd", Type: "kubernetes:apps/v1:Deployment", Op: "update", Diffs: []string{"spec"}},
+		{URN: "urn:deleted-by-hand", Type: "kubernetes:apps/v1:Deployment", Op: "create"},
+		{URN: "urn:console", Type: "kubernetes:apps/v1:Deployment", Op: "replace", Diffs: []string{"metadata"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("drift (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,190 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoSuchUpdate is returned by Rollback for a version that isn't a successful update of the stack.
+var ErrNoSuchUpdate = errors.New("no successful update with that version")
+
+// versionKeys are the config keys, without the helium: namespace, that pin what a workspace runs.
+var versionKeys = []string{
+	"helm-chart-version",
+	"pachd-version",
+	"console-version",
+	"notebooks-version",
+	"mount-server-version",
+}
+
+// History returns every update of a stack, newest first.
+func History(i api.ID) (*api.HistoryResponse, error) {
+	ctx := context.Background()
+	s, err := selectStack(ctx, Resolve(i))
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	updates := summarizeHistory(history)
+	for n := range updates {
+		updates[n].URL = updateURL(info.URL, updates[n].Version)
+	}
+	return &api.HistoryResponse{Updates: updates}, nil
+}
+
+// latestUpdate returns the most recent update of a stack, or nil if it has none.
+func latestUpdate(ctx context.Context, s auto.Stack) (*auto.UpdateSummary, error) {
+	history, err := s.History(ctx, 1, 1)
+	if err != nil || len(history) == 0 {
+		return nil, err
+	}
+	return &history[0], nil
+}
+
+// latestDeployment returns the most recent successful update of a stack, whose config is what's
+// deployed, or nil if it has none.
+func latestDeployment(ctx context.Context, s auto.Stack) (*auto.UpdateSummary, error) {
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return lastSucceeded(history), nil
+}
+
+// lastSucceeded returns the most recent update in history, newest first, that succeeded, or nil.
+// Refreshes don't count: they deploy nothing, whatever config they ran with.
+func lastSucceeded(history []auto.UpdateSummary) *auto.UpdateSummary {
+	for n := range history {
+		if history[n].Kind == "update" && history[n].Result == "succeeded" {
+			return &history[n]
+		}
+	}
+	return nil
+}
+
+// updateURL returns the link to an update of a stack, whose own link is stackURL, in the Pulumi
+// console. Self-managed backends have no console, and so no links. An update that is still
+// starting may not have a version yet, so it gets the stack's link.
+func updateURL(stackURL string, version int) string {
+	if stackURL == "" || version == 0 {
+		return stackURL
+	}
+	return fmt.Sprintf("%s/updates/%d", stackURL, version)
+}
+
+// summarizeHistory converts stack history, newest first, into updates. Each update's changed
+// versions are found by comparing its config with that of the update before it.
+func summarizeHistory(history []auto.UpdateSummary) []api.Update {
+	updates := make([]api.Update, len(history))
+	for n, h := range history {
+		u := api.Update{
+			Version:   h.Version,
+			Kind:      h.Kind,
+			Result:    h.Result,
+			StartTime: h.StartTime,
+		}
+		if h.EndTime != nil {
+			u.EndTime = *h.EndTime
+		}
+		if h.ResourceChanges != nil {
+			u.ResourceChanges = *h.ResourceChanges
+		}
+		var previous auto.ConfigMap
+		if n+1 < len(history) {
+			previous = history[n+1].Config
+		}
+		for _, k := range versionKeys {
+			v := h.Config["helium:"+k].Value
+			if v != previous["helium:"+k].Value {
+				if u.Changed == nil {
+					u.Changed = make(map[string]string)
+				}
+				u.Changed[k] = v
+			}
+		}
+		updates[n] = u
+	}
+	return updates
+}
+
+// Rollback deploys a stack again with the config of an earlier successful update, such as the one
+// before an upgrade that broke it. The stack keeps its current expiry, labels and credentials, so
+// a rollback can't bring back an expiry it has been extended past, or credentials that have been
+// rotated. It holds the workspace's lock.
+func Rollback(i api.ID, version int) error {
+	ctx := context.Background()
+	i = Resolve(i)
+	unlock, err := lockWorkspace(i, "rollback")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return err
+	}
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		return err
+	}
+	config, err := rollbackConfig(history, version)
+	if err != nil {
+		return fmt.Errorf("roll back %q to version %d: %w", i, version, err)
+	}
+	s, err = configuredStack(ctx, i, config)
+	if err != nil {
+		return err
+	}
+	_, err = s.Up(ctx, optup.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": "rollback", "stream": "stdout"}))))
+	if err != nil {
+		return err
+	}
+	return forgetDrift(i)
+}
+
+// rollbackConfig returns the config of the given successful update, with the expiry, labels and
+// credentials of the most recent successful update, which are what's deployed. A failed update or
+// a refresh since then doesn't change them.
+func rollbackConfig(history []auto.UpdateSummary, version int) (auto.ConfigMap, error) {
+	var target auto.ConfigMap
+	for _, h := range history {
+		if h.Version == version && h.Kind == "update" && h.Result == "succeeded" {
+			target = h.Config
+			break
+		}
+	}
+	if target == nil {
+		return nil, ErrNoSuchUpdate
+	}
+	config := make(auto.ConfigMap, len(target))
+	for k, v := range target {
+		config[k] = v
+	}
+	kept := []string{"helium:expiry", "helium:labels"}
+	for _, k := range credentialKeys {
+		kept = append(kept, "helium:"+k)
+	}
+	latest := lastSucceeded(history)
+	for _, k := range kept {
+		if v, ok := latest.Config[k]; ok {
+			config[k] = v
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,104 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+
+	"github.com/pachyderm/helium/api"
+)
+
+func stackConfig(kv ...string) auto.ConfigMap {
+	c := auto.ConfigMap{}
+	for n := 0; n < len(kv); n += 2 {
+		c["helium:"+kv[n]] = auto.ConfigValue{Value: kv[n+1]}
+	}
+	return c
+}
+
+var testHistory = []auto.UpdateSummary{
+	{Version: 4, Kind: "refresh", Result: "succeeded", Config: stackConfig("pachd-version", "2.5.0", "expiry", "2023-03-01", "labels", "team=core", "pachd-root-token", "rotated")},
+	{Version: 3, Kind: "update", Result: "failed", Config: stackConfig("pachd-version", "2.5.0", "expiry", "2023-02-01")},
+	{Version: 2, Kind: "update", Result: "succeeded", Config: stackConfig("pachd-version", "2.4.1", "console-version", "2.4.0", "expiry", "2023-02-01", "pachd-root-token", "original")},
+	{Version: 1, Kind: "update", Result: "succeeded", Config: stackConfig("pachd-version", "2.4.0", "expiry", "2023-02-01")},
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	end := "2023-01-01T00:10:00Z"
+	history := append([]auto.UpdateSummary(nil), testHistory...)
+	history[3].StartTime = "2023-01-01T00:00:00Z"
+	history[3].EndTime = &end
+	history[3].ResourceChanges = &map[string]int{"create": 12}
+
+	want := []api.Update{
+		{Version: 4, Kind: "refresh", Result: "succeeded"},
+		{Version: 3, Kind: "update", Result: "failed", Changed: map[string]string{"pachd-version": "2.5.0", "console-version": ""}},
+		{Version: 2, Kind: "update", Result: "succeeded", Changed: map[string]string{"pachd-version": "2.4.1", "console-version": "2.4.0"}},
+		{
+			Version:         1,
+			Kind:            "update",
+			Result:          "succeeded",
+			StartTime:       "2023-01-01T00:00:00Z",
+			EndTime:         end,
+			Changed:         map[string]string{"pachd-version": "2.4.0"},
+			ResourceChanges: map[string]int{"create": 12},
+		},
+	}
+	if diff := cmp.Diff(want, summarizeHistory(history)); diff != "" {
+		t.Errorf("summarizeHistory (-want +got):\n%s", diff)
+	}
+}
+
+func TestRollbackConfig(t *testing.T) {
+	// Since version 2, an update extended the expiry, labelled the workspace and rotated its
+	// credentials, then a later update failed and a refresh ran.
+	history := append([]auto.UpdateSummary{
+		{Version: 7, Kind: "refresh", Result: "succeeded", Config: stackConfig("pachd-version", "2.6.0", "expiry", "2023-05-01", "pachd-root-token", "refreshed")},
+		{Version: 6, Kind: "update", Result: "failed", Config: stackConfig("pachd-version", "2.6.0", "expiry", "2023-05-01", "pachd-root-token", "failed")},
+		{Version: 5, Kind: "update", Result: "succeeded", Config: stackConfig("pachd-version", "2.5.0", "expiry", "2023-03-01", "labels", "team=core", "pachd-root-token", "rotated")},
+	}, testHistory[1:]...)
+	got, err := rollbackConfig(history, 2)
+	if err != nil {
+		t.Fatalf("rollbackConfig: %v", err)
+	}
+	want := stackConfig("pachd-version", "2.4.1", "console-version", "2.4.0", "expiry", "2023-03-01", "labels", "team=core", "pachd-root-token", "rotated")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("rollbackConfig (-want +got):\n%s", diff)
+	}
+	if testHistory[2].Config["helium:expiry"].Value != "2023-02-01" {
+		t.Errorf("rollbackConfig modified the history")
+	}
+	for _, v := range []int{3, 4, 5} {
+		if _, err := rollbackConfig(testHistory, v); !errors.Is(err, ErrNoSuchUpdate) {
+			t.Errorf("rollbackConfig(%d) = %v, want ErrNoSuchUpdate", v, err)
+		}
+	}
+}
+
+func TestUpdateURL(t *testing.T) {
+	stack := "https://app.pulumi.com/pachyderm/helium/ws-1"
+	if got, want := updateURL(stack, 3), stack+"/updates/3"; got != want {
+		t.Errorf("updateURL = %q, want %q", got, want)
+	}
+	if got := updateURL(stack, 0); got != stack {
+		t.Errorf("updateURL for an update without a version yet = %q, want the stack's %q", got, stack)
+	}
+	// Self-managed backends have no console to link to.
+	if got := updateURL("", 3); got != "" {
+		t.Errorf("updateURL for a self-managed backend = %q, want none", got)
+	}
+}
+
+func TestLastSucceeded(t *testing.T) {
+	if u := lastSucceeded(testHistory); u == nil || u.Version != 2 {
+		t.Errorf("lastSucceeded skipping a refresh = %+v, want version 2", u)
+	}
+	if u := lastSucceeded(testHistory[1:]); u == nil || u.Version != 2 {
+		t.Errorf("lastSucceeded skipping a failed update = %+v, want version 2", u)
+	}
+	if u := lastSucceeded(testHistory[1:2]); u != nil {
+		t.Errorf("lastSucceeded of only a failed update = %+v, want nil", u)
+	}
+}
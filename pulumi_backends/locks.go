@@ -0,0 +1,120 @@
+package pulumi_backends
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+const (
+	workspaceLockPrefix = "workspace-locks/"
+	// workspaceLockDuration is how long a workspace's lock outlasts a holder that died without
+	// unlocking it. Holders renew it every third of that.
+	workspaceLockDuration = time.Minute
+)
+
+// ErrWorkspaceBusy is returned for an operation on a workspace while another operation that it
+// could race holds the workspace's lock.
+var ErrWorkspaceBusy = errors.New("workspace busy")
+
+// WorkspaceLock is the record kept in the store while an operation, such as a create, destroy,
+// drift check or credential rotation, runs on a workspace on any replica.
+type WorkspaceLock struct {
+	Op        string
+	Holder    string
+	RenewedAt time.Time
+	Duration  time.Duration
+}
+
+func (l *WorkspaceLock) expired(now time.Time) bool {
+	return !now.Before(l.RenewedAt.Add(l.Duration))
+}
+
+func workspaceLockKey(i api.ID) string { return workspaceLockPrefix + string(i) }
+
+// lockWorkspace takes a workspace's lock for op, and renews it until unlock is called. It returns
+// ErrWorkspaceBusy if another operation holds it.
+func lockWorkspace(i api.ID, op string) (unlock func(), err error) {
+	return lockWorkspaceIn(store.Default(), i, op, workspaceLockDuration)
+}
+
+// LockWorkspace takes a workspace's lock for op, for a caller that runs several operations on it
+// as one, such as the recovery controller. It returns ErrWorkspaceBusy if another operation holds it.
+func LockWorkspace(i api.ID, op string) (unlock func(), err error) {
+	return lockWorkspace(Resolve(i), op)
+}
+
+func lockWorkspaceIn(st store.Store, i api.ID, op string, d time.Duration) (func(), error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	mine := WorkspaceLock{Op: op, Holder: hex.EncodeToString(b), Duration: d}
+	key := workspaceLockKey(i)
+	for {
+		var cur WorkspaceLock
+		version, err := st.Get(key, &cur)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+		if err == nil && !cur.expired(time.Now()) {
+			return nil, fmt.Errorf("%w: %v is running a %s", ErrWorkspaceBusy, i, cur.Op)
+		}
+		mine.RenewedAt = time.Now()
+		_, err = st.Put(key, mine, version)
+		if errors.Is(err, store.ErrConflict) {
+			// Another operation took or released the lock since we read it.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(d / 3):
+			}
+			if err := renewWorkspaceLock(st, key, &mine, d); err != nil {
+				log.WithField("stack", i).Errorf("renew %s lock: %v", op, err)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		// Expire the lock rather than deleting it, so the unlock can't race a takeover.
+		if err := renewWorkspaceLock(st, key, &mine, 0); err != nil {
+			log.WithField("stack", i).Errorf("release %s lock: %v", op, err)
+		}
+	}, nil
+}
+
+// renewWorkspaceLock renews a held lock for d. It fails if the lock is no longer held.
+func renewWorkspaceLock(st store.Store, key string, mine *WorkspaceLock, d time.Duration) error {
+	var cur WorkspaceLock
+	version, err := st.Get(key, &cur)
+	if err != nil {
+		return err
+	}
+	if cur.Holder != mine.Holder {
+		return fmt.Errorf("lock was taken over by a %s", cur.Op)
+	}
+	next := *mine
+	next.RenewedAt, next.Duration = time.Now(), d
+	_, err = st.Put(key, next, version)
+	return err
+}
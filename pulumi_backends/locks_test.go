@@ -0,0 +1,48 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/store"
+)
+
+func TestLockWorkspace(t *testing.T) {
+	st := store.NewMemory()
+	unlock, err := lockWorkspaceIn(st, "a", "create", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("lock a: %v", err)
+	}
+	if _, err := lockWorkspaceIn(st, "a", "credential rotation", 30*time.Millisecond); !errors.Is(err, ErrWorkspaceBusy) {
+		t.Fatalf("second lock of a: %v, want busy", err)
+	}
+	other, err := lockWorkspaceIn(st, "b", "destroy", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("lock b: %v", err)
+	}
+	other()
+
+	// The holder renews the lock for as long as it holds it.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := lockWorkspaceIn(st, "a", "credential rotation", 30*time.Millisecond); !errors.Is(err, ErrWorkspaceBusy) {
+		t.Fatalf("lock of a held past its duration: %v, want busy", err)
+	}
+	unlock()
+	unlock, err = lockWorkspaceIn(st, "a", "credential rotation", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("lock of a after unlocking: %v", err)
+	}
+	unlock()
+
+	// A lock its holder stopped renewing can be taken over once it expires.
+	if _, err := st.Put(workspaceLockKey("c"), WorkspaceLock{Op: "create", Holder: "dead", RenewedAt: time.Now(), Duration: 10 * time.Millisecond}, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	unlock, err = lockWorkspaceIn(st, "c", "destroy", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("lock of c after its holder died: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,83 @@
+package pulumi_backends
+
+import (
+	"context"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/opthistory"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/util"
+)
+
+// Metadata is what helium recorded about a stack in the config of its most recent update.
+type Metadata struct {
+	// ClusterStack is the cluster a workspace was deployed into. It's empty for workspaces in
+	// the default cluster, and for stacks that are clusters themselves.
+	ClusterStack string
+	Backend      string
+	Labels       map[string]string
+	// CreatedBy is who the workspace belongs to: whoever claimed it, for a claimed prewarmed
+	// workspace, and whoever created it otherwise.
+	CreatedBy string
+	// CreatedAt is when the stack was first created. Stacks created before helium recorded it
+	// report the start of their oldest update instead, which is their first deployment.
+	CreatedAt time.Time
+}
+
+// GetMetadata returns the metadata recorded for a stack, with its claimant as CreatedBy if it's a
+// claimed prewarmed workspace.
+func GetMetadata(i api.ID) (*Metadata, error) {
+	ctx := context.Background()
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	md, err := getMetadata(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	c, err := GetClaim(i)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		md.CreatedBy = c.CreatedBy
+	}
+	return md, nil
+}
+
+func getMetadata(ctx context.Context, s auto.Stack) (*Metadata, error) {
+	history, err := s.History(ctx, 1, 1, opthistory.ShowSecrets(false))
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return &Metadata{}, nil
+	}
+	config := history[0].Config
+	md := &Metadata{
+		ClusterStack: config["helium:cluster-stack"].Value,
+		Backend:      config["helium:backend"].Value,
+		Labels:       util.ParseLabels(config["helium:labels"].Value),
+		CreatedBy:    config["helium:created-by"].Value,
+	}
+	if t, err := time.Parse(time.RFC3339, config["helium:created-at"].Value); err == nil {
+		md.CreatedAt = t
+		return md, nil
+	}
+	// Only stacks from before helium recorded created-at get here, so reading their whole
+	// history is rare.
+	all, err := s.History(ctx, 0, 0, opthistory.ShowSecrets(false))
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		return md, nil
+	}
+	if t, err := time.Parse(time.RFC3339, all[len(all)-1].StartTime); err == nil {
+		md.CreatedAt = t
+	}
+	return md, nil
+}
@@ -0,0 +1,130 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+const ownershipPrefix = "owners/"
+
+// Ownership records who a workspace belongs to and when it expires, so that quotas can count
+// what each user has without asking Pulumi about every stack. It's written when a workspace is
+// created or claimed, and removed when it's destroyed.
+type Ownership struct {
+	Workspace api.ID
+	Owner     string
+	Expiry    time.Time
+	CreatedAt time.Time
+}
+
+func ownershipKey(i api.ID) string { return ownershipPrefix + string(i) }
+
+// setOwner records that a workspace belongs to owner until expiry, in the format of the
+// helium-expiry output. Updating a workspace keeps when it was created.
+func setOwner(i api.ID, owner, expiry string) error {
+	if owner == "" {
+		return nil
+	}
+	e, err := time.Parse(timeFormat, expiry)
+	if err != nil {
+		return err
+	}
+	st := store.Default()
+	var o Ownership
+	version, err := st.Get(ownershipKey(i), &o)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = time.Now().UTC()
+	}
+	o.Workspace, o.Owner, o.Expiry = i, owner, e
+	_, err = st.Put(ownershipKey(i), o, version)
+	return err
+}
+
+// updatedOwner returns who a workspace with metadata md belongs to once requested creates or
+// updates it. An update keeps the workspace's owner, whoever makes it: the claimant of a claimed
+// prewarmed workspace, and whoever created it otherwise. md is nil for a new workspace.
+func updatedOwner(i api.ID, md *Metadata, requested string) (string, error) {
+	c, err := GetClaim(i)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case c != nil:
+		return c.CreatedBy, nil
+	case md != nil && md.CreatedBy != "":
+		return md.CreatedBy, nil
+	}
+	return requested, nil
+}
+
+// ReserveOwner records that a workspace belongs to owner until expiry before it's created, so it
+// counts against the owner's quota while it is. release puts back whatever was recorded before,
+// for a create that fails.
+func ReserveOwner(i api.ID, owner, expiry string) (release func() error, err error) {
+	st := store.Default()
+	var prev Ownership
+	_, err = st.Get(ownershipKey(i), &prev)
+	existed := err == nil
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if err := setOwner(i, owner, expiry); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if !existed {
+			return forgetOwner(i)
+		}
+		version, err := st.Get(ownershipKey(i), &Ownership{})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		_, err = st.Put(ownershipKey(i), prev, version)
+		return err
+	}, nil
+}
+
+// backfillOwner records the owner of a workspace from before helium recorded owners, unless one is
+// recorded already.
+func backfillOwner(i api.ID, owner string, expiry time.Time) error {
+	if owner == "" {
+		return nil
+	}
+	o := Ownership{Workspace: i, Owner: owner, Expiry: expiry}
+	if _, err := store.Default().Put(ownershipKey(i), o, 0); err != nil && !errors.Is(err, store.ErrConflict) {
+		return err
+	}
+	return nil
+}
+
+// forgetOwner removes the ownership of a destroyed workspace.
+func forgetOwner(i api.ID) error {
+	return store.Default().Delete(ownershipKey(i))
+}
+
+// Ownerships returns the ownership of every workspace that has an owner.
+func Ownerships() ([]Ownership, error) {
+	st := store.Default()
+	keys, err := st.List(ownershipPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var owned []Ownership
+	for _, k := range keys {
+		var o Ownership
+		if _, err := st.Get(k, &o); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		owned = append(owned, o)
+	}
+	return owned, nil
+}
@@ -0,0 +1,83 @@
+package pulumi_backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestOwners(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+
+	for _, o := range []struct {
+		id     api.ID
+		owner  string
+		expiry string
+	}{
+		{"a", "someone@example.com", "2030-01-02"},
+		{"b", "other@example.com", "2030-01-02"},
+		{"prewarm-1", "helium-prewarm", "2030-01-02"},
+		{"c", "", "2030-01-02"},
+	} {
+		if err := setOwner(o.id, o.owner, o.expiry); err != nil {
+			t.Fatalf("setOwner(%v): %v", o.id, err)
+		}
+	}
+	if err := PutClaim(&Claim{Stack: "prewarm-1", CreatedBy: "Someone@example.com", Expiry: "2030-02-01"}); err != nil {
+		t.Fatalf("PutClaim: %v", err)
+	}
+	// Backfilling only records owners that weren't recorded.
+	if err := backfillOwner("a", "backfill@example.com", time.Now()); err != nil {
+		t.Fatalf("backfillOwner of a: %v", err)
+	}
+	if err := backfillOwner("d", "old@example.com", time.Now()); err != nil {
+		t.Fatalf("backfillOwner of d: %v", err)
+	}
+	if err := forgetOwner("b"); err != nil {
+		t.Fatalf("forgetOwner: %v", err)
+	}
+
+	owned, err := Ownerships()
+	if err != nil {
+		t.Fatalf("Ownerships: %v", err)
+	}
+	if len(owned) != 3 || owned[0].Workspace != "a" || owned[1].Workspace != "d" || owned[2].Workspace != "prewarm-1" {
+		t.Fatalf("ownerships are %+v, want a, d and prewarm-1", owned)
+	}
+	if owned[0].Owner != "someone@example.com" {
+		t.Errorf("a is owned by %q after backfilling, want its recorded owner", owned[0].Owner)
+	}
+	if o := owned[2]; o.Owner != "Someone@example.com" || o.Expiry.Format(timeFormat) != "2030-02-01" {
+		t.Errorf("claimed workspace is %+v, want the claimant's with the claim's expiry", o)
+	}
+}
+
+func TestUpdatedOwner(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	if err := PutClaim(&Claim{Stack: "prewarm-1", CreatedBy: "claimant@example.com", Expiry: "2030-02-01"}); err != nil {
+		t.Fatalf("PutClaim: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		id   api.ID
+		md   *Metadata
+		want string
+	}{
+		{"new workspace", "a", nil, "admin@example.com"},
+		{"update", "a", &Metadata{CreatedBy: "dev@example.com"}, "dev@example.com"},
+		{"update of a workspace nobody owns", "a", &Metadata{}, "admin@example.com"},
+		{"update of a claimed workspace", "prewarm-1", &Metadata{CreatedBy: "helium-prewarm"}, "claimant@example.com"},
+	} {
+		got, err := updatedOwner(test.id, test.md, "admin@example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: owned by %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package pulumi_backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+
+	"github.com/pachyderm/helium/api"
+)
+
+const (
+	defaultProgramRepo = "https://github.com/pachyderm/poc-pulumi.git"
+	defaultProgramRef  = "refs/heads/main"
+	// trustedRepoPrefix is where repos that may be sent HELIUM_GITHUB_PERSONAL_TOKEN live.
+	trustedRepoPrefix = "https://github.com/pachyderm/"
+)
+
+// ErrInvalidProgramSource is returned for a spec's program repo that isn't an https URL.
+var ErrInvalidProgramSource = errors.New("invalid program source")
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ProgramSource is where the Pulumi programs come from: either a directory on the server, or a git
+// repo at a branch, tag or commit. Either way, the program for a backend is in the subdirectory
+// named after it.
+type ProgramSource struct {
+	Dir  string
+	Repo string
+	Ref  string
+}
+
+// DefaultProgramSource returns the program source in the config: its program dir, or failing that
+// its program repo and ref.
+func DefaultProgramSource() ProgramSource {
+	p := settings().Program
+	if p.Dir != "" {
+		return ProgramSource{Dir: p.Dir}
+	}
+	return ProgramSource{Repo: p.Repo, Ref: p.Ref}
+}
+
+// specProgramSource returns the program source a spec asks for. A spec can only pick a repo and
+// ref, never a directory on the server; whichever it leaves out comes from the config's program
+// repo and ref.
+func specProgramSource(req *api.Spec) ProgramSource {
+	if req.ProgramRepo == "" && req.ProgramRef == "" {
+		return DefaultProgramSource()
+	}
+	src := ProgramSource{Repo: req.ProgramRepo, Ref: req.ProgramRef}
+	if src.Repo == "" {
+		src.Repo = settings().Program.Repo
+	}
+	if src.Ref == "" {
+		src.Ref = settings().Program.Ref
+	}
+	return src
+}
+
+// CheckProgramSource checks the program repo a spec asks for, if any. It must be an https URL, so
+// that a spec can't have the server run a program from its own filesystem. Which repos may be used
+// is up to the program-sources policy rule.
+func CheckProgramSource(spec *api.Spec) error {
+	if spec.ProgramRepo == "" {
+		return nil
+	}
+	_, err := parseProgramRepo(spec.ProgramRepo)
+	return err
+}
+
+// ProgramRepoUnder reports whether repo is under one of prefixes, such as
+// "https://github.com/pachyderm/". It returns ErrInvalidProgramSource if repo isn't an https URL.
+func ProgramRepoUnder(repo string, prefixes []string) (bool, error) {
+	u, err := parseProgramRepo(repo)
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range prefixes {
+		if p, err := url.Parse(prefix); err == nil && underPrefix(u, p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseProgramRepo parses a spec's program repo, which must be a plain https URL.
+func parseProgramRepo(repo string) (*url.URL, error) {
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%w: %q isn't an https URL", ErrInvalidProgramSource, repo)
+	}
+	return u, nil
+}
+
+// underPrefix reports whether the repo u is on the same host as the prefix p, and within its path,
+// once both paths are cleaned of any "..".
+func underPrefix(u, p *url.URL) bool {
+	if p.Scheme != u.Scheme || !strings.EqualFold(p.Host, u.Host) {
+		return false
+	}
+	dir := path.Clean("/" + p.Path)
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return strings.HasPrefix(path.Clean("/"+u.Path), dir)
+}
+
+// recordedProgramSource returns the program source recorded in the config of a stack's update,
+// pinned to the commit that was deployed. Stacks from before it was recorded used poc-pulumi's
+// main branch.
+func recordedProgramSource(config auto.ConfigMap) ProgramSource {
+	if dir := config["helium:program-dir"].Value; dir != "" {
+		return ProgramSource{Dir: dir}
+	}
+	src := ProgramSource{Repo: config["helium:program-repo"].Value, Ref: config["helium:program-commit"].Value}
+	if src.Repo == "" {
+		src.Repo = defaultProgramRepo
+	}
+	if src.Ref == "" {
+		src.Ref = defaultProgramRef
+	}
+	return src
+}
+
+// gitRepo returns the auto.GitRepo for a backend's program. A ref that is a full commit hash is
+// checked out as a commit, and anything else as a branch or tag.
+func (p ProgramSource) gitRepo(backend string) auto.GitRepo {
+	repo := auto.GitRepo{URL: p.Repo, ProjectPath: backend}
+	if commitHash.MatchString(p.Ref) {
+		repo.CommitHash = p.Ref
+	} else {
+		repo.Branch = p.Ref
+	}
+	if trusted, _ := ProgramRepoUnder(p.Repo, []string{trustedRepoPrefix}); trusted {
+		repo.Auth = &auto.GitAuth{PersonalAccessToken: settings().Program.GitHubToken}
+	}
+	return repo
+}
+
+// upsertStack creates or selects a stack with the program for backend.
+func (p ProgramSource) upsertStack(ctx context.Context, stackName, backend string) (auto.Stack, error) {
+	if p.Dir != "" {
+		return auto.UpsertStackLocalSource(ctx, stackName, filepath.Join(p.Dir, backend))
+	}
+	return auto.UpsertStackRemoteSource(ctx, stackName, p.gitRepo(backend))
+}
+
+// config returns the stack config that records where a stack's program came from, including the
+// commit that the stack's workspace has checked out, so the stack can be deployed again from
+// exactly the same program. The program exports the commit as an output; see deployedCommit.
+func (p ProgramSource) config(s auto.Stack) (map[string]string, error) {
+	commit, err := headCommit(s.Workspace().WorkDir())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"program-dir":    p.Dir,
+		"program-repo":   p.Repo,
+		"program-ref":    p.Ref,
+		"program-commit": commit,
+	}, nil
+}
+
+// deployedCommit returns the commit of the program a stack was deployed from. Programs export the
+// helium:program-commit config as their helium-program-commit output, as they do helium:expiry as
+// helium-expiry; for a stack deployed by a program from before they did, it's the config of the
+// latest update, which may be nil.
+func deployedCommit(outs auto.OutputMap, latest *auto.UpdateSummary) string {
+	if commit, ok := outs["helium-program-commit"].Value.(string); ok && commit != "" {
+		return commit
+	}
+	if latest == nil {
+		return ""
+	}
+	return latest.Config["helium:program-commit"].Value
+}
+
+// headCommit returns the commit checked out in the git repo containing dir, or "" if dir isn't in
+// one, as a local program directory may not be.
+func headCommit(dir string) (string, error) {
+	r, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
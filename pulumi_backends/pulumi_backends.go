@@ -2,6 +2,7 @@ package pulumi_backends
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -17,35 +18,51 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 
 	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/config"
+	"github.com/pachyderm/helium/secrets"
 	"github.com/pachyderm/helium/util"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // This implementation is mostly a thin wrapper around https://github.com/pachyderm/pulumihttp/
-func init() {
-	ensurePlugins()
-}
 
-//
 const (
 	//BackendName = "gcp-namespace-pulumi"
 	timeFormat = "2006-01-02"
+	// ExpiryFormat is the layout of expiry dates, in specs and the helium-expiry output.
+	ExpiryFormat = timeFormat
 )
 
 var (
-	project           = "helium"
-	clientSecret      = os.Getenv("HELIUM_CLIENT_SECRET")
-	clientID          = os.Getenv("HELIUM_CLIENT_ID")
-	expirationNumDays = os.Getenv("HELIUM_DEFAULT_EXPIRATION_DAYS")
-	auth0Domain       = "https://***REMOVED***.auth0.com/"
+	project = "helium"
+
+	// serverConfig is the server's settings, from Configure.
+	serverConfig *config.Config
 )
 
+// Configure sets the server settings that workspaces are created with, and the plugins that
+// EnsurePlugins installs.
+func Configure(c *config.Config) { serverConfig = c }
+
+// settings returns the server settings. It panics if Configure wasn't called, rather than creating
+// workspaces with settings nobody chose.
+func settings() *config.Config {
+	if serverConfig == nil {
+		log.Panic("pulumi_backends: Configure wasn't called")
+	}
+	return serverConfig
+}
+
+// DefaultBackend returns the backend of workspaces that don't name one.
+func DefaultBackend() string { return settings().DefaultBackend }
+
 func GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
 	log.WithField("backend", "pulumi").Debugf("Get Info")
 
+	i = Resolve(i)
 	stackName := string(i)
 	// we don't need a program since we're just getting stack outputs
 	var program pulumi.RunFunc = nil
@@ -73,6 +90,16 @@ func GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
 		"resourcecount":    info.ResourceCount,
 	}).Infof("get stack info")
 
+	// The link and commit are extras, and not worth failing the whole request over.
+	latest, err := latestUpdate(ctx, s)
+	if err != nil {
+		log.WithError(err).Warnf("reading latest update of %v", i)
+	}
+	pulumiURL := updateURL(info.URL, 0)
+	if latest != nil {
+		pulumiURL = updateURL(info.URL, latest.Version)
+	}
+
 	if !info.UpdateInProgress {
 		// fetch the outputs from the stack
 		outs, err := s.Outputs(ctx)
@@ -84,11 +111,9 @@ func GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
 		if !ok {
 			return &api.GetConnectionInfoResponse{
 				Workspace: api.ConnectionInfo{
-					Status: "failed",
-					ID:     i,
-					// Updates aren't supported, so first update is always accurate
-					// TODO: ^That isn't true anymore
-					PulumiURL:   info.URL + "/updates/1",
+					Status:      "failed",
+					ID:          i,
+					PulumiURL:   pulumiURL,
 					LastUpdated: info.LastUpdate,
 				},
 			}, nil
@@ -132,28 +157,36 @@ func GetConnectionInfo(i api.ID) (*api.GetConnectionInfoResponse, error) {
 			juypterUrlInfo = ""
 		}
 
-		return &api.GetConnectionInfoResponse{Workspace: api.ConnectionInfo{
-			Status:       status,
-			ID:           i,
-			K8s:          k8sInfo,
-			PulumiURL:    info.URL + "/updates/1",
-			LastUpdated:  info.LastUpdate,
-			K8sNamespace: outs["k8sNamespace"].Value.(string),
-			ConsoleURL:   "https://" + outs["consoleUrl"].Value.(string),
-			NotebooksURL: "https://" + juypterUrlInfo,
-			GCSBucket:    outs["bucket"].Value.(string),
-			Expiry:       outs["helium-expiry"].Value.(string),
-			PachdIp:      pachdUrl,
-			Pachctl:      pachdAddress,
-			CreatedBy:    createdBy,
-			Backend:      backendOutput,
-		}}, nil
+		res := &api.GetConnectionInfoResponse{Workspace: api.ConnectionInfo{
+			Status:        status,
+			ID:            i,
+			K8s:           k8sInfo,
+			PulumiURL:     pulumiURL,
+			LastUpdated:   info.LastUpdate,
+			K8sNamespace:  outs["k8sNamespace"].Value.(string),
+			ConsoleURL:    "https://" + outs["consoleUrl"].Value.(string),
+			NotebooksURL:  "https://" + juypterUrlInfo,
+			GCSBucket:     outs["bucket"].Value.(string),
+			Expiry:        outs["helium-expiry"].Value.(string),
+			PachdIp:       pachdUrl,
+			Pachctl:       pachdAddress,
+			CreatedBy:     createdBy,
+			Backend:       backendOutput,
+			ProgramCommit: deployedCommit(outs, latest),
+		}}
+		if err := applyClaim(&res.Workspace); err != nil {
+			return nil, err
+		}
+		if err := applyDrift(&res.Workspace); err != nil {
+			return nil, err
+		}
+		return res, nil
 	}
 	return &api.GetConnectionInfoResponse{
 		Workspace: api.ConnectionInfo{
 			Status:      "creating",
 			ID:          i,
-			PulumiURL:   info.URL + "/updates/1",
+			PulumiURL:   pulumiURL,
 			LastUpdated: info.LastUpdate,
 		},
 	}, nil
@@ -185,11 +218,56 @@ func List() (*api.ListResponse, error) {
 	return &api.ListResponse{IDs: ids}, nil
 }
 
+// ErrInvalidExpiry is returned by ParseExpiry for an expiry that isn't a date.
+var ErrInvalidExpiry = errors.New("invalid expiry")
+
+// ErrStackNotFound is returned by GetExpiry, Destroy and GetMetadata for a stack that doesn't exist.
+var ErrStackNotFound = errors.New("stack not found")
+
+// ErrUpdateInProgress is returned by GetExpiry for a stack that is being updated. A stack can't
+// expire while it's being updated.
+var ErrUpdateInProgress = errors.New("update in progress")
+
+// ErrNoExpiry is returned by GetExpiry for a stack without a helium-expiry output, such as one
+// whose first update hasn't finished.
+var ErrNoExpiry = errors.New("no expiry recorded")
+
 func IsExpired(i api.ID) (bool, error) {
+	expiry, err := GetExpiry(i)
+	if errors.Is(err, ErrUpdateInProgress) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Now().After(expiry), nil
+}
+
+// outputExpiry returns the expiry in a stack's helium-expiry output.
+func outputExpiry(outs auto.OutputMap, stackName string) (time.Time, error) {
+	if outs["helium-expiry"].Value == nil {
+		return time.Time{}, fmt.Errorf("%w: expected stack output 'helium-expiry' not found for stack: %v", ErrNoExpiry, stackName)
+	}
+	v, ok := outs["helium-expiry"].Value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("stack output 'helium-expiry' of %v isn't a string: %v", stackName, outs["helium-expiry"].Value)
+	}
+	log.Debugf("Expiry: %v", v)
+	expiry, err := time.Parse(timeFormat, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("stack output 'helium-expiry' of %v: %w", stackName, err)
+	}
+	return expiry, nil
+}
+
+// GetExpiry returns the time a stack expires: the claimant's expiry for a claimed prewarmed
+// workspace, and the helium-expiry output otherwise.
+func GetExpiry(i api.ID) (time.Time, error) {
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
-	log.WithField("backend", "pulumi").Debugf("isexpired")
+	log.WithField("backend", "pulumi").Debugf("getexpiry")
 	//
+	i = Resolve(i)
 	stackName := string(i)
 	// we don't need a program since we're just getting stack outputs
 	var program pulumi.RunFunc = nil
@@ -198,65 +276,112 @@ func IsExpired(i api.ID) (bool, error) {
 	if err != nil {
 		// if the stack doesn't already exist, 404
 		if auto.IsSelectStack404Error(err) {
-			return false, fmt.Errorf("stack %q not found: %w", stackName, err)
+			return time.Time{}, fmt.Errorf("%w: %q: %v", ErrStackNotFound, stackName, err)
 		}
-		return false, err
+		return time.Time{}, err
 	}
 	info, err := s.Info(ctx)
 	if err != nil {
-		return false, err
+		return time.Time{}, err
 	}
 	// an update is currently ongoing, it can't be expired while actively updating
 	if info.UpdateInProgress {
-		return false, nil
+		return time.Time{}, ErrUpdateInProgress
 	}
-	// fetch the outputs from the stack
-	outs, err := s.Outputs(ctx)
+	// a claimed prewarmed workspace expires when its claimant asked for, not when the pool did
+	claim, err := GetClaim(i)
 	if err != nil {
-		return false, err
+		return time.Time{}, err
 	}
-	if outs["helium-expiry"].Value == nil {
-		return false, fmt.Errorf("expected stack output 'helium-expiry' not found for stack: %v", stackName)
+	var expiry time.Time
+	if claim != nil {
+		expiry, err = time.Parse(timeFormat, claim.Expiry)
+	} else {
+		// fetch the outputs from the stack
+		var outs auto.OutputMap
+		outs, err = s.Outputs(ctx)
+		if err != nil {
+			return time.Time{}, err
+		}
+		expiry, err = outputExpiry(outs, stackName)
 	}
-	log.Debugf("Expiry: %v", outs["helium-expiry"].Value.(string))
-	expiry, err := time.Parse(timeFormat, outs["helium-expiry"].Value.(string))
 	if err != nil {
-		return false, err
+		return time.Time{}, err
+	}
+	// a workspace can't outlive the cluster it's deployed into
+	md, err := getMetadata(ctx, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cluster, ok, err := clusterExpiry(md.ClusterStack)
+	if err != nil {
+		return time.Time{}, err
 	}
-	if time.Now().After(expiry) {
-		return true, nil
+	if ok && cluster.Before(expiry) {
+		expiry = cluster
 	}
-	return false, nil
+	return expiry, nil
 }
 
-func Create(req *api.Spec) (*api.CreateResponse, error) {
-
-	ctx := context.Background()
-	log.WithField("backend", "pulumi").Debugf("create")
-
-	helmchartVersion := req.HelmVersion
-	stackName := req.Name
-
+// ParseExpiry validates a requested expiry date and returns the expiry a workspace should get: the
+// configured default number of days from now if none was requested, and never more than 90 days
+// from now.
+func ParseExpiry(requested string) (string, error) {
 	var expiry time.Time
 	var err error
-	if req.Expiry != "" {
-		expiry, err = time.Parse(timeFormat, req.Expiry)
+	if requested != "" {
+		expiry, err = time.Parse(timeFormat, requested)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("%w %q: must be YYYY-MM-DD", ErrInvalidExpiry, requested)
 		}
 	}
 
 	if expiry.IsZero() {
-		// default to 1 day for expiry
-		expiry = time.Now().AddDate(0, 0, 1)
-		//expiry = time.Now().AddDate(0, 0, 1*expiryDefaul)
+		expiry = time.Now().AddDate(0, 0, settings().DefaultExpiryDays)
 		log.Debugf("Expiry: %v", expiry)
 	} else if expiry.After(time.Now().AddDate(0, 0, 1*90)) {
 		// Max expiration date is 90 days from now
 		expiry = time.Now().AddDate(0, 0, 1*90)
 		log.Debugf("Expiry: %v", expiry)
 	}
-	expiryStr := expiry.Format(timeFormat)
+	return expiry.Format(timeFormat), nil
+}
+
+// secretConfigKeys are the config keys whose values Create resolves from the secret provider,
+// which has them under the same names. They're shared by every workspace, unlike credentialKeys.
+// The managed zones are internal GCP IDs, which can be found with
+// https://cloud.google.com/dns/docs/reference/v1/managedZones/get.
+var secretConfigKeys = []string{
+	"workspace-managed-zone-gcp-id",
+	"testci-managed-zone-gcp-id",
+	"pachd-enterprise-license",
+}
+
+// CheckSecrets checks that the secret provider has every secret Create resolves, so that a server
+// missing any fails when it starts, naming them, rather than failing every create.
+func CheckSecrets(ctx context.Context) error {
+	_, err := secrets.Resolve(ctx, secretConfigKeys)
+	return err
+}
+
+// Create creates or updates a workspace's stack. Cancelling ctx stops the Pulumi run, which may
+// leave the stack with pending operations for the recovery controller.
+func Create(ctx context.Context, req *api.Spec) (*api.CreateResponse, error) {
+	log.WithField("backend", "pulumi").Debugf("create")
+
+	helmchartVersion := req.HelmVersion
+	// Creating a workspace with the name of a claimed prewarmed workspace updates it.
+	stackName := string(Resolve(api.ID(req.Name)))
+	unlock, err := lockWorkspace(api.ID(stackName), "create")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	expiryStr, err := ParseExpiry(req.Expiry)
+	if err != nil {
+		return nil, err
+	}
 
 	var disableNotebooks bool
 	if req.DisableNotebooks == "True" {
@@ -265,27 +390,42 @@ func Create(req *api.Spec) (*api.CreateResponse, error) {
 
 	backend := strings.ToLower(req.Backend)
 	if backend == "" {
-		backend = "gcp_namespace_only"
+		backend = DefaultBackend()
 	}
 
-	gcpProjectID := "***REMOVED***"
-
 	var s auto.Stack
 
-	repo := auto.GitRepo{
-		URL:         "https://github.com/pachyderm/poc-pulumi.git",
-		ProjectPath: backend,
-		//Branch:      "refs/remotes/origin/common",
-		Branch: "refs/heads/main",
-		Auth: &auto.GitAuth{
-			PersonalAccessToken: os.Getenv("HELIUM_GITHUB_PERSONAL_TOKEN"),
-		},
+	// The program-sources policy rule decides which repos a spec may name, but no spec may name
+	// anything but an https repo.
+	if req.ProgramRepo != "" {
+		if _, err := parseProgramRepo(req.ProgramRepo); err != nil {
+			return nil, err
+		}
+	}
+	source := specProgramSource(req)
+	s, err = source.upsertStack(ctx, stackName, backend)
+	if err != nil {
+		return nil, fmt.Errorf("create or select stack %q: %w", stackName, err)
+	}
+	sourceConfig, err := source.config(s)
+	if err != nil {
+		return nil, fmt.Errorf("resolve program commit for %q: %w", stackName, err)
 	}
 
-	s, err = auto.UpsertStackRemoteSource(ctx, stackName, repo)
+	// Updating an existing workspace keeps its original creation time and owner.
+	createdAt := time.Now().UTC()
+	// Going on without it would transfer the owner, reset the creation time and leave the stack
+	// recorded as a dependent of its old cluster.
+	md, err := getMetadata(ctx, s)
 	if err != nil {
-		fmt.Printf("failed to create or select stack: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("read metadata of %q: %w", stackName, err)
+	}
+	if !md.CreatedAt.IsZero() {
+		createdAt = md.CreatedAt
+	}
+	createdBy, err := updatedOwner(api.ID(stackName), md, req.CreatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("owner of %q: %w", stackName, err)
 	}
 
 	wwYaml, err := os.ReadFile("workspace-wildcard.yaml")
@@ -294,10 +434,12 @@ func Create(req *api.Spec) (*api.CreateResponse, error) {
 		os.Exit(1)
 	}
 
+	c := settings()
 	config := map[string]string{
 		"id":                   stackName,
+		"backend":              backend,
 		"expiry":               expiryStr,
-		"created-by":           req.CreatedBy,
+		"created-by":           createdBy,
 		"workspace-wildcard":   string(wwYaml),
 		"helm-chart-version":   helmchartVersion,
 		"console-version":      req.ConsoleVersion,
@@ -307,57 +449,107 @@ func Create(req *api.Spec) (*api.CreateResponse, error) {
 		"disable-notebooks":    strconv.FormatBool(disableNotebooks),
 		"pachd-values-file":    req.ValuesYAML,
 		"cluster-stack":        req.ClusterStack,
+		"labels":               util.FormatLabels(util.ParseLabels(req.Labels)),
+		"created-at":           createdAt.Format(time.RFC3339),
 		// TODO: deprecated
 		"cleanup-on-failure":   "true",
 		"pachd-values-content": string(req.ValuesYAMLContent),
 		"infra-json-content":   string(req.InfraJSONContent),
 		"aws-access-key-id":    os.Getenv("AWS_ACCESS_KEY_ID"),
-		"aws-secret-key":       os.Getenv("AWS_SECRET_ACCESS_KEY"),
-
-		// This is an internal GCP ID, not sure if it's exposed at all through pulumi.  I got it by doing a GET call directly against their API here:
-		// https://cloud.google.com/dns/docs/reference/v1/managedZones/get?apix_params=%7B%22project%22%3A%22***REMOVED***%22%2C%22managedZone%22%3A%22test-ci%22%7D
-		"workspace-managed-zone-gcp-id": "***REMOVED***",
-		"workspace-base-url":            "***REMOVED***",
-		"testci-base-url":               "***REMOVED***",
-		"testci-managed-zone-gcp-id":    "***REMOVED***",
-		"client-secret":                 os.Getenv("HELIUM_CLIENT_SECRET"),
-		"client-id":                     os.Getenv("HELIUM_CLIENT_ID"),
-		"auth-domain":                   "https://***REMOVED***.auth0.com/",
-		"auth-subdomain":                "***REMOVED***",
-		"postgres-password":             "***REMOVED***",
-		"postgres-pg-password":          "***REMOVED***",
-		"console-oauthClientSecret":     "***REMOVED***",
-		"pachd-oauthClientSecret":       "***REMOVED***",
-		"pachd-root-token":              "***REMOVED***",
-		"pachd-enterprise-secret":       "***REMOVED***",
-		"pachd-enterprise-license":      "***REMOVED***",
+
+		"workspace-base-url": c.WorkspaceBaseURL,
+		"testci-base-url":    c.TestCIBaseURL,
+		"client-id":          c.Auth0.ClientID,
+		"auth-domain":        c.Auth0.Domain,
+		"auth-subdomain":     c.Auth0.Subdomain,
+	}
+	// Credentials come from the secret provider, or for the ones helium itself is configured
+	// with, its environment, and are only ever set as Pulumi secrets.
+	secretConfig, err := secrets.Resolve(ctx, secretConfigKeys)
+	if err != nil {
+		return nil, fmt.Errorf("resolve secrets for %q: %w", stackName, err)
+	}
+	secretConfig["aws-secret-key"] = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	secretConfig["client-secret"] = c.Auth0.ClientSecret
+	creds, err := workspaceCredentials(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("credentials for %q: %w", stackName, err)
+	}
+	for k, v := range creds {
+		secretConfig[k] = v
 	}
 
+	for k, v := range sourceConfig {
+		config[k] = v
+	}
+
+	// Deploying with only some of the config set would run the program with missing or stale
+	// values, secrets included, so nothing is recorded or deployed unless all of it is.
+	stackConfig := auto.ConfigMap{
+		"gcp:project": {Value: c.GCP.Project},
+		"gcp:zone":    {Value: c.GCP.Zone},
+	}
 	for k, v := range config {
-		s.SetConfig(ctx, fmt.Sprintf("helium:%s", k), auto.ConfigValue{Value: v})
+		stackConfig[fmt.Sprintf("helium:%s", k)] = auto.ConfigValue{Value: v}
+	}
+	for k, v := range secretConfig {
+		stackConfig[fmt.Sprintf("helium:%s", k)] = auto.ConfigValue{Value: v, Secret: true}
+	}
+	if err := s.SetAllConfig(ctx, stackConfig); err != nil {
+		return nil, fmt.Errorf("set config of %q: %w", stackName, err)
 	}
 
-	// TODO: should be able to switch gcp project to
-	s.SetConfig(ctx, "gcp:project", auto.ConfigValue{Value: gcpProjectID})
-	s.SetConfig(ctx, "gcp:zone", auto.ConfigValue{Value: "us-east1-b"})
+	added, err := addDependent(req.ClusterStack, api.ID(stackName))
+	if err != nil {
+		return nil, fmt.Errorf("record cluster stack of %q: %w", stackName, err)
+	}
+	if err := setOwner(api.ID(stackName), createdBy, expiryStr); err != nil {
+		return nil, fmt.Errorf("record owner of %q: %w", stackName, err)
+	}
 
 	// deploy the stack
 	// we'll write all of the update logs to st	out so we can watch requests get processed
 	_, err = s.Up(ctx, optup.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": "create", "stream": "stdout"}))))
 	if err != nil {
-		s.SetConfig(ctx, "status", auto.ConfigValue{Value: "failed"})
+		if err := s.SetConfig(ctx, "status", auto.ConfigValue{Value: "failed"}); err != nil {
+			log.Errorf("mark failed create of %v: %v", stackName, err)
+		}
+		if added {
+			if err := removeDependent(req.ClusterStack, api.ID(stackName)); err != nil {
+				log.Errorf("forget cluster stack of failed create of %v: %v", stackName, err)
+			}
+		}
 		return nil, err
 	}
+	// A workspace moved to another cluster is no longer deployed into its old one.
+	if md.ClusterStack != req.ClusterStack {
+		if err := removeDependent(md.ClusterStack, api.ID(stackName)); err != nil {
+			log.Errorf("forget old cluster stack %v of %v: %v", md.ClusterStack, stackName, err)
+		}
+	}
 
-	return &api.CreateResponse{api.ID(stackName)}, nil
+	return &api.CreateResponse{ID: api.ID(stackName)}, nil
 }
 
-func Destroy(i api.ID) error {
+// Destroy destroys a stack and removes it, with everything helium recorded about it. Cancelling ctx
+// stops the Pulumi run, which may leave the stack with pending operations for the recovery
+// controller.
+func Destroy(ctx context.Context, i api.ID) error {
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
 	log.WithField("backend", "pulumi").Debugf("destroy")
 
-	ctx := context.Background()
+	i = Resolve(i)
+	unlock, err := lockWorkspace(i, "destroy")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return destroy(ctx, i)
+}
+
+// destroy destroys a resolved stack whose lock the caller holds.
+func destroy(ctx context.Context, i api.ID) error {
 	stackName := string(i)
 	// program doesn't matter for destroying a stack
 	var program pulumi.RunFunc = nil
@@ -367,13 +559,29 @@ func Destroy(i api.ID) error {
 		// if stack doesn't already exist, 404
 		if auto.IsSelectStack404Error(err) {
 			log.Errorf("stack %q not found", stackName)
-			return err
+			return fmt.Errorf("%w: %q: %v", ErrStackNotFound, stackName, err)
 		}
 		return err
 	}
+	// workspaces deployed into a cluster stack must go first
+	deps, err := LiveDependents(ctx, i)
+	if err != nil {
+		return err
+	}
+	if len(deps) > 0 {
+		return fmt.Errorf("%w: %v is the cluster stack of %v", ErrHasDependents, i, deps)
+	}
+	md, err := getMetadata(ctx, s)
+	if err != nil {
+		return err
+	}
 	//s.SetConfig(ctx, "gcp:project", auto.ConfigValue{Value: "***REMOVED***"})
 	//s.SetConfig(ctx, "gcp:zone", auto.ConfigValue{Value: "us-east1-b"})
 
+	// From here on, an interrupted refresh was on the way to this destroy.
+	if err := endDriftRefresh(i); err != nil {
+		return err
+	}
 	// Doing a refresh with PULUMI_K8S_DELETE_UNREACHABLE="true" set will allow
 	// pulumi to automatically remove stack resources when a cluster is unreachable.
 	// This will potentially leak resources on transient GKE connection
@@ -399,41 +607,38 @@ func Destroy(i api.ID) error {
 	if err != nil {
 		return err
 	}
+	if err := forgetClaim(i); err != nil {
+		return err
+	}
+	if err := forgetDrift(i); err != nil {
+		return err
+	}
+	if err := removeDependent(md.ClusterStack, i); err != nil {
+		return err
+	}
+	if err := forgetOwner(i); err != nil {
+		return err
+	}
 	log.Infof("deleted all associated stack information with: %s", stackName)
 	return nil
 }
 
+// EnsurePlugins installs the provider plugins the Pulumi programs need. It must be called once at
+// startup, before any stack operations.
 // TODO: Document need to add plugins for other providers
-func ensurePlugins() {
+func EnsurePlugins() {
 	ctx := context.Background()
 	w, err := auto.NewLocalWorkspace(ctx)
 	if err != nil {
 		fmt.Printf("Failed to setup and run http server: %v\n", err)
 		os.Exit(1)
 	}
-	err = w.InstallPlugin(ctx, "gcp", "v6.5.0")
-	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
-	}
-	err = w.InstallPlugin(ctx, "kubernetes", "v3.12.1")
-	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
-	}
-	err = w.InstallPlugin(ctx, "aws", "v5.7.0")
-	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
-	}
-	err = w.InstallPlugin(ctx, "eks", "v0.40.0")
-	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
-	}
-	err = w.InstallPlugin(ctx, "postgresql", "v3.4.0")
-	if err != nil {
-		fmt.Printf(("Failed to install program plugins: %v\n"), err)
-		os.Exit(1)
+	c := settings()
+	for _, name := range c.PluginNames() {
+		err = w.InstallPlugin(ctx, name, c.Plugins[name])
+		if err != nil {
+			fmt.Printf("Failed to install program plugins: %v\n", err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,31 @@
+package pulumi_backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+func TestOutputExpiry(t *testing.T) {
+	expiry, err := outputExpiry(auto.OutputMap{"helium-expiry": {Value: "2023-02-01"}}, "test")
+	if err != nil {
+		t.Fatalf("outputExpiry: %v", err)
+	}
+	if want := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC); !expiry.Equal(want) {
+		t.Errorf("expiry = %v, want %v", expiry, want)
+	}
+
+	if _, err := outputExpiry(auto.OutputMap{}, "test"); !errors.Is(err, ErrNoExpiry) {
+		t.Errorf("missing: err = %v, want ErrNoExpiry", err)
+	}
+	for name, outs := range map[string]auto.OutputMap{
+		"malformed":  {"helium-expiry": {Value: "next tuesday"}},
+		"not string": {"helium-expiry": {Value: 20230201.0}},
+	} {
+		if _, err := outputExpiry(outs, "test"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
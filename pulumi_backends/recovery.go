@@ -0,0 +1,261 @@
+package pulumi_backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PendingUpdate describes a Pulumi operation that has started on a stack but not finished.
+type PendingUpdate struct {
+	// Kind is the kind of operation, as reported by stack history: "update", "refresh" or
+	// "destroy".
+	Kind      string
+	StartTime time.Time
+}
+
+// selectStack selects an existing stack without a program, which is enough for everything except
+// deploying it.
+func selectStack(ctx context.Context, i api.ID) (auto.Stack, error) {
+	stackName := string(i)
+	var program pulumi.RunFunc = nil
+	s, err := auto.SelectStackInlineSource(ctx, stackName, project, program)
+	if err != nil {
+		if auto.IsSelectStack404Error(err) {
+			return s, fmt.Errorf("%w: %q: %v", ErrStackNotFound, stackName, err)
+		}
+		return s, err
+	}
+	return s, nil
+}
+
+// GetPendingUpdate returns the operation currently in progress on a stack, or nil if there is none.
+func GetPendingUpdate(i api.ID) (*PendingUpdate, error) {
+	ctx := context.Background()
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.UpdateInProgress {
+		return nil, nil
+	}
+	history, err := s.History(ctx, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("stack %q has an update in progress but no history", i)
+	}
+	start, err := time.Parse(time.RFC3339, history[0].StartTime)
+	if err != nil {
+		return nil, fmt.Errorf("parse start time of pending update on %q: %w", i, err)
+	}
+	return &PendingUpdate{Kind: history[0].Kind, StartTime: start}, nil
+}
+
+// Cancel stops the update currently running on a stack. The stack may be left with pending
+// operations, which ClearPendingOperations removes.
+func Cancel(ctx context.Context, i api.ID) error {
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return err
+	}
+	return s.Cancel(ctx)
+}
+
+// ClearPendingOperations exports the stack's state, drops any pending operations left behind by an
+// interrupted update, and imports it again. It returns the number of operations removed. This is
+// the programmatic version of the "pulumi stack export | pulumi stack import" dance.
+func ClearPendingOperations(ctx context.Context, i api.ID) (int, error) {
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return 0, err
+	}
+	state, err := s.Export(ctx)
+	if err != nil {
+		return 0, err
+	}
+	deployment, n, err := clearPendingOperations(state.Deployment)
+	if err != nil {
+		return 0, fmt.Errorf("clear pending operations on %q: %w", i, err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	state.Deployment = deployment
+	if err := s.Import(ctx, state); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// clearPendingOperations removes the pending_operations field from an exported deployment, leaving
+// everything else untouched.
+func clearPendingOperations(deployment json.RawMessage) (json.RawMessage, int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(deployment, &fields); err != nil {
+		return nil, 0, err
+	}
+	raw, ok := fields["pending_operations"]
+	if !ok {
+		return deployment, 0, nil
+	}
+	var ops []json.RawMessage
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal pending_operations: %w", err)
+	}
+	delete(fields, "pending_operations")
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, len(ops), nil
+}
+
+// Retry runs an interrupted operation of the given kind again. An update is retried with its own
+// config, so that an interrupted create or change is finished rather than reverted. Helium runs a
+// refresh either on the way to a destroy, which is retried as a destroy, or to check for drift,
+// which isn't retried: the drift controller checks again on its next pass. The caller holds the
+// workspace's lock, from LockWorkspace, from before it cancels the interrupted operation until Retry
+// returns, so that no other operation runs on the stack in between.
+func Retry(ctx context.Context, i api.ID, kind string) error {
+	destroys, err := RetryDestroys(i, kind)
+	if err != nil {
+		return err
+	}
+	switch {
+	case destroys:
+		return destroy(ctx, Resolve(i))
+	case kind == "refresh":
+		return endDriftRefresh(i)
+	case kind == "update":
+		return retryUpdate(ctx, i, newestUpdates, deployConfig)
+	default:
+		return fmt.Errorf("don't know how to retry a %q on stack %q", kind, i)
+	}
+}
+
+// retryUpdate deploys a stack again with the config of its newest update, which is the one that
+// was interrupted. Unlike reapply, it doesn't fall back to the last successful update: a first
+// create that was interrupted has none, and an interrupted change, such as an expiry extension or a
+// version bump, would be silently undone. history and deploy read the stack's newest update and
+// deploy it with a config; tests substitute fakes.
+func retryUpdate(ctx context.Context, i api.ID,
+	history func(context.Context, api.ID) ([]auto.UpdateSummary, error),
+	deploy func(context.Context, api.ID, auto.ConfigMap) error) error {
+	h, err := history(ctx, i)
+	if err != nil {
+		return err
+	}
+	if len(h) == 0 || h[0].Kind != "update" {
+		return fmt.Errorf("stack %q has no interrupted update to retry", i)
+	}
+	return deploy(ctx, i, h[0].Config)
+}
+
+// newestUpdates returns the newest entry in a stack's history.
+func newestUpdates(ctx context.Context, i api.ID) ([]auto.UpdateSummary, error) {
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	return s.History(ctx, 1, 1)
+}
+
+// deployConfig runs a stack's program with config, as an interrupted update did.
+func deployConfig(ctx context.Context, i api.ID, config auto.ConfigMap) error {
+	s, err := configuredStack(ctx, i, config)
+	if err != nil {
+		return err
+	}
+	_, err = s.Up(ctx, optup.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": "retry", "stream": "stdout"}))))
+	return err
+}
+
+// RetryDestroys reports whether Retry destroys a stack to retry an interrupted operation of the
+// given kind.
+func RetryDestroys(i api.ID, kind string) (bool, error) {
+	switch kind {
+	case "destroy":
+		return true, nil
+	case "refresh":
+		drift, err := isDriftRefresh(i)
+		return !drift, err
+	}
+	return false, nil
+}
+
+// Reapply runs a stack's program again with the config of its most recent successful update,
+// putting back anything that has drifted from it. It holds the workspace's lock.
+func Reapply(i api.ID) error {
+	i = Resolve(i)
+	unlock, err := lockWorkspace(i, "reapply")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := reapply(context.Background(), i, "reapply"); err != nil {
+		return err
+	}
+	return forgetDrift(i)
+}
+
+// reapply runs the stack's program again with the config of its most recent successful update. op
+// names the operation in the logs.
+func reapply(ctx context.Context, i api.ID, op string) error {
+	s, err := programStack(ctx, i)
+	if err != nil {
+		return err
+	}
+	_, err = s.Up(ctx, optup.ProgressStreams(util.NewLogWriter(log.WithFields(log.Fields{"pulumi_op": op, "stream": "stdout"}))))
+	return err
+}
+
+// programStack selects an existing stack with its program and the config of its most recent
+// successful update, which is what's deployed, ready to be previewed or deployed again. A failed
+// update or a refresh since then doesn't change it.
+func programStack(ctx context.Context, i api.ID) (auto.Stack, error) {
+	s, err := selectStack(ctx, i)
+	if err != nil {
+		return s, err
+	}
+	u, err := latestDeployment(ctx, s)
+	if err != nil {
+		return s, err
+	}
+	if u == nil {
+		return s, fmt.Errorf("stack %q has no successful update to deploy again", i)
+	}
+	return configuredStack(ctx, i, u.Config)
+}
+
+// configuredStack selects an existing stack with the program recorded in config, and replaces its
+// config with config.
+func configuredStack(ctx context.Context, i api.ID, config auto.ConfigMap) (auto.Stack, error) {
+	backend, ok := config["helium:backend"]
+	if !ok || backend.Value == "" {
+		return auto.Stack{}, fmt.Errorf("stack %q predates recording its backend in config, it can't be reapplied", i)
+	}
+	s, err := recordedProgramSource(config).upsertStack(ctx, string(i), backend.Value)
+	if err != nil {
+		return s, err
+	}
+	if err := s.SetAllConfig(ctx, config); err != nil {
+		return s, err
+	}
+	return s, nil
+}
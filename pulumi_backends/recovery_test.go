@@ -0,0 +1,149 @@
+package pulumi_backends
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/store"
+)
+
+func TestClearPendingOperations(t *testing.T) {
+	testData := []struct {
+		name       string
+		deployment string
+		want       string
+		wantN      int
+	}{
+		{
+			name:       "no pending operations",
+			deployment: `{"manifest":{"time":"2022-11-30T00:00:00Z"},"resources":[{"urn":"a"}]}`,
+			want:       `{"manifest":{"time":"2022-11-30T00:00:00Z"},"resources":[{"urn":"a"}]}`,
+		},
+		{
+			name:       "pending operations",
+			deployment: `{"manifest":{"time":"2022-11-30T00:00:00Z"},"pending_operations":[{"resource":{"urn":"b"},"type":"creating"},{"resource":{"urn":"c"},"type":"deleting"}],"resources":[{"urn":"a"}]}`,
+			want:       `{"manifest":{"time":"2022-11-30T00:00:00Z"},"resources":[{"urn":"a"}]}`,
+			wantN:      2,
+		},
+		{
+			name:       "empty pending operations",
+			deployment: `{"pending_operations":[],"resources":[]}`,
+			want:       `{"resources":[]}`,
+		},
+	}
+
+	for _, test := range testData {
+		t.Run(test.name, func(t *testing.T) {
+			got, n, err := clearPendingOperations(json.RawMessage(test.deployment))
+			if err != nil {
+				t.Fatalf("clearPendingOperations: %v", err)
+			}
+			if n != test.wantN {
+				t.Errorf("removed %d operations, want %d", n, test.wantN)
+			}
+			var gotFields, wantFields map[string]any
+			if err := json.Unmarshal(got, &gotFields); err != nil {
+				t.Fatalf("unmarshal result: %v", err)
+			}
+			if err := json.Unmarshal([]byte(test.want), &wantFields); err != nil {
+				t.Fatalf("unmarshal want: %v", err)
+			}
+			if diff := cmp.Diff(wantFields, gotFields); diff != "" {
+				t.Errorf("deployment (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClearPendingOperationsInvalid(t *testing.T) {
+	if _, _, err := clearPendingOperations(json.RawMessage(`{"pending_operations":{}}`)); err == nil {
+		t.Error("expected an error for malformed pending_operations")
+	}
+}
+
+func TestRetryDestroys(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+
+	if err := startDriftRefresh("checked"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		id   api.ID
+		kind string
+		want bool
+	}{
+		{"destroyed", "destroy", true},
+		{"destroyed", "refresh", true},
+		{"checked", "refresh", false},
+		{"checked", "update", false},
+	} {
+		got, err := RetryDestroys(test.id, test.kind)
+		if err != nil || got != test.want {
+			t.Errorf("RetryDestroys(%v, %v) = %v, %v; want %v", test.id, test.kind, got, err, test.want)
+		}
+	}
+	if err := endDriftRefresh("checked"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := RetryDestroys("checked", "refresh"); !got {
+		t.Error("a refresh after the drift check finished isn't retried as a destroy")
+	}
+}
+
+func TestRetryUpdate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		history []auto.UpdateSummary
+		want    auto.ConfigMap
+	}{
+		{
+			// A first create that was interrupted has no successful update to go back to.
+			name: "first create",
+			history: []auto.UpdateSummary{
+				{Version: 1, Kind: "update", Result: "in-progress", Config: stackConfig("backend", "gcp_namespace_only", "expiry", "2023-02-01")},
+			},
+			want: stackConfig("backend", "gcp_namespace_only", "expiry", "2023-02-01"),
+		},
+		{
+			// An interrupted expiry extension and version bump is made, not reverted.
+			name: "update",
+			history: []auto.UpdateSummary{
+				{Version: 3, Kind: "update", Result: "in-progress", Config: stackConfig("backend", "gcp_namespace_only", "expiry", "2023-03-01", "pachd-version", "2.5.0")},
+				{Version: 2, Kind: "update", Result: "succeeded", Config: stackConfig("backend", "gcp_namespace_only", "expiry", "2023-02-01", "pachd-version", "2.4.0")},
+			},
+			want: stackConfig("backend", "gcp_namespace_only", "expiry", "2023-03-01", "pachd-version", "2.5.0"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			history := func(context.Context, api.ID) ([]auto.UpdateSummary, error) { return test.history, nil }
+			var deployed auto.ConfigMap
+			deploy := func(_ context.Context, _ api.ID, config auto.ConfigMap) error {
+				deployed = config
+				return nil
+			}
+			if err := retryUpdate(context.Background(), "stuck", history, deploy); err != nil {
+				t.Fatalf("retryUpdate: %v", err)
+			}
+			if diff := cmp.Diff(test.want, deployed); diff != "" {
+				t.Errorf("deployed config (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	history := func(context.Context, api.ID) ([]auto.UpdateSummary, error) {
+		return []auto.UpdateSummary{{Version: 2, Kind: "refresh"}}, nil
+	}
+	deploy := func(context.Context, api.ID, auto.ConfigMap) error {
+		t.Error("deployed a stack whose newest operation isn't an update")
+		return nil
+	}
+	if err := retryUpdate(context.Background(), "refreshed", history, deploy); err == nil {
+		t.Error("retryUpdate of a stack whose newest operation is a refresh succeeded, want an error")
+	}
+}
@@ -0,0 +1,244 @@
+// Package quota limits what each user, and each team together, may have: how many workspaces at
+// once, how many workspace-days until they expire, how far ahead they may expire, and with which
+// backends. The limits are in the quota file, and what users have is counted from the ownership
+// pulumi_backends records for each workspace.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+const (
+	defaultQuotaFile = "quotas.yaml"
+	day              = 24 * time.Hour
+	// generationKey is rewritten by every reservation, so that concurrent ones conflict.
+	generationKey = "quota-generation"
+)
+
+var (
+	// ErrNotAllowed is returned by Check for a workspace that the limits never allow, such as one
+	// with a backend that isn't allowed.
+	ErrNotAllowed = errors.New("not allowed by quota")
+	// ErrExceeded is returned by Check for a workspace that would take a user or team over its
+	// limits, given what it already has.
+	ErrExceeded = errors.New("quota exceeded")
+)
+
+// file is the path of the quota file, from SetFile.
+var file = defaultQuotaFile
+
+// SetFile sets the path of the quota file, from the config's files.quotas.
+func SetFile(path string) { file = path }
+
+// File returns the path of the quota file.
+func File() string { return file }
+
+// Team is a group of users whose workspaces count against the team's limits together, as well as
+// against each member's own.
+type Team struct {
+	Name    string          `yaml:"name"`
+	Members []string        `yaml:"members"`
+	Limits  api.QuotaLimits `yaml:",inline"`
+}
+
+// Config is the contents of the quota file.
+type Config struct {
+	// Default limits every user who isn't in Users.
+	Default api.QuotaLimits `yaml:"default"`
+	// Users have their own limits, by identity, instead of the default ones.
+	Users map[string]api.QuotaLimits `yaml:"users"`
+	Teams []Team                     `yaml:"teams"`
+}
+
+// LoadConfig reads and validates a quota file. A missing file means there are no quotas.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse quota file: %w", err)
+	}
+	limits := map[string]api.QuotaLimits{"default": c.Default}
+	for identity, l := range c.Users {
+		limits["user "+identity] = l
+	}
+	seen := make(map[string]bool)
+	for _, t := range c.Teams {
+		if t.Name == "" || seen[t.Name] {
+			return nil, fmt.Errorf("teams must have unique names, not %q", t.Name)
+		}
+		seen[t.Name] = true
+		limits["team "+t.Name] = t.Limits
+	}
+	for name, l := range limits {
+		if l.MaxWorkspaces < 0 || l.MaxWorkspaceDays < 0 || l.MaxExpiryDays < 0 {
+			return nil, fmt.Errorf("%s: limits can't be negative", name)
+		}
+	}
+	return &c, nil
+}
+
+// limits returns the user's own limits and the teams they're a member of.
+func (c *Config) limits(identity string) (api.QuotaLimits, []Team) {
+	own := c.Default
+	for u, l := range c.Users {
+		if strings.EqualFold(u, identity) {
+			own = l
+		}
+	}
+	var teams []Team
+	for _, t := range c.Teams {
+		if containsFold(t.Members, identity) {
+			teams = append(teams, t)
+		}
+	}
+	return own, teams
+}
+
+// usage adds up what the owners have at now, not counting the workspace except, which is being
+// updated.
+func usage(owned []pulumi_backends.Ownership, name string, owners []string, limits api.QuotaLimits, except api.ID, now time.Time) *api.QuotaUsage {
+	u := &api.QuotaUsage{Name: name, Workspaces: []api.ID{}, Limits: limits}
+	for _, o := range owned {
+		// Expired workspaces are only waiting for the deletion controller.
+		if o.Workspace == except || !o.Expiry.After(now) || !containsFold(owners, o.Owner) {
+			continue
+		}
+		u.Workspaces = append(u.Workspaces, o.Workspace)
+		u.WorkspaceDays += days(o.Expiry.Sub(now))
+	}
+	return u
+}
+
+// Usage returns what a user and each of their teams have, against their limits.
+func Usage(identity string) (*api.QuotaResponse, error) {
+	c, err := LoadConfig(File())
+	if err != nil {
+		return nil, err
+	}
+	return c.usage(identity, "", time.Now())
+}
+
+func (c *Config) usage(identity string, except api.ID, now time.Time) (*api.QuotaResponse, error) {
+	owned, err := pulumi_backends.Ownerships()
+	if err != nil {
+		return nil, err
+	}
+	own, teams := c.limits(identity)
+	res := &api.QuotaResponse{User: *usage(owned, identity, []string{identity}, own, except, now)}
+	for _, t := range teams {
+		res.Teams = append(res.Teams, *usage(owned, t.Name, t.Members, t.Limits, except, now))
+	}
+	return res, nil
+}
+
+// Reserve checks that creating the workspace spec describes keeps its creator within their limits
+// and their teams', then records the workspace as the creator's straight away, rather than once
+// its create gets going, so that creates in flight count against each other. A spec naming an
+// existing workspace updates it, so that workspace isn't counted twice. An expiry that isn't a
+// date is pulumi_backends.ErrInvalidExpiry. release undoes the reservation, for a create that
+// doesn't happen or fails.
+func Reserve(spec *api.Spec) (release func() error, err error) {
+	c, err := LoadConfig(File())
+	if err != nil {
+		return nil, err
+	}
+	return c.reserve(store.Default(), spec, time.Now())
+}
+
+func (c *Config) reserve(st store.Store, spec *api.Spec, now time.Time) (func() error, error) {
+	id := pulumi_backends.Resolve(api.ID(spec.Name))
+	// Replicas reserve concurrently, so a reservation only stands if no other was made between
+	// counting what the creator has and recording it.
+	return store.Serialize(st, generationKey, func() (func() error, error) {
+		expiry, err := c.check(spec, now)
+		if err != nil {
+			return nil, err
+		}
+		return pulumi_backends.ReserveOwner(id, spec.CreatedBy, expiry.Format(pulumi_backends.ExpiryFormat))
+	})
+}
+
+// check checks spec against the limits, and returns the expiry it will get.
+func (c *Config) check(spec *api.Spec, now time.Time) (time.Time, error) {
+	expiryStr, err := pulumi_backends.ParseExpiry(spec.Expiry)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiry, err := time.Parse(pulumi_backends.ExpiryFormat, expiryStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res, err := c.usage(spec.CreatedBy, pulumi_backends.Resolve(api.ID(spec.Name)), now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, u := range append([]api.QuotaUsage{res.User}, res.Teams...) {
+		if err := checkUsage(&u, spec.Backend, expiry, now); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return expiry, nil
+}
+
+func checkUsage(u *api.QuotaUsage, backend string, expiry, now time.Time) error {
+	l := u.Limits
+	if len(l.Backends) > 0 && !contains(l.Backends, backend) {
+		return fmt.Errorf("%w: %s may only create workspaces with %s, not %s", ErrNotAllowed, u.Name, strings.Join(l.Backends, ", "), backend)
+	}
+	if l.MaxExpiryDays > 0 && expiry.After(now.Add(time.Duration(l.MaxExpiryDays)*day)) {
+		return fmt.Errorf("%w: %s may only create workspaces that expire within %d days", ErrNotAllowed, u.Name, l.MaxExpiryDays)
+	}
+	if l.MaxWorkspaces > 0 && len(u.Workspaces)+1 > l.MaxWorkspaces {
+		return fmt.Errorf("%w: %s already has %d of %d workspaces", ErrExceeded, u.Name, len(u.Workspaces), l.MaxWorkspaces)
+	}
+	if requested := days(expiry.Sub(now)); l.MaxWorkspaceDays > 0 && u.WorkspaceDays+requested > l.MaxWorkspaceDays {
+		return fmt.Errorf("%w: %s's workspaces already take %.1f of %.1f workspace-days, and this one needs %.1f", ErrExceeded, u.Name, u.WorkspaceDays, l.MaxWorkspaceDays, requested)
+	}
+	return nil
+}
+
+func days(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return d.Hours() / 24
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold is contains for identities, which are emails and so case insensitive.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
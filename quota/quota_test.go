@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/helium/api"
+	"github.com/pachyderm/helium/pulumi_backends"
+	"github.com/pachyderm/helium/store"
+)
+
+const testConfig = `
+default:
+  maxWorkspaces: 2
+  maxExpiryDays: 14
+  backends: [gcp_namespace_only]
+users:
+  power@example.com:
+    maxWorkspaces: 10
+teams:
+  - name: console
+    members: [a@example.com, b@example.com]
+    maxWorkspaceDays: 17
+`
+
+func TestParseConfig(t *testing.T) {
+	if _, err := LoadConfig("../quotas.yaml"); err != nil {
+		t.Errorf("LoadConfig of the shipped quota file: %v", err)
+	}
+	if c, err := LoadConfig("no-such-file.yaml"); err != nil || c.Default.MaxWorkspaces != 0 {
+		t.Errorf("a missing quota file should mean no quotas, got %+v, %v", c, err)
+	}
+	for _, data := range []string{
+		"default: {maxWorkspaces: -1}",
+		"teams: [{name: a}, {name: a}]",
+		"teams: [{members: [a@example.com]}]",
+	} {
+		if _, err := parseConfig([]byte(data)); err == nil {
+			t.Errorf("parseConfig(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	store.SetDefault(store.NewMemory())
+	defer store.SetDefault(nil)
+	c, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expiry := func(days int) string { return now.AddDate(0, 0, days).Format(pulumi_backends.ExpiryFormat) }
+	// a has two workspaces with 14 to 16 days left between them, and b one more with 2 to 3.
+	for _, s := range []api.Spec{
+		{Name: "a-1", CreatedBy: "a@example.com", Expiry: expiry(10)},
+		{Name: "a-2", CreatedBy: "A@example.com", Expiry: expiry(6)},
+		{Name: "b-1", CreatedBy: "b@example.com", Expiry: expiry(3)},
+		{Name: "a-old", CreatedBy: "a@example.com", Expiry: expiry(-1)},
+	} {
+		if err := pulumi_backends.PutClaim(&pulumi_backends.Claim{Stack: api.ID(s.Name), CreatedBy: s.CreatedBy, Expiry: s.Expiry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		spec api.Spec
+		want error
+	}{
+		{"within limits", api.Spec{Name: "new", CreatedBy: "c@example.com", Backend: "gcp_namespace_only", Expiry: expiry(3)}, nil},
+		{"backend", api.Spec{Name: "new", CreatedBy: "c@example.com", Backend: "gcp_cluster_only", Expiry: expiry(3)}, ErrNotAllowed},
+		{"expiry", api.Spec{Name: "new", CreatedBy: "c@example.com", Backend: "gcp_namespace_only", Expiry: expiry(30)}, ErrNotAllowed},
+		{"workspaces", api.Spec{Name: "new", CreatedBy: "a@example.com", Backend: "gcp_namespace_only", Expiry: expiry(1)}, ErrExceeded},
+		{"updating one of them", api.Spec{Name: "a-2", CreatedBy: "a@example.com", Backend: "gcp_namespace_only", Expiry: expiry(1)}, nil},
+		{"team workspace-days", api.Spec{Name: "new", CreatedBy: "b@example.com", Backend: "gcp_namespace_only", Expiry: expiry(3)}, ErrExceeded},
+		{"own limits", api.Spec{Name: "new", CreatedBy: "power@example.com", Backend: "gcp_namespace_only", Expiry: expiry(60)}, nil},
+		{"invalid expiry", api.Spec{Name: "new", CreatedBy: "c@example.com", Backend: "gcp_namespace_only", Expiry: "next week"}, pulumi_backends.ErrInvalidExpiry},
+	} {
+		_, err := c.check(&test.spec, now)
+		if test.want == nil && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	res, err := c.usage("a@example.com", "", now)
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	if len(res.User.Workspaces) != 2 || len(res.Teams) != 1 || len(res.Teams[0].Workspaces) != 3 {
+		t.Errorf("usage of a is %+v", res)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	st := store.NewMemory()
+	store.SetDefault(st)
+	defer store.SetDefault(nil)
+	c, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	spec := func(name string) *api.Spec {
+		return &api.Spec{Name: name, CreatedBy: "c@example.com", Backend: "gcp_namespace_only", Expiry: now.AddDate(0, 0, 3).Format(pulumi_backends.ExpiryFormat)}
+	}
+
+	// c may have two workspaces, and reserving counts them before they're created.
+	if _, err := c.reserve(st, spec("c-1"), now); err != nil {
+		t.Fatalf("reserving c-1: %v", err)
+	}
+	release, err := c.reserve(st, spec("c-2"), now)
+	if err != nil {
+		t.Fatalf("reserving c-2: %v", err)
+	}
+	if _, err := c.reserve(st, spec("c-3"), now); !errors.Is(err, ErrExceeded) {
+		t.Errorf("reserving c-3: %v, want ErrExceeded", err)
+	}
+	// A create that fails gives its reservation back.
+	if err := release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := c.reserve(st, spec("c-3"), now); err != nil {
+		t.Errorf("reserving c-3 after c-2 failed: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Package secrets resolves the credentials workspaces are deployed with, such as the pachd root
+// token and the enterprise license, from where they're kept rather than from the source. A
+// Provider looks secrets up by name; the config's secrets.provider picks environment variables (the
+// default), files such as a mounted Kubernetes secret, or a Vault-compatible KV store.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/helium/config"
+)
+
+// ErrNotFound is returned when a provider has no secret by the name asked for.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks up secrets by name, such as "pachd-root-token".
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// FromConfig returns the provider the config's secrets section names:
+//
+//   - env: HELIUM_SECRET_<NAME> environment variables
+//   - file: files named after the secrets in its dir
+//   - vault: the KV version 2 secret at its vault path on the vault addr, read with its token
+func FromConfig(c config.Secrets) (Provider, error) {
+	switch c.Provider {
+	case "", "env":
+		return Env{}, nil
+	case "file":
+		return File{Dir: c.Dir}, nil
+	case "vault":
+		if c.Vault.Addr == "" || c.Vault.Token == "" {
+			return nil, fmt.Errorf("the vault secret provider needs VAULT_ADDR and VAULT_TOKEN")
+		}
+		return &Vault{Addr: c.Vault.Addr, Token: c.Vault.Token, Path: c.Vault.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q", c.Provider)
+	}
+}
+
+var (
+	defaultMu       sync.Mutex
+	defaultProvider Provider
+)
+
+// Default returns the process-wide provider. Unless SetDefault was called, it's Env.
+func Default() Provider {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultProvider == nil {
+		return Env{}
+	}
+	return defaultProvider
+}
+
+// SetDefault replaces the process-wide provider.
+func SetDefault(p Provider) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultProvider = p
+}
+
+// Fetcher is a Provider that reads all its secrets at once, such as Vault, which keeps them in
+// one KV secret. Resolve fetches once, rather than once per secret.
+type Fetcher interface {
+	Fetch(ctx context.Context) (Provider, error)
+}
+
+// MissingError is returned by Resolve when any of the secrets are missing, naming every one.
+type MissingError struct {
+	// Errs are the errors the provider returned for each missing secret.
+	Errs []error
+}
+
+func (e *MissingError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *MissingError) Unwrap() error { return ErrNotFound }
+
+// Resolve looks up each of names with the default provider. Errors name the secret, but never
+// include its value. If any are missing, it returns a *MissingError naming all of them.
+func Resolve(ctx context.Context, names []string) (map[string]string, error) {
+	p := Default()
+	if f, ok := p.(Fetcher); ok {
+		var err error
+		if p, err = f.Fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	values := make(map[string]string, len(names))
+	var missing []error
+	for _, name := range names {
+		v, err := p.Get(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, fmt.Errorf("secret %q: %w", name, err))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %w", name, err)
+		}
+		values[name] = v
+	}
+	if len(missing) > 0 {
+		return nil, &MissingError{Errs: missing}
+	}
+	return values, nil
+}
+
+var notEnvChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// Env reads secrets from environment variables, so "pachd-root-token" is read from
+// HELIUM_SECRET_PACHD_ROOT_TOKEN. An empty variable counts as missing.
+type Env struct{}
+
+// EnvVar returns the variable Env reads a secret from.
+func EnvVar(name string) string {
+	return "HELIUM_SECRET_" + notEnvChars.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+func (Env) Get(_ context.Context, name string) (string, error) {
+	v := os.Getenv(EnvVar(name))
+	if v == "" {
+		return "", fmt.Errorf("%w: %s isn't set", ErrNotFound, EnvVar(name))
+	}
+	return v, nil
+}
+
+// File reads each secret from the file of the same name in Dir, as Kubernetes mounts a secret's
+// keys. A trailing newline is dropped.
+type File struct {
+	Dir string
+}
+
+func (f File) Get(_ context.Context, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: no file %s in %s", ErrNotFound, name, f.Dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
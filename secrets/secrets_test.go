@@ -0,0 +1,157 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/helium/config"
+)
+
+func TestProviders(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("HELIUM_SECRET_PACHD_ROOT_TOKEN", "from-env")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pachd-root-token"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// vault stands in for a Vault server with one KV version 2 secret.
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Vault-Token") != "root":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path != "/v1/secret/data/helium":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{
+				"data": map[string]any{"data": map[string]string{"pachd-root-token": "from-vault"}},
+			})
+		}
+	}))
+	defer vault.Close()
+
+	for _, test := range []struct {
+		name     string
+		p        Provider
+		secret   string
+		want     string
+		notFound bool
+	}{
+		{"env", Env{}, "pachd-root-token", "from-env", false},
+		{"env missing", Env{}, "pachd-enterprise-license", "", true},
+		{"file", File{Dir: dir}, "pachd-root-token", "from-file", false},
+		{"file missing", File{Dir: dir}, "pachd-enterprise-license", "", true},
+		{"file outside dir", File{Dir: dir}, "../pachd-root-token", "", false},
+		{"vault", &Vault{Addr: vault.URL, Token: "root", Path: "secret/data/helium"}, "pachd-root-token", "from-vault", false},
+		{"vault missing field", &Vault{Addr: vault.URL, Token: "root", Path: "secret/data/helium"}, "pachd-enterprise-license", "", true},
+		{"vault missing secret", &Vault{Addr: vault.URL, Token: "root", Path: "secret/data/other"}, "pachd-root-token", "", true},
+		{"vault bad token", &Vault{Addr: vault.URL, Token: "wrong", Path: "secret/data/helium"}, "pachd-root-token", "", false},
+	} {
+		got, err := test.p.Get(ctx, test.secret)
+		if test.want != "" {
+			if err != nil || got != test.want {
+				t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got %q, want an error", test.name, got)
+		} else if errors.Is(err, ErrNotFound) != test.notFound {
+			t.Errorf("%s: %v, want not found %v", test.name, err, test.notFound)
+		}
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	vault := config.Defaults().Secrets
+	vault.Provider, vault.Vault.Addr, vault.Vault.Token = "vault", "http://vault:8200", "t"
+	for _, test := range []struct {
+		provider string
+		c        config.Secrets
+		want     Provider
+	}{
+		{"default", config.Defaults().Secrets, Env{}},
+		{"file", config.Secrets{Provider: "file", Dir: "/var/secrets/helium"}, File{Dir: "/var/secrets/helium"}},
+		{"vault", vault, &Vault{Addr: "http://vault:8200", Token: "t", Path: "secret/data/helium"}},
+		{"vault without a token", config.Secrets{Provider: "vault"}, nil},
+		{"unknown", config.Secrets{Provider: "literals"}, nil},
+	} {
+		p, err := FromConfig(test.c)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("FromConfig with %s: got %#v, want an error", test.provider, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FromConfig with %s: %v", test.provider, err)
+			continue
+		}
+		if gotJSON, wantJSON := jsonString(p), jsonString(test.want); gotJSON != wantJSON {
+			t.Errorf("FromConfig with %s: got %s, want %s", test.provider, gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	SetDefault(File{Dir: t.TempDir()})
+	defer SetDefault(nil)
+	if _, err := Resolve(context.Background(), []string{"postgres-password"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve of a missing secret: %v, want not found", err)
+	}
+	t.Setenv(EnvVar("postgres-password"), "shh")
+	SetDefault(nil)
+	values, err := Resolve(context.Background(), []string{"postgres-password"})
+	if err != nil || values["postgres-password"] != "shh" {
+		t.Errorf("Resolve: %v, %v", values, err)
+	}
+}
+
+func TestResolveReportsEveryMissingSecret(t *testing.T) {
+	SetDefault(Env{})
+	defer SetDefault(nil)
+	t.Setenv(EnvVar("postgres-password"), "shh")
+	_, err := Resolve(context.Background(), []string{"pachd-enterprise-license", "postgres-password", "testci-managed-zone-gcp-id"})
+	var missing *MissingError
+	if !errors.As(err, &missing) || !errors.Is(err, ErrNotFound) || len(missing.Errs) != 2 {
+		t.Fatalf("Resolve: %v, want two missing secrets", err)
+	}
+	for _, v := range []string{"HELIUM_SECRET_PACHD_ENTERPRISE_LICENSE", "HELIUM_SECRET_TESTCI_MANAGED_ZONE_GCP_ID"} {
+		if !strings.Contains(err.Error(), v) {
+			t.Errorf("Resolve: %v doesn't name %s", err, v)
+		}
+	}
+}
+
+func TestResolveReadsVaultOnce(t *testing.T) {
+	var reads int
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads++
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{"data": map[string]string{"a": "1", "b": "2"}},
+		})
+	}))
+	defer vault.Close()
+	SetDefault(&Vault{Addr: vault.URL, Token: "root", Path: "secret/data/helium"})
+	defer SetDefault(nil)
+	values, err := Resolve(context.Background(), []string{"a", "b"})
+	if err != nil || values["a"] != "1" || values["b"] != "2" {
+		t.Fatalf("Resolve: %v, %v", values, err)
+	}
+	if reads != 1 {
+		t.Errorf("read the secret from vault %d times, want once", reads)
+	}
+}
+
+func jsonString(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault reads secrets from the fields of one KV version 2 secret, through the HTTP API that Vault
+// and compatible stores serve.
+type Vault struct {
+	// Addr is the server's address, such as https://vault.example.com:8200.
+	Addr  string
+	Token string
+	// Path is the secret's API path under /v1, including the engine's data segment, such as
+	// secret/data/helium.
+	Path string
+	// Client defaults to one with a 10 second timeout.
+	Client *http.Client
+}
+
+func (v *Vault) Get(ctx context.Context, name string) (string, error) {
+	p, err := v.Fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.Get(ctx, name)
+}
+
+// Fetch reads the secret once, for looking up each of its fields.
+func (v *Vault) Fetch(ctx context.Context) (Provider, error) {
+	url := strings.TrimSuffix(v.Addr, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("read %s from vault: %w", v.Path, err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: vault has no secret %s", ErrNotFound, v.Path)
+	case res.StatusCode != http.StatusOK:
+		// The body isn't included, in case it echoes anything sensitive.
+		return nil, fmt.Errorf("read %s from vault: %s", v.Path, res.Status)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode %s from vault: %w", v.Path, err)
+	}
+	return vaultSecret{path: v.Path, fields: body.Data.Data}, nil
+}
+
+// vaultSecret is a KV secret read from Vault.
+type vaultSecret struct {
+	path   string
+	fields map[string]string
+}
+
+func (v vaultSecret) Get(_ context.Context, name string) (string, error) {
+	s, ok := v.fields[name]
+	if !ok || s == "" {
+		return "", fmt.Errorf("%w: vault secret %s has no field %s", ErrNotFound, v.path, name)
+	}
+	return s, nil
+}
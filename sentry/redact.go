@@ -0,0 +1,212 @@
+package sentry
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Redacted replaces secret values.
+	Redacted = "[redacted]"
+	// MaxFieldLength is the most bytes of a field's value that are logged or sent to Sentry.
+	MaxFieldLength = 4096
+)
+
+var (
+	// keyWord splits keys such as "pachd-root-token" and "clientSecret" into words.
+	keyWord = regexp.MustCompile(`[A-Z]?[a-z0-9]+|[A-Z]+`)
+	// secretWords are words that make a key secret wherever they are in it, and secretLastWords
+	// those that do at the end of it, which "tokenId" doesn't.
+	secretWords     = map[string]bool{"secret": true, "secrets": true, "password": true, "passwd": true, "credential": true, "credentials": true, "private": true}
+	secretLastWords = map[string]bool{"token": true, "key": true, "apikey": true, "cred": true, "creds": true}
+	// keyValue matches what a key and its value look like when formatted into a message, as
+	// key=value, key: value, "key": "value" or, from %#v, Key:"value".
+	keyValue = regexp.MustCompile(`("?)([A-Za-z_][\w.-]*)("?)([ \t]*[:=][ \t]*)("(?:[^"\\]|\\.)*"|[^\s,;&"}\])]+)`)
+)
+
+// SecretPaths are the dotted paths, as matched by path.Match with "*" for list items, of secrets
+// in values files whose keys don't say they're secret.
+var SecretPaths = []string{
+	"pachd.storage.google.cred",
+	"pachd.storage.amazon.id",
+}
+
+// SecretKey reports whether a key, such as a log field or a parameter name, holds a secret.
+func SecretKey(name string) bool {
+	words := keyWord.FindAllString(name, -1)
+	for i, w := range words {
+		w = strings.ToLower(w)
+		if secretWords[w] || (i == len(words)-1 && secretLastWords[w]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactHook is a logrus hook that masks secrets in every entry's fields and message, and
+// truncates long ones, before the entry is written. In the message, only secrets formatted along
+// with their keys are found, as RedactMessage does; a secret formatted without one, such as a
+// field of a struct logged with %v, can't be told apart from the rest, so pass secrets as fields.
+// It must be added before any hook that sends entries elsewhere, such as Logrus, since hooks run
+// in the order they were added.
+type RedactHook struct{}
+
+// Levels implements a Logrus hook.
+func (RedactHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+// Fire implements a Logrus hook.
+func (RedactHook) Fire(entry *logrus.Entry) error {
+	entry.Data = RedactFields(entry.Data)
+	entry.Message = Truncate(RedactMessage(entry.Message))
+	return nil
+}
+
+// RedactMessage returns a formatted message with the values of secret keys masked, wherever they
+// appear as key=value, key: value, "key": "value" or Key:"value".
+func RedactMessage(msg string) string {
+	return keyValue.ReplaceAllStringFunc(msg, func(m string) string {
+		sub := keyValue.FindStringSubmatch(m)
+		if !SecretKey(sub[2]) {
+			return m
+		}
+		v := Redacted
+		if strings.HasPrefix(sub[5], `"`) {
+			v = `"` + Redacted + `"`
+		}
+		return sub[1] + sub[2] + sub[3] + sub[4] + v
+	})
+}
+
+// RedactFields returns a copy of fields with the values of secret keys masked, the secrets in
+// file contents masked, and long values truncated. Fields whose keys end in "content", and byte
+// slices, are taken to be YAML or JSON files, such as a values file.
+func RedactFields(fields logrus.Fields) logrus.Fields {
+	redacted := make(logrus.Fields, len(fields))
+	for k, v := range fields {
+		redacted[k] = redactField(k, v)
+	}
+	return redacted
+}
+
+func redactField(k string, v any) any {
+	if k == logrus.ErrorKey {
+		return redactError(v)
+	}
+	if SecretKey(k) {
+		return Redacted
+	}
+	switch x := v.(type) {
+	case []byte:
+		return Truncate(RedactDocument(x))
+	case string:
+		if strings.HasSuffix(strings.ToLower(k), "content") {
+			return Truncate(RedactDocument([]byte(x)))
+		}
+		return Truncate(x)
+	}
+	return v
+}
+
+// redactError returns the value of an error field with its text redacted, as RedactMessage does,
+// and truncated. An error whose text needs neither is returned as is.
+func redactError(v any) any {
+	err, ok := v.(error)
+	if !ok {
+		if msg, ok := v.(string); ok {
+			return Truncate(RedactMessage(msg))
+		}
+		return v
+	}
+	msg := Truncate(RedactMessage(err.Error()))
+	if msg == err.Error() {
+		return err
+	}
+	return redactedError{msg}
+}
+
+// redactedError is an error whose text has been redacted. It doesn't unwrap to the error it
+// replaces, whose text would give the secrets back.
+type redactedError struct{ msg string }
+
+func (e redactedError) Error() string { return e.msg }
+
+// RedactDocument returns a YAML or JSON document, as YAML, with the values of secret keys and of
+// SecretPaths masked, and without comments. A document that can't be parsed is masked entirely,
+// since there's no telling where its secrets are.
+func RedactDocument(doc []byte) string {
+	if len(bytes.TrimSpace(doc)) == 0 {
+		return string(doc)
+	}
+	var n yaml.Node
+	if err := yaml.Unmarshal(doc, &n); err != nil {
+		return fmt.Sprintf("[redacted: %d bytes that aren't YAML]", len(doc))
+	}
+	switch {
+	case len(n.Content) == 0:
+		return ""
+	case n.Content[0].Kind == yaml.ScalarNode:
+		// Plain text has no keys to tell secrets by, only comments to drop.
+		return n.Content[0].Value
+	}
+	redactNode(&n, nil)
+	out, err := yaml.Marshal(&n)
+	if err != nil {
+		return fmt.Sprintf("[redacted: %d bytes that can't be redacted]", len(doc))
+	}
+	return string(out)
+}
+
+func redactNode(n *yaml.Node, keys []string) {
+	n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			redactNode(c, keys)
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			redactNode(c, append(keys[:len(keys):len(keys)], "*"))
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			k.HeadComment, k.LineComment, k.FootComment = "", "", ""
+			p := append(keys[:len(keys):len(keys)], k.Value)
+			if SecretKey(k.Value) || secretPath(p) {
+				// In place, so that aliases of the value are masked too.
+				*v = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: Redacted, Anchor: v.Anchor}
+				continue
+			}
+			redactNode(v, p)
+		}
+	}
+}
+
+func secretPath(keys []string) bool {
+	p := strings.Join(keys, ".")
+	for _, pattern := range SecretPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Truncate shortens s to MaxFieldLength bytes, saying how much was cut.
+func Truncate(s string) string {
+	if len(s) <= MaxFieldLength {
+		return s
+	}
+	n := MaxFieldLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", s[:n], len(s)-n)
+}
@@ -0,0 +1,140 @@
+package sentry
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+const testValues = `# the root token is hunter2
+pachd:
+  rootToken: hunter2
+  enterpriseLicenseKey: &license abc123
+  storage:
+    google:
+      cred: '{"private_key": "..."}'
+      bucket: example
+console:
+  config:
+    oauthClientSecret: shh
+    license: *license
+oidc:
+  upstreamIDPs:
+    - id: github
+      config:
+        clientSecret: shh
+`
+
+func TestRedactDocument(t *testing.T) {
+	got := RedactDocument([]byte(testValues))
+	for _, secret := range []string{"hunter2", "abc123", "private_key", "shh"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redacted document still has %q:\n%s", secret, got)
+		}
+	}
+	for _, kept := range []string{"bucket: example", "id: github"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("redacted document lost %q:\n%s", kept, got)
+		}
+	}
+	if got := RedactDocument([]byte(`{"k8s": {"nodepools": [{"nodeType": "m5.xlarge"}]}, "password": "x"}`)); strings.Contains(got, `"x"`) || !strings.Contains(got, "m5.xlarge") {
+		t.Errorf("redacted JSON document is %q", got)
+	}
+	if got := RedactDocument([]byte("pachd: [")); strings.Contains(got, "pachd") {
+		t.Errorf("an unparseable document should be redacted entirely, got %q", got)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	long := strings.Repeat("é", MaxFieldLength)
+	got := RedactFields(logrus.Fields{
+		"name":              "example",
+		"pachd-root-token":  "hunter2",
+		"tokenId":           "0123456789abcdef",
+		"valuesYAMLContent": []byte("pachd:\n  rootToken: hunter2\n"),
+		"infraJSONContent":  `{"rds": {"password": "hunter2"}}`,
+		"long":              long,
+		"count":             3,
+	})
+	want := logrus.Fields{
+		"name":              "example",
+		"pachd-root-token":  Redacted,
+		"tokenId":           "0123456789abcdef",
+		"valuesYAMLContent": "pachd:\n    rootToken: '[redacted]'\n",
+		"infraJSONContent":  "{\"rds\": {\"password\": '[redacted]'}}\n",
+		"long":              long[:MaxFieldLength] + "... (4096 bytes truncated)",
+		"count":             3,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RedactFields (-want +got):\n%s", diff)
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	testData := []struct {
+		msg, want string
+	}{
+		{"rootToken=hunter2 id=7", "rootToken=[redacted] id=7"},
+		{"pachd:\n  rootToken: hunter2\n  image: pachd", "pachd:\n  rootToken: [redacted]\n  image: pachd"},
+		{`{"clientSecret": "hun\"ter2", "tokenId": "7"}`, `{"clientSecret": "[redacted]", "tokenId": "7"}`},
+		{`&api.Spec{Name:"ws", PachdRootToken:"hunter2"}`, `&api.Spec{Name:"ws", PachdRootToken:"[redacted]"}`},
+		{"create failed: https://example.com/token", "create failed: https://example.com/token"},
+	}
+	for _, test := range testData {
+		if got := RedactMessage(test.msg); got != test.want {
+			t.Errorf("RedactMessage(%q) = %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	ch := make(chan *sentry.Event, 1)
+	if err := sentry.Init(sentry.ClientOptions{Transport: &fakeTransport{ch: ch}}); err != nil {
+		t.Fatalf("init sentry: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	l := &logrus.Logger{
+		Out:       buf,
+		Formatter: &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true},
+		Level:     logrus.DebugLevel,
+		Hooks:     make(logrus.LevelHooks),
+	}
+	l.AddHook(RedactHook{})
+	l.AddHook(&Logrus{EnabledLevels: []logrus.Level{logrus.ErrorLevel}})
+	l.WithError(fmt.Errorf("pulumi up: exit status 1: password=hunter2 %s", strings.Repeat("x", MaxFieldLength))).WithFields(logrus.Fields{
+		"client-secret":     "hunter2",
+		"valuesYAMLContent": []byte("pachd:\n  rootToken: hunter2\n  image:\n    tag: " + strings.Repeat("x", maxTagLength) + "\n"),
+	}).Errorf("create failed: %#v", struct{ Password string }{"hunter2"})
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("log has a secret: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "bytes truncated") {
+		t.Errorf("log has a long error: %s", buf.String())
+	}
+	select {
+	case event := <-ch:
+		if strings.Contains(event.Message, "hunter2") {
+			t.Errorf("event message has a secret: %s", event.Message)
+		}
+		for _, e := range event.Exception {
+			if strings.Contains(e.Value, "hunter2") {
+				t.Errorf("event exception has a secret: %s", e.Value)
+			}
+		}
+		if event.Tags["client-secret"] != Redacted {
+			t.Errorf("tags are %v, want client-secret redacted", event.Tags)
+		}
+		if _, ok := event.Tags["valuesYAMLContent"]; ok {
+			t.Errorf("tags are %v, want the values file in the extra data", event.Tags)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("no event sent to sentry")
+	}
+}
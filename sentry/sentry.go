@@ -37,6 +37,9 @@ var sentryLevel = map[logrus.Level]sentry.Level{
 // annoying.
 const logrusDepth = 6
 
+// maxTagLength is the longest tag value Sentry accepts.
+const maxTagLength = 200
+
 // Fire implements a Logrus hook.
 func (l *Logrus) Fire(entry *logrus.Entry) error {
 	var err error
@@ -51,22 +54,30 @@ func (l *Logrus) Fire(entry *logrus.Entry) error {
 
 	sentry.WithScope(func(s *sentry.Scope) {
 		s.SetLevel(sentryLevel[entry.Level])
-		for k, v := range entry.Data {
+		// RedactHook has normally done this already, but nothing unredacted may reach Sentry.
+		for k, v := range RedactFields(entry.Data) {
 			if k == logrus.ErrorKey {
 				continue
 			}
+			var tag string
 			switch x := v.(type) {
 			case string:
-				s.SetTag(k, x)
+				tag = x
 			case []byte:
-				s.SetTag(k, string(x))
+				tag = string(x)
 			case int, int8, int32, int64, uint, uint8, uint32, uint64, float32, float64, bool:
-				s.SetTag(k, fmt.Sprintf("%v", v))
+				tag = fmt.Sprintf("%v", v)
 			case time.Time:
-				s.SetTag(k, x.In(time.UTC).Format(time.RFC3339))
+				tag = x.In(time.UTC).Format(time.RFC3339)
 			default:
-				s.SetTag(k, fmt.Sprintf("%#v", v))
+				tag = fmt.Sprintf("%#v", v)
+			}
+			// Sentry drops tags longer than this, so those go in the extra data instead.
+			if len(tag) > maxTagLength {
+				s.SetExtra(k, tag)
+				continue
 			}
+			s.SetTag(k, tag)
 		}
 		sentry.CaptureException(err)
 	})
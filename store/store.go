@@ -0,0 +1,339 @@
+// Package store persists helium's own metadata: the things that don't belong in a Pulumi stack's
+// state, such as prewarmed workspace claims. Documents are JSON and versioned, so that concurrent
+// writers can use compare-and-swap instead of locks.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotFound is returned when a key doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned by Put when the key's version isn't the one expected.
+	ErrConflict = errors.New("version conflict")
+)
+
+// Store is a versioned JSON document store. Keys are slash separated paths such as
+// "claims/my-workspace".
+type Store interface {
+	// Get unmarshals the document at key into v, and returns its version.
+	Get(key string, v any) (int64, error)
+	// Put writes v to key if the key's current version is version, where version 0 means the
+	// key must not exist. It returns the new version.
+	Put(key string, v any, version int64) (int64, error)
+	// Delete removes key. Deleting a key that doesn't exist is not an error.
+	Delete(key string) error
+	// List returns every key with the given prefix, sorted.
+	List(prefix string) ([]string, error)
+}
+
+type document struct {
+	Version int64           `json:"version"`
+	Value   json.RawMessage `json:"value"`
+}
+
+var (
+	defaultMu    sync.Mutex
+	defaultStore Store
+)
+
+// Open opens the store in dir, the config's storeDir. Every API and controlplane replica must
+// share the store, so unlike Default there's no fallback to a directory of the process's own: a
+// server without the shared volume refuses to start rather than keep state no other replica sees.
+func Open(dir string) (Store, error) {
+	if dir == "" {
+		return nil, errors.New("storeDir (HELIUM_STORE_DIR) isn't set; it must be a volume shared by every API and controlplane replica")
+	}
+	d, err := NewDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Fail now, rather than on the first write, on a volume without flock.
+	if err := d.lock(func() error { return nil }); err != nil {
+		return nil, fmt.Errorf("store in %s: %w", dir, err)
+	}
+	return d, nil
+}
+
+// Default returns the process-wide store. Unless SetDefault was called, it's a Dir store in
+// "helium-store", which is only good enough for local development; servers open theirs with Open.
+func Default() Store {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultStore == nil {
+		s, err := NewDir("helium-store")
+		if err != nil {
+			log.Panicf("open store: %v", err)
+		}
+		defaultStore = s
+	}
+	return defaultStore
+}
+
+// SetDefault replaces the process-wide store.
+func SetDefault(s Store) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultStore = s
+}
+
+// generation is the document at a Serialize key. Only its version matters.
+type generation struct {
+	At time.Time
+}
+
+// Serialize runs f, which reads documents and writes others based on what it read, such that no
+// other call with the same key runs between its reads and its writes, even on another replica.
+// key is rewritten after every run, so runs that overlapped conflict; the one that loses calls the
+// undo func f returned, to take back its writes, and runs f again. Serialize returns undo once f
+// has run alone, for its caller to take back its writes later.
+func Serialize(st Store, key string, f func() (undo func() error, err error)) (func() error, error) {
+	for {
+		version, err := st.Get(key, &generation{})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		undo, err := f()
+		if err != nil {
+			return nil, err
+		}
+		_, err = st.Put(key, generation{At: time.Now().UTC()}, version)
+		if err == nil {
+			return undo, nil
+		}
+		if err := undo(); err != nil {
+			return nil, fmt.Errorf("undo: %w", err)
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+	}
+}
+
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, ".") {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// Memory is an in-memory Store.
+type Memory struct {
+	mu   sync.Mutex
+	docs map[string]document
+}
+
+func NewMemory() *Memory {
+	return &Memory{docs: make(map[string]document)}
+}
+
+func (m *Memory) Get(key string, v any) (int64, error) {
+	if err := validKey(key); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.docs[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return d.Version, json.Unmarshal(d.Value, v)
+}
+
+func (m *Memory) Put(key string, v any, version int64) (int64, error) {
+	if err := validKey(key); err != nil {
+		return 0, err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.docs[key].Version != version {
+		return 0, ErrConflict
+	}
+	m.docs[key] = document{Version: version + 1, Value: value}
+	return version + 1, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.docs, key)
+	return nil
+}
+
+func (m *Memory) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.docs {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Dir is a Store that keeps each document in a file under a directory. Writes are serialized with
+// an flock on a lock file, so processes sharing the directory, including over a shared volume
+// that supports flock, see consistent versions.
+type Dir struct {
+	root string
+}
+
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+func (d *Dir) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key)+".json")
+}
+
+// lock holds an exclusive flock on the store for the duration of f.
+func (d *Dir) lock(f func() error) error {
+	lf, err := os.OpenFile(filepath.Join(d.root, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if err := syscall.Flock(int(lf.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock store: %w", err)
+	}
+	defer syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+	return f()
+}
+
+func (d *Dir) read(key string) (document, error) {
+	var doc document
+	data, err := os.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return doc, ErrNotFound
+	}
+	if err != nil {
+		return doc, err
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return doc, fmt.Errorf("corrupt document %q: %w", key, err)
+	}
+	return doc, nil
+}
+
+func (d *Dir) Get(key string, v any) (int64, error) {
+	if err := validKey(key); err != nil {
+		return 0, err
+	}
+	// Documents are replaced by rename, so reads don't need the lock.
+	doc, err := d.read(key)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Version, json.Unmarshal(doc.Value, v)
+}
+
+func (d *Dir) Put(key string, v any, version int64) (int64, error) {
+	if err := validKey(key); err != nil {
+		return 0, err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	err = d.lock(func() error {
+		cur, err := d.read(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if cur.Version != version {
+			return ErrConflict
+		}
+		data, err := json.Marshal(document{Version: version + 1, Value: value})
+		if err != nil {
+			return err
+		}
+		p := d.path(key)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+func (d *Dir) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	return d.lock(func() error {
+		if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (d *Dir) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(p string, e os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
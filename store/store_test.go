@@ -0,0 +1,170 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type doc struct {
+	Name  string
+	Count int
+}
+
+func testStore(t *testing.T, s Store) {
+	var got doc
+	if _, err := s.Get("a/b", &got); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of missing key: got %v, want ErrNotFound", err)
+	}
+
+	v, err := s.Put("a/b", doc{Name: "b", Count: 1}, 0)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Put("a/b", doc{Name: "b", Count: 2}, 0); !errors.Is(err, ErrConflict) {
+		t.Errorf("create of existing key: got %v, want ErrConflict", err)
+	}
+	if v, err = s.Put("a/b", doc{Name: "b", Count: 2}, v); err != nil {
+		t.Fatalf("Put with current version: %v", err)
+	}
+	gotV, err := s.Get("a/b", &got)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if gotV != v || got != (doc{Name: "b", Count: 2}) {
+		t.Errorf("Get: got %v at version %d, want count 2 at version %d", got, gotV, v)
+	}
+
+	if _, err := s.Put("a/c", doc{Name: "c"}, 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Put("ab", doc{Name: "ab"}, 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	keys, err := s.List("a/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a/b", "a/c"}, keys); diff != "" {
+		t.Errorf("List (-want +got):\n%s", diff)
+	}
+
+	if err := s.Delete("a/b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete("a/b"); err != nil {
+		t.Errorf("Delete of missing key: %v", err)
+	}
+	if _, err := s.Get("a/b", &got); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of deleted key: got %v, want ErrNotFound", err)
+	}
+
+	for _, bad := range []string{"", "/a", "a/", "a//b", "../a", "a/.lock"} {
+		if _, err := s.Put(bad, doc{}, 0); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", bad)
+		}
+	}
+
+	// Concurrent increments with compare-and-swap must not lose updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var d doc
+				v, err := s.Get("counter", &d)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				d.Count++
+				if _, err := s.Put("counter", d, v); errors.Is(err, ErrConflict) {
+					continue
+				} else if err != nil {
+					t.Errorf("Put: %v", err)
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := s.Get("counter", &got); err != nil || got.Count != 10 {
+		t.Errorf("counter is %d (err %v), want 10", got.Count, err)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	s := NewMemory()
+	// Each run records how many documents it saw. Another run that overlaps it may have seen
+	// them before it wrote its own, so it must run again.
+	var runs int
+	var race func()
+	count := func(name string) func() (func() error, error) {
+		return func() (func() error, error) {
+			runs++
+			keys, err := s.List("docs/")
+			if err != nil {
+				return nil, err
+			}
+			key := "docs/" + name
+			if _, err := s.Put(key, doc{Name: name, Count: len(keys)}, 0); err != nil {
+				return nil, err
+			}
+			if race != nil {
+				r := race
+				race = nil
+				r()
+			}
+			return func() error { return s.Delete(key) }, nil
+		}
+	}
+	race = func() {
+		if _, err := Serialize(s, "generation", count("e")); err != nil {
+			t.Errorf("racing Serialize: %v", err)
+		}
+	}
+	undo, err := Serialize(s, "generation", count("f"))
+	if err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	var got doc
+	if _, err := s.Get("docs/f", &got); err != nil || got.Count != 1 || runs != 3 {
+		t.Errorf("f saw %d documents (err %v) after %d runs, want 1 after 3", got.Count, err, runs)
+	}
+	if err := undo(); err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+	keys, err := s.List("docs/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if diff := cmp.Diff([]string{"docs/e"}, keys); diff != "" {
+		t.Errorf("documents after undo (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestDir(t *testing.T) {
+	s, err := NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDir: %v", err)
+	}
+	testStore(t, s)
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(""); err == nil {
+		t.Error("Open without a directory: want an error")
+	}
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	testStore(t, s)
+}
@@ -7,6 +7,8 @@ import (
 	"crypto/rand"
 	"io"
 	rando "math/rand"
+	"sort"
+	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	log "github.com/sirupsen/logrus"
@@ -88,6 +90,39 @@ func MergeMaps(src, dest map[string]any) map[string]any {
 	return out
 }
 
+// ParseLabels parses a comma separated list of labels, such as "team=core,protected". A label
+// without a value maps to "true".
+func ParseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			v = "true"
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels
+}
+
+// FormatLabels is the inverse of ParseLabels. Labels are sorted by key so that the output is
+// stable.
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
 func randomString(n int) string {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -151,3 +151,28 @@ oidc:
 		t.Errorf(cmp.Diff(got, want))
 	}
 }
+
+func TestLabels(t *testing.T) {
+	testData := []struct {
+		in        string
+		want      map[string]string
+		formatted string
+	}{
+		{in: "", want: map[string]string{}, formatted: ""},
+		{in: "protected", want: map[string]string{"protected": "true"}, formatted: "protected=true"},
+		{
+			in:        " team=core, gpu ,,owner = me",
+			want:      map[string]string{"team": "core", "gpu": "true", "owner": "me"},
+			formatted: "gpu=true,owner=me,team=core",
+		},
+	}
+	for _, test := range testData {
+		got := ParseLabels(test.in)
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("ParseLabels(%q): %s", test.in, cmp.Diff(test.want, got))
+		}
+		if got := FormatLabels(got); got != test.formatted {
+			t.Errorf("FormatLabels(ParseLabels(%q)) = %q, want %q", test.in, got, test.formatted)
+		}
+	}
+}